@@ -0,0 +1,113 @@
+-- MySQL 8 version of init.sql (used with -driver mysql)
+
+-- 1. Old EAV model
+CREATE TABLE users (
+    user_id BIGINT AUTO_INCREMENT PRIMARY KEY
+);
+
+CREATE TABLE user_attributes (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    user_id BIGINT,
+    `key` VARCHAR(50),
+    value TEXT,
+    FOREIGN KEY (user_id) REFERENCES users(user_id)
+);
+
+CREATE INDEX idx_user_attrs_user_id ON user_attributes(user_id);
+CREATE INDEX idx_user_attrs_key ON user_attributes(`key`);
+
+-- 2. New denormalized model (no partial or BRIN indexes in MySQL; sets are JSON arrays
+-- behind a multi-valued index instead of text[] behind GIN)
+CREATE TABLE user_profiles (
+    user_id BIGINT PRIMARY KEY,
+    country VARCHAR(2),
+    tier VARCHAR(20),
+    last_active_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    has_purchased BOOLEAN DEFAULT FALSE,
+    total_spend DECIMAL(10,2) DEFAULT 0,
+    signup_date DATE,
+    age SMALLINT,
+    interests JSON,
+    INDEX idx_country (country),
+    INDEX idx_tier (tier),
+    INDEX idx_active_recent (last_active_at),
+    INDEX idx_has_purchased (has_purchased),
+    INDEX idx_high_spender (total_spend),
+    INDEX idx_signup_date (signup_date),
+    INDEX idx_age (age),
+    INDEX idx_interests ((CAST(interests AS CHAR(20) ARRAY)))
+) PARTITION BY HASH (user_id) PARTITIONS 10;
+
+-- 3. Predicate cache
+CREATE TABLE predicate_cache (
+    predicate_hash VARCHAR(64) PRIMARY KEY,
+    user_count INT,
+    last_updated DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Populate 100k users for initial test
+SET SESSION cte_max_recursion_depth = 100000;
+
+INSERT INTO users (user_id)
+WITH RECURSIVE seq (n) AS (SELECT 1 UNION ALL SELECT n + 1 FROM seq WHERE n < 100000)
+SELECT n FROM seq;
+
+INSERT INTO user_attributes (user_id, `key`, value)
+SELECT user_id, 'country',
+       IF(RAND() < 0.4, 'US', ELT(1 + FLOOR(RAND() * 9), 'US', 'UK', 'DE', 'FR', 'JP', 'AU', 'CA', 'BR', 'IN'))
+FROM users;
+
+INSERT INTO user_attributes (user_id, `key`, value)
+SELECT user_id, 'tier', ELT(1 + FLOOR(RAND() * 6), 'free', 'free', 'free', 'free', 'gold', 'platinum')
+FROM users;
+
+INSERT INTO user_attributes (user_id, `key`, value)
+SELECT user_id, 'last_active_at',
+       DATE_FORMAT(NOW() - INTERVAL FLOOR(RAND() * 365 * 86400) SECOND, '%Y-%m-%d %H:%i:%s')
+FROM users;
+
+INSERT INTO user_attributes (user_id, `key`, value)
+SELECT user_id, 'has_purchased', IF(RAND() < 0.2, 'true', 'false')
+FROM users;
+
+INSERT INTO user_attributes (user_id, `key`, value)
+SELECT user_id, 'total_spend', ROUND(RAND() * 1000, 2)
+FROM users;
+
+INSERT INTO user_attributes (user_id, `key`, value)
+SELECT user_id, 'signup_date', DATE_FORMAT(CURDATE() - INTERVAL FLOOR(RAND() * 730) DAY, '%Y-%m-%d')
+FROM users;
+
+INSERT INTO user_attributes (user_id, `key`, value)
+SELECT user_id, 'age', 18 + FLOOR(RAND() * 63)
+FROM users;
+
+-- A set: one row per element, each interest held by 25% of users
+INSERT INTO user_attributes (user_id, `key`, value)
+SELECT u.user_id, 'interests', i.name
+FROM users u
+CROSS JOIN (SELECT 'sports' AS name UNION ALL SELECT 'music' UNION ALL SELECT 'travel' UNION ALL SELECT 'gaming'
+            UNION ALL SELECT 'food' UNION ALL SELECT 'fashion' UNION ALL SELECT 'tech' UNION ALL SELECT 'fitness') i
+WHERE RAND() < 0.25;
+
+INSERT INTO user_profiles (user_id, country, tier, last_active_at, has_purchased, total_spend, signup_date, age)
+SELECT
+    u.user_id,
+    MAX(CASE WHEN ua.`key` = 'country' THEN ua.value END),
+    MAX(CASE WHEN ua.`key` = 'tier' THEN ua.value END),
+    MAX(CASE WHEN ua.`key` = 'last_active_at' THEN CAST(ua.value AS DATETIME) END),
+    MAX(CASE WHEN ua.`key` = 'has_purchased' THEN ua.value = 'true' END),
+    MAX(CASE WHEN ua.`key` = 'total_spend' THEN CAST(ua.value AS DECIMAL(10,2)) END),
+    MAX(CASE WHEN ua.`key` = 'signup_date' THEN CAST(ua.value AS DATE) END),
+    MAX(CASE WHEN ua.`key` = 'age' THEN CAST(ua.value AS SIGNED) END)
+FROM users u
+JOIN user_attributes ua ON u.user_id = ua.user_id
+GROUP BY u.user_id;
+
+-- JSON_ARRAYAGG keeps NULLs, so sets are aggregated on their own
+UPDATE user_profiles p
+JOIN (SELECT user_id, JSON_ARRAYAGG(value) AS interests
+      FROM user_attributes WHERE `key` = 'interests' GROUP BY user_id) i ON i.user_id = p.user_id
+SET p.interests = i.interests;
+
+ANALYZE TABLE user_attributes, user_profiles;
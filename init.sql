@@ -2,7 +2,9 @@
 
 -- 1. Old EAV model
 CREATE TABLE users (
-    user_id BIGSERIAL PRIMARY KEY
+    user_id BIGSERIAL PRIMARY KEY,
+    -- Brand the user belongs to; user_profiles and the API are scoped by it
+    tenant_id TEXT NOT NULL DEFAULT 'default'
 );
 
 CREATE TABLE user_attributes (
@@ -18,11 +20,17 @@ CREATE INDEX idx_user_attrs_key ON user_attributes(key);
 -- 2. New denormalized model
 CREATE TABLE user_profiles (
     user_id BIGINT PRIMARY KEY,
+    tenant_id TEXT NOT NULL DEFAULT 'default',
     country VARCHAR(2),
     tier VARCHAR(20),
     last_active_at TIMESTAMP DEFAULT NOW(),
     has_purchased BOOLEAN DEFAULT FALSE,
-    total_spend DECIMAL(10,2) DEFAULT 0
+    total_spend DECIMAL(10,2) DEFAULT 0,
+    signup_date DATE,
+    age SMALLINT,
+    interests TEXT[],
+    -- Registered attributes without a column of their own, see `schema sync`
+    overflow JSONB
 ) PARTITION BY HASH (user_id);
 
 -- Create 10 partitions
@@ -38,19 +46,133 @@ CREATE TABLE user_profiles_8 PARTITION OF user_profiles FOR VALUES WITH (modulus
 CREATE TABLE user_profiles_9 PARTITION OF user_profiles FOR VALUES WITH (modulus 10, remainder 9);
 
 -- Optimal indexes
+CREATE INDEX idx_tenant ON user_profiles USING btree (tenant_id);
 CREATE INDEX idx_country ON user_profiles USING btree (country);
 CREATE INDEX idx_tier ON user_profiles USING btree (tier);
 CREATE INDEX idx_active_recent ON user_profiles USING BRIN (last_active_at);
 CREATE INDEX idx_has_purchased ON user_profiles USING btree (has_purchased) WHERE has_purchased = true;
 CREATE INDEX idx_high_spender ON user_profiles USING btree (total_spend) WHERE total_spend > 100;
+CREATE INDEX idx_signup_date ON user_profiles USING btree (signup_date);
+CREATE INDEX idx_age ON user_profiles USING btree (age);
+CREATE INDEX idx_interests ON user_profiles USING GIN (interests);
+CREATE INDEX idx_overflow ON user_profiles USING GIN (overflow jsonb_path_ops);
 
--- 3. Predicate cache
+-- Attributes `schema sync` found in user_attributes and added to user_profiles,
+-- as a column (with its index) or a field of the overflow document
+CREATE TABLE attribute_registry (
+    name VARCHAR(50) PRIMARY KEY,
+    type TEXT NOT NULL,
+    storage TEXT NOT NULL CHECK (storage IN ('column', 'overflow')),
+    index_name TEXT,
+    registered_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- 3. JSONB model: one attributes document per user, GIN index for @> containment
+CREATE TABLE user_profiles_jsonb (
+    user_id BIGINT PRIMARY KEY,
+    attributes JSONB NOT NULL
+);
+
+CREATE INDEX idx_profiles_jsonb_gin ON user_profiles_jsonb USING GIN (attributes jsonb_path_ops);
+
+-- 4. Progress of the `migrate` command, so an interrupted run can resume
+CREATE TABLE migration_checkpoints (
+    name VARCHAR(64) PRIMARY KEY,
+    last_user_id BIGINT NOT NULL,
+    users_done BIGINT NOT NULL,
+    started_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    completed_at TIMESTAMP
+);
+
+-- 5. Predicate cache
 CREATE TABLE predicate_cache (
     predicate_hash VARCHAR(64) PRIMARY KEY,
     user_count INT,
     last_updated TIMESTAMP DEFAULT NOW()
 );
 
+-- 6. Named audience definitions, evaluated by id
+CREATE TABLE audiences (
+    audience_id BIGSERIAL PRIMARY KEY,
+    tenant_id TEXT NOT NULL DEFAULT 'default',
+    name TEXT NOT NULL,
+    rule TEXT NOT NULL,
+    owner TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Names are unique within a tenant
+CREATE UNIQUE INDEX audiences_tenant_name ON audiences (tenant_id, name);
+
+-- Audience sizes over time, written by `snapshots run`
+CREATE TABLE audience_snapshots (
+    snapshot_id BIGSERIAL PRIMARY KEY,
+    audience_id BIGINT NOT NULL REFERENCES audiences(audience_id) ON DELETE CASCADE,
+    rule TEXT NOT NULL,
+    user_count BIGINT NOT NULL,
+    duration_ms DOUBLE PRECISION NOT NULL,
+    taken_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_audience_snapshots_taken ON audience_snapshots (audience_id, taken_at);
+
+-- Static user lists loaded by `import`, referenced by rules as IN AUDIENCE('name')
+CREATE TABLE audience_lists (
+    list_id BIGSERIAL PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE,
+    tenant_id TEXT NOT NULL DEFAULT 'default',
+    source TEXT NOT NULL,
+    member_count BIGINT NOT NULL,
+    imported_at TIMESTAMPTZ NOT NULL
+);
+
+-- No foreign key, it would be checked per member; import and delete replace members themselves
+CREATE TABLE audience_list_members (
+    list_id BIGINT NOT NULL,
+    user_id BIGINT NOT NULL,
+    PRIMARY KEY (list_id, user_id)
+);
+
+-- Size notifications, checked by `snapshots run` against the previous snapshot
+CREATE TABLE audience_triggers (
+    trigger_id BIGSERIAL PRIMARY KEY,
+    audience_id BIGINT NOT NULL REFERENCES audiences(audience_id) ON DELETE CASCADE,
+    condition TEXT NOT NULL,
+    threshold DOUBLE PRECISION NOT NULL,
+    target TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Precomputed audiences, written by `audiences materialize` and `audiences refresh`
+CREATE TABLE audience_materializations (
+    audience_id BIGINT PRIMARY KEY REFERENCES audiences(audience_id) ON DELETE CASCADE,
+    rule TEXT NOT NULL,
+    member_count BIGINT NOT NULL,
+    rows_written BIGINT NOT NULL,
+    duration_ms DOUBLE PRECISION NOT NULL,
+    refreshed_at TIMESTAMPTZ NOT NULL
+);
+
+-- No foreign key, it would be checked per member; the trigger below cleans up instead
+CREATE TABLE audience_members (
+    audience_id BIGINT NOT NULL,
+    user_id BIGINT NOT NULL,
+    PRIMARY KEY (audience_id, user_id)
+);
+
+CREATE OR REPLACE FUNCTION drop_audience_members() RETURNS trigger AS $$
+BEGIN
+    DELETE FROM audience_members WHERE audience_id = OLD.audience_id;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audience_materializations_drop
+    AFTER DELETE ON audience_materializations
+    FOR EACH ROW EXECUTE FUNCTION drop_audience_members();
+
 -- Function to populate test data
 CREATE OR REPLACE FUNCTION populate_test_data(num_users INT)
 RETURNS void AS $$
@@ -58,6 +180,8 @@ DECLARE
     i INT;
     countries TEXT[] := ARRAY['US', 'UK', 'DE', 'FR', 'JP', 'AU', 'CA', 'BR', 'IN'];
     tiers TEXT[] := ARRAY['free', 'free', 'free', 'free', 'gold', 'platinum'];
+    interest_names TEXT[] := ARRAY['sports', 'music', 'travel', 'gaming', 'food', 'fashion', 'tech', 'fitness'];
+    last_active TIMESTAMP;
 BEGIN
     -- Populate old EAV model
     INSERT INTO users (user_id) SELECT generate_series(1, num_users);
@@ -77,8 +201,9 @@ BEGIN
         VALUES (i, 'tier', tiers[1 + floor(random() * 6)::int]);
 
         -- last_active attribute
+        last_active := NOW() - (random() * INTERVAL '365 days');
         INSERT INTO user_attributes (user_id, key, value)
-        VALUES (i, 'last_active_at', (NOW() - (random() * INTERVAL '365 days'))::text);
+        VALUES (i, 'last_active_at', last_active::text);
 
         -- has_purchased attribute
         INSERT INTO user_attributes (user_id, key, value)
@@ -87,26 +212,80 @@ BEGIN
         -- total_spend attribute
         INSERT INTO user_attributes (user_id, key, value)
         VALUES (i, 'total_spend', (random() * 1000)::text);
+
+        -- signup_date attribute, within the two years before last activity
+        INSERT INTO user_attributes (user_id, key, value)
+        VALUES (i, 'signup_date', (last_active - (random() * INTERVAL '730 days'))::date::text);
+
+        -- age attribute
+        INSERT INTO user_attributes (user_id, key, value)
+        VALUES (i, 'age', (18 + floor(random() * 63)::int)::text);
+
+        -- interests attribute, a set: one row per element, each held by 25% of users
+        INSERT INTO user_attributes (user_id, key, value)
+        SELECT i, 'interests', name FROM unnest(interest_names) AS name WHERE random() < 0.25;
     END LOOP;
 
     -- Populate new denormalized model
-    INSERT INTO user_profiles (user_id, country, tier, last_active_at, has_purchased, total_spend)
+    INSERT INTO user_profiles (user_id, country, tier, last_active_at, has_purchased, total_spend, signup_date, age, interests)
     SELECT
         u.user_id,
         MAX(CASE WHEN ua.key = 'country' THEN ua.value END) as country,
         MAX(CASE WHEN ua.key = 'tier' THEN ua.value END) as tier,
         MAX(CASE WHEN ua.key = 'last_active_at' THEN ua.value::timestamp END) as last_active_at,
         bool_or(CASE WHEN ua.key = 'has_purchased' THEN ua.value::boolean END) as has_purchased,
-        MAX(CASE WHEN ua.key = 'total_spend' THEN ua.value::decimal END) as total_spend
+        MAX(CASE WHEN ua.key = 'total_spend' THEN ua.value::decimal END) as total_spend,
+        MAX(CASE WHEN ua.key = 'signup_date' THEN ua.value::date END) as signup_date,
+        MAX(CASE WHEN ua.key = 'age' THEN ua.value::smallint END) as age,
+        array_agg(ua.value ORDER BY ua.value) FILTER (WHERE ua.key = 'interests') as interests
     FROM users u
     JOIN user_attributes ua ON u.user_id = ua.user_id
     GROUP BY u.user_id;
 
+    -- Populate JSONB model from the denormalized one
+    INSERT INTO user_profiles_jsonb (user_id, attributes)
+    SELECT user_id, jsonb_strip_nulls(jsonb_build_object(
+        'country', country,
+        'tier', tier,
+        'last_active_at', last_active_at,
+        'has_purchased', has_purchased,
+        'total_spend', total_spend,
+        'signup_date', signup_date,
+        'age', age,
+        'interests', interests
+    ))
+    FROM user_profiles;
+
     -- Analyze tables for query optimization
     ANALYZE user_attributes;
     ANALYZE user_profiles;
+    ANALYZE user_profiles_jsonb;
 END;
 $$ LANGUAGE plpgsql;
 
 -- Populate 100k users for initial test
-SELECT populate_test_data(100000);
\ No newline at end of file
+SELECT populate_test_data(100000);
+
+-- 7. Change capture for `sync`: every write to user_attributes queues its user_id,
+-- created after the initial load so populating doesn't fill the queue
+CREATE TABLE user_attributes_changes (
+    change_id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    changed_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE OR REPLACE FUNCTION record_user_attributes_change() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP <> 'INSERT' THEN
+        INSERT INTO user_attributes_changes (user_id) VALUES (OLD.user_id);
+    END IF;
+    IF TG_OP <> 'DELETE' AND (TG_OP = 'INSERT' OR NEW.user_id IS DISTINCT FROM OLD.user_id) THEN
+        INSERT INTO user_attributes_changes (user_id) VALUES (NEW.user_id);
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER user_attributes_cdc
+    AFTER INSERT OR UPDATE OR DELETE ON user_attributes
+    FOR EACH ROW EXECUTE FUNCTION record_user_attributes_change();
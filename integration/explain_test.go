@@ -0,0 +1,99 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"testing"
+
+	"audience-poc/internal/store"
+)
+
+// Users of the seeded database. The fixture's eight rows are read faster
+// with a sequential scan than through any index, so plans are checked on a
+// table large enough for the planner to reach for one.
+const explainUsers = 20000
+
+var explain struct {
+	once sync.Once
+	db   *sql.DB
+	err  error
+}
+
+// A second database of the container, seeded the way `seed` does and
+// vacuumed, so the planner has statistics and a visibility map to go on
+func explainDB(t *testing.T) *sql.DB {
+	t.Helper()
+	explain.once.Do(func() {
+		ctx := context.Background()
+		if _, explain.err = testDB.ExecContext(ctx, `CREATE DATABASE explain_db`); explain.err != nil {
+			return
+		}
+		if explain.db, explain.err = openContainer(ctx, testContainer, "explain_db"); explain.err != nil {
+			return
+		}
+		if explain.err = store.Seed(ctx, explain.db, explainUsers, store.Uniform); explain.err != nil {
+			return
+		}
+		_, explain.err = explain.db.ExecContext(ctx, `VACUUM ANALYZE users, user_attributes, user_profiles`)
+	})
+	if explain.err != nil {
+		t.Fatalf("seed explain_db: %v", explain.err)
+	}
+	return explain.db
+}
+
+func explainRule(t *testing.T, db *sql.DB, build func(string) (string, []interface{}, error), rule string) *store.QueryPlan {
+	t.Helper()
+	query, args, err := build(rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := store.Explain(context.Background(), db, query, args...)
+	if err != nil {
+		t.Fatalf("explain %s: %v", rule, err)
+	}
+	return plan
+}
+
+// The optimized model answers the benchmark's country query from idx_country;
+// the EAV model has no index on attribute values and scans for them
+func TestExplainScans(t *testing.T) {
+	db := explainDB(t)
+	const rule = "country = 'US'"
+
+	optimized := explainRule(t, db, store.OptimizedCountSQL, rule)
+	if !optimized.UsesIndexScan() || optimized.UsesSeqScan() {
+		t.Errorf("optimized plan scans %v, want an index scan only", optimized.Scans())
+	}
+	if optimized.PlanningTime <= 0 || optimized.ExecutionTime <= 0 {
+		t.Errorf("optimized plan timings %v planning, %v execution, want both positive", optimized.PlanningTime, optimized.ExecutionTime)
+	}
+
+	eav := explainRule(t, db, store.EAVCountSQL, rule)
+	if !eav.UsesSeqScan() {
+		t.Errorf("EAV plan scans %v, want a sequential scan", eav.Scans())
+	}
+}
+
+// The index the plan reports for the country query is idx_country, and it is
+// one of the seeded table's indexes rather than a name the parser made up
+func TestExplainIndexName(t *testing.T) {
+	db := explainDB(t)
+	plan := explainRule(t, db, store.OptimizedCountSQL, "country = 'US'")
+	names := plan.IndexNames()
+	if len(names) != 1 || names[0] != "idx_country" {
+		t.Fatalf("optimized plan reads through %v, want [idx_country]", names)
+	}
+	var exists bool
+	err := db.QueryRowContext(context.Background(),
+		`SELECT EXISTS (SELECT 1 FROM pg_indexes WHERE tablename = 'user_profiles' AND indexname = $1)`, names[0]).Scan(&exists)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		t.Errorf("index %s not found on user_profiles", names[0])
+	}
+}
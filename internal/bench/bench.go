@@ -0,0 +1,149 @@
+// Package bench measures queries: warm-up plus measured runs, latency
+// percentiles, significance tests, load tests and growth-curve fits.
+package bench
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"time"
+)
+
+// A benchmarked query: returns the matched count and its own execution time
+type QueryFunc func(ctx context.Context) (int, time.Duration, error)
+
+type Options struct {
+	Warmup     int           // runs that warm caches and the connection pool
+	Iterations int           // measured runs
+	Timeout    time.Duration // per-run deadline, 0 disables it
+	// Count the warm-up runs as samples instead of discarding them as cold-cache runs
+	KeepCold bool
+	// Retry policy of every run; nil runs each once
+	Retry *Retry
+}
+
+// Latency distribution over the measured runs
+type Stats struct {
+	Runs   int
+	Min    time.Duration
+	Median time.Duration
+	P95    time.Duration
+	P99    time.Duration
+	Max    time.Duration
+	StdDev time.Duration // sample standard deviation
+}
+
+type Result struct {
+	Count    int
+	Stats    Stats
+	Samples  []time.Duration // measured runs, in execution order
+	Cold     time.Duration   // first warm-up run, 0 without warm-up
+	Err      error
+	TimedOut bool
+	Retries  int // runs that succeeded only after a retry, or failed after one
+}
+
+// Bound a single query by the configured timeout
+func QueryContext(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, timeout)
+}
+
+// Run one query under its own deadline
+func RunWithTimeout(ctx context.Context, fn QueryFunc, timeout time.Duration) (int, time.Duration, error) {
+	runCtx, cancel := QueryContext(ctx, timeout)
+	defer cancel()
+
+	count, duration, err := fn(runCtx)
+	if err != nil && errors.Is(runCtx.Err(), context.DeadlineExceeded) {
+		// lib/pq reports a server-side cancellation, surface it as the deadline
+		err = context.DeadlineExceeded
+	}
+	return count, duration, err
+}
+
+// Run fn warm-up + iterations times and collect the latency distribution.
+// The first error or timeout left after opts.Retry aborts the benchmark.
+func Run(ctx context.Context, fn QueryFunc, opts Options) Result {
+	iterations := max(opts.Iterations, 1)
+	samples := make([]time.Duration, 0, opts.Warmup+iterations)
+	var cold time.Duration
+	var retried int
+	for i := 0; i < opts.Warmup; i++ {
+		_, d, retries, err := opts.Retry.run(ctx, fn, opts.Timeout)
+		retried += min(retries, 1)
+		if err != nil {
+			return failure(err, retried)
+		}
+		if i == 0 {
+			cold = d
+		}
+		if opts.KeepCold {
+			samples = append(samples, d)
+		}
+	}
+
+	var count int
+	for i := 0; i < iterations; i++ {
+		c, d, retries, err := opts.Retry.run(ctx, fn, opts.Timeout)
+		retried += min(retries, 1)
+		if err != nil {
+			return failure(err, retried)
+		}
+		count = c
+		samples = append(samples, d)
+	}
+	return Result{Count: count, Stats: ComputeStats(samples), Samples: samples, Cold: cold, Retries: retried}
+}
+
+func failure(err error, retries int) Result {
+	return Result{Err: err, TimedOut: errors.Is(err, context.DeadlineExceeded), Retries: retries}
+}
+
+func ComputeStats(samples []time.Duration) Stats {
+	if len(samples) == 0 {
+		return Stats{}
+	}
+	sorted := append([]time.Duration(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	n := len(sorted)
+	median := sorted[n/2]
+	if n%2 == 0 {
+		median = (sorted[n/2-1] + sorted[n/2]) / 2
+	}
+	return Stats{
+		Runs:   n,
+		Min:    sorted[0],
+		Median: median,
+		P95:    percentile(sorted, 95),
+		P99:    percentile(sorted, 99),
+		Max:    sorted[n-1],
+		StdDev: stdDev(sorted),
+	}
+}
+
+func stdDev(samples []time.Duration) time.Duration {
+	if len(samples) < 2 {
+		return 0
+	}
+	var mean float64
+	for _, d := range samples {
+		mean += float64(d)
+	}
+	mean /= float64(len(samples))
+	var sq float64
+	for _, d := range samples {
+		sq += (float64(d) - mean) * (float64(d) - mean)
+	}
+	return time.Duration(math.Sqrt(sq / float64(len(samples)-1)))
+}
+
+// Nearest-rank percentile of an ascending slice
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[min(max(rank, 1), len(sorted))-1]
+}
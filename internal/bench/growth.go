@@ -0,0 +1,103 @@
+package bench
+
+import (
+	"math"
+	"time"
+)
+
+// t(n) = a + b·f(n)
+type GrowthModel struct {
+	Name string
+	F    func(n float64) float64
+}
+
+var GrowthModels = []GrowthModel{
+	{"linear", func(n float64) float64 { return n }},
+	{"n·log(n)", func(n float64) float64 { return n * math.Log(n) }},
+}
+
+type GrowthFit struct {
+	Model     GrowthModel
+	A, B      float64
+	R2        float64
+	Projected time.Duration
+	Band      time.Duration // ~95% prediction interval half-width at the target size
+}
+
+// Least-squares fit of t = a + b·f(n) with a rough prediction interval at target
+func FitGrowth(m GrowthModel, sizes []float64, latencies []time.Duration, target float64) GrowthFit {
+	k := float64(len(sizes))
+	xs := make([]float64, len(sizes))
+	var sumX, sumY float64
+	for i, n := range sizes {
+		xs[i] = m.F(n)
+		sumX += xs[i]
+		sumY += float64(latencies[i])
+	}
+	meanX, meanY := sumX/k, sumY/k
+
+	var sxx, sxy, syy float64
+	for i := range xs {
+		dx, dy := xs[i]-meanX, float64(latencies[i])-meanY
+		sxx += dx * dx
+		sxy += dx * dy
+		syy += dy * dy
+	}
+	fit := GrowthFit{Model: m}
+	if sxx == 0 {
+		return fit
+	}
+	fit.B = sxy / sxx
+	fit.A = meanY - fit.B*meanX
+
+	var sse float64
+	for i := range xs {
+		r := float64(latencies[i]) - (fit.A + fit.B*xs[i])
+		sse += r * r
+	}
+	if syy > 0 {
+		fit.R2 = 1 - sse/syy
+	} else {
+		fit.R2 = 1
+	}
+
+	x0 := m.F(target)
+	fit.Projected = time.Duration(fit.A + fit.B*x0)
+	if k > 2 {
+		s := math.Sqrt(sse / (k - 2))
+		fit.Band = time.Duration(2 * s * math.Sqrt(1+1/k+(x0-meanX)*(x0-meanX)/sxx))
+	}
+	return fit
+}
+
+// Slope of log(latency) against log(n): about 1 for a full scan, near 0 for an
+// index lookup whose result size doesn't grow, above 1 when something degrades
+// faster than the data. NaN with fewer than two positive points.
+func ScalingExponent(sizes []float64, latencies []time.Duration) float64 {
+	var xs, ys []float64
+	for i, n := range sizes {
+		if n > 0 && latencies[i] > 0 {
+			xs = append(xs, math.Log(n))
+			ys = append(ys, math.Log(float64(latencies[i])))
+		}
+	}
+	if len(xs) < 2 {
+		return math.NaN()
+	}
+	var meanX, meanY float64
+	for i := range xs {
+		meanX += xs[i]
+		meanY += ys[i]
+	}
+	meanX /= float64(len(xs))
+	meanY /= float64(len(ys))
+	var sxx, sxy float64
+	for i := range xs {
+		sxx += (xs[i] - meanX) * (xs[i] - meanX)
+		sxy += (xs[i] - meanX) * (ys[i] - meanY)
+	}
+	if sxx == 0 {
+		return math.NaN()
+	}
+	return sxy / sxx
+}
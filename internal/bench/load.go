@@ -0,0 +1,251 @@
+package bench
+
+import (
+	"context"
+	"database/sql"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// One entry of a load workload; queries are picked in proportion to Weight
+type LoadQuery struct {
+	Name   string
+	Fn     QueryFunc
+	Weight float64
+}
+
+type LoadOptions struct {
+	Workers  int
+	Duration time.Duration
+	Timeout  time.Duration
+	// Requests started per second across all workers; 0 runs closed-loop,
+	// every worker starting its next query as soon as the last one finished
+	TargetQPS float64
+}
+
+type LoadResult struct {
+	Workers     int
+	TargetQPS   float64
+	Elapsed     time.Duration
+	Queries     int
+	Stats       Stats
+	Histogram   []HistogramBucket
+	PerQuery    []QueryLoad    // in workload order
+	Errors      map[string]int // error message -> occurrences
+	ErrorCount  int
+	Dropped     int           // paced requests not started because every worker was still busy
+	PoolWaits   int64         // connection requests that had to wait for a free pool slot
+	PoolWaited  time.Duration // total time spent waiting for a pool slot
+	MaxOpenConn int
+	PeakInUse   int     // most connections in use at once, sampled
+	Saturation  float64 // share of samples with every allowed connection in use
+}
+
+type QueryLoad struct {
+	Name    string
+	Queries int
+	Errors  int
+	Stats   Stats
+}
+
+func (r LoadResult) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Queries) / r.Elapsed.Seconds()
+}
+
+// How often pool usage is sampled during a load test
+const poolSampleInterval = 50 * time.Millisecond
+
+// Seed of the workload mix, so repeated runs send the same sequence of rules
+const loadRandomSeed = 42
+
+// Run the workload from opts.Workers goroutines for opts.Duration. Every
+// worker shares db, so the pool's SetMaxOpenConns limit applies to the whole
+// load. With a target rate, latency is measured from each request's scheduled
+// start, so time spent queued behind busy workers counts against it.
+func RunLoad(ctx context.Context, db *sql.DB, queries []LoadQuery, opts LoadOptions) LoadResult {
+	loadCtx, cancel := context.WithTimeout(ctx, opts.Duration)
+	defer cancel()
+
+	before := db.Stats()
+	start := time.Now()
+
+	// Requests carry the workload entry and, when paced, their scheduled start
+	type request struct {
+		query     int
+		scheduled time.Time
+	}
+	requests := make(chan request, opts.Workers)
+	pick := weightedPicker(queries, rand.New(rand.NewSource(loadRandomSeed)))
+	var dropped int
+	dispatched := make(chan struct{})
+	go func() {
+		defer close(dispatched)
+		defer close(requests)
+		if opts.TargetQPS <= 0 {
+			for {
+				select {
+				case requests <- request{query: pick()}:
+				case <-loadCtx.Done():
+					return
+				}
+			}
+		}
+		interval := time.Duration(float64(time.Second) / opts.TargetQPS)
+		next := start
+		for {
+			select {
+			case <-time.After(time.Until(next)):
+			case <-loadCtx.Done():
+				return
+			}
+			// Never queue more than one request per worker; the rest are dropped and counted
+			select {
+			case requests <- request{query: pick(), scheduled: next}:
+			default:
+				dropped++
+			}
+			next = next.Add(interval)
+		}
+	}()
+
+	var (
+		mu       sync.Mutex
+		samples  []time.Duration
+		perQuery = make([][]time.Duration, len(queries))
+		perErrs  = make([]int, len(queries))
+		errs     = map[string]int{}
+		errN     int
+		wg       sync.WaitGroup
+	)
+	for w := 0; w < opts.Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for req := range requests {
+				_, d, err := RunWithTimeout(loadCtx, queries[req.query].Fn, opts.Timeout)
+				if loadCtx.Err() != nil {
+					// Cancelled because the load window closed, not a real failure
+					break
+				}
+				if !req.scheduled.IsZero() {
+					d = time.Since(req.scheduled)
+				}
+
+				mu.Lock()
+				if err != nil {
+					errs[err.Error()]++
+					errN++
+					perErrs[req.query]++
+				} else {
+					samples = append(samples, d)
+					perQuery[req.query] = append(perQuery[req.query], d)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	peak, saturated, observed := samplePool(loadCtx, db)
+	wg.Wait()
+	<-dispatched
+
+	elapsed := time.Since(start)
+	after := db.Stats()
+	res := LoadResult{
+		Workers:     opts.Workers,
+		TargetQPS:   opts.TargetQPS,
+		Elapsed:     elapsed,
+		Queries:     len(samples),
+		Stats:       ComputeStats(samples),
+		Histogram:   LatencyHistogram(samples),
+		Errors:      errs,
+		ErrorCount:  errN,
+		Dropped:     dropped,
+		PoolWaits:   after.WaitCount - before.WaitCount,
+		PoolWaited:  after.WaitDuration - before.WaitDuration,
+		MaxOpenConn: after.MaxOpenConnections,
+		PeakInUse:   peak,
+	}
+	if observed > 0 {
+		res.Saturation = float64(saturated) / float64(observed)
+	}
+	for i, q := range queries {
+		res.PerQuery = append(res.PerQuery, QueryLoad{
+			Name:    q.Name,
+			Queries: len(perQuery[i]),
+			Errors:  perErrs[i],
+			Stats:   ComputeStats(perQuery[i]),
+		})
+	}
+	return res
+}
+
+// Sample db.Stats until ctx is done: peak connections in use, and how many
+// samples had the whole pool busy out of how many were taken
+func samplePool(ctx context.Context, db *sql.DB) (peak, saturated, observed int) {
+	ticker := time.NewTicker(poolSampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return peak, saturated, observed
+		case <-ticker.C:
+		}
+		s := db.Stats()
+		peak = max(peak, s.InUse)
+		observed++
+		if s.MaxOpenConnections > 0 && s.InUse >= s.MaxOpenConnections {
+			saturated++
+		}
+	}
+}
+
+// Index of a workload entry, drawn in proportion to the weights
+func weightedPicker(queries []LoadQuery, r *rand.Rand) func() int {
+	cumulative := make([]float64, len(queries))
+	var total float64
+	for i, q := range queries {
+		total += q.Weight
+		cumulative[i] = total
+	}
+	return func() int {
+		if len(queries) == 1 {
+			return 0
+		}
+		return sort.SearchFloat64s(cumulative, r.Float64()*total)
+	}
+}
+
+// Latency bucket with an exclusive lower and inclusive upper bound
+type HistogramBucket struct {
+	UpperBound time.Duration
+	Count      int
+}
+
+// Power-of-two buckets from 1ms up to the slowest sample
+func LatencyHistogram(samples []time.Duration) []HistogramBucket {
+	if len(samples) == 0 {
+		return nil
+	}
+	var slowest time.Duration
+	for _, d := range samples {
+		slowest = max(slowest, d)
+	}
+	var buckets []HistogramBucket
+	for bound := time.Millisecond; ; bound *= 2 {
+		buckets = append(buckets, HistogramBucket{UpperBound: bound})
+		if bound >= slowest {
+			break
+		}
+	}
+	for _, d := range samples {
+		i := sort.Search(len(buckets), func(i int) bool { return d <= buckets[i].UpperBound })
+		buckets[i].Count++
+	}
+	return buckets
+}
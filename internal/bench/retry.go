@@ -0,0 +1,147 @@
+package bench
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// Returned instead of running a query while the circuit breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker open: the database is failing, query not attempted")
+
+// How a query is retried. A nil *Retry runs every query once.
+type Retry struct {
+	Attempts int // tries per query, including the first
+	// Wait before the second try, doubled for each later one up to MaxBackoff;
+	// each wait is jittered between half and all of it
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Errors worth another try, such as a dropped connection; the database
+	// decides, so the caller supplies it
+	Transient func(error) bool
+	// Also retry queries that ran out of time, each try with a fresh deadline
+	Timeouts bool
+	// Optional; sees every try, and while open fails queries without running them
+	Breaker *Breaker
+	// Optional; called before each retry
+	OnRetry func(attempt int, err error, wait time.Duration)
+}
+
+func (r *Retry) retryable(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return r.Timeouts
+	}
+	return r.Transient != nil && r.Transient(err)
+}
+
+// Failures that say the database is struggling, as opposed to a bad query
+func (r *Retry) unhealthy(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || r.Transient != nil && r.Transient(err)
+}
+
+// Run fn under its own deadline like RunWithTimeout, trying again after
+// retryable errors. The duration is the successful try's.
+func (r *Retry) Run(ctx context.Context, fn QueryFunc, timeout time.Duration) (int, time.Duration, error) {
+	count, duration, _, err := r.run(ctx, fn, timeout)
+	return count, duration, err
+}
+
+func (r *Retry) run(ctx context.Context, fn QueryFunc, timeout time.Duration) (count int, duration time.Duration, retries int, err error) {
+	if r == nil {
+		count, duration, err = RunWithTimeout(ctx, fn, timeout)
+		return count, duration, 0, err
+	}
+	wait := r.Backoff
+	for attempt := 1; ; attempt++ {
+		var probe bool
+		if probe, err = r.Breaker.allow(); err != nil {
+			return 0, 0, retries, err
+		}
+		count, duration, err = RunWithTimeout(ctx, fn, timeout)
+		r.Breaker.record(probe, err == nil, err != nil && r.unhealthy(err))
+		if err == nil || attempt >= r.Attempts || !r.retryable(err) || ctx.Err() != nil {
+			return count, duration, retries, err
+		}
+
+		jittered := wait/2 + rand.N(wait/2+1)
+		if r.OnRetry != nil {
+			r.OnRetry(attempt, err, jittered)
+		}
+		select {
+		case <-ctx.Done():
+			return 0, 0, retries, err
+		case <-time.After(jittered):
+		}
+		retries++
+		wait = min(wait*2, max(r.MaxBackoff, r.Backoff))
+	}
+}
+
+// Sheds load while the database is failing: after Threshold queries in a row
+// time out or fail transiently it opens and fails queries without running them
+// for Cooldown, then lets one through to probe, closing again only when that
+// one succeeds. Other errors, such as a bad rule, say nothing about the
+// database and count neither way.
+type Breaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openTill time.Time
+	probing  bool
+}
+
+// Whether the breaker is currently shedding queries
+func (b *Breaker) Open() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures >= b.Threshold && (b.probing || time.Now().Before(b.openTill))
+}
+
+// Whether a query may run, and whether it is the probe of an open breaker
+func (b *Breaker) allow() (probe bool, err error) {
+	if b == nil {
+		return false, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.Threshold {
+		return false, nil
+	}
+	if b.probing || time.Now().Before(b.openTill) {
+		return false, ErrCircuitOpen
+	}
+	b.probing = true
+	return true, nil
+}
+
+// Count one try that allow let through. Once open, only the probe's outcome
+// matters: queries still running from before it opened neither close it nor
+// extend the cooldown.
+func (b *Breaker) record(probe, succeeded, failed bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		b.probing = false
+	} else if b.failures >= b.Threshold {
+		return
+	}
+	switch {
+	case succeeded:
+		b.failures = 0
+	case failed:
+		b.failures++
+		if b.failures >= b.Threshold {
+			b.openTill = time.Now().Add(b.Cooldown)
+		}
+	}
+}
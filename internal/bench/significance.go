@@ -0,0 +1,136 @@
+package bench
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	bootstrapResamples = 2000
+	significanceLevel  = 0.05
+)
+
+// Ratio of two latency distributions with its uncertainty
+type Speedup struct {
+	Median      float64 // baseline median / candidate median
+	CILow       float64 // 95% bootstrap interval of the median ratio
+	CIHigh      float64
+	PValue      float64 // two-sided Mann-Whitney U
+	Significant bool
+}
+
+// Compare baseline and candidate latencies. A speedup above 1 means the candidate is faster.
+// The difference counts as real only if the rank test rejects equal distributions and
+// the bootstrap interval of the ratio excludes 1.
+func EstimateSpeedup(baseline, candidate []time.Duration) (Speedup, bool) {
+	if len(baseline) == 0 || len(candidate) == 0 {
+		return Speedup{}, false
+	}
+	cm := medianOf(candidate)
+	if cm <= 0 {
+		return Speedup{}, false
+	}
+	e := Speedup{
+		Median: medianOf(baseline) / cm,
+		PValue: mannWhitneyP(baseline, candidate),
+	}
+	e.CILow, e.CIHigh = bootstrapRatioCI(baseline, candidate)
+	e.Significant = e.PValue < significanceLevel && (e.CILow > 1 || e.CIHigh < 1)
+	return e, true
+}
+
+func (e Speedup) String() string {
+	s := fmt.Sprintf("%.1fx (95%% CI %.1fx–%.1fx, p=%.3g)", e.Median, e.CILow, e.CIHigh, e.PValue)
+	if !e.Significant {
+		s += " ⚠️  not significant"
+	}
+	return s
+}
+
+func medianOf(samples []time.Duration) float64 {
+	sorted := make([]float64, len(samples))
+	for i, d := range samples {
+		sorted[i] = float64(d)
+	}
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 0 {
+		return (sorted[n/2-1] + sorted[n/2]) / 2
+	}
+	return sorted[n/2]
+}
+
+// Percentile bootstrap of median(a)/median(b); seeded so reruns on the same samples agree
+func bootstrapRatioCI(a, b []time.Duration) (float64, float64) {
+	r := rand.New(rand.NewSource(1))
+	ra, rb := make([]time.Duration, len(a)), make([]time.Duration, len(b))
+	ratios := make([]float64, 0, bootstrapResamples)
+	for i := 0; i < bootstrapResamples; i++ {
+		for j := range ra {
+			ra[j] = a[r.Intn(len(a))]
+		}
+		for j := range rb {
+			rb[j] = b[r.Intn(len(b))]
+		}
+		if m := medianOf(rb); m > 0 {
+			ratios = append(ratios, medianOf(ra)/m)
+		}
+	}
+	if len(ratios) == 0 {
+		return math.NaN(), math.NaN()
+	}
+	sort.Float64s(ratios)
+	at := func(q float64) float64 {
+		return ratios[min(int(q*float64(len(ratios))), len(ratios)-1)]
+	}
+	return at(0.025), at(0.975)
+}
+
+// Two-sided p-value of the Mann-Whitney U test, normal approximation with tie correction
+func mannWhitneyP(a, b []time.Duration) float64 {
+	type obs struct {
+		v     time.Duration
+		fromA bool
+	}
+	all := make([]obs, 0, len(a)+len(b))
+	for _, v := range a {
+		all = append(all, obs{v, true})
+	}
+	for _, v := range b {
+		all = append(all, obs{v, false})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].v < all[j].v })
+
+	n1, n2, n := float64(len(a)), float64(len(b)), float64(len(all))
+	var rankSumA, tieTerm float64
+	for i := 0; i < len(all); {
+		j := i
+		for j < len(all) && all[j].v == all[i].v {
+			j++
+		}
+		rank := float64(i+j+1) / 2 // average of ranks i+1..j
+		for k := i; k < j; k++ {
+			if all[k].fromA {
+				rankSumA += rank
+			}
+		}
+		t := float64(j - i)
+		tieTerm += t*t*t - t
+		i = j
+	}
+
+	u := rankSumA - n1*(n1+1)/2
+	mean := n1 * n2 / 2
+	variance := n1 * n2 / 12 * ((n + 1) - tieTerm/(n*(n-1)))
+	if variance <= 0 {
+		return 1
+	}
+	z := (math.Abs(u-mean) - 0.5) / math.Sqrt(variance)
+	if z < 0 {
+		return 1
+	}
+	return math.Erfc(z / math.Sqrt2)
+}
@@ -0,0 +1,223 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"audience-poc/internal/bench"
+	"audience-poc/internal/store"
+)
+
+// Runs per rule before and after --apply; enough to see an index pay off
+var adviseOpts = bench.Options{Warmup: 1, Iterations: 5}
+
+func newSchemaAdviseCmd(cfg *Config) *cobra.Command {
+	var apply bool
+	var outFile string
+	cmd := &cobra.Command{
+		Use:   "advise WORKLOAD",
+		Short: "Recommend user_profiles indexes for a workload of rules",
+		Long: `Read a JSON file of weighted rules, in the bench --workload format, EXPLAIN each one
+against the optimized model and print the indexes its predicates need as executable DDL:
+GIN for set attributes and overflow containment, b-tree otherwise, partial when every rule
+on a column requires the same boolean flag or lower bound. Indexes that already exist are
+listed but not recommended. --apply creates the recommended indexes and times every rule
+before and after.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := requirePostgres(cfg, "schema advise"); err != nil {
+				return err
+			}
+			ctx := cmd.Context()
+			db, err := connect(ctx, *cfg)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+			// Parsed after connecting, so rules can use registered attributes
+			workload, err := loadWorkload(args[0])
+			if err != nil {
+				return fmt.Errorf("failed to load the workload: %w", err)
+			}
+
+			advised := make([]store.AdvisedRule, len(workload))
+			for i, e := range workload {
+				advised[i] = store.AdvisedRule{Name: e.Name, Rule: e.Rule, Weight: e.Weight}
+				plan, err := explainRule(ctx, db, store.OptimizedCountSQL, e.Rule, cfg.QueryTimeout)
+				if err != nil {
+					slog.Warn("failed to explain rule, advising without its plan", "rule", e.Name, "err", err)
+					continue
+				}
+				advised[i].Plan = plan
+			}
+			indexCtx, cancel := bench.QueryContext(ctx, cfg.QueryTimeout)
+			existing, err := store.ProfileIndexes(indexCtx, db)
+			cancel()
+			if err != nil {
+				return fmt.Errorf("failed to list user_profiles indexes: %w", err)
+			}
+			advice, err := store.AdviseIndexes(advised, existing)
+			if err != nil {
+				return err
+			}
+
+			var recommended []store.IndexAdvice
+			for _, a := range advice {
+				if a.CoveredBy == "" {
+					recommended = append(recommended, a)
+				}
+			}
+			printIndexAdvice(advice, len(recommended))
+			if outFile != "" {
+				if err := writeAdviceDDL(outFile, recommended); err != nil {
+					return fmt.Errorf("failed to write %s: %w", outFile, err)
+				}
+				fmt.Fprintf(summaryOut, "📝 DDL written to %s\n", outFile)
+			}
+			if !apply || len(recommended) == 0 {
+				return nil
+			}
+			return applyIndexAdvice(ctx, db, workload, recommended, cfg)
+		},
+	}
+	f := cmd.Flags()
+	f.BoolVar(&apply, "apply", false, "create the recommended indexes and time every rule before and after")
+	f.StringVar(&outFile, "out-file", "", "also write the recommended DDL to this SQL file")
+	return cmd
+}
+
+func printIndexAdvice(advice []store.IndexAdvice, recommended int) {
+	fmt.Fprintf(summaryOut, "🧭 %d indexes recommended, %d already covered\n", recommended, len(advice)-recommended)
+	tw := tabwriter.NewWriter(summaryOut, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "index\tkind\tweight\trules\tseq scans\tstatus")
+	for _, a := range advice {
+		status := "recommended"
+		if a.CoveredBy != "" {
+			status = "covered by " + a.CoveredBy
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%g\t%s\t%d\t%s\n", a.Name, a.Kind, a.Weight, strings.Join(a.Rules, ","), len(a.SeqScanRules), status)
+	}
+	tw.Flush()
+	if recommended > 0 {
+		fmt.Fprintln(summaryOut)
+		writeAdviceSQL(summaryOut, advice)
+	}
+}
+
+// The recommended indexes as a script psql can run, each with the rules it serves
+func writeAdviceSQL(w io.Writer, advice []store.IndexAdvice) {
+	for _, a := range advice {
+		if a.CoveredBy != "" {
+			continue
+		}
+		fmt.Fprintf(w, "-- %s: %s (weight %g)", a.Kind, strings.Join(a.Rules, ", "), a.Weight)
+		if len(a.SeqScanRules) > 0 {
+			fmt.Fprintf(w, ", seq scan in %s", strings.Join(a.SeqScanRules, ", "))
+		}
+		fmt.Fprintf(w, "\n%s;\n", a.DDL)
+	}
+}
+
+func writeAdviceDDL(path string, advice []store.IndexAdvice) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	writeAdviceSQL(f, advice)
+	return f.Close()
+}
+
+// Time every rule, build the indexes in one transaction, refresh the planner
+// statistics and time the rules again, reporting whether each plan uses a new index
+func applyIndexAdvice(ctx context.Context, db *sql.DB, workload []workloadEntry, advice []store.IndexAdvice, cfg *Config) error {
+	opts := adviseOpts
+	opts.Timeout = cfg.QueryTimeout
+	before := make([]bench.Result, len(workload))
+	for i, e := range workload {
+		before[i] = bench.Run(ctx, optimizedCount(db, e.Rule), opts)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := store.UnboundedStatements(ctx, tx); err != nil {
+		return err
+	}
+	for _, a := range advice {
+		fmt.Fprintf(out, "🔨 %s\n", a.DDL)
+		if _, err := tx.ExecContext(ctx, a.DDL); err != nil {
+			return fmt.Errorf("create %s: %w", a.Name, err)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "ANALYZE user_profiles"); err != nil {
+		return fmt.Errorf("analyze user_profiles: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	names := make([]string, len(advice))
+	for i, a := range advice {
+		names[i] = a.Name
+	}
+	// Partitions get indexes of their own, attached to the new ones
+	parentCtx, cancel := bench.QueryContext(ctx, cfg.QueryTimeout)
+	parents, err := store.PartitionIndexParents(parentCtx, db, names)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("failed to list partition indexes: %w", err)
+	}
+	for _, name := range names {
+		parents[name] = name
+	}
+	fmt.Fprintf(summaryOut, "\n📊 Optimized model median latency, before and after %d new indexes\n", len(advice))
+	tw := tabwriter.NewWriter(summaryOut, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "rule\tbefore\tafter\tchange\tnew index used")
+	var failed []string
+	for i, e := range workload {
+		after := bench.Run(ctx, optimizedCount(db, e.Rule), opts)
+		if b := before[i]; b.Err != nil || after.Err != nil {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t-\t-\n", e.Name, medianOrFailure(b), medianOrFailure(after))
+			if after.Err != nil {
+				failed = append(failed, fmt.Sprintf("%s: %v", e.Name, after.Err))
+			}
+			continue
+		}
+		used := "no"
+		if plan, err := explainRule(ctx, db, store.OptimizedCountSQL, e.Rule, cfg.QueryTimeout); err == nil {
+			for _, name := range plan.IndexNames() {
+				if parent, ok := parents[name]; ok {
+					used = parent
+					break
+				}
+			}
+		}
+		change := float64(after.Stats.Median)/float64(before[i].Stats.Median) - 1
+		fmt.Fprintf(tw, "%s\t%v\t%v\t%+.1f%%\t%s\n", e.Name, before[i].Stats.Median, after.Stats.Median, change*100, used)
+	}
+	tw.Flush()
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func medianOrFailure(r bench.Result) string {
+	switch {
+	case r.TimedOut:
+		return "timed out"
+	case r.Err != nil:
+		return "error"
+	}
+	return r.Stats.Median.String()
+}
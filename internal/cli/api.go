@@ -0,0 +1,266 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+
+	"audience-poc/internal/bench"
+	"audience-poc/internal/rules"
+	"audience-poc/internal/store"
+)
+
+const maxRequestBody = 1 << 20
+
+type countRequest struct {
+	Rule       string `json:"rule"`
+	AudienceID int64  `json:"audience_id"`
+	Estimate   bool   `json:"estimate"` // approximate the count instead of running it
+}
+
+type countResponse struct {
+	AudienceID int64   `json:"audience_id,omitempty"`
+	Rule       string  `json:"rule"`
+	Count      int     `json:"count"`
+	DurationMS float64 `json:"duration_ms"`
+	Cached     bool    `json:"cached,omitempty"` // served from the --redis count cache
+	// Served from the audience's materialization, refreshed within --materialized-max-age
+	Materialized bool `json:"materialized,omitempty"`
+	// Set only when count is an estimate
+	Estimate *estimateResponse `json:"estimate,omitempty"`
+}
+
+type estimateResponse struct {
+	Method        string  `json:"method"`
+	Margin        int64   `json:"margin,omitempty"` // 95% half-width, sampled estimates only
+	SamplePercent float64 `json:"sample_percent,omitempty"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+type statusResponse struct {
+	Status string `json:"status"`
+}
+
+// POST /audiences/evaluate (and the older POST /count): evaluate a rule, or a
+// stored audience by id, against the optimized model
+func countHandler(route *store.Router, timeout time.Duration, retry *bench.Retry, estimates store.EstimateOptions, cache *countCache, maxAge time.Duration, m *apiMetrics) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req countRequest
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			m.evaluated("http", nil, reasonInvalidRequest)
+			writeJSON(w, http.StatusBadRequest, errorResponse{fmt.Sprintf("invalid request body: %v", err)})
+			return
+		}
+		evaluate(w, r, route, timeout, retry, estimates, cache, maxAge, m, req)
+	}
+}
+
+// POST /audiences/{id}/evaluate[?estimate=true]: evaluate a stored audience
+func audienceEvaluateHandler(route *store.Router, timeout time.Duration, retry *bench.Retry, estimates store.EstimateOptions, cache *countCache, maxAge time.Duration, m *apiMetrics) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := audienceID(w, r)
+		if !ok {
+			m.evaluated("http", nil, reasonInvalidRequest)
+			return
+		}
+		evaluate(w, r, route, timeout, retry, estimates, cache, maxAge, m, countRequest{AudienceID: id, Estimate: r.URL.Query().Get("estimate") == "true"})
+	}
+}
+
+// Exact counts go through cache when it is set; estimates never do. Stored
+// audiences are read from the primary, so one just created can be evaluated,
+// and the count from a replica, retried by retry. An exact count of a stored
+// audience comes from its materialization instead while that is under maxAge
+// and matches the current rule.
+func evaluate(w http.ResponseWriter, r *http.Request, route *store.Router, timeout time.Duration, retry *bench.Retry, estimates store.EstimateOptions, cache *countCache, maxAge time.Duration, m *apiMetrics, req countRequest) {
+	ctx, ruleText, err := resolveRule(r.Context(), route.Primary(), req.Rule, req.AudienceID, timeout)
+	switch {
+	case errors.Is(err, errRuleOrAudience):
+		m.evaluated("http", nil, reasonInvalidRequest)
+		writeJSON(w, http.StatusBadRequest, errorResponse{err.Error()})
+		return
+	case errors.Is(err, store.ErrAudienceNotFound):
+		m.evaluated("http", nil, reasonNotFound)
+		writeJSON(w, http.StatusNotFound, errorResponse{err.Error()})
+		return
+	case err != nil:
+		status := queryErrorStatus(r.Context(), route.Primary(), err)
+		m.evaluated("http", nil, queryErrorReason(status))
+		slog.WarnContext(r.Context(), "audience lookup failed", "audience_id", req.AudienceID, "status", status, "err", err)
+		writeJSON(w, status, errorResponse{http.StatusText(status)})
+		return
+	}
+	rule, err := rules.Parse(ruleText)
+	if err != nil {
+		m.evaluated("http", nil, reasonInvalidRule)
+		writeJSON(w, http.StatusBadRequest, errorResponse{err.Error()})
+		return
+	}
+	rule = store.Scope(ctx, rule)
+
+	if req.Estimate && store.Active().Name() != (store.Postgres{}).Name() {
+		m.evaluated("http", rule, reasonInvalidRequest)
+		writeJSON(w, http.StatusBadRequest, errorResponse{"estimates are only supported with PostgreSQL"})
+		return
+	}
+
+	db := route.Read()
+	query, fn := "count", optimizedCount(db, ruleText)
+	var est store.Estimate
+	var cached, materialized bool
+	switch {
+	case req.Estimate:
+		query = "estimate"
+		fn = func(ctx context.Context) (int, time.Duration, error) {
+			var err error
+			est, err = store.EstimateCount(ctx, db, ruleText, estimates)
+			return int(est.Count), est.Duration, err
+		}
+	case cache != nil:
+		fn = func(ctx context.Context) (int, time.Duration, error) {
+			count, duration, hit, err := cache.count(ctx, db, rule, ruleText)
+			cached = hit
+			return count, duration, err
+		}
+	}
+	if req.AudienceID != 0 && !req.Estimate && maxAge > 0 {
+		fn = materializedCount(db, req.AudienceID, ruleText, maxAge, fn, &materialized)
+	}
+	count, duration, err := retry.Run(ctx, fn, timeout)
+	if err != nil {
+		status := queryErrorStatus(r.Context(), db, err)
+		m.evaluated("http", rule, queryErrorReason(status))
+		slog.WarnContext(ctx, query+" query failed", "rule", ruleText, "rule_hash", rule.Hash(), "status", status, "err", err)
+		writeJSON(w, status, errorResponse{http.StatusText(status)})
+		return
+	}
+	m.observe(ctx, countModel(cached, materialized), query, rule, duration, count)
+	m.evaluated("http", rule, "")
+	res := countResponse{
+		AudienceID:   req.AudienceID,
+		Rule:         ruleText,
+		Count:        count,
+		DurationMS:   float64(duration.Microseconds()) / 1000,
+		Cached:       cached,
+		Materialized: materialized,
+	}
+	if req.Estimate {
+		res.Estimate = &estimateResponse{Method: est.Method, Margin: est.Margin, SamplePercent: est.SamplePercent}
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// Liveness: the process is up and serving
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, statusResponse{"ok"})
+}
+
+// Readiness: not shutting down and the primary answers, so evaluate requests
+// can succeed with or without replicas
+func readyzHandler(db *sql.DB, sd *shutdown) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if sd.isDraining() {
+			writeJSON(w, http.StatusServiceUnavailable, statusResponse{"draining"})
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		defer cancel()
+		if err := db.PingContext(ctx); err != nil {
+			slog.Warn("readiness check failed", "err", err)
+			writeJSON(w, http.StatusServiceUnavailable, statusResponse{"unavailable"})
+			return
+		}
+		writeJSON(w, http.StatusOK, statusResponse{"ok"})
+	}
+}
+
+// 504 when the query ran out of time, 503 when the database is gone or the
+// circuit breaker shed the query, 500 otherwise
+func queryErrorStatus(ctx context.Context, db *sql.DB, err error) int {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, bench.ErrCircuitOpen):
+		return http.StatusServiceUnavailable
+	}
+	pingCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	if db.PingContext(pingCtx) != nil {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("write response", "err", err)
+	}
+}
+
+// Serve the rule API and its metrics on addr until ctx is done, then drain
+func serveAPI(ctx context.Context, route *store.Router, addr string, timeout time.Duration, retry *bench.Retry, estimates store.EstimateOptions, cache *countCache, maxAge time.Duration, reg *prometheus.Registry, m *apiMetrics, sd *shutdown, clients *clientAuth, tenants *tenantAuth, targets store.TriggerTargets) error {
+	api := http.NewServeMux()
+	count := countHandler(route, timeout, retry, estimates, cache, maxAge, m)
+	// Evaluations join the caller's trace through its traceparent header
+	api.Handle("POST /audiences/evaluate", otelhttp.NewHandler(count, "POST /audiences/evaluate"))
+	api.Handle("POST /count", otelhttp.NewHandler(count, "POST /count"))
+	api.Handle("POST /audiences/{id}/evaluate", otelhttp.NewHandler(audienceEvaluateHandler(route, timeout, retry, estimates, cache, maxAge, m), "POST /audiences/{id}/evaluate"))
+	api.Handle("POST /audiences/overlap", otelhttp.NewHandler(overlapHandler(route, timeout, retry, m), "POST /audiences/overlap"))
+	api.Handle("POST /audiences/evaluate-batch", otelhttp.NewHandler(batchHandler(route, timeout, retry, m), "POST /audiences/evaluate-batch"))
+	registerAudienceRoutes(api, route.Primary(), timeout)
+	registerTriggerRoutes(api, route.Primary(), timeout, targets)
+	// Every route but the probes and metrics is one client's and one tenant's
+	mux := http.NewServeMux()
+	mux.Handle("/", clients.middleware(tenants.middleware(api)))
+	mux.HandleFunc("GET /healthz", healthzHandler)
+	mux.Handle("GET /readyz", readyzHandler(route.Primary(), sd))
+	mux.Handle("GET /metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	// Requests outlive ctx while they drain; this cancels the ones still running at the deadline
+	requests, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           requestLog(mux),
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return requests },
+	}
+
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- srv.ListenAndServe() }()
+	slog.Info("serving HTTP API", "addr", addr)
+
+	select {
+	case <-ctx.Done():
+		// Stop accepting, close idle keep-alive connections and wait for in-flight requests
+		start := time.Now()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), sd.timeout)
+		defer cancel()
+		err := srv.Shutdown(shutdownCtx)
+		if errors.Is(err, context.DeadlineExceeded) {
+			slog.Warn("HTTP requests still running at --shutdown-timeout, cancelling them", "timeout", sd.timeout)
+			cancelRequests()
+			return srv.Close()
+		}
+		slog.Info("HTTP server drained", "duration", time.Since(start).Round(time.Millisecond))
+		return err
+	case err := <-serveErr:
+		return fmt.Errorf("HTTP server: %w", err)
+	}
+}
@@ -0,0 +1,167 @@
+package cli
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+
+	"audience-poc/internal/bench"
+	"audience-poc/internal/rules"
+	"audience-poc/internal/store"
+)
+
+// Distinct rules labelled individually; later ones share the "other" label so
+// clients sending generated rules can't grow the series without bound
+const maxRuleLabels = 100
+
+// Error reasons of the serve metrics
+const (
+	reasonInvalidRequest = "invalid_request"
+	reasonInvalidRule    = "invalid_rule"
+	reasonNotFound       = "not_found"
+	reasonTimeout        = "timeout"
+	reasonUnavailable    = "unavailable"
+	reasonInternal       = "internal"
+)
+
+// Reasons requests are turned away before they are served
+const (
+	reasonUnauthenticated = "unauthenticated"
+	reasonRateLimited     = "rate_limited"
+)
+
+// Metrics of serve, shared by the HTTP and gRPC APIs and exposed on GET /metrics
+type apiMetrics struct {
+	evaluations *prometheus.CounterVec
+	duration    *prometheus.HistogramVec
+	errors      *prometheus.CounterVec
+	cache       *prometheus.CounterVec
+	rejected    *prometheus.CounterVec
+
+	mu    sync.Mutex
+	rules map[string]bool
+}
+
+func newAPIMetrics(reg prometheus.Registerer, route *store.Router, breaker *bench.Breaker, dbName string) *apiMetrics {
+	m := &apiMetrics{
+		evaluations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "audience_serve_evaluations_total",
+			Help: "Rule evaluations served, by canonical rule and outcome.",
+		}, []string{"transport", "rule", "status"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "audience_serve_query_duration_seconds",
+			Help:    "Execution time of the database queries behind served evaluations.",
+			Buckets: durationBuckets,
+		}, []string{"model", "query"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "audience_serve_errors_total",
+			Help: "Evaluation requests that failed, by reason.",
+		}, []string{"transport", "reason"}),
+		cache: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "audience_serve_cache_requests_total",
+			Help: "Count cache lookups with --redis: hit, miss or error.",
+		}, []string{"result"}),
+		rejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "audience_serve_rejected_requests_total",
+			Help: "Requests turned away without a valid API key or token, or over their client's rate limit.",
+		}, []string{"transport", "reason"}),
+		rules: map[string]bool{},
+	}
+	// go_sql_* pool gauges and counters from db.Stats()
+	reg.MustRegister(m.evaluations, m.duration, m.errors, m.cache, m.rejected, collectors.NewDBStatsCollector(route.Primary(), dbName))
+	if breaker != nil {
+		reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "audience_serve_breaker_open",
+			Help: "Whether the circuit breaker is open and shedding evaluation queries.",
+		}, func() float64 {
+			if breaker.Open() {
+				return 1
+			}
+			return 0
+		}))
+	}
+	for _, rep := range route.Replicas() {
+		reg.MustRegister(collectors.NewDBStatsCollector(rep.DB, dbName+"@"+rep.Addr), prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "audience_serve_replica_up",
+			Help:        "Whether the read replica answered its last health check and takes reads.",
+			ConstLabels: prometheus.Labels{"replica": rep.Addr},
+		}, func() float64 {
+			if rep.Healthy() {
+				return 1
+			}
+			return 0
+		}))
+	}
+	return m
+}
+
+// Label of a parsed rule: its canonical form, or "other" past maxRuleLabels
+func (m *apiMetrics) ruleLabel(rule *rules.Rule) string {
+	canonical := rule.Canonical()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.rules[canonical] {
+		if len(m.rules) >= maxRuleLabels {
+			return "other"
+		}
+		m.rules[canonical] = true
+	}
+	return canonical
+}
+
+// A served evaluation; reason is empty when it succeeded
+func (m *apiMetrics) evaluated(transport string, rule *rules.Rule, reason string) {
+	label := "invalid"
+	if rule != nil {
+		label = m.ruleLabel(rule)
+	}
+	status := "ok"
+	if reason != "" {
+		status = "error"
+		m.errors.WithLabelValues(transport, reason).Inc()
+	}
+	m.evaluations.WithLabelValues(transport, label, status).Inc()
+}
+
+// A served query, in the metrics and the log. rows is what it answered with:
+// the users counted, the user_ids of a members page or the audiences of an
+// overlap or batch. rule is nil for queries of several rules.
+func (m *apiMetrics) observe(ctx context.Context, model, query string, rule *rules.Rule, d time.Duration, rows int) {
+	m.duration.WithLabelValues(model, query).Observe(d.Seconds())
+	attrs := []any{"query", query, "model", model, "duration_ms", ms(d), "rows", rows}
+	if rule != nil {
+		attrs = append(attrs, "rule_hash", rule.Hash())
+	}
+	slog.InfoContext(ctx, "query", attrs...)
+}
+
+// model label of a count: where it came from
+func countModel(cached, materialized bool) string {
+	switch {
+	case materialized:
+		return "materialized"
+	case cached:
+		return "cache"
+	}
+	return "optimized"
+}
+
+func (m *apiMetrics) cacheRequest(result string) {
+	m.cache.WithLabelValues(result).Inc()
+}
+
+// Error reason of a failed query, from its queryErrorStatus
+func queryErrorReason(status int) string {
+	switch status {
+	case http.StatusGatewayTimeout:
+		return reasonTimeout
+	case http.StatusServiceUnavailable:
+		return reasonUnavailable
+	}
+	return reasonInternal
+}
@@ -0,0 +1,382 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"audience-poc/internal/bench"
+	"audience-poc/internal/store"
+)
+
+var errRuleOrAudience = errors.New("set exactly one of rule and audience_id")
+
+// Rule an evaluation request refers to: the rule itself, or the stored
+// audience's along with ctx restricted to the audience's tenant. Fails with
+// store.ErrAudienceNotFound for an unknown id or another tenant's audience.
+func resolveRule(ctx context.Context, db *sql.DB, rule string, audienceID int64, timeout time.Duration) (context.Context, string, error) {
+	if (rule == "") == (audienceID == 0) {
+		return ctx, "", errRuleOrAudience
+	}
+	if audienceID == 0 {
+		return ctx, rule, nil
+	}
+	queryCtx, cancel := bench.QueryContext(ctx, timeout)
+	defer cancel()
+	a, err := store.GetAudience(queryCtx, db, audienceID)
+	if err != nil {
+		return ctx, "", err
+	}
+	return store.WithTenant(ctx, a.Tenant), a.Rule, nil
+}
+
+// Cases for --audience flags, named audience_<id>, titled with the audience
+// name and evaluated over the audience's tenant, as serve evaluates them
+func audienceCases(ctx context.Context, db *sql.DB, ids []int64, timeout time.Duration) ([]benchCase, error) {
+	cases := make([]benchCase, len(ids))
+	for i, id := range ids {
+		queryCtx, cancel := bench.QueryContext(ctx, timeout)
+		a, err := store.GetAudience(queryCtx, db, id)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("audience %d: %w", id, err)
+		}
+		cases[i] = benchCase{fmt.Sprintf("audience_%d", id), fmt.Sprintf("Audience %d", id), a.Name, a.Rule, true, false, a.Tenant}
+	}
+	return cases, nil
+}
+
+// HTTP: /audiences CRUD
+
+// 400 for an invalid definition, 404/409 for a missing or duplicate audience
+// (404 for a missing trigger), and the usual query error statuses otherwise
+func audienceErrorStatus(ctx context.Context, db *sql.DB, err error) int {
+	switch {
+	case errors.Is(err, store.ErrAudienceNotFound), errors.Is(err, store.ErrTriggerNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, store.ErrAudienceExists):
+		return http.StatusConflict
+	}
+	return queryErrorStatus(ctx, db, err)
+}
+
+func writeAudienceError(w http.ResponseWriter, r *http.Request, db *sql.DB, err error) {
+	status := audienceErrorStatus(r.Context(), db, err)
+	msg := http.StatusText(status)
+	if status == http.StatusNotFound || status == http.StatusConflict {
+		msg = err.Error()
+	}
+	writeJSON(w, status, errorResponse{msg})
+}
+
+func decodeAudienceSpec(w http.ResponseWriter, r *http.Request) (store.AudienceSpec, bool) {
+	var spec store.AudienceSpec
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&spec); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{fmt.Sprintf("invalid request body: %v", err)})
+		return spec, false
+	}
+	if err := spec.Validate(); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{err.Error()})
+		return spec, false
+	}
+	return spec, true
+}
+
+func audienceID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id < 1 {
+		writeJSON(w, http.StatusBadRequest, errorResponse{fmt.Sprintf("invalid audience id %q", r.PathValue("id"))})
+		return 0, false
+	}
+	return id, true
+}
+
+func registerAudienceRoutes(mux *http.ServeMux, db *sql.DB, timeout time.Duration) {
+	mux.HandleFunc("POST /audiences", func(w http.ResponseWriter, r *http.Request) {
+		spec, ok := decodeAudienceSpec(w, r)
+		if !ok {
+			return
+		}
+		ctx, cancel := bench.QueryContext(r.Context(), timeout)
+		defer cancel()
+		a, err := store.CreateAudience(ctx, db, spec)
+		if err != nil {
+			writeAudienceError(w, r, db, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, a)
+	})
+	mux.HandleFunc("GET /audiences", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := bench.QueryContext(r.Context(), timeout)
+		defer cancel()
+		audiences, err := store.ListAudiences(ctx, db, r.URL.Query().Get("owner"))
+		if err != nil {
+			writeAudienceError(w, r, db, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, audiences)
+	})
+	mux.HandleFunc("GET /audiences/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, ok := audienceID(w, r)
+		if !ok {
+			return
+		}
+		ctx, cancel := bench.QueryContext(r.Context(), timeout)
+		defer cancel()
+		a, err := store.GetAudience(ctx, db, id)
+		if err != nil {
+			writeAudienceError(w, r, db, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, a)
+	})
+	mux.HandleFunc("PUT /audiences/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, ok := audienceID(w, r)
+		if !ok {
+			return
+		}
+		spec, ok := decodeAudienceSpec(w, r)
+		if !ok {
+			return
+		}
+		ctx, cancel := bench.QueryContext(r.Context(), timeout)
+		defer cancel()
+		a, err := store.UpdateAudience(ctx, db, id, spec)
+		if err != nil {
+			writeAudienceError(w, r, db, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, a)
+	})
+	mux.HandleFunc("DELETE /audiences/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, ok := audienceID(w, r)
+		if !ok {
+			return
+		}
+		ctx, cancel := bench.QueryContext(r.Context(), timeout)
+		defer cancel()
+		if err := store.DeleteAudience(ctx, db, id); err != nil {
+			writeAudienceError(w, r, db, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// CLI: audiences create/list/get/update/delete
+
+func newAudiencesCmd(cfg *Config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "audiences",
+		Short: "Create, list, update, delete and materialize stored audience definitions, attach triggers and manage imported lists",
+		Args:  cobra.NoArgs,
+	}
+	cmd.AddCommand(
+		newAudienceCreateCmd(cfg),
+		newAudienceListCmd(cfg),
+		newAudienceGetCmd(cfg),
+		newAudienceUpdateCmd(cfg),
+		newAudienceDeleteCmd(cfg),
+		newAudienceMaterializeCmd(cfg),
+		newAudienceRefreshCmd(cfg),
+		newAudienceDematerializeCmd(cfg),
+		newTriggersCmd(cfg),
+		newListsCmd(cfg),
+	)
+	bindTenantFlag(cmd.PersistentFlags(), cfg)
+	return cmd
+}
+
+// Connect for an audiences subcommand, creating the audiences table on older databases
+func connectAudiences(ctx context.Context, cfg *Config) (*sql.DB, error) {
+	if err := requirePostgres(cfg, "audiences"); err != nil {
+		return nil, err
+	}
+	db, err := connect(ctx, *cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.EnsureSchema(ctx, db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func parseAudienceID(arg string) (int64, error) {
+	id, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || id < 1 {
+		return 0, fmt.Errorf("invalid audience id %q", arg)
+	}
+	return id, nil
+}
+
+func printAudience(a store.Audience) {
+	fmt.Fprintf(summaryOut, "%d\t%s (owner %s)\n\t%s\n", a.ID, a.Name, a.Owner, a.Rule)
+}
+
+func newAudienceCreateCmd(cfg *Config) *cobra.Command {
+	var spec store.AudienceSpec
+	cmd := &cobra.Command{
+		Use:   "create",
+		Short: "Store a named audience rule",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := spec.Validate(); err != nil {
+				return err
+			}
+			ctx := cmd.Context()
+			db, err := connectAudiences(ctx, cfg)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+			a, err := store.CreateAudience(ctx, db, spec)
+			if err != nil {
+				return fmt.Errorf("failed to create audience: %w", err)
+			}
+			printAudience(a)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&spec.Name, "name", "", "audience name, unique within the tenant")
+	cmd.Flags().StringVar(&spec.Rule, "rule", "", "audience rule, e.g. \"country = 'US' AND has_purchased = true\"")
+	cmd.Flags().StringVar(&spec.Owner, "owner", "", "team or person owning the audience")
+	return cmd
+}
+
+func newAudienceListCmd(cfg *Config) *cobra.Command {
+	var owner string
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List stored audiences",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			db, err := connectAudiences(ctx, cfg)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+			audiences, err := store.ListAudiences(ctx, db, owner)
+			if err != nil {
+				return fmt.Errorf("failed to list audiences: %w", err)
+			}
+			tw := tabwriter.NewWriter(summaryOut, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(tw, "ID\tNAME\tOWNER\tUPDATED\tRULE")
+			for _, a := range audiences {
+				fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", a.ID, a.Name, a.Owner, a.UpdatedAt.Format(time.DateTime), a.Rule)
+			}
+			return tw.Flush()
+		},
+	}
+	cmd.Flags().StringVar(&owner, "owner", "", "only audiences of this owner")
+	return cmd
+}
+
+func newAudienceGetCmd(cfg *Config) *cobra.Command {
+	return &cobra.Command{
+		Use:   "get ID",
+		Short: "Show one stored audience",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			id, err := parseAudienceID(args[0])
+			if err != nil {
+				return err
+			}
+			ctx := cmd.Context()
+			db, err := connectAudiences(ctx, cfg)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+			a, err := store.GetAudience(ctx, db, id)
+			if err != nil {
+				return fmt.Errorf("audience %d: %w", id, err)
+			}
+			printAudience(a)
+			return nil
+		},
+	}
+}
+
+func newAudienceUpdateCmd(cfg *Config) *cobra.Command {
+	var spec store.AudienceSpec
+	cmd := &cobra.Command{
+		Use:   "update ID",
+		Short: "Change the name, rule or owner of a stored audience",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			id, err := parseAudienceID(args[0])
+			if err != nil {
+				return err
+			}
+			ctx := cmd.Context()
+			db, err := connectAudiences(ctx, cfg)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			// Flags left out keep their stored value
+			current, err := store.GetAudience(ctx, db, id)
+			if err != nil {
+				return fmt.Errorf("audience %d: %w", id, err)
+			}
+			if !cmd.Flags().Changed("name") {
+				spec.Name = current.Name
+			}
+			if !cmd.Flags().Changed("rule") {
+				spec.Rule = current.Rule
+			}
+			if !cmd.Flags().Changed("owner") {
+				spec.Owner = current.Owner
+			}
+			a, err := store.UpdateAudience(ctx, db, id, spec)
+			if err != nil {
+				return fmt.Errorf("failed to update audience %d: %w", id, err)
+			}
+			printAudience(a)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&spec.Name, "name", "", "new audience name")
+	cmd.Flags().StringVar(&spec.Rule, "rule", "", "new audience rule")
+	cmd.Flags().StringVar(&spec.Owner, "owner", "", "new owner")
+	return cmd
+}
+
+func newAudienceDeleteCmd(cfg *Config) *cobra.Command {
+	return &cobra.Command{
+		Use:   "delete ID",
+		Short: "Delete a stored audience",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			id, err := parseAudienceID(args[0])
+			if err != nil {
+				return err
+			}
+			ctx := cmd.Context()
+			db, err := connectAudiences(ctx, cfg)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+			if err := store.DeleteAudience(ctx, db, id); err != nil {
+				return fmt.Errorf("failed to delete audience %d: %w", id, err)
+			}
+			fmt.Fprintf(out, "🗑️  Deleted audience %d\n", id)
+			return nil
+		},
+	}
+}
@@ -0,0 +1,410 @@
+package cli
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"audience-poc/internal/store"
+)
+
+// Header (gRPC metadata key) of API keys
+const apiKeyHeader = "X-API-Key"
+
+// Clock skew tolerated on a JWT's exp and nbf
+const jwtLeeway = 30 * time.Second
+
+// Buckets idle this long are forgotten; they would have refilled long before
+const bucketIdle = 10 * time.Minute
+
+// A client of --api-clients. Rate and burst override --rate-limit and
+// --rate-burst; a rate of 0 exempts the client from rate limiting. A client
+// with a tenant only ever acts for that tenant.
+type apiClient struct {
+	Keys   []string `json:"keys"`
+	Rate   *float64 `json:"rate"`
+	Burst  *int     `json:"burst"`
+	Tenant string   `json:"tenant"`
+}
+
+// Who made a request. Authenticated callers were identified by a key or a
+// JWT; the others are told apart by address and are bound to no tenant.
+type principal struct {
+	client        string
+	tenant        string // the only tenant the client may act for, "" for any
+	authenticated bool
+}
+
+type principalKey struct{}
+
+func withPrincipal(ctx context.Context, p principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// The caller clientAuth identified, if serve authenticates callers
+func principalFrom(ctx context.Context) (principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(principal)
+	return p, ok && p.authenticated
+}
+
+// Requests per second a client may make on average, and in a burst
+type rateLimit struct {
+	rate  float64 // 0 for no limit
+	burst int
+}
+
+// Who is calling serve and how often they may. With neither --api-clients nor
+// --jwt-secret-file anyone may call and clients are told apart by address; a
+// nil clientAuth neither authenticates nor limits.
+type clientAuth struct {
+	keys    map[string]string // API key to client
+	tenants map[string]string // client to the tenant it is bound to
+	limits  map[string]rateLimit
+	secret  []byte // HS256 key of the JWTs, nil when they aren't accepted
+	def     rateLimit
+	metrics *apiMetrics
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type clientOptions struct {
+	clientsFile string
+	secretFile  string
+	rate        float64
+	burst       int
+}
+
+func newClientAuth(opts clientOptions) (*clientAuth, error) {
+	if opts.rate < 0 || opts.burst < 0 {
+		return nil, errors.New("--rate-limit and --rate-burst must not be negative")
+	}
+	if opts.clientsFile == "" && opts.secretFile == "" && opts.rate == 0 {
+		return nil, nil
+	}
+	a := &clientAuth{
+		keys:    map[string]string{},
+		tenants: map[string]string{},
+		limits:  map[string]rateLimit{},
+		def:     newRateLimit(opts.rate, opts.burst),
+		buckets: map[string]*bucket{},
+	}
+	if opts.secretFile != "" {
+		raw, err := os.ReadFile(opts.secretFile)
+		if err != nil {
+			return nil, fmt.Errorf("--jwt-secret-file: %w", err)
+		}
+		a.secret = []byte(strings.TrimSpace(string(raw)))
+		// RFC 7518: an HS256 key must be at least as long as the hash
+		if len(a.secret) < sha256.Size {
+			return nil, fmt.Errorf("--jwt-secret-file %s: the secret must be at least %d bytes", opts.secretFile, sha256.Size)
+		}
+	}
+	if opts.clientsFile == "" {
+		return a, nil
+	}
+	raw, err := os.ReadFile(opts.clientsFile)
+	if err != nil {
+		return nil, fmt.Errorf("--api-clients: %w", err)
+	}
+	var clients map[string]apiClient
+	if err := json.Unmarshal(raw, &clients); err != nil {
+		return nil, fmt.Errorf("--api-clients %s: %w", opts.clientsFile, err)
+	}
+	if len(clients) == 0 {
+		return nil, fmt.Errorf("--api-clients %s has no clients", opts.clientsFile)
+	}
+	for name, c := range clients {
+		if name == "" {
+			return nil, fmt.Errorf("--api-clients %s: empty client name", opts.clientsFile)
+		}
+		if len(c.Keys) == 0 && a.secret == nil {
+			return nil, fmt.Errorf("--api-clients %s: client %s has no keys", opts.clientsFile, name)
+		}
+		for _, key := range c.Keys {
+			if key == "" {
+				return nil, fmt.Errorf("--api-clients %s: client %s has an empty key", opts.clientsFile, name)
+			}
+			if other, ok := a.keys[key]; ok {
+				return nil, fmt.Errorf("--api-clients %s: clients %s and %s share a key", opts.clientsFile, other, name)
+			}
+			a.keys[key] = name
+		}
+		if c.Tenant != "" {
+			if err := store.ValidTenant(c.Tenant); err != nil {
+				return nil, fmt.Errorf("--api-clients %s: client %s: %w", opts.clientsFile, name, err)
+			}
+			a.tenants[name] = c.Tenant
+		}
+		limit := a.def
+		if c.Rate != nil {
+			limit.rate = *c.Rate
+		}
+		if c.Burst != nil {
+			limit.burst = *c.Burst
+		}
+		if limit.rate < 0 || limit.burst < 0 {
+			return nil, fmt.Errorf("--api-clients %s: client %s has a negative rate or burst", opts.clientsFile, name)
+		}
+		a.limits[name] = newRateLimit(limit.rate, limit.burst)
+	}
+	return a, nil
+}
+
+// A burst of 0 defaults to a second's worth of requests, and at least one
+func newRateLimit(rate float64, burst int) rateLimit {
+	if burst == 0 {
+		burst = max(1, int(math.Ceil(rate)))
+	}
+	return rateLimit{rate: rate, burst: burst}
+}
+
+// Caller of a request with the given headers (gRPC metadata for gRPC), made
+// from addr. Keys are compared in constant time, so response times don't give them away.
+func (a *clientAuth) client(header func(name string) string, addr string) (principal, error) {
+	if key := header(apiKeyHeader); key != "" && len(a.keys) > 0 {
+		for k, client := range a.keys {
+			if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+				return principal{client: client, tenant: a.tenants[client], authenticated: true}, nil
+			}
+		}
+		return principal{}, errors.New("unknown API key")
+	}
+	if token, ok := strings.CutPrefix(header("Authorization"), "Bearer "); ok && a.secret != nil {
+		claims, err := verifyJWT(token, a.secret, time.Now())
+		if err != nil {
+			return principal{}, fmt.Errorf("invalid token: %w", err)
+		}
+		tenant := claims.Tenant
+		// A subject listed in --api-clients keeps the tenant it is bound to there
+		if bound := a.tenants[claims.Sub]; bound != "" {
+			if tenant != "" && tenant != bound {
+				return principal{}, fmt.Errorf("invalid token: tenant claim %s, but client %s belongs to tenant %s", tenant, claims.Sub, bound)
+			}
+			tenant = bound
+		}
+		return principal{client: claims.Sub, tenant: tenant, authenticated: true}, nil
+	}
+	switch {
+	case len(a.keys) > 0 && a.secret != nil:
+		return principal{}, fmt.Errorf("missing %s header or bearer token", apiKeyHeader)
+	case len(a.keys) > 0:
+		return principal{}, fmt.Errorf("missing %s header", apiKeyHeader)
+	case a.secret != nil:
+		return principal{}, errors.New("missing bearer token")
+	}
+	// Anonymous callers are limited by address
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return principal{client: "addr:" + host}, nil
+}
+
+// Whether any client of --api-clients is bound to a tenant
+func (a *clientAuth) bindsTenants() bool {
+	return a != nil && len(a.tenants) > 0
+}
+
+// Claims of a JWT that serve checks; sub names the client, and tenant, when
+// set, is the only tenant it may act for
+type jwtClaims struct {
+	Sub    string   `json:"sub"`
+	Tenant string   `json:"tenant"`
+	Exp    *float64 `json:"exp"`
+	Nbf    *float64 `json:"nbf"`
+}
+
+// Claims of an HS256 JWT signed with secret, valid at now
+func verifyJWT(token string, secret []byte, now time.Time) (jwtClaims, error) {
+	var claims jwtClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return jwtClaims{}, errors.New("not a JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return jwtClaims{}, fmt.Errorf("header: %w", err)
+	}
+	// Never "none", nor an algorithm the secret wasn't meant for
+	if header.Alg != "HS256" {
+		return jwtClaims{}, fmt.Errorf("unsupported algorithm %q, only HS256 is accepted", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return jwtClaims{}, errors.New("malformed signature")
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return jwtClaims{}, errors.New("bad signature")
+	}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return jwtClaims{}, fmt.Errorf("claims: %w", err)
+	}
+	if claims.Exp != nil && now.After(unixTime(*claims.Exp).Add(jwtLeeway)) {
+		return jwtClaims{}, errors.New("expired")
+	}
+	if claims.Nbf != nil && now.Before(unixTime(*claims.Nbf).Add(-jwtLeeway)) {
+		return jwtClaims{}, errors.New("not valid yet")
+	}
+	if claims.Sub == "" {
+		return jwtClaims{}, errors.New("no sub claim")
+	}
+	if claims.Tenant != "" {
+		if err := store.ValidTenant(claims.Tenant); err != nil {
+			return jwtClaims{}, fmt.Errorf("tenant claim: %w", err)
+		}
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v any) error {
+	raw, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("malformed base64")
+	}
+	return json.Unmarshal(raw, v)
+}
+
+func unixTime(seconds float64) time.Time {
+	sec, frac := math.Modf(seconds)
+	return time.Unix(int64(sec), int64(frac*float64(time.Second)))
+}
+
+// Token bucket of one client: burst tokens, refilled at the client's rate,
+// one taken per request
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Whether client may make a request now, and if not how long until it may
+func (a *clientAuth) allow(client string, now time.Time) (bool, time.Duration) {
+	limit, ok := a.limits[client]
+	if !ok {
+		limit = a.def
+	}
+	if limit.rate == 0 {
+		return true, 0
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if now.Sub(a.lastSweep) > bucketIdle {
+		for c, b := range a.buckets {
+			if now.Sub(b.last) > bucketIdle {
+				delete(a.buckets, c)
+			}
+		}
+		a.lastSweep = now
+	}
+	b, ok := a.buckets[client]
+	if !ok {
+		b = &bucket{tokens: float64(limit.burst), last: now}
+		a.buckets[client] = b
+	}
+	b.tokens = min(float64(limit.burst), b.tokens+now.Sub(b.last).Seconds()*limit.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / limit.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+func (a *clientAuth) rejected(transport, reason string) {
+	if a.metrics != nil {
+		a.metrics.rejected.WithLabelValues(transport, reason).Inc()
+	}
+}
+
+// Answer 401 to requests without valid credentials and 429 to clients over their limit
+func (a *clientAuth) middleware(next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, err := a.client(r.Header.Get, r.RemoteAddr)
+		if err != nil {
+			a.rejected("http", reasonUnauthenticated)
+			if a.secret != nil {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			writeJSON(w, http.StatusUnauthorized, errorResponse{err.Error()})
+			return
+		}
+		if ok, wait := a.allow(client.client, time.Now()); !ok {
+			a.rejected("http", reasonRateLimited)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeJSON(w, http.StatusTooManyRequests, errorResponse{"rate limit exceeded"})
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), client)))
+	})
+}
+
+// The call with its caller, or Unauthenticated or ResourceExhausted for a
+// call that may not go ahead; health checks are always let through
+func (a *clientAuth) admit(ctx context.Context, method string) (context.Context, error) {
+	if a == nil || strings.HasPrefix(method, "/grpc.health.v1.Health/") {
+		return ctx, nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	var addr string
+	if p, ok := peer.FromContext(ctx); ok {
+		addr = p.Addr.String()
+	}
+	client, err := a.client(func(name string) string {
+		if v := md.Get(name); len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}, addr)
+	if err != nil {
+		a.rejected("grpc", reasonUnauthenticated)
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	if ok, wait := a.allow(client.client, time.Now()); !ok {
+		a.rejected("grpc", reasonRateLimited)
+		return nil, status.Errorf(codes.ResourceExhausted, "rate limit exceeded, retry in %v", wait.Round(time.Millisecond))
+	}
+	return withPrincipal(ctx, client), nil
+}
+
+func (a *clientAuth) unary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := a.admit(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (a *clientAuth) stream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := a.admit(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, contextStream{ServerStream: ss, ctx: ctx})
+}
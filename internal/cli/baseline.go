@@ -0,0 +1,59 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"audience-poc/internal/bench"
+)
+
+// Load a --format json (or --output json) report from an earlier run
+func loadReport(path string) (jsonReport, error) {
+	var report jsonReport
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return report, err
+	}
+	if err := json.Unmarshal(data, &report); err != nil {
+		return report, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return report, nil
+}
+
+// Compare this run against a baseline report; only statistically real slowdowns are failures
+func compareBaseline(baseline jsonReport, results []caseResult) []string {
+	previous := map[string][]time.Duration{}
+	for _, t := range baseline.Tests {
+		previous[t.TestName+"/"+t.Model] = samplesOf(t)
+	}
+
+	fmt.Fprintln(out, "\n📉 Regression check against baseline:")
+	fmt.Fprintln(out, strings.Repeat("-", 50))
+	var failures []string
+	for _, r := range results {
+		for _, m := range []struct {
+			model  string
+			result bench.Result
+			ran    bool
+		}{{"eav", r.eav, r.withEAV}, {"optimized", r.optimized, true}, {"jsonb", r.jsonb, r.withJSONB}, {"bitmap", r.bitmap, r.withBitmap}, {"clickhouse", r.clickhouse, r.withClickHouse}} {
+			before, ok := previous[r.name+"/"+m.model]
+			if !m.ran || !ok || m.result.Err != nil {
+				continue
+			}
+			// >1 means this run is faster than the baseline
+			e, ok := bench.EstimateSpeedup(before, m.result.Samples)
+			if !ok {
+				continue
+			}
+			fmt.Fprintf(out, "%-12s %-10s %s\n", r.name, m.model, e)
+			if e.Significant && e.Median < 1 {
+				failures = append(failures, fmt.Sprintf("%s %s regressed: %.2fx of baseline speed (p=%.3g)",
+					r.label, m.model, e.Median, e.PValue))
+			}
+		}
+	}
+	return failures
+}
@@ -0,0 +1,242 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"audience-poc/internal/bench"
+	"audience-poc/internal/rules"
+	"audience-poc/internal/store"
+)
+
+// One audience of a batch: an inline rule or a stored audience
+type batchInput struct {
+	Rule       string `json:"rule,omitempty"`
+	AudienceID int64  `json:"audience_id,omitempty"`
+}
+
+type batchRequest struct {
+	Audiences []batchInput `json:"audiences"`
+}
+
+type batchResult struct {
+	AudienceID int64  `json:"audience_id,omitempty"`
+	Name       string `json:"name,omitempty"`
+	Rule       string `json:"rule"`
+	Count      int64  `json:"count"`
+}
+
+type batchResponse struct {
+	Results    []batchResult `json:"results"` // in request order
+	Distinct   int           `json:"distinct"`
+	Passes     int           `json:"passes"`
+	DurationMS float64       `json:"duration_ms"`
+}
+
+var errInvalidBatch = errors.New("invalid batch request")
+
+// Rule of every input, parsed; stored audiences are looked up in one query
+func resolveBatch(ctx context.Context, db *sql.DB, inputs []batchInput, timeout time.Duration) ([]batchResult, []*rules.Rule, error) {
+	if len(inputs) == 0 || len(inputs) > store.MaxBatchAudiences {
+		return nil, nil, fmt.Errorf("%w: need 1 to %d audiences, got %d", errInvalidBatch, store.MaxBatchAudiences, len(inputs))
+	}
+	var ids []int64
+	for i, in := range inputs {
+		if (in.Rule == "") == (in.AudienceID == 0) {
+			return nil, nil, fmt.Errorf("%w: audiences[%d]: %v", errInvalidBatch, i, errRuleOrAudience)
+		}
+		if in.AudienceID != 0 {
+			ids = append(ids, in.AudienceID)
+		}
+	}
+	var stored map[int64]store.Audience
+	if len(ids) > 0 {
+		queryCtx, cancel := bench.QueryContext(ctx, timeout)
+		var err error
+		stored, err = store.GetAudiences(queryCtx, db, ids)
+		cancel()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	results := make([]batchResult, len(inputs))
+	parsed := make([]*rules.Rule, len(inputs))
+	for i, in := range inputs {
+		res := batchResult{AudienceID: in.AudienceID, Rule: in.Rule}
+		var tenant string
+		if in.AudienceID != 0 {
+			a, ok := stored[in.AudienceID]
+			if !ok {
+				return nil, nil, fmt.Errorf("audience %d: %w", in.AudienceID, store.ErrAudienceNotFound)
+			}
+			res.Name, res.Rule, tenant = a.Name, a.Rule, a.Tenant
+		}
+		rule, err := rules.Parse(res.Rule)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: audiences[%d]: %v", errInvalidBatch, i, err)
+		}
+		if tenant != "" {
+			rule = rule.ForTenant(tenant)
+		}
+		results[i], parsed[i] = res, rule
+	}
+	return results, parsed, nil
+}
+
+func computeBatch(ctx context.Context, db *sql.DB, results []batchResult, parsed []*rules.Rule, timeout time.Duration, retry *bench.Retry) (batchResponse, error) {
+	var b store.BatchCounts
+	_, duration, err := retry.Run(ctx, func(ctx context.Context) (int, time.Duration, error) {
+		var err error
+		b, err = store.BatchCount(ctx, db, parsed)
+		return 0, b.Duration, err
+	}, timeout)
+	if err != nil {
+		return batchResponse{}, err
+	}
+	for i := range results {
+		results[i].Count = b.Counts[i]
+	}
+	return batchResponse{
+		Results:    results,
+		Distinct:   b.Distinct,
+		Passes:     b.Passes,
+		DurationMS: float64(duration.Microseconds()) / 1000,
+	}, nil
+}
+
+// POST /audiences/evaluate-batch: counts of many audiences in a few scans
+func batchHandler(route *store.Router, timeout time.Duration, retry *bench.Retry, m *apiMetrics) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req batchRequest
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{fmt.Sprintf("invalid request body: %v", err)})
+			return
+		}
+		// Stored audiences from the primary, the counts from a replica
+		db := route.Primary()
+		results, parsed, err := resolveBatch(r.Context(), db, req.Audiences, timeout)
+		if err == nil {
+			db = route.Read()
+			var res batchResponse
+			if res, err = computeBatch(r.Context(), db, results, parsed, timeout, retry); err == nil {
+				m.observe(r.Context(), "optimized", "evaluate_batch", nil, time.Duration(res.DurationMS*float64(time.Millisecond)), len(res.Results))
+				writeJSON(w, http.StatusOK, res)
+				return
+			}
+		}
+
+		var status int
+		switch {
+		case errors.Is(err, errInvalidBatch):
+			status = http.StatusBadRequest
+		case errors.Is(err, store.ErrAudienceNotFound):
+			status = http.StatusNotFound
+		default:
+			status = queryErrorStatus(r.Context(), db, err)
+			slog.WarnContext(r.Context(), "batch query failed", "audiences", len(req.Audiences), "status", status, "err", err)
+			writeJSON(w, status, errorResponse{http.StatusText(status)})
+			return
+		}
+		writeJSON(w, status, errorResponse{err.Error()})
+	}
+}
+
+func newEvaluateBatchCmd(cfg *Config) *cobra.Command {
+	var inputs []batchInput
+	var file string
+	cmd := &cobra.Command{
+		Use:   "evaluate-batch",
+		Short: "Count many audiences at once, combining them into a few scans",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if file != "" {
+				fromFile, err := readBatchFile(file)
+				if err != nil {
+					return err
+				}
+				inputs = append(inputs, fromFile...)
+			}
+			ctx := cmd.Context()
+			db, err := connect(ctx, *cfg)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+			results, parsed, err := resolveBatch(ctx, db, inputs, cfg.QueryTimeout)
+			if err != nil {
+				return err
+			}
+			res, err := computeBatch(ctx, db, results, parsed, cfg.QueryTimeout, nil)
+			if err != nil {
+				return fmt.Errorf("batch query failed: %w", err)
+			}
+			return printBatch(res)
+		},
+	}
+	cmd.Flags().Func("rule", "audience rule to count, repeatable", func(s string) error {
+		if _, err := rules.Parse(s); err != nil {
+			return err
+		}
+		inputs = append(inputs, batchInput{Rule: s})
+		return nil
+	})
+	cmd.Flags().Func("audience", "stored audience id to count, repeatable", func(s string) error {
+		id, err := parseAudienceID(s)
+		if err != nil {
+			return err
+		}
+		inputs = append(inputs, batchInput{AudienceID: id})
+		return nil
+	})
+	bindTenantFlag(cmd.Flags(), cfg)
+	cmd.Flags().StringVar(&file, "file", "", `JSON request body of POST /audiences/evaluate-batch to count after the flags, or - for stdin`)
+	return cmd
+}
+
+func readBatchFile(path string) ([]batchInput, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	var req batchRequest
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		return nil, fmt.Errorf("invalid --file %s: %w", path, err)
+	}
+	return req.Audiences, nil
+}
+
+func printBatch(res batchResponse) error {
+	fmt.Fprintf(summaryOut, "🧮 %d audiences (%d distinct) counted in %d scans, %.1fms\n",
+		len(res.Results), res.Distinct, res.Passes, res.DurationMS)
+	tw := tabwriter.NewWriter(summaryOut, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tCOUNT\tRULE")
+	for _, r := range res.Results {
+		id := "-"
+		if r.AudienceID != 0 {
+			id = fmt.Sprint(r.AudienceID)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", id, r.Name, r.Count, r.Rule)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,522 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"audience-poc/internal/bench"
+	"audience-poc/internal/store"
+)
+
+// Audience rules exercised by the benchmark
+const (
+	simpleRule     = "country = 'US'"
+	complexORRule  = "country = 'US' OR tier IN ('gold', 'platinum')"
+	complexANDRule = "has_purchased = true AND total_spend > 100"
+	exclusionRule  = "country = 'US' AND NOT has_purchased = true AND tier NOT IN ('gold', 'platinum')"
+	typedRule      = "signup_date >= '2024-01-01' AND age BETWEEN 25 AND 34 AND interests && ARRAY['sports', 'travel']"
+)
+
+// Human-readable progress and results; discarded when --format json or --quiet
+var out io.Writer = os.Stdout
+
+// Final summary; discarded only when --format json
+var summaryOut io.Writer = os.Stdout
+
+type benchCase struct {
+	name    string // stable identifier used in JSON output and --rule-frequency
+	label   string
+	title   string
+	rule    string
+	withEAV bool // also run against the EAV model and compare counts
+	// The optimized plan must read through an index; a seq scan is a plan regression
+	wantIndex bool
+	// A stored audience's tenant, whose users alone the models count; empty for every tenant's
+	tenant string
+}
+
+// ctx restricted to the case's tenant, if it has one
+func (c benchCase) scope(ctx context.Context) context.Context {
+	if c.tenant == "" {
+		return ctx
+	}
+	return store.WithTenant(ctx, c.tenant)
+}
+
+var benchCases = []benchCase{
+	{"simple", "Test 1", "Simple Query (country = 'US')", simpleRule, true, true, ""},
+	{"complex_or", "Test 2", "Complex OR Query", complexORRule, true, true, ""},
+	{"complex_and", "Test 3", "Complex AND Query", complexANDRule, false, true, ""},
+	{"exclusion", "Test 4", "Exclusion Query (NOT / NOT IN)", exclusionRule, true, true, ""},
+	{"typed", "Test 5", "Typed Attributes (date, BETWEEN, set overlap)", typedRule, true, true, ""},
+}
+
+// Cases for --rule flags, named rule_1, rule_2, ... in order
+func benchCasesFor(rules []string) []benchCase {
+	if len(rules) == 0 {
+		return benchCases
+	}
+	cases := make([]benchCase, len(rules))
+	for i, rule := range rules {
+		cases[i] = benchCase{fmt.Sprintf("rule_%d", i+1), fmt.Sprintf("Rule %d", i+1), rule, rule, true, false, ""}
+	}
+	return cases
+}
+
+type caseResult struct {
+	benchCase
+	eav         bench.Result
+	optimized   bench.Result
+	countsMatch bool
+	// JSONB model, run when user_profiles_jsonb exists (PostgreSQL only)
+	withJSONB  bool
+	jsonb      bench.Result
+	jsonbMatch bool
+	// Scans the planner chose for the optimized query; nil if EXPLAIN failed
+	optimizedScans []store.ScanAccess
+	// Approximate count of the optimized model with --estimate; nil if not taken
+	estimate *store.Estimate
+	// In-memory bitmap model with --bitmap
+	withBitmap  bool
+	bitmap      bench.Result
+	bitmapMatch bool
+	// ClickHouse copy of the optimized model with --clickhouse
+	withClickHouse  bool
+	clickhouse      bench.Result
+	clickhouseMatch bool
+	// pg_stat_statements totals by SQL model with --pg-stat-statements
+	statements map[string]*store.StatementStats
+}
+
+// Why a test case can't be trusted, if it can't
+func (r caseResult) failures() []string {
+	var failures []string
+	for _, m := range []struct {
+		model  string
+		result bench.Result
+		ran    bool
+	}{{"EAV", r.eav, r.withEAV}, {"optimized", r.optimized, true}, {"JSONB", r.jsonb, r.withJSONB}, {"bitmap", r.bitmap, r.withBitmap}, {"ClickHouse", r.clickhouse, r.withClickHouse}} {
+		switch {
+		case !m.ran:
+		case m.result.TimedOut:
+			failures = append(failures, fmt.Sprintf("%s %s query timed out", r.label, m.model))
+		case m.result.Err != nil:
+			failures = append(failures, fmt.Sprintf("%s %s query: %v", r.label, m.model, m.result.Err))
+		}
+	}
+	if r.withEAV && !r.countsMatch && r.eav.Err == nil && r.optimized.Err == nil {
+		failures = append(failures, fmt.Sprintf("%s: EAV and optimized counts differ", r.label))
+	}
+	if r.withJSONB && !r.jsonbMatch && r.jsonb.Err == nil && r.optimized.Err == nil {
+		failures = append(failures, fmt.Sprintf("%s: JSONB and optimized counts differ", r.label))
+	}
+	if r.withBitmap && !r.bitmapMatch && r.bitmap.Err == nil && r.optimized.Err == nil {
+		failures = append(failures, fmt.Sprintf("%s: bitmap and optimized counts differ", r.label))
+	}
+	if r.withClickHouse && !r.clickhouseMatch && r.clickhouse.Err == nil && r.optimized.Err == nil {
+		failures = append(failures, fmt.Sprintf("%s: ClickHouse and optimized counts differ", r.label))
+	}
+	return failures
+}
+
+// Benchmark adapters binding a rule to each model
+func eavCount(db store.Querier, rule string) bench.QueryFunc {
+	return func(ctx context.Context) (int, time.Duration, error) { return store.EAVCount(ctx, db, rule) }
+}
+
+func optimizedCount(db store.Querier, rule string) bench.QueryFunc {
+	return func(ctx context.Context) (int, time.Duration, error) { return store.OptimizedCount(ctx, db, rule) }
+}
+
+func jsonbCount(db store.Querier, rule string) bench.QueryFunc {
+	return func(ctx context.Context) (int, time.Duration, error) { return store.JSONBCount(ctx, db, rule) }
+}
+
+// EXPLAIN ANALYZE the COUNT query a model generates for a rule
+func explainRule(ctx context.Context, db *sql.DB, build func(string) (string, []interface{}, error), rule string, timeout time.Duration) (*store.QueryPlan, error) {
+	query, args, err := build(rule)
+	if err != nil {
+		return nil, err
+	}
+	explainCtx, cancel := bench.QueryContext(ctx, timeout)
+	defer cancel()
+	return store.Explain(explainCtx, db, query, args...)
+}
+
+// Run the whole benchmark. Setup failures abort immediately; query failures
+// and count mismatches are reported and then returned as a single error.
+func runBench(ctx context.Context, cfg Config) error {
+	if cfg.Format == "json" {
+		out, summaryOut = io.Discard, io.Discard
+	}
+	if cfg.Quiet {
+		out = io.Discard
+	}
+
+	d, err := store.DialectFor(cfg.DB.Driver)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "🚀 Audience Service Performance Test with Real %s\n", d.Name())
+	fmt.Fprintln(out, strings.Repeat("=", 60))
+
+	db, err := connect(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	countCtx, cancel := bench.QueryContext(ctx, cfg.QueryTimeout)
+	userCount, err := store.CountUsers(countCtx, db)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("failed to count users: %w", err)
+	}
+	fmt.Fprintf(out, "\n📈 Test dataset: %d users\n\n", userCount)
+
+	opts := bench.Options{Warmup: cfg.Warmup, Iterations: cfg.Iterations, Timeout: cfg.QueryTimeout, KeepCold: !cfg.DiscardCold, Retry: cfg.retry()}
+	if opts.KeepCold {
+		fmt.Fprintf(out, "⏱️  %d runs per query, the first %d (cold cache) included\n\n", opts.Warmup+opts.Iterations, opts.Warmup)
+	} else {
+		fmt.Fprintf(out, "⏱️  %d measured runs per query after %d discarded warm-up runs\n\n", opts.Iterations, opts.Warmup)
+	}
+
+	cases := benchCasesFor(cfg.Rules)
+	if len(cfg.Audiences) > 0 {
+		stored, err := audienceCases(ctx, db, cfg.Audiences, cfg.QueryTimeout)
+		if err != nil {
+			return err
+		}
+		if len(cfg.Rules) == 0 {
+			cases = stored
+		} else {
+			cases = append(cases, stored...)
+		}
+	}
+	if cfg.MetricsAddr != "" {
+		return serveMetrics(ctx, db, cfg.MetricsAddr, cfg.MetricsInterval, cases, opts)
+	}
+
+	withJSONB, err := store.HasJSONBModel(ctx, db)
+	if err != nil {
+		return fmt.Errorf("failed to look up the JSONB model: %w", err)
+	}
+	if !withJSONB && d.Name() == (store.Postgres{}).Name() {
+		slog.Info("user_profiles_jsonb not found, skipping the JSONB model; run migrate or seed to create it")
+	}
+
+	var bitmaps *bitmapBackend
+	if cfg.Bitmap {
+		if bitmaps, err = loadBitmapBackend(ctx, db, cfg.QueryTimeout); err != nil {
+			return err
+		}
+		printBitmapIndex(bitmaps.current())
+		refreshCtx, stopRefresh := context.WithCancel(ctx)
+		defer stopRefresh()
+		go bitmaps.refreshEvery(refreshCtx, db, cfg.BitmapRefresh, cfg.QueryTimeout)
+	}
+
+	var clickhouse *clickhouseBackend
+	if cfg.ClickHouse != "" {
+		if clickhouse, err = loadClickHouseBackend(ctx, db, cfg.ClickHouse, cfg.QueryTimeout); err != nil {
+			return err
+		}
+		defer clickhouse.db.Close()
+		printClickHouseLoad(clickhouse.load)
+	}
+
+	var tracker *statementTracker
+	if cfg.StatStatements {
+		enableCtx, cancel := bench.QueryContext(ctx, cfg.QueryTimeout)
+		err := store.EnableStatementStats(enableCtx, db)
+		cancel()
+		if err != nil {
+			return err
+		}
+		tracker = &statementTracker{db: db, timeout: cfg.QueryTimeout}
+	}
+	// The SQL models, with their server-side totals when tracked
+	runSQL := func(ctx context.Context, r *caseResult, model, label string, fn bench.QueryFunc) bench.Result {
+		res, s := tracker.run(ctx, fn, opts)
+		printBenchResult(label, res, "test", r.name, "rule", r.rule)
+		if s != nil {
+			r.statements[model] = s
+			printStatements(*s)
+		}
+		return res
+	}
+
+	results := make([]caseResult, 0, len(cases))
+	var failures []string
+	for i, c := range cases {
+		if i > 0 {
+			fmt.Fprintln(out)
+		}
+		fmt.Fprintf(out, "📊 %s: %s\n", c.label, c.title)
+		fmt.Fprintln(out, strings.Repeat("-", 50))
+
+		r := caseResult{benchCase: c, withJSONB: withJSONB, withBitmap: bitmaps != nil, withClickHouse: clickhouse != nil, statements: map[string]*store.StatementStats{}}
+		// The other models have no tenants to restrict a stored audience to
+		if c.tenant != "" && (r.withJSONB || r.withBitmap || r.withClickHouse) {
+			slog.Info("skipping the JSONB, bitmap and ClickHouse models for a tenant's audience", "test", c.name, "tenant", c.tenant)
+			r.withJSONB, r.withBitmap, r.withClickHouse = false, false, false
+		}
+		caseCtx := c.scope(ctx)
+		if c.withEAV {
+			r.eav = runSQL(caseCtx, &r, "eav", "EAV Model", eavCount(db, c.rule))
+		}
+		r.optimized = runSQL(caseCtx, &r, "optimized", "Optimized Model", optimizedCount(db, c.rule))
+		if r.optimized.Err == nil {
+			if plan, err := explainRule(ctx, db, store.OptimizedCountSQL, c.rule, cfg.QueryTimeout); err != nil {
+				slog.Warn("explain failed", "test", c.name, "model", "optimized", "rule", c.rule, "err", err)
+			} else {
+				r.optimizedScans = plan.Scans()
+				fmt.Fprintf(out, "%-17s %s\n", "Optimized scans:", describeScans(r.optimizedScans))
+			}
+		}
+		if cfg.Estimate {
+			queryCtx, cancel := bench.QueryContext(caseCtx, cfg.QueryTimeout)
+			est, err := store.EstimateCount(queryCtx, db, c.rule, cfg.Estimates)
+			cancel()
+			if err != nil {
+				failures = append(failures, fmt.Sprintf("%s: estimate failed: %v", c.label, err))
+			} else {
+				r.estimate = &est
+				printEstimate(est, r.optimized)
+			}
+		}
+		if r.withJSONB {
+			r.jsonb = runSQL(caseCtx, &r, "jsonb", "JSONB Model", jsonbCount(db, c.rule))
+		}
+		if r.withBitmap {
+			r.bitmap = bench.Run(ctx, bitmapCount(bitmaps, c.rule), opts)
+			printBenchResult("Bitmap Index", r.bitmap, "test", c.name, "rule", c.rule)
+		}
+		if r.withClickHouse {
+			r.clickhouse = bench.Run(ctx, clickhouseCount(clickhouse, c.rule), opts)
+			printBenchResult("ClickHouse", r.clickhouse, "test", c.name, "rule", c.rule)
+		}
+		if c.withEAV {
+			r.countsMatch = verifyCounts(c.label, "EAV", r.eav, r.optimized)
+			if r.countsMatch {
+				printSpeedup("Speedup", r.eav, r.optimized)
+			}
+		}
+		if r.withJSONB {
+			r.jsonbMatch = verifyCounts(c.label, "JSONB", r.jsonb, r.optimized)
+			if r.jsonbMatch {
+				printSpeedup("vs JSONB", r.jsonb, r.optimized)
+			}
+		}
+		if r.withBitmap {
+			r.bitmapMatch = verifyCounts(c.label, "Bitmap", r.bitmap, r.optimized)
+			if r.bitmapMatch {
+				printSpeedup("Bitmap vs SQL", r.optimized, r.bitmap)
+			}
+		}
+		if r.withClickHouse {
+			r.clickhouseMatch = verifyCounts(c.label, "ClickHouse", r.clickhouse, r.optimized)
+			if r.clickhouseMatch {
+				printSpeedup("ClickHouse vs SQL", r.optimized, r.clickhouse)
+			}
+		}
+		failures = append(failures, r.failures()...)
+		results = append(results, r)
+	}
+
+	var loads []loadRun
+	if cfg.Concurrency > 0 {
+		loadOpts := bench.LoadOptions{
+			Workers:   cfg.Concurrency,
+			Duration:  cfg.LoadDuration,
+			Timeout:   cfg.QueryTimeout,
+			TargetQPS: cfg.TargetQPS,
+		}
+		for _, model := range cfg.LoadModels {
+			if model == "jsonb" && !withJSONB {
+				failures = append(failures, "jsonb load test: user_profiles_jsonb not found")
+				continue
+			}
+			load := bench.RunLoad(ctx, db, workloadQueries(db, model, cfg.Workload), loadOpts)
+			printLoadResult(model, cfg.Workload, load)
+			loads = append(loads, loadRun{model: model, LoadResult: load})
+			if load.ErrorCount > 0 {
+				failures = append(failures, fmt.Sprintf("%s load test: %d queries failed", model, load.ErrorCount))
+			}
+		}
+	}
+
+	if cfg.RedisAddr != "" {
+		rdb := redis.NewClient(&redis.Options{Addr: cfg.RedisAddr})
+		if err := cacheBenchmark(ctx, rdb, db, results, opts, cfg.RedisTTL); err != nil {
+			failures = append(failures, fmt.Sprintf("cache benchmark: %v", err))
+		}
+		rdb.Close()
+	}
+
+	if cfg.CompareStrategies {
+		if err := compareStrategies(ctx, db, cases, opts); err != nil {
+			failures = append(failures, fmt.Sprintf("strategy comparison: %v", err))
+		}
+	}
+
+	if cfg.ComparePartitioning {
+		if err := comparePartitioning(ctx, db, cases, opts); err != nil {
+			failures = append(failures, fmt.Sprintf("partitioning comparison: %v", err))
+		}
+	}
+
+	if cfg.CompareDrivers {
+		if err := compareDrivers(ctx, cfg, cases, opts); err != nil {
+			failures = append(failures, fmt.Sprintf("driver comparison: %v", err))
+		}
+	}
+
+	if cfg.Pagination {
+		if err := paginationBenchmark(ctx, db, cfg.QueryTimeout); err != nil {
+			failures = append(failures, fmt.Sprintf("pagination benchmark: %v", err))
+		}
+	}
+
+	if cfg.Matview != "" {
+		if err := matviewBenchmark(ctx, db, cfg.Matview, userCount, cfg.MatviewInterval, cfg.QueryTimeout); err != nil {
+			failures = append(failures, fmt.Sprintf("materialized view benchmark: %v", err))
+		}
+	}
+
+	if cfg.Materialize {
+		if err := materializeBenchmark(ctx, db, cases, opts); err != nil {
+			failures = append(failures, fmt.Sprintf("materialized audience benchmark: %v", err))
+		}
+	}
+
+	if cfg.JSONBStudy {
+		if err := jsonbStudy(ctx, db, cfg.QueryTimeout); err != nil {
+			failures = append(failures, fmt.Sprintf("JSONB study: %v", err))
+		}
+	}
+
+	fmt.Fprintln(out, "\n🔍 Query Execution Plan (Optimized Model):")
+	if plan, err := explainRule(ctx, db, store.OptimizedCountSQL, simpleRule, cfg.QueryTimeout); err != nil {
+		failures = append(failures, fmt.Sprintf("explain optimized model: %v", err))
+	} else {
+		printPlan(plan)
+	}
+
+	fmt.Fprintln(out, "\n🔍 Query Execution Plan (EAV Model):")
+	if plan, err := explainRule(ctx, db, store.EAVCountSQL, simpleRule, cfg.QueryTimeout); err != nil {
+		failures = append(failures, fmt.Sprintf("explain EAV model: %v", err))
+	} else {
+		printPlanSummary(plan)
+	}
+
+	fmt.Fprintln(summaryOut, "\n📈 Summary:")
+	fmt.Fprintln(summaryOut, strings.Repeat("-", 50))
+	fmt.Fprintf(summaryOut, "Dataset size:     %d users\n", userCount)
+	var eavTotal, optimizedTotal time.Duration
+	targetMet, measured := true, true
+	deltas := map[string]ruleDelta{}
+	for _, r := range results {
+		if !r.withEAV {
+			continue
+		}
+		eavMedian, optimizedMedian := r.eav.Stats.Median, r.optimized.Stats.Median
+		line := fmt.Sprintf("%-17s EAV %v, optimized %v", r.label+":", eavMedian, optimizedMedian)
+		if r.withJSONB {
+			line += fmt.Sprintf(", JSONB %v", r.jsonb.Stats.Median)
+		}
+		if r.withBitmap {
+			line += fmt.Sprintf(", bitmap %v", r.bitmap.Stats.Median)
+		}
+		if r.withClickHouse {
+			line += fmt.Sprintf(", ClickHouse %v", r.clickhouse.Stats.Median)
+		}
+		fmt.Fprintln(summaryOut, line)
+		if eavMedian <= 0 || optimizedMedian <= 0 {
+			measured = false
+		}
+		eavTotal += eavMedian
+		optimizedTotal += optimizedMedian
+		targetMet = targetMet && optimizedMedian < 2*time.Second
+		deltas[r.name] = ruleDelta{eav: eavMedian, optimized: optimizedMedian}
+	}
+	if measured && optimizedTotal > 0 {
+		avgSpeedup := float64(eavTotal) / float64(optimizedTotal)
+		fmt.Fprintf(summaryOut, "Average speedup:  %.1fx (median)\n", avgSpeedup)
+		fmt.Fprintf(summaryOut, "Target achieved:  %v\n", targetMet)
+	}
+	// A seq scan here usually means stale statistics or a dropped index, not a slow model
+	for _, r := range results {
+		if r.optimizedScans == nil || store.UsesIndex(r.optimizedScans) {
+			continue
+		}
+		if r.wantIndex && !cfg.AllowSeqScan {
+			fmt.Fprintf(summaryOut, "❌ %s optimized query fell back to a sequential scan: %s\n", r.label, describeScans(r.optimizedScans))
+			failures = append(failures, fmt.Sprintf("%s optimized query used no index", r.label))
+		} else {
+			fmt.Fprintf(summaryOut, "⚠️  %s optimized query used no index: %s\n", r.label, describeScans(r.optimizedScans))
+		}
+	}
+
+	var savings *dailySavings
+	if len(cfg.RuleFrequencies) > 0 {
+		s := estimateDailySavings(cfg.RuleFrequencies, deltas, cfg.CostPerCPUSecond)
+		savings = &s
+		printDailySavings(s, cfg.RuleFrequencies)
+	}
+
+	// Extrapolation to 10M users
+	if userCount > 0 && userCount < extrapolationTarget {
+		growth, err := extrapolateGrowth(ctx, db, userCount, cases, cfg.QueryTimeout)
+		if err != nil {
+			fmt.Fprintf(out, "\n⚠️  Curve fit unavailable (%v), falling back to linear scaling\n", err)
+			simpleOptimized := results[0].optimized.Stats.Median
+			if simpleOptimized > 0 {
+				scaleFactor := float64(extrapolationTarget) / float64(userCount)
+				estimatedTime := time.Duration(float64(simpleOptimized) * scaleFactor)
+				fmt.Fprintf(out, "\n🔮 Estimated for 10M users: %v\n", estimatedTime)
+				fmt.Fprintf(out, "   Target <2s:     %v\n", estimatedTime < 2*time.Second)
+			}
+		} else {
+			printExtrapolation(growth)
+		}
+	}
+
+	if cfg.Baseline != "" {
+		if baseline, err := loadReport(cfg.Baseline); err != nil {
+			failures = append(failures, fmt.Sprintf("baseline: %v", err))
+		} else {
+			failures = append(failures, compareBaseline(baseline, results)...)
+		}
+	}
+
+	if cfg.Format == "json" || cfg.OutFile != "" {
+		report := buildJSONReport(userCount, opts, results, loads, savings, bitmaps, clickhouse)
+		if cfg.Format == "json" {
+			if err := writeJSONReport(os.Stdout, report); err != nil {
+				return fmt.Errorf("failed to write JSON report: %w", err)
+			}
+		}
+		// Written even when checks failed, so CI keeps the numbers of a failing run
+		if cfg.OutFile != "" {
+			if err := exportReport(cfg.OutFile, cfg.Output, report); err != nil {
+				return fmt.Errorf("failed to write %s report: %w", cfg.Output, err)
+			}
+			fmt.Fprintf(out, "\n💾 Wrote the %s report to %s\n", cfg.Output, cfg.OutFile)
+		}
+	}
+
+	if len(failures) > 0 {
+		fmt.Fprintln(summaryOut, "\n❌ Some checks failed, results are not trustworthy")
+		return fmt.Errorf("benchmark failed: %s", strings.Join(failures, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"audience-poc/internal/bench"
+	"audience-poc/internal/store"
+)
+
+// The bitmap model's index; a refresh loads a new one and swaps it in, so
+// queries in flight keep the index they started with
+type bitmapBackend struct {
+	index     atomic.Pointer[store.BitmapIndex]
+	refreshes atomic.Int64
+}
+
+func loadBitmapBackend(ctx context.Context, db *sql.DB, timeout time.Duration) (*bitmapBackend, error) {
+	loadCtx, cancel := bench.QueryContext(ctx, timeout)
+	defer cancel()
+	ix, err := store.LoadBitmapIndex(loadCtx, db)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the bitmap index: %w", err)
+	}
+	b := &bitmapBackend{}
+	b.index.Store(ix)
+	return b, nil
+}
+
+func (b *bitmapBackend) current() *store.BitmapIndex { return b.index.Load() }
+
+// Reload the index every interval until ctx is done. A failed reload is
+// logged and the previous index keeps serving.
+func (b *bitmapBackend) refreshEvery(ctx context.Context, db *sql.DB, interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		loadCtx, cancel := bench.QueryContext(ctx, timeout)
+		ix, err := store.LoadBitmapIndex(loadCtx, db)
+		cancel()
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Warn("bitmap index refresh failed", "err", err)
+			}
+			continue
+		}
+		b.index.Store(ix)
+		b.refreshes.Add(1)
+		slog.Debug("bitmap index refreshed", "users", ix.Users, "took", ix.LoadDuration)
+	}
+}
+
+func bitmapCount(b *bitmapBackend, rule string) bench.QueryFunc {
+	return func(ctx context.Context) (int, time.Duration, error) { return b.current().Count(rule) }
+}
+
+func printBitmapIndex(ix *store.BitmapIndex) {
+	fmt.Fprintf(out, "🧮 Bitmap index: %d users loaded in %v, %.1f MiB\n\n",
+		ix.Users, ix.LoadDuration.Round(time.Millisecond), float64(ix.SizeBytes())/(1<<20))
+}
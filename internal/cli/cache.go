@@ -0,0 +1,208 @@
+package cli
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"audience-poc/internal/bench"
+	"audience-poc/internal/rules"
+	"audience-poc/internal/store"
+)
+
+const segmentKeyPrefix = "audience:count:"
+
+// Redis key for a rule's precomputed count, shared by equivalent spellings of the rule
+func segmentCacheKey(rule *rules.Rule) string {
+	sum := sha256.Sum256([]byte(rule.Canonical()))
+	return segmentKeyPrefix + hex.EncodeToString(sum[:])
+}
+
+// Precomputed-segment path: serve the count from Redis and fall back to
+// the optimized model on a miss, populating the cache for the next caller.
+// The returned bool reports whether the count came from the cache.
+func cachedCount(ctx context.Context, rdb *redis.Client, db store.Querier, audienceRule string, ttl time.Duration) (int, time.Duration, bool, error) {
+	rule, err := rules.Parse(audienceRule)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	key := segmentCacheKey(store.Scope(ctx, rule))
+
+	start := time.Now()
+	cached, err := rdb.Get(ctx, key).Result()
+	switch {
+	case err == nil:
+		count, convErr := strconv.Atoi(cached)
+		if convErr == nil {
+			return count, time.Since(start), true, nil
+		}
+		// Corrupt entry: recompute and overwrite it
+	case !errors.Is(err, redis.Nil):
+		return 0, 0, false, fmt.Errorf("redis get: %w", err)
+	}
+
+	count, _, err := store.OptimizedCount(ctx, db, audienceRule)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if err := rdb.Set(ctx, key, count, ttl).Err(); err != nil {
+		return 0, 0, false, fmt.Errorf("redis set: %w", err)
+	}
+	return count, time.Since(start), false, nil
+}
+
+// Counts cached in Redis for serve. Unlike cachedCount, a Redis failure falls
+// back to the database, so the cache can make serving faster but never fail it.
+type countCache struct {
+	rdb     *redis.Client
+	ttl     time.Duration
+	metrics *apiMetrics
+}
+
+// Count of the optimized model, from the cache when it holds one; the bool
+// reports a hit, and the duration is the Redis round trip or the query
+func (c *countCache) count(ctx context.Context, db store.Querier, rule *rules.Rule, ruleText string) (int, time.Duration, bool, error) {
+	key := segmentCacheKey(store.Scope(ctx, rule))
+	start := time.Now()
+	cached, err := c.rdb.Get(ctx, key).Int()
+	switch {
+	case err == nil:
+		c.metrics.cacheRequest("hit")
+		return cached, time.Since(start), true, nil
+	case errors.Is(err, redis.Nil):
+		c.metrics.cacheRequest("miss")
+	case ctx.Err() != nil:
+		return 0, 0, false, ctx.Err()
+	default:
+		// Unreachable or a corrupt entry: query, and overwrite it below
+		c.metrics.cacheRequest("error")
+		slog.WarnContext(ctx, "count cache read failed, querying the database", "err", err)
+	}
+
+	count, duration, err := store.OptimizedCount(ctx, db, ruleText)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if err := c.rdb.Set(ctx, key, count, c.ttl).Err(); err != nil {
+		slog.WarnContext(ctx, "count cache write failed", "err", err)
+	}
+	return count, duration, false, nil
+}
+
+// Drop every cached count. Any profile change can move users in or out of any
+// audience, so sync clears them all rather than guessing which rules it touched.
+func invalidateCounts(ctx context.Context, rdb *redis.Client) (int, error) {
+	const batch = 1000
+	var keys []string
+	dropped := 0
+	unlink := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		n, err := rdb.Unlink(ctx, keys...).Result()
+		dropped += int(n)
+		keys = keys[:0]
+		return err
+	}
+	iter := rdb.Scan(ctx, 0, segmentKeyPrefix+"*", batch).Iterator()
+	for iter.Next(ctx) {
+		if keys = append(keys, iter.Val()); len(keys) == batch {
+			if err := unlink(); err != nil {
+				return dropped, fmt.Errorf("redis unlink: %w", err)
+			}
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return dropped, fmt.Errorf("redis scan: %w", err)
+	}
+	if err := unlink(); err != nil {
+		return dropped, fmt.Errorf("redis unlink: %w", err)
+	}
+	return dropped, nil
+}
+
+// Benchmark the cache-hit path against the live SQL path for each case
+func cacheBenchmark(ctx context.Context, rdb *redis.Client, db *sql.DB, results []caseResult, opts bench.Options, ttl time.Duration) error {
+	fmt.Fprintln(out, "\n📊 Precomputed segments: Redis cache vs live SQL (median latency)")
+	fmt.Fprintln(out, strings.Repeat("-", 50))
+	fmt.Fprintf(out, "%-14s %14s %14s %14s %10s\n", "Test", "Miss (SQL+SET)", "Cache hit", "Live SQL", "Speedup")
+
+	var failed []string
+	for _, r := range results {
+		rule, err := rules.Parse(r.rule)
+		if err != nil {
+			return err
+		}
+		// Start cold so the first call measures the miss path
+		if err := rdb.Del(ctx, segmentCacheKey(rule)).Err(); err != nil {
+			return fmt.Errorf("redis del: %w", err)
+		}
+
+		missCtx, cancel := bench.QueryContext(ctx, opts.Timeout)
+		missCount, missDuration, hit, err := cachedCount(missCtx, rdb, db, r.rule, ttl)
+		cancel()
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s miss: %v", r.name, err))
+			continue
+		}
+		if hit {
+			failed = append(failed, fmt.Sprintf("%s: expected a cache miss after DEL", r.name))
+			continue
+		}
+
+		hitResult := bench.Run(ctx, func(ctx context.Context) (int, time.Duration, error) {
+			count, d, hit, err := cachedCount(ctx, rdb, db, r.rule, ttl)
+			if err == nil && !hit {
+				err = errors.New("unexpected cache miss")
+			}
+			return count, d, err
+		}, opts)
+		if hitResult.Err != nil {
+			failed = append(failed, fmt.Sprintf("%s hit: %v", r.name, hitResult.Err))
+			continue
+		}
+		if hitResult.Count != missCount || (r.optimized.Err == nil && missCount != r.optimized.Count) {
+			fmt.Fprintf(out, "⚠️  %s: cached count %d differs from live count %d\n", r.name, hitResult.Count, r.optimized.Count)
+		}
+
+		speedup := "-"
+		if r.optimized.Err == nil && hitResult.Stats.Median > 0 {
+			speedup = fmt.Sprintf("%.0fx", float64(r.optimized.Stats.Median)/float64(hitResult.Stats.Median))
+		}
+		fmt.Fprintf(out, "%-14s %14v %14v %14v %10s\n",
+			r.name, missDuration, hitResult.Stats.Median, r.optimized.Stats.Median, speedup)
+	}
+
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// Any cached count may have come from a rule the change affects, so all of
+// them go, as after a sync round. Entries a failure leaves behind still expire
+// with --redis-ttl.
+func clearCachedCounts(ctx context.Context, cfg *Config) {
+	if cfg.RedisAddr == "" {
+		return
+	}
+	rdb := redis.NewClient(&redis.Options{Addr: cfg.RedisAddr})
+	defer rdb.Close()
+	cacheCtx, cancel := bench.QueryContext(ctx, cfg.QueryTimeout)
+	defer cancel()
+	dropped, err := invalidateCounts(cacheCtx, rdb)
+	if err != nil {
+		slog.Warn("count cache invalidation failed", "err", err)
+		return
+	}
+	slog.Debug("count cache invalidated", "keys", dropped)
+}
@@ -0,0 +1,45 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"audience-poc/internal/bench"
+	"audience-poc/internal/store"
+)
+
+// The ClickHouse copy of user_profiles the clickhouse model counts against
+type clickhouseBackend struct {
+	db   *sql.DB
+	load store.ClickHouseLoad
+}
+
+func loadClickHouseBackend(ctx context.Context, db *sql.DB, url string, timeout time.Duration) (*clickhouseBackend, error) {
+	ch, err := store.OpenClickHouse(url)
+	if err != nil {
+		return nil, err
+	}
+	loadCtx, cancel := bench.QueryContext(ctx, timeout)
+	defer cancel()
+	if err := ch.PingContext(loadCtx); err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("failed to connect to ClickHouse: %w", err)
+	}
+	load, err := store.LoadClickHouse(loadCtx, db, ch)
+	if err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("failed to load ClickHouse: %w", err)
+	}
+	return &clickhouseBackend{db: ch, load: load}, nil
+}
+
+func clickhouseCount(b *clickhouseBackend, rule string) bench.QueryFunc {
+	return func(ctx context.Context) (int, time.Duration, error) { return store.ClickHouseCount(ctx, b.db, rule) }
+}
+
+func printClickHouseLoad(load store.ClickHouseLoad) {
+	fmt.Fprintf(out, "🏠 ClickHouse: %d users loaded in %v, %s on disk\n\n",
+		load.Users, load.Duration.Round(time.Millisecond), formatBytes(load.Bytes))
+}
@@ -0,0 +1,178 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"audience-poc/internal/bench"
+)
+
+type compareOptions struct {
+	threshold float64 // relative slowdown that fails, e.g. 0.15
+	metric    string  // median or p95
+	// Only fail slowdowns the raw samples show are real, when both reports have them
+	significance bool
+}
+
+// One test and model present in both reports
+type comparison struct {
+	test, model       string
+	baseline, current float64 // ms of the compared metric
+	change            float64 // current / baseline - 1
+	speedup           *bench.Speedup
+	verdict           string
+	regressed         bool
+}
+
+func newBenchCompareCmd() *cobra.Command {
+	opts := compareOptions{threshold: 0.15, metric: "median", significance: true}
+	cmd := &cobra.Command{
+		Use:   "compare BASELINE CURRENT",
+		Short: "Diff two benchmark JSON reports and fail on queries that got slower",
+		Long: `Diff two benchmark reports written with --format json or --out-file, matching tests
+by name and model, and exit non-zero when one is slower than the baseline by more than
+--threshold, errored, or timed out.`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if opts.threshold <= 0 {
+				return errors.New("--threshold must be positive")
+			}
+			if opts.metric != "median" && opts.metric != "p95" {
+				return fmt.Errorf("unknown --metric %q, expected median or p95", opts.metric)
+			}
+			baseline, err := loadReport(args[0])
+			if err != nil {
+				return fmt.Errorf("failed to load the baseline: %w", err)
+			}
+			current, err := loadReport(args[1])
+			if err != nil {
+				return fmt.Errorf("failed to load the current report: %w", err)
+			}
+			results, notes := compareReports(baseline, current, opts)
+			printComparison(results, notes, opts)
+
+			var regressed []string
+			for _, c := range results {
+				if c.regressed {
+					regressed = append(regressed, c.test+"/"+c.model)
+				}
+			}
+			if len(regressed) > 0 {
+				return fmt.Errorf("%d queries regressed: %s", len(regressed), strings.Join(regressed, ", "))
+			}
+			return nil
+		},
+	}
+	f := cmd.Flags()
+	f.Float64Var(&opts.threshold, "threshold", opts.threshold, "relative slowdown that fails the comparison, e.g. 0.15 for 15% slower")
+	f.StringVar(&opts.metric, "metric", opts.metric, "latency compared: median or p95")
+	f.BoolVar(&opts.significance, "significance", opts.significance, "only fail slowdowns that are statistically significant, when both reports have raw samples")
+	return cmd
+}
+
+// Every test and model of the baseline against the current report. Tests
+// only in one of them, and changed counts, are reported as notes.
+func compareReports(baseline, current jsonReport, opts compareOptions) ([]comparison, []string) {
+	metric := func(t jsonTestResult) float64 {
+		if opts.metric == "p95" {
+			return t.P95MS
+		}
+		return t.DurationMS
+	}
+	after := map[string]jsonTestResult{}
+	for _, t := range current.Tests {
+		after[t.TestName+"/"+t.Model] = t
+	}
+
+	var notes []string
+	if baseline.DatasetSize != current.DatasetSize {
+		notes = append(notes, fmt.Sprintf("dataset size changed from %d to %d users", baseline.DatasetSize, current.DatasetSize))
+	}
+	var results []comparison
+	seen := map[string]bool{}
+	for _, before := range baseline.Tests {
+		key := before.TestName + "/" + before.Model
+		seen[key] = true
+		now, ok := after[key]
+		if !ok {
+			notes = append(notes, fmt.Sprintf("%s is missing from the current report", key))
+			continue
+		}
+		c := comparison{test: before.TestName, model: before.Model, baseline: metric(before), current: metric(now)}
+		switch {
+		case now.TimedOut || now.Error != "":
+			c.verdict, c.regressed = "❌ failed", before.Error == "" && !before.TimedOut
+			if !c.regressed {
+				c.verdict = "failed in both"
+			}
+			results = append(results, c)
+			continue
+		case before.TimedOut || before.Error != "" || c.baseline <= 0:
+			c.verdict = "no baseline"
+			results = append(results, c)
+			continue
+		}
+		if before.Count != now.Count {
+			notes = append(notes, fmt.Sprintf("%s count changed from %d to %d", key, before.Count, now.Count))
+		}
+
+		c.change = c.current/c.baseline - 1
+		if opts.significance && len(before.SamplesMS) > 0 && len(now.SamplesMS) > 0 {
+			if s, ok := bench.EstimateSpeedup(samplesOf(before), samplesOf(now)); ok {
+				c.speedup = &s
+			}
+		}
+		slower := c.change > opts.threshold
+		significant := c.speedup == nil || c.speedup.Significant
+		switch {
+		case slower && significant:
+			c.verdict, c.regressed = "❌ regressed", true
+		case slower:
+			c.verdict = "⚠️  slower, not significant"
+		case c.change < -opts.threshold && significant:
+			c.verdict = "✅ faster"
+		default:
+			c.verdict = "ok"
+		}
+		results = append(results, c)
+	}
+	for _, t := range current.Tests {
+		if key := t.TestName + "/" + t.Model; !seen[key] {
+			notes = append(notes, fmt.Sprintf("%s is new, no baseline to compare", key))
+		}
+	}
+	return results, notes
+}
+
+func samplesOf(t jsonTestResult) []time.Duration {
+	samples := make([]time.Duration, len(t.SamplesMS))
+	for i, v := range t.SamplesMS {
+		samples[i] = time.Duration(v * float64(time.Millisecond))
+	}
+	return samples
+}
+
+func printComparison(results []comparison, notes []string, opts compareOptions) {
+	fmt.Fprintf(summaryOut, "📉 %s latency, baseline vs current (fails beyond %+.0f%%)\n", opts.metric, opts.threshold*100)
+	tw := tabwriter.NewWriter(summaryOut, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "test\tmodel\tbaseline\tcurrent\tchange\tp\tverdict")
+	for _, c := range results {
+		change, p := "-", "-"
+		if c.baseline > 0 && c.current > 0 {
+			change = fmt.Sprintf("%+.1f%%", c.change*100)
+		}
+		if c.speedup != nil {
+			p = fmt.Sprintf("%.3g", c.speedup.PValue)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%.2fms\t%.2fms\t%s\t%s\t%s\n", c.test, c.model, c.baseline, c.current, change, p, c.verdict)
+	}
+	tw.Flush()
+	for _, n := range notes {
+		fmt.Fprintf(summaryOut, "ℹ️  %s\n", n)
+	}
+}
@@ -0,0 +1,320 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/spf13/pflag"
+
+	"audience-poc/internal/bench"
+	"audience-poc/internal/config"
+	"audience-poc/internal/rules"
+	"audience-poc/internal/store"
+)
+
+// Everything a command needs, from environment and command-line flags
+type Config struct {
+	DB           config.DB
+	QueryTimeout time.Duration
+	LogLevel     string
+	LogFormat    string
+	OTLPEndpoint string
+	// Only this tenant's users and audiences, for the commands taking --tenant
+	Tenant string
+
+	// Benchmarked rules; empty means the built-in benchCases
+	Rules       []string
+	Audiences   []int64 // stored audiences benchmarked alongside Rules
+	Iterations  int
+	Warmup      int
+	DiscardCold bool
+
+	// Approximate counts next to the exact ones (bench) or on request (serve)
+	Estimate  bool
+	Estimates store.EstimateOptions
+
+	// In-memory roaring bitmap model, reloaded from user_profiles every BitmapRefresh
+	Bitmap        bool
+	BitmapRefresh time.Duration
+	// ClickHouse server the optimized model is copied to and counted on as well
+	ClickHouse string
+	// Reset and read pg_stat_statements around each SQL model's runs
+	StatStatements bool
+
+	// Retries of failed queries (bench and serve) and serve's circuit breaker
+	RetryAttempts    int
+	RetryBackoff     time.Duration
+	RetryMaxBackoff  time.Duration
+	RetryTimeouts    bool
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	Pagination        bool
+	JSONBStudy        bool
+	CompareStrategies bool
+	// Time the rules against unpartitioned and list-partitioned copies of user_profiles
+	ComparePartitioning bool
+	// Time counts and member listings through both PostgreSQL client libraries
+	CompareDrivers bool
+
+	Matview         string
+	MatviewInterval time.Duration
+	// Time refreshing the rules as materialized audiences against reading them
+	Materialize bool
+
+	Concurrency  int
+	LoadDuration time.Duration
+	LoadRule     string
+	TargetQPS    float64
+	WorkloadFile string
+	// Rules the load test draws from: the --workload file, or just --load-rule
+	Workload   []workloadEntry
+	LoadModels []string
+
+	RedisAddr string
+	RedisTTL  time.Duration
+
+	MetricsAddr     string
+	MetricsInterval time.Duration
+
+	RuleFrequencies  map[string]float64
+	CostPerCPUSecond float64
+
+	Format string
+	// Report written to OutFile in the Output format, next to the stdout output
+	Output   string
+	OutFile  string
+	Baseline string
+	Quiet    bool
+	// Report built-in optimized queries that fall back to a seq scan instead of failing
+	AllowSeqScan bool
+}
+
+// Flags shared by every subcommand, besides the database ones
+func bindGlobalFlags(fs *pflag.FlagSet, cfg *Config) {
+	fs.DurationVar(&cfg.QueryTimeout, "query-timeout", 30*time.Second, "per-query timeout, 0 disables it")
+	fs.StringVar(&cfg.LogLevel, "log-level", "info", "diagnostics level: debug, info, warn or error")
+	fs.StringVar(&cfg.LogFormat, "log-format", "", "diagnostics on stderr: plain log lines, or structured text or json (default plain, json for serve)")
+	fs.StringVar(&cfg.OTLPEndpoint, "otlp-endpoint", "", "export traces over OTLP/gRPC to this collector, e.g. http://localhost:4317")
+}
+
+// --tenant of the commands that evaluate or manage stored audiences
+func bindTenantFlag(fs *pflag.FlagSet, cfg *Config) {
+	fs.StringVar(&cfg.Tenant, "tenant", "", "only this tenant's users and audiences (default every tenant's; PostgreSQL only)")
+}
+
+// How approximate counts are taken, for bench --estimate and serve
+func bindEstimateFlags(fs *pflag.FlagSet, cfg *Config) {
+	fs.StringVar(&cfg.Estimates.Method, "estimate-method", store.EstimateSample, "approximate counts with tablesample (block sample) or planner (EXPLAIN row estimate)")
+	fs.Float64Var(&cfg.Estimates.MaxError, "estimate-error", 0.05, "target 95% margin of sampled estimates, relative to the count")
+}
+
+func (cfg *Config) validateEstimates() error {
+	if cfg.Estimates.Method != store.EstimateSample && cfg.Estimates.Method != store.EstimatePlanner {
+		return fmt.Errorf("unknown --estimate-method %q, expected %s or %s", cfg.Estimates.Method, store.EstimateSample, store.EstimatePlanner)
+	}
+	if cfg.Estimates.MaxError <= 0 || cfg.Estimates.MaxError >= 1 {
+		return errors.New("--estimate-error must be between 0 and 1")
+	}
+	return nil
+}
+
+// Retries of queries that failed for a transient reason, for bench and serve
+func bindRetryFlags(fs *pflag.FlagSet, cfg *Config) {
+	fs.IntVar(&cfg.RetryAttempts, "retry-attempts", 3, "tries per query after a dropped connection, serialization failure or deadlock, 1 disables retrying")
+	fs.DurationVar(&cfg.RetryBackoff, "retry-backoff", 100*time.Millisecond, "wait before the first retry, doubled for each next one")
+	fs.DurationVar(&cfg.RetryMaxBackoff, "retry-max-backoff", 2*time.Second, "longest wait between retries")
+	fs.BoolVar(&cfg.RetryTimeouts, "retry-timeouts", false, "also retry queries that exceeded --query-timeout, each try with its own deadline")
+}
+
+func (cfg *Config) validateRetry() error {
+	if cfg.RetryAttempts < 1 {
+		return errors.New("--retry-attempts must be at least 1")
+	}
+	if cfg.RetryBackoff < 0 || cfg.RetryMaxBackoff < 0 {
+		return errors.New("--retry-backoff and --retry-max-backoff must be non-negative")
+	}
+	if cfg.BreakerThreshold < 0 || cfg.BreakerCooldown < 0 {
+		return errors.New("--breaker-threshold and --breaker-cooldown must be non-negative")
+	}
+	return nil
+}
+
+// Retry policy of the flags, logging every retry; the breaker is left to serve
+func (cfg *Config) retry() *bench.Retry {
+	return &bench.Retry{
+		Attempts:   cfg.RetryAttempts,
+		Backoff:    cfg.RetryBackoff,
+		MaxBackoff: cfg.RetryMaxBackoff,
+		Transient:  store.IsTransient,
+		Timeouts:   cfg.RetryTimeouts,
+		OnRetry: func(attempt int, err error, wait time.Duration) {
+			slog.Warn("query failed, retrying", "attempt", attempt, "wait", wait.Round(time.Millisecond), "err", err)
+		},
+	}
+}
+
+// Redis holding cached counts, for the bench segment benchmark and serve's cache
+func bindRedisFlags(fs *pflag.FlagSet, cfg *Config, usage string) {
+	fs.StringVar(&cfg.RedisAddr, "redis", "", usage+", e.g. localhost:6379 (empty disables it)")
+	fs.DurationVar(&cfg.RedisTTL, "redis-ttl", 5*time.Minute, "TTL of cached counts")
+}
+
+// Flags of the bench command; ruleFrequency is parsed by validateBench
+func bindBenchFlags(fs *pflag.FlagSet, cfg *Config, ruleFrequency *string) {
+	fs.BoolVar(&cfg.Pagination, "pagination", false, "benchmark OFFSET vs keyset pagination at increasing page depths")
+	fs.BoolVar(&cfg.CompareStrategies, "compare-strategies", false, "compare full scan, b-tree and partial index strategies for the optimized model")
+	fs.BoolVar(&cfg.ComparePartitioning, "compare-partitioning", false, "compare hash-partitioned, unpartitioned and list-by-country user_profiles layouts")
+	fs.BoolVar(&cfg.CompareDrivers, "compare-drivers", false, "compare counts and member listings through the pq and pgx client libraries")
+	fs.StringVar(&cfg.Matview, "matview", "", "benchmark REFRESH MATERIALIZED VIEW on this view, created from user_attributes if missing")
+	fs.DurationVar(&cfg.MatviewInterval, "matview-interval", 5*time.Minute, "planned refresh schedule, used to report worst-case staleness")
+	fs.BoolVar(&cfg.Materialize, "materialize", false, "compare counting the rules live with reading them from materialized audiences, and time the refreshes")
+	fs.BoolVar(&cfg.JSONBStudy, "compare-json-path-vs-columns", false, "compare JSONB indexing strategies against the denormalized columns")
+	fs.StringVar(ruleFrequency, "rule-frequency", "", "executions per day by rule, e.g. simple=50000,complex_or=12000")
+	fs.Float64Var(&cfg.CostPerCPUSecond, "cost-per-cpu-second", 0, "database cost per CPU-second in dollars, used to price the time saved")
+	fs.Func("rule", "audience rule to benchmark instead of the built-in tests, repeatable", func(s string) error {
+		if _, err := rules.Parse(s); err != nil {
+			return err
+		}
+		cfg.Rules = append(cfg.Rules, s)
+		return nil
+	})
+	fs.BoolVar(&cfg.Estimate, "estimate", false, "also estimate every count from a sample or planner statistics and compare it with the exact one")
+	bindEstimateFlags(fs, cfg)
+	bindRetryFlags(fs, cfg)
+	fs.BoolVar(&cfg.Bitmap, "bitmap", false, "also benchmark an in-memory roaring bitmap index loaded from user_profiles")
+	fs.DurationVar(&cfg.BitmapRefresh, "bitmap-refresh", time.Minute, "how often the bitmap index is reloaded while the benchmark runs")
+	fs.StringVar(&cfg.ClickHouse, "clickhouse", "", "also benchmark a ClickHouse copy of user_profiles on this server, e.g. clickhouse://default:@localhost:9000/default")
+	fs.BoolVar(&cfg.StatStatements, "pg-stat-statements", false, "reset and read pg_stat_statements around every test query, for server-side time, rows and buffer hits")
+	fs.Int64SliceVar(&cfg.Audiences, "audience", nil, "stored audience id to benchmark instead of the built-in tests, repeatable")
+	fs.IntVar(&cfg.Iterations, "iterations", 20, "measured runs per benchmark query")
+	fs.IntVar(&cfg.Warmup, "warmup", 3, "warm-up runs per benchmark query")
+	fs.BoolVar(&cfg.DiscardCold, "discard-cold", true, "discard the warm-up runs as cold-cache runs; false counts them in the statistics")
+	fs.IntVar(&cfg.Concurrency, "concurrency", 0, "run a load test with this many concurrent workers (0 disables it)")
+	fs.DurationVar(&cfg.LoadDuration, "duration", 30*time.Second, "how long the load test runs against each model")
+	fs.DurationVar(&cfg.LoadDuration, "load-duration", 30*time.Second, "how long the load test runs against each model")
+	fs.MarkDeprecated("load-duration", "use --duration")
+	fs.Float64Var(&cfg.TargetQPS, "target-qps", 0, "requests per second the load test starts across all workers (0: as fast as the workers go)")
+	fs.StringVar(&cfg.LoadRule, "load-rule", simpleRule, "audience rule evaluated by the load test")
+	fs.StringVar(&cfg.WorkloadFile, "workload", "", `JSON file of weighted rules for the load test instead of --load-rule, e.g. [{"rule": "country = 'US'", "weight": 3}]`)
+	fs.StringSliceVar(&cfg.LoadModels, "load-models", []string{"optimized", "eav"}, "models the load test runs against, one after the other: optimized, eav, jsonb")
+	bindRedisFlags(fs, cfg, "Redis address for the precomputed-segment benchmark")
+	fs.StringVar(&cfg.MetricsAddr, "metrics-addr", "", "run the benchmark on an interval and expose Prometheus metrics on this address, e.g. :9090")
+	fs.DurationVar(&cfg.MetricsInterval, "metrics-interval", time.Minute, "time between benchmark rounds with --metrics-addr")
+	fs.StringVar(&cfg.Format, "format", "text", "output format: text or json")
+	fs.StringVar(&cfg.Output, "output", "", "format of the --out-file report: json, csv or markdown (default: from the file extension)")
+	fs.StringVar(&cfg.OutFile, "out-file", "", "also write the benchmark report to this file, e.g. results.json")
+	fs.BoolVar(&cfg.Quiet, "quiet", false, "suppress progress output, print only the summary (or the JSON report)")
+	fs.BoolVar(&cfg.AllowSeqScan, "allow-seq-scan", false, "only warn, instead of failing, when a built-in optimized query is planned without an index")
+	fs.StringVar(&cfg.Baseline, "baseline", "", "JSON report of an earlier run; fail on statistically significant slowdowns against it")
+}
+
+func (cfg *Config) validateBench(ruleFrequency string) error {
+	if cfg.DB.Driver == "mysql" {
+		for flagName, set := range map[string]bool{
+			"--pagination":                   cfg.Pagination,
+			"--compare-json-path-vs-columns": cfg.JSONBStudy,
+			"--compare-strategies":           cfg.CompareStrategies,
+			"--compare-partitioning":         cfg.ComparePartitioning,
+			"--compare-drivers":              cfg.CompareDrivers,
+			"--matview":                      cfg.Matview != "",
+			"--materialize":                  cfg.Materialize,
+			"--audience":                     len(cfg.Audiences) > 0,
+			"--estimate":                     cfg.Estimate,
+			"--pg-stat-statements":           cfg.StatStatements,
+		} {
+			if set {
+				return fmt.Errorf("%s is only supported with the postgres driver", flagName)
+			}
+		}
+	}
+	if cfg.Iterations < 1 || cfg.Warmup < 0 {
+		return errors.New("--iterations must be at least 1 and --warmup non-negative")
+	}
+	if err := cfg.validateRetry(); err != nil {
+		return err
+	}
+	if cfg.Format != "text" && cfg.Format != "json" {
+		return fmt.Errorf("unknown --format %q, expected text or json", cfg.Format)
+	}
+	if cfg.Output != "" || cfg.OutFile != "" {
+		if err := cfg.validateExport(); err != nil {
+			return err
+		}
+	}
+	if cfg.Matview != "" && !relationName.MatchString(cfg.Matview) {
+		return fmt.Errorf("invalid --matview %q: expected [schema.]name", cfg.Matview)
+	}
+	if cfg.Estimate {
+		if err := cfg.validateEstimates(); err != nil {
+			return err
+		}
+	}
+	if cfg.Bitmap && cfg.BitmapRefresh <= 0 {
+		return errors.New("--bitmap-refresh must be positive")
+	}
+	if cfg.MetricsAddr != "" && cfg.MetricsInterval <= 0 {
+		return errors.New("--metrics-interval must be positive")
+	}
+	if cfg.Concurrency > 0 {
+		if err := cfg.validateLoad(); err != nil {
+			return err
+		}
+	}
+	var err error
+	if cfg.RuleFrequencies, err = parseRuleFrequencies(ruleFrequency); err != nil {
+		return fmt.Errorf("invalid --rule-frequency: %w", err)
+	}
+	return nil
+}
+
+func (cfg *Config) validateExport() error {
+	if cfg.OutFile == "" {
+		return errors.New("--output needs --out-file; use --format json for JSON on stdout")
+	}
+	if cfg.Output == "" {
+		format, ok := exportFormatFor(cfg.OutFile)
+		if !ok {
+			return fmt.Errorf("can't tell the report format from --out-file %q, set --output", cfg.OutFile)
+		}
+		cfg.Output = format
+	}
+	if _, ok := exportFormats[cfg.Output]; !ok {
+		return fmt.Errorf("unknown --output %q, expected json, csv or markdown", cfg.Output)
+	}
+	return nil
+}
+
+func (cfg *Config) validateLoad() error {
+	if cfg.LoadDuration <= 0 {
+		return errors.New("--duration must be positive")
+	}
+	if cfg.TargetQPS < 0 {
+		return errors.New("--target-qps must be non-negative")
+	}
+	if len(cfg.LoadModels) == 0 {
+		return errors.New("--load-models needs at least one model")
+	}
+	for _, model := range cfg.LoadModels {
+		if _, ok := loadModels[model]; !ok {
+			return fmt.Errorf("unknown --load-models entry %q, expected optimized, eav or jsonb", model)
+		}
+		if model == "jsonb" && cfg.DB.Driver == "mysql" {
+			return errors.New("the jsonb load model is only supported with the postgres driver")
+		}
+	}
+	if cfg.WorkloadFile == "" {
+		if _, err := rules.Parse(cfg.LoadRule); err != nil {
+			return fmt.Errorf("invalid --load-rule: %w", err)
+		}
+		cfg.Workload = []workloadEntry{{Name: "load_rule", Rule: cfg.LoadRule, Weight: 1}}
+		return nil
+	}
+	var err error
+	if cfg.Workload, err = loadWorkload(cfg.WorkloadFile); err != nil {
+		return fmt.Errorf("invalid --workload: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"audience-poc/internal/bench"
+	"audience-poc/internal/rules"
+	"audience-poc/internal/store"
+)
+
+// PostgreSQL clients compared with --compare-drivers
+var driverClients = []string{"pq", "pgx"}
+
+// Members fetched per listing; large enough for row decoding to dominate
+const driverPageSize = 10000
+
+func membersPage(db store.Querier, rule string) bench.QueryFunc {
+	return func(ctx context.Context) (int, time.Duration, error) {
+		r, err := rules.Parse(rule)
+		if err != nil {
+			return 0, 0, err
+		}
+		start := time.Now()
+		ids, err := store.MembersAfter(ctx, db, r, 0, driverPageSize)
+		return len(ids), time.Since(start), err
+	}
+}
+
+// Time the optimized count and the first page of members of every rule
+// through each client library, over a pool of its own
+func compareDrivers(ctx context.Context, cfg Config, cases []benchCase, opts bench.Options) error {
+	fmt.Fprintln(out, "\n📊 Client libraries (median latency)")
+	fmt.Fprintln(out, strings.Repeat("-", 50))
+
+	type measurement struct {
+		name, rule string
+		query      func(db store.Querier, rule string) bench.QueryFunc
+	}
+	var measurements []measurement
+	for _, c := range cases {
+		measurements = append(measurements,
+			measurement{c.name, c.rule, optimizedCount},
+			measurement{c.name + " page", c.rule, membersPage})
+	}
+
+	table := make([][]bench.Result, len(driverClients))
+	for i, client := range driverClients {
+		clientCfg := cfg
+		clientCfg.DB.Client = client
+		db, err := connect(ctx, clientCfg)
+		if err != nil {
+			return fmt.Errorf("%s: %w", client, err)
+		}
+		table[i] = make([]bench.Result, len(measurements))
+		for mi, m := range measurements {
+			table[i][mi] = bench.Run(ctx, m.query(db, m.rule), opts)
+		}
+		db.Close()
+	}
+
+	fmt.Fprintf(out, "\n%-20s", "Test")
+	for _, client := range driverClients {
+		fmt.Fprintf(out, " %12s", client)
+	}
+	fmt.Fprintln(out)
+
+	var failed []string
+	for mi, m := range measurements {
+		fmt.Fprintf(out, "%-20s", m.name)
+		best, bestMedian := -1, int64(0)
+		for i, client := range driverClients {
+			r := table[i][mi]
+			switch {
+			case r.TimedOut:
+				fmt.Fprintf(out, " %12s", "timed out")
+			case r.Err != nil:
+				fmt.Fprintf(out, " %12s", "error")
+				failed = append(failed, fmt.Sprintf("%s/%s: %v", client, m.name, r.Err))
+			default:
+				fmt.Fprintf(out, " %12v", r.Stats.Median)
+				if best < 0 || int64(r.Stats.Median) < bestMedian {
+					best, bestMedian = i, int64(r.Stats.Median)
+				}
+			}
+		}
+		fmt.Fprintln(out)
+
+		if best >= 0 {
+			fmt.Fprintf(out, "%-20s 🏆 %s\n", "", driverClients[best])
+		}
+		if counts := strategyCounts(table, mi); len(counts) > 1 {
+			fmt.Fprintf(out, "⚠️  %s: clients disagree on the count: %v\n", m.name, counts)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return nil
+}
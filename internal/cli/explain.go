@@ -0,0 +1,53 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+
+	"audience-poc/internal/store"
+)
+
+// Print the plan as an indented tree with planner estimates vs actual rows
+func printPlan(p *store.QueryPlan) {
+	fmt.Fprintln(out, "\n📊 Query Plan:")
+	var printNode func(n store.PlanNode, depth int)
+	printNode = func(n store.PlanNode, depth int) {
+		label := n.NodeType
+		if n.IndexName != "" {
+			label += " using " + n.IndexName
+		}
+		if n.RelationName != "" {
+			label += " on " + n.RelationName
+		}
+		fmt.Fprintf(out, "   %s%s (rows estimated=%.0f actual=%.0f)\n",
+			strings.Repeat("  ", depth), label, n.PlanRows, n.ActualRows*max(n.ActualLoops, 1))
+		for _, child := range n.Plans {
+			printNode(child, depth+1)
+		}
+	}
+	printNode(p.Root, 0)
+	printPlanSummary(p)
+}
+
+func printPlanSummary(p *store.QueryPlan) {
+	fmt.Fprintf(out, "   Planning Time: %v, Execution Time: %v\n", p.PlanningTime, p.ExecutionTime)
+	fmt.Fprintf(out, "   Scans: %s\n", strings.Join(p.ScanTypes, ", "))
+	if names := p.IndexNames(); len(names) > 0 {
+		fmt.Fprintf(out, "   Indexes: %s\n", strings.Join(names, ", "))
+	}
+}
+
+// One-line description of scans, e.g. "Bitmap Heap Scan on user_profiles_0, Bitmap Index Scan using idx_country"
+func describeScans(scans []store.ScanAccess) string {
+	parts := make([]string, len(scans))
+	for i, s := range scans {
+		parts[i] = s.ScanType
+		if s.IndexName != "" {
+			parts[i] += " using " + s.IndexName
+		}
+		if s.Relation != "" {
+			parts[i] += " on " + s.Relation
+		}
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,171 @@
+package cli
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Formats --output writes the benchmark report in, all built from the JSON report
+var exportFormats = map[string]func(io.Writer, jsonReport) error{
+	"json":     writeJSONReport,
+	"csv":      writeCSVReport,
+	"markdown": writeMarkdownReport,
+}
+
+// --output implied by the --out-file extension
+func exportFormatFor(path string) (string, bool) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return "json", true
+	case ".csv":
+		return "csv", true
+	case ".md", ".markdown":
+		return "markdown", true
+	}
+	return "", false
+}
+
+func exportReport(path, format string, report jsonReport) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := exportFormats[format](f, report); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// One row per test and model. The speedup columns are the optimized model's
+// speedup over the row's model, so they are set on eav and jsonb rows only.
+func writeCSVReport(w io.Writer, report jsonReport) error {
+	speedups := map[string]jsonSpeedup{}
+	for _, s := range report.Speedups {
+		speedups[s.TestName+"/"+s.Baseline] = s
+	}
+	cw := csv.NewWriter(w)
+	cw.Write([]string{
+		"test_name", "model", "rule", "count", "median_ms", "min_ms", "p95_ms", "p99_ms", "max_ms", "stddev_ms",
+		"cold_ms", "runs", "timed_out", "error", "uses_index", "scans",
+		"speedup", "speedup_ci_low", "speedup_ci_high", "speedup_p_value", "speedup_significant", "counts_match",
+	})
+	for _, t := range report.Tests {
+		row := []string{
+			t.TestName, t.Model, t.Rule, strconv.Itoa(t.Count),
+			csvMS(t.DurationMS), csvMS(t.MinMS), csvMS(t.P95MS), csvMS(t.P99MS), csvMS(t.MaxMS), csvMS(t.StdDevMS),
+			csvMS(t.ColdMS), strconv.Itoa(t.Runs), strconv.FormatBool(t.TimedOut), t.Error, "", describeScans(t.Scans),
+		}
+		if t.UsesIndex != nil {
+			row[14] = strconv.FormatBool(*t.UsesIndex)
+		}
+		if s, ok := speedups[t.TestName+"/"+t.Model]; ok {
+			row = append(row,
+				strconv.FormatFloat(s.Speedup, 'f', 2, 64), strconv.FormatFloat(s.CILow, 'f', 2, 64),
+				strconv.FormatFloat(s.CIHigh, 'f', 2, 64), strconv.FormatFloat(s.PValue, 'g', 3, 64),
+				strconv.FormatBool(s.Significant), strconv.FormatBool(s.CountsMatch))
+		} else {
+			row = append(row, "", "", "", "", "", "")
+		}
+		cw.Write(row)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func csvMS(v float64) string { return strconv.FormatFloat(v, 'f', 3, 64) }
+
+// Tables for a PR comment or job summary: tests with their plans, speedups,
+// and estimates, load tests and savings when the run had them
+func writeMarkdownReport(w io.Writer, report jsonReport) error {
+	var b strings.Builder
+	b.WriteString("# Benchmark results\n\n")
+	warmup := "discarded"
+	if !report.DiscardCold {
+		warmup = "included"
+	}
+	fmt.Fprintf(&b, "%d users, %d measured runs per query, %d warm-up runs (%s).\n\n",
+		report.DatasetSize, report.Iterations, report.Warmup, warmup)
+
+	b.WriteString("## Tests\n\n")
+	b.WriteString("| Test | Model | Rule | Count | Median | p95 | p99 | Runs | Plan |\n")
+	b.WriteString("|------|-------|------|------:|-------:|----:|----:|-----:|------|\n")
+	for _, t := range report.Tests {
+		median, p95, p99 := mdMS(t.DurationMS), mdMS(t.P95MS), mdMS(t.P99MS)
+		switch {
+		case t.TimedOut:
+			median, p95, p99 = "timed out", "", ""
+		case t.Error != "":
+			median, p95, p99 = "error: "+mdCell(t.Error), "", ""
+		}
+		plan := describeScans(t.Scans)
+		if t.UsesIndex != nil && !*t.UsesIndex {
+			plan += " ⚠️ no index"
+		}
+		fmt.Fprintf(&b, "| %s | %s | `%s` | %d | %s | %s | %s | %d | %s |\n",
+			t.TestName, t.Model, mdCell(t.Rule), t.Count, median, p95, p99, t.Runs, mdCell(plan))
+	}
+
+	if len(report.Speedups) > 0 {
+		b.WriteString("\n## Speedups\n\nThe optimized model's median speedup over the baseline model.\n\n")
+		b.WriteString("| Test | Baseline | Speedup | 95% CI | p | Significant | Counts match |\n")
+		b.WriteString("|------|----------|--------:|-------:|--:|-------------|--------------|\n")
+		for _, s := range report.Speedups {
+			fmt.Fprintf(&b, "| %s | %s | %.1fx | %.1fx–%.1fx | %.3g | %s | %s |\n",
+				s.TestName, s.Baseline, s.Speedup, s.CILow, s.CIHigh, s.PValue, mdBool(s.Significant), mdBool(s.CountsMatch))
+		}
+	}
+
+	if len(report.Estimates) > 0 {
+		b.WriteString("\n## Estimates\n\n")
+		b.WriteString("| Test | Method | Estimate | Margin | Exact | Error | Duration |\n")
+		b.WriteString("|------|--------|---------:|-------:|------:|------:|---------:|\n")
+		for _, e := range report.Estimates {
+			margin := "-"
+			if e.Margin > 0 {
+				margin = fmt.Sprintf("±%d", e.Margin)
+			}
+			fmt.Fprintf(&b, "| %s | %s | %d | %s | %d | %+.1f%% | %s |\n",
+				e.TestName, e.Method, e.Count, margin, e.ExactCount, e.Error*100, mdMS(e.DurationMS))
+		}
+	}
+
+	if len(report.Load) > 0 {
+		b.WriteString("\n## Load tests\n\n")
+		b.WriteString("| Model | Workers | Queries | Throughput | Median | p95 | p99 | Errors | Pool saturation |\n")
+		b.WriteString("|-------|--------:|--------:|-----------:|-------:|----:|----:|-------:|----------------:|\n")
+		for _, l := range report.Load {
+			fmt.Fprintf(&b, "| %s | %d | %d | %.1f qps | %s | %s | %s | %d | %.0f%% |\n",
+				l.Model, l.Workers, l.Queries, l.ThroughputQPS, mdMS(l.MedianMS), mdMS(l.P95MS), mdMS(l.P99MS), l.Errors, l.Saturation*100)
+		}
+	}
+
+	if s := report.Savings; s != nil {
+		fmt.Fprintf(&b, "\n## Savings\n\n%.0f s of database time saved per day", s.TimeSavedPerDaySeconds)
+		if s.CostSavedPerDayUSD != nil {
+			fmt.Fprintf(&b, ", $%.2f per day", *s.CostSavedPerDayUSD)
+		}
+		b.WriteString(".\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func mdMS(v float64) string { return strconv.FormatFloat(v, 'f', 2, 64) + " ms" }
+
+func mdBool(v bool) string {
+	if v {
+		return "yes"
+	}
+	return "no"
+}
+
+// Keep a value inside its table cell
+func mdCell(s string) string {
+	return strings.NewReplacer("|", `\|`, "\n", " ").Replace(s)
+}
@@ -0,0 +1,451 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/spf13/cobra"
+
+	"audience-poc/internal/bench"
+	"audience-poc/internal/rules"
+	"audience-poc/internal/store"
+)
+
+type memberExportOptions struct {
+	rule       string
+	audienceID int64
+	profiles   bool // whole user_profiles rows instead of user_ids
+	format     string
+	gzip       bool
+	maxSize    int64 // bytes per file, 0 for one file
+	out        string
+	s3URL      string
+	s3Path     bool
+	pageSize   int
+}
+
+func newExportCmd(cfg *Config) *cobra.Command {
+	var opts memberExportOptions
+	var maxSize string
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Write the members of an audience to NDJSON or CSV files, optionally gzipped and uploaded to S3",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var err error
+			if opts.maxSize, err = parseByteSize(maxSize); err != nil {
+				return fmt.Errorf("invalid --max-file-size: %w", err)
+			}
+			if err := opts.validate(); err != nil {
+				return err
+			}
+			// Stdout carries the members
+			if opts.out == "-" {
+				out, summaryOut = os.Stderr, os.Stderr
+			}
+			ctx := cmd.Context()
+			db, err := connect(ctx, *cfg)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+			return exportMembers(ctx, db, opts, cfg.QueryTimeout)
+		},
+	}
+	cmd.Flags().StringVar(&opts.rule, "rule", "", "audience rule whose members are exported")
+	cmd.Flags().Int64Var(&opts.audienceID, "audience", 0, "stored audience id whose members are exported, instead of --rule")
+	cmd.Flags().BoolVar(&opts.profiles, "profiles", false, "export every attribute of each member, not only the user_id")
+	cmd.Flags().StringVar(&opts.format, "format", "ndjson", "file format: ndjson or csv")
+	cmd.Flags().BoolVar(&opts.gzip, "gzip", false, "gzip the files (adds .gz)")
+	cmd.Flags().StringVar(&maxSize, "max-file-size", "0", "start a new numbered file once one reaches this size, e.g. 100MB (0: a single file)")
+	cmd.Flags().StringVar(&opts.out, "out", "members", "file name without the extension, or - for stdout")
+	cmd.Flags().StringVar(&opts.s3URL, "s3", "", "upload the files to this s3://bucket/prefix instead of keeping them")
+	cmd.Flags().BoolVar(&opts.s3Path, "s3-path-style", false, "address the bucket in the URL path, as MinIO and other S3-compatible stores expect")
+	cmd.Flags().IntVar(&opts.pageSize, "page-size", 10000, "members read per query")
+	bindTenantFlag(cmd.Flags(), cfg)
+	return cmd
+}
+
+func (o memberExportOptions) validate() error {
+	switch {
+	case (o.rule == "") == (o.audienceID == 0):
+		return errors.New("exactly one of --rule or --audience is required")
+	case o.format != "ndjson" && o.format != "csv":
+		return fmt.Errorf("unknown --format %q, expected ndjson or csv", o.format)
+	case o.pageSize < 1:
+		return errors.New("--page-size must be at least 1")
+	case o.out == "-" && (o.maxSize > 0 || o.s3URL != ""):
+		return errors.New("--out - can't be combined with --max-file-size or --s3")
+	}
+	if o.s3URL != "" {
+		if _, _, err := parseS3URL(o.s3URL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 100MB, 64KiB, 1G, or plain bytes
+func parseByteSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		bytes  int64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+		{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9},
+		{"K", 1e3}, {"M", 1e6}, {"G", 1e9}, {"B", 1},
+	}
+	s = strings.TrimSpace(s)
+	multiplier := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(strings.ToUpper(s), strings.ToUpper(u.suffix)) {
+			s, multiplier = strings.TrimSpace(s[:len(s)-len(u.suffix)]), u.bytes
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("expected a size such as 100MB, got %q", s)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+func parseS3URL(raw string) (bucket, prefix string, err error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return "", "", fmt.Errorf("invalid --s3 %q, expected s3://bucket/prefix", raw)
+	}
+	return u.Host, strings.TrimPrefix(u.Path, "/"), nil
+}
+
+// Page through the audience in one read-only snapshot, so members who join or
+// leave during the export don't shift the pages, and write them through sink
+func exportMembers(ctx context.Context, db *sql.DB, opts memberExportOptions, timeout time.Duration) error {
+	ctx, ruleText, err := resolveRule(ctx, db, opts.rule, opts.audienceID, timeout)
+	if err != nil {
+		return err
+	}
+	rule, err := rules.Parse(ruleText)
+	if err != nil {
+		return err
+	}
+	var attrs []rules.Attribute
+	columns := []string{"user_id"}
+	if opts.profiles {
+		attrs = rules.AllAttributes()
+		for _, a := range attrs {
+			columns = append(columns, a.Name)
+		}
+	}
+
+	sink, err := newMemberSink(ctx, opts, columns)
+	if err != nil {
+		return err
+	}
+	defer sink.abort()
+
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	start := time.Now()
+	var cursor, members int64
+	for {
+		pageCtx, cancel := bench.QueryContext(ctx, timeout)
+		var page []store.Profile
+		if opts.profiles {
+			page, err = store.ProfilesAfter(pageCtx, tx, rule, attrs, cursor, opts.pageSize)
+		} else {
+			var ids []int64
+			ids, err = store.MembersAfter(pageCtx, tx, rule, cursor, opts.pageSize)
+			for _, id := range ids {
+				page = append(page, store.Profile{UserID: id})
+			}
+		}
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to read members after user %d: %w", cursor, err)
+		}
+		for _, p := range page {
+			if err := sink.write(ctx, p, attrs); err != nil {
+				return err
+			}
+		}
+		members += int64(len(page))
+		if len(page) < opts.pageSize {
+			break
+		}
+		cursor = page[len(page)-1].UserID
+	}
+	if err := sink.close(ctx); err != nil {
+		return err
+	}
+
+	where := fmt.Sprintf("%d files", len(sink.files))
+	if len(sink.files) == 1 {
+		where = sink.files[0]
+	}
+	fmt.Fprintf(summaryOut, "📤 Exported %d members of %s to %s in %v\n", members, ruleText, where, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// Files of one export: numbered parts when maxSize is set, each gzipped if
+// asked, and handed to S3 as soon as it is complete
+type memberSink struct {
+	opts    memberExportOptions
+	columns []string
+	dir     string // where parts are written; a temporary one with --s3
+	s3      *s3.Client
+	bucket  string
+	prefix  string
+
+	part    int
+	path    string
+	file    io.WriteCloser
+	written *countingWriter // bytes that reached the file, after compression
+	gz      *gzip.Writer
+	buf     *bufio.Writer
+	rows    int64
+	line    bytes.Buffer
+	files   []string // completed, as local paths or s3:// URLs
+}
+
+func newMemberSink(ctx context.Context, opts memberExportOptions, columns []string) (*memberSink, error) {
+	s := &memberSink{opts: opts, columns: columns, dir: filepath.Dir(opts.out)}
+	if opts.s3URL != "" {
+		s.bucket, s.prefix, _ = parseS3URL(opts.s3URL)
+		awsCfg, err := awsconfig.LoadDefaultConfig(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load AWS configuration: %w", err)
+		}
+		s.s3 = s3.NewFromConfig(awsCfg, func(o *s3.Options) { o.UsePathStyle = opts.s3Path })
+		if s.dir, err = os.MkdirTemp("", "audience-export-"); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// members.ndjson.gz, or members-00001.ndjson.gz for a part
+func (s *memberSink) name() string {
+	name := filepath.Base(s.opts.out)
+	if s.opts.maxSize > 0 {
+		name += fmt.Sprintf("-%05d", s.part)
+	}
+	name += "." + s.opts.format
+	if s.opts.gzip {
+		name += ".gz"
+	}
+	return name
+}
+
+func (s *memberSink) open() error {
+	s.part++
+	s.rows = 0
+	if s.opts.out == "-" {
+		s.path, s.file = "stdout", nopCloser{os.Stdout}
+	} else {
+		s.path = filepath.Join(s.dir, s.name())
+		f, err := os.Create(s.path)
+		if err != nil {
+			return err
+		}
+		s.file = f
+	}
+	s.written = &countingWriter{w: s.file}
+	var w io.Writer = s.written
+	if s.opts.gzip {
+		s.gz = gzip.NewWriter(w)
+		w = s.gz
+	}
+	s.buf = bufio.NewWriterSize(w, 64<<10)
+	if s.opts.format == "csv" {
+		return s.writeCSV(s.columns)
+	}
+	return nil
+}
+
+func (s *memberSink) write(ctx context.Context, p store.Profile, attrs []rules.Attribute) error {
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	var err error
+	if s.opts.format == "csv" {
+		row := make([]string, 1, len(attrs)+1)
+		row[0] = strconv.FormatInt(p.UserID, 10)
+		for i, a := range attrs {
+			row = append(row, store.CSVValue(a, p.Values[i]))
+		}
+		err = s.writeCSV(row)
+	} else {
+		err = s.writeJSON(p, attrs)
+	}
+	if err != nil {
+		return fmt.Errorf("write %s: %w", s.path, err)
+	}
+	s.rows++
+	// Compressed size is only known once gzip emits a block, so a gzipped part
+	// ends up to about a block over the limit
+	size := s.written.n
+	if s.gz == nil {
+		size += int64(s.buf.Buffered())
+	}
+	if s.opts.maxSize > 0 && size >= s.opts.maxSize {
+		return s.finish(ctx)
+	}
+	return nil
+}
+
+func (s *memberSink) writeCSV(row []string) error {
+	s.line.Reset()
+	cw := csv.NewWriter(&s.line)
+	cw.Write(row)
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+	_, err := s.buf.Write(s.line.Bytes())
+	return err
+}
+
+// Keys in column order, which a map would lose
+func (s *memberSink) writeJSON(p store.Profile, attrs []rules.Attribute) error {
+	s.line.Reset()
+	s.line.WriteString(`{"user_id":`)
+	s.line.WriteString(strconv.FormatInt(p.UserID, 10))
+	for i, a := range attrs {
+		value, err := json.Marshal(store.JSONValue(a, p.Values[i]))
+		if err != nil {
+			return err
+		}
+		key, _ := json.Marshal(a.Name)
+		s.line.WriteByte(',')
+		s.line.Write(key)
+		s.line.WriteByte(':')
+		s.line.Write(value)
+	}
+	s.line.WriteString("}\n")
+	_, err := s.buf.Write(s.line.Bytes())
+	return err
+}
+
+// Complete the current file and upload it with --s3
+func (s *memberSink) finish(ctx context.Context) error {
+	err := s.buf.Flush()
+	if s.gz != nil && err == nil {
+		err = s.gz.Close()
+	}
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	s.file, s.gz = nil, nil
+	if err != nil {
+		return fmt.Errorf("write %s: %w", s.path, err)
+	}
+	if s.opts.out == "-" {
+		s.files = append(s.files, s.path)
+		return nil
+	}
+	fmt.Fprintf(out, "📦 %s: %d rows, %s\n", filepath.Base(s.path), s.rows, formatBytes(s.written.n))
+	if s.s3 == nil {
+		s.files = append(s.files, s.path)
+		return nil
+	}
+	key := strings.TrimSuffix(s.prefix, "/")
+	if key != "" {
+		key += "/"
+	}
+	key += filepath.Base(s.path)
+	if err := s.upload(ctx, key); err != nil {
+		return fmt.Errorf("upload s3://%s/%s: %w", s.bucket, key, err)
+	}
+	s.files = append(s.files, "s3://"+s.bucket+"/"+key)
+	fmt.Fprintf(out, "☁️  Uploaded s3://%s/%s\n", s.bucket, key)
+	return os.Remove(s.path)
+}
+
+func (s *memberSink) upload(ctx context.Context, key string) error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	contentType := "application/x-ndjson"
+	switch {
+	case s.opts.gzip:
+		contentType = "application/gzip"
+	case s.opts.format == "csv":
+		contentType = "text/csv"
+	}
+	_, err = s.s3.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(key),
+		Body:          f,
+		ContentLength: aws.Int64(s.written.n),
+		ContentType:   aws.String(contentType),
+	})
+	return err
+}
+
+// Finish the last file; an empty audience still gets one, so the export always leaves something to look at
+func (s *memberSink) close(ctx context.Context) error {
+	if s.file == nil && s.part == 0 {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	if s.file == nil {
+		return nil
+	}
+	return s.finish(ctx)
+}
+
+// Drop what a failed export left behind: the open part, and the staging directory with --s3
+func (s *memberSink) abort() {
+	if s.file != nil {
+		s.file.Close()
+		if s.opts.out != "-" {
+			os.Remove(s.path)
+		}
+		s.file = nil
+	}
+	if s.s3 != nil {
+		os.RemoveAll(s.dir)
+	}
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
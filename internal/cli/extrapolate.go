@@ -0,0 +1,124 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"audience-poc/internal/bench"
+	"audience-poc/internal/store"
+)
+
+const extrapolationTarget = 10000000
+
+// Fractions of the dataset measured to fit the growth curve
+var extrapolationFractions = []float64{0.01, 0.1, 0.25, 0.5, 1}
+
+// Fewer runs per point than the main benchmark: the fit averages out noise
+var extrapolationOpts = bench.Options{Warmup: 1, Iterations: 5}
+
+type extrapolation struct {
+	test, model string
+	points      int
+	best        bench.GrowthFit
+	others      []bench.GrowthFit
+}
+
+// user_id cutoffs selecting the first n users, so every size is a prefix of the real data
+func sizeCutoffs(ctx context.Context, db *sql.DB, userCount int) ([]float64, []int64, error) {
+	var sizes []float64
+	var cutoffs []int64
+	for _, f := range extrapolationFractions {
+		n := int(float64(userCount) * f)
+		if n < 1000 || (len(sizes) > 0 && float64(n) == sizes[len(sizes)-1]) {
+			continue
+		}
+		cutoff, err := store.UserCutoff(ctx, db, n)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cutoff for %d users: %w", n, err)
+		}
+		sizes = append(sizes, float64(n))
+		cutoffs = append(cutoffs, cutoff)
+	}
+	return sizes, cutoffs, nil
+}
+
+// Queries restricted to users up to a cutoff id
+func eavCountUpTo(db store.Querier, rule string, cutoff int64) bench.QueryFunc {
+	return func(ctx context.Context) (int, time.Duration, error) {
+		return store.EAVCountUpTo(ctx, db, rule, cutoff)
+	}
+}
+
+func optimizedCountUpTo(db store.Querier, rule string, cutoff int64) bench.QueryFunc {
+	return func(ctx context.Context) (int, time.Duration, error) {
+		return store.OptimizedCountUpTo(ctx, db, rule, cutoff)
+	}
+}
+
+// Measure both models at several dataset sizes and extrapolate each to 10M users
+func extrapolateGrowth(ctx context.Context, db *sql.DB, userCount int, cases []benchCase, timeout time.Duration) ([]extrapolation, error) {
+	sizes, cutoffs, err := sizeCutoffs(ctx, db, userCount)
+	if err != nil {
+		return nil, err
+	}
+	if len(sizes) < 3 {
+		return nil, fmt.Errorf("need at least 3 dataset sizes of 1000+ users to fit a curve, have %d", len(sizes))
+	}
+
+	opts := extrapolationOpts
+	opts.Timeout = timeout
+
+	var results []extrapolation
+	for _, c := range cases {
+		if !c.withEAV {
+			continue
+		}
+		for _, m := range []struct {
+			name  string
+			query func(store.Querier, string, int64) bench.QueryFunc
+		}{{"eav", eavCountUpTo}, {"optimized", optimizedCountUpTo}} {
+			latencies := make([]time.Duration, len(sizes))
+			for i, cutoff := range cutoffs {
+				r := bench.Run(ctx, m.query(db, c.rule, cutoff), opts)
+				if r.Err != nil {
+					return nil, fmt.Errorf("%s/%s at %.0f users: %w", c.name, m.name, sizes[i], r.Err)
+				}
+				latencies[i] = r.Stats.Median
+			}
+
+			fits := make([]bench.GrowthFit, len(bench.GrowthModels))
+			best := 0
+			for i, gm := range bench.GrowthModels {
+				fits[i] = bench.FitGrowth(gm, sizes, latencies, extrapolationTarget)
+				if fits[i].R2 > fits[best].R2 {
+					best = i
+				}
+			}
+			e := extrapolation{test: c.name, model: m.name, points: len(sizes), best: fits[best]}
+			e.others = append(append(e.others, fits[:best]...), fits[best+1:]...)
+			results = append(results, e)
+		}
+	}
+	return results, nil
+}
+
+func printExtrapolation(results []extrapolation) {
+	fmt.Fprintf(out, "\n🔮 Estimated for 10M users (curve fit over %d dataset sizes):\n", results[0].points)
+	targetMet := true
+	for _, e := range results {
+		alternatives := make([]string, len(e.others))
+		for i, o := range e.others {
+			alternatives[i] = fmt.Sprintf("%s R²=%.3f → %v", o.Model.Name, o.R2, o.Projected.Round(time.Millisecond))
+		}
+		fmt.Fprintf(out, "   %-22s %v ± %v  (best fit %s, R²=%.3f; %s)\n",
+			e.test+" / "+e.model+":", e.best.Projected.Round(time.Millisecond), e.best.Band.Round(time.Millisecond),
+			e.best.Model.Name, e.best.R2, strings.Join(alternatives, ", "))
+		if e.model == "optimized" {
+			targetMet = targetMet && e.best.Projected < 2*time.Second
+		}
+	}
+	fmt.Fprintf(out, "   Target <2s:     %v\n", targetMet)
+}
@@ -0,0 +1,220 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	"audience-poc/internal/bench"
+	audiencev1 "audience-poc/internal/gen/audience/v1"
+	"audience-poc/internal/rules"
+	"audience-poc/internal/store"
+)
+
+const (
+	defaultMemberBatch = 1000
+	maxMemberBatch     = 10000
+)
+
+type audienceServer struct {
+	audiencev1.UnimplementedAudienceServiceServer
+	route   *store.Router
+	timeout time.Duration
+	retry   *bench.Retry
+	metrics *apiMetrics
+	cache   *countCache   // nil without --redis
+	maxAge  time.Duration // of materializations used for stored audiences, 0 for none
+}
+
+func (s *audienceServer) Count(ctx context.Context, req *audiencev1.CountRequest) (*audiencev1.CountResponse, error) {
+	ctx, ruleText, rule, err := s.resolve(ctx, req.GetRule(), req.GetAudienceId())
+	if err != nil {
+		return nil, err
+	}
+	db := s.route.Read()
+	fn, cached, materialized := optimizedCount(db, ruleText), false, false
+	if s.cache != nil {
+		fn = func(ctx context.Context) (int, time.Duration, error) {
+			count, duration, hit, err := s.cache.count(ctx, db, rule, ruleText)
+			cached = hit
+			return count, duration, err
+		}
+	}
+	if req.GetAudienceId() != 0 && s.maxAge > 0 {
+		fn = materializedCount(db, req.GetAudienceId(), ruleText, s.maxAge, fn, &materialized)
+	}
+	count, duration, err := s.retry.Run(ctx, fn, s.timeout)
+	if err != nil {
+		return nil, s.queryError(ctx, db, "count", rule, ruleText, err)
+	}
+	s.metrics.observe(ctx, countModel(cached, materialized), "count", rule, duration, count)
+	s.metrics.evaluated("grpc", rule, "")
+	return &audiencev1.CountResponse{
+		Rule:       ruleText,
+		Count:      int64(count),
+		DurationMs: float64(duration.Microseconds()) / 1000,
+		AudienceId: req.GetAudienceId(),
+		Cached:     cached,
+	}, nil
+}
+
+// Rule of a request, given inline or as a stored audience (read from the
+// primary), parsed and restricted to the tenant of the returned context
+func (s *audienceServer) resolve(ctx context.Context, ruleText string, audienceID int64) (context.Context, string, *rules.Rule, error) {
+	ctx, ruleText, err := resolveRule(ctx, s.route.Primary(), ruleText, audienceID, s.timeout)
+	switch {
+	case errors.Is(err, errRuleOrAudience):
+		s.metrics.evaluated("grpc", nil, reasonInvalidRequest)
+		return ctx, "", nil, status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, store.ErrAudienceNotFound):
+		s.metrics.evaluated("grpc", nil, reasonNotFound)
+		return ctx, "", nil, status.Errorf(codes.NotFound, "audience %d not found", audienceID)
+	case err != nil:
+		return ctx, "", nil, s.queryError(ctx, s.route.Primary(), "audience lookup", nil, "", err)
+	}
+	rule, err := rules.Parse(ruleText)
+	if err != nil {
+		s.metrics.evaluated("grpc", nil, reasonInvalidRule)
+		return ctx, "", nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return ctx, ruleText, store.Scope(ctx, rule), nil
+}
+
+// Page through the optimized model by user_id, one query per batch, so a
+// long export never holds a single query or snapshot open. Every batch reads
+// from the same replica, whose lag can't differ between pages, and from a
+// stored audience's materialization for the whole export when it is fresh.
+func (s *audienceServer) ListMembers(req *audiencev1.ListMembersRequest, stream grpc.ServerStreamingServer[audiencev1.ListMembersResponse]) error {
+	ctx, ruleText, rule, err := s.resolve(stream.Context(), req.GetRule(), req.GetAudienceId())
+	if err != nil {
+		return err
+	}
+	batch := int(req.GetBatchSize())
+	switch {
+	case batch < 0 || batch > maxMemberBatch:
+		s.metrics.evaluated("grpc", rule, reasonInvalidRequest)
+		return status.Errorf(codes.InvalidArgument, "batch_size must be between 0 and %d", maxMemberBatch)
+	case batch == 0:
+		batch = defaultMemberBatch
+	}
+
+	db := s.route.Read()
+	cursor := req.GetAfterUserId()
+	model, page := "optimized", func(ctx context.Context) ([]int64, error) {
+		return store.MembersAfter(ctx, db, rule, cursor, batch)
+	}
+	if s.materializationFresh(ctx, db, req.GetAudienceId(), ruleText) {
+		model, page = "materialized", func(ctx context.Context) ([]int64, error) {
+			return store.MaterializedMembersAfter(ctx, db, req.GetAudienceId(), cursor, batch)
+		}
+	}
+	for {
+		var ids []int64
+		start := time.Now()
+		_, _, err := s.retry.Run(ctx, func(ctx context.Context) (int, time.Duration, error) {
+			var err error
+			ids, err = page(ctx)
+			return len(ids), 0, err
+		}, s.timeout)
+		if err != nil {
+			return s.queryError(ctx, db, "list members", rule, ruleText, err)
+		}
+		s.metrics.observe(ctx, model, "members", rule, time.Since(start), len(ids))
+		if len(ids) == 0 {
+			s.metrics.evaluated("grpc", rule, "")
+			return nil
+		}
+		cursor = ids[len(ids)-1]
+		if err := stream.Send(&audiencev1.ListMembersResponse{UserIds: ids, Cursor: cursor}); err != nil {
+			return err
+		}
+		if len(ids) < batch {
+			s.metrics.evaluated("grpc", rule, "")
+			return nil
+		}
+	}
+}
+
+// Whether a stored audience has a materialization fresh enough to answer for
+// rule; a failed lookup leaves the request to the live query
+func (s *audienceServer) materializationFresh(ctx context.Context, db *sql.DB, audienceID int64, rule string) bool {
+	if audienceID == 0 || s.maxAge <= 0 {
+		return false
+	}
+	queryCtx, cancel := bench.QueryContext(ctx, s.timeout)
+	defer cancel()
+	m, err := store.LoadMaterialization(queryCtx, db, audienceID)
+	return err == nil && m.Fresh(rule, s.maxAge)
+}
+
+// Same classification as the HTTP API, as gRPC codes
+func (s *audienceServer) queryError(ctx context.Context, db *sql.DB, op string, parsed *rules.Rule, rule string, err error) error {
+	code := codes.Internal
+	httpStatus := queryErrorStatus(ctx, db, err)
+	s.metrics.evaluated("grpc", parsed, queryErrorReason(httpStatus))
+	switch httpStatus {
+	case http.StatusGatewayTimeout:
+		code = codes.DeadlineExceeded
+	case http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	}
+	slog.WarnContext(ctx, op+" query failed", "rule", rule, "rule_hash", parsed.Hash(), "code", code, "err", err)
+	return status.Error(code, code.String())
+}
+
+// Serve AudienceService and the gRPC health service on addr until ctx is done, then drain
+func serveGRPC(ctx context.Context, route *store.Router, addr string, timeout time.Duration, retry *bench.Retry, cache *countCache, maxAge time.Duration, m *apiMetrics, sd *shutdown, clients *clientAuth, tenants *tenantAuth) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("gRPC server: %w", err)
+	}
+	srv := grpc.NewServer(grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		grpc.ChainUnaryInterceptor(requestLogUnary, clients.unary, tenants.unary),
+		grpc.ChainStreamInterceptor(requestLogStream, clients.stream, tenants.stream))
+	audiencev1.RegisterAudienceServiceServer(srv, &audienceServer{route: route, timeout: timeout, retry: retry, metrics: m, cache: cache, maxAge: maxAge})
+	// Readiness of the process, like /readyz while draining: SERVING until shutdown
+	// starts, then NOT_SERVING. The database is not checked, unlike /readyz.
+	hs := health.NewServer()
+	healthpb.RegisterHealthServer(srv, hs)
+	go func() {
+		select {
+		case <-sd.draining:
+			hs.Shutdown()
+		case <-ctx.Done():
+		}
+	}()
+
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- srv.Serve(lis) }()
+	slog.Info("serving gRPC AudienceService", "addr", addr)
+
+	select {
+	case <-ctx.Done():
+		// Same grace as the HTTP server, then cancel open calls and member streams
+		start := time.Now()
+		stopped := make(chan struct{})
+		go func() { srv.GracefulStop(); close(stopped) }()
+		select {
+		case <-stopped:
+			slog.Info("gRPC server drained", "duration", time.Since(start).Round(time.Millisecond))
+		case <-time.After(sd.timeout):
+			slog.Warn("gRPC calls still running at --shutdown-timeout, cancelling them", "timeout", sd.timeout)
+			srv.Stop()
+		}
+		return nil
+	case err := <-serveErr:
+		return fmt.Errorf("gRPC server: %w", err)
+	}
+}
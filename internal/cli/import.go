@@ -0,0 +1,137 @@
+package cli
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"audience-poc/internal/store"
+)
+
+// --format implied by the file extension
+func listFormatFor(path string) (string, bool) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv", ".txt":
+		return store.ListCSV, true
+	case ".ndjson", ".jsonl", ".json":
+		return store.ListNDJSON, true
+	}
+	return "", false
+}
+
+func newImportCmd(cfg *Config) *cobra.Command {
+	var name, format, column string
+	cmd := &cobra.Command{
+		Use:   "import FILE",
+		Short: "Load a CSV or NDJSON file of user ids into a static list rules reference as IN AUDIENCE('name') (PostgreSQL only)",
+		Long: `Load the user ids in FILE, e.g. a customer list from a DMP, into --list with COPY,
+replacing the list's members if it exists. Ids that are no user of the tenant are
+dropped. Rules then combine the list with profile predicates:
+
+  country = 'US' AND IN AUDIENCE('crm-q3') AND NOT has_purchased = true`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := requirePostgres(cfg, "import"); err != nil {
+				return err
+			}
+			if format == "" {
+				var ok bool
+				if format, ok = listFormatFor(args[0]); !ok {
+					return fmt.Errorf("cannot tell the format of %s from its extension, set --format csv or ndjson", args[0])
+				}
+			}
+			ctx := cmd.Context()
+			db, err := connectAudiences(ctx, cfg)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+			res, err := store.ImportList(ctx, db, name, args[0], format, column)
+			if err != nil {
+				return fmt.Errorf("failed to import %s into list %s: %w", args[0], name, err)
+			}
+			clearCachedCounts(ctx, cfg)
+			fmt.Fprintf(summaryOut, "📥 Imported %d members into list %s in %v (%d ids read, %d match no user, %d materializations stale)\n",
+				res.List.Members, res.List.Name, res.Duration.Round(time.Millisecond), res.Rows, res.Unknown, res.Stale)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&name, "list", "", "name rules refer to the list by, e.g. crm-q3 (required)")
+	cmd.MarkFlagRequired("list")
+	cmd.Flags().StringVar(&format, "format", "", "csv or ndjson (default: from the file extension)")
+	cmd.Flags().StringVar(&column, "column", "user_id", "CSV column or NDJSON field holding the user id")
+	bindListRedisFlag(cmd, cfg)
+	bindTenantFlag(cmd.Flags(), cfg)
+	return cmd
+}
+
+func bindListRedisFlag(cmd *cobra.Command, cfg *Config) {
+	cmd.Flags().StringVar(&cfg.RedisAddr, "redis", "", "Redis of serve's count cache, cleared once the list changed (empty disables it)")
+}
+
+// CLI: audiences lists list/delete
+
+func newListsCmd(cfg *Config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "lists",
+		Short: "Show and delete the static lists `import` loaded",
+		Args:  cobra.NoArgs,
+	}
+	cmd.AddCommand(newListListCmd(cfg), newListDeleteCmd(cfg))
+	return cmd
+}
+
+func newListListCmd(cfg *Config) *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "List imported lists",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			db, err := connectAudiences(ctx, cfg)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+			lists, err := store.ListLists(ctx, db)
+			if err != nil {
+				return fmt.Errorf("failed to list imported lists: %w", err)
+			}
+			tw := tabwriter.NewWriter(summaryOut, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(tw, "NAME\tTENANT\tMEMBERS\tIMPORTED\tSOURCE")
+			for _, l := range lists {
+				fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", l.Name, l.Tenant, l.Members, l.ImportedAt.Format(time.DateTime), l.Source)
+			}
+			return tw.Flush()
+		},
+	}
+}
+
+func newListDeleteCmd(cfg *Config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "delete NAME",
+		Short: "Delete an imported list; rules referencing it match no one",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			db, err := connectAudiences(ctx, cfg)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+			stale, err := store.DeleteList(ctx, db, args[0])
+			if err != nil {
+				return fmt.Errorf("failed to delete list %s: %w", args[0], err)
+			}
+			clearCachedCounts(ctx, cfg)
+			fmt.Fprintf(summaryOut, "🗑️  Deleted list %s, %d materializations stale\n", args[0], stale)
+			return nil
+		},
+	}
+	bindListRedisFlag(cmd, cfg)
+	return cmd
+}
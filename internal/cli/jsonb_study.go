@@ -0,0 +1,144 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"audience-poc/internal/bench"
+	"audience-poc/internal/rules"
+	"audience-poc/internal/store"
+)
+
+// One way of indexing the audience attributes
+type jsonbStrategy struct {
+	name        string
+	table       string
+	indexDDL    []string
+	indexSize   string // returns the total size in bytes of the strategy's indexes
+	equality    string // attributes->>'country' = 'US' (or the column equivalent)
+	containment string // attributes @> '{"country":"US"}' (or the column equivalent)
+}
+
+var jsonbStrategies = []jsonbStrategy{
+	{
+		name:        "Columns (btree)",
+		table:       "user_profiles",
+		indexSize:   `SELECT COALESCE(SUM(pg_relation_size(relid)), 0) FROM pg_partition_tree('idx_country')`,
+		equality:    `SELECT COUNT(*) FROM user_profiles WHERE country = 'US'`,
+		containment: `SELECT COUNT(*) FROM user_profiles WHERE country = 'US'`,
+	},
+	{
+		name:  "JSONB ->> expression",
+		table: "user_profiles_jsonb_expr",
+		indexDDL: []string{
+			`CREATE INDEX idx_jsonb_expr_country ON user_profiles_jsonb_expr ((attributes->>'country'))`,
+			`CREATE INDEX idx_jsonb_expr_tier ON user_profiles_jsonb_expr ((attributes->>'tier'))`,
+		},
+		indexSize: `SELECT COALESCE(SUM(pg_relation_size(indexrelid)), 0) FROM pg_index
+			WHERE indrelid = 'user_profiles_jsonb_expr'::regclass AND NOT indisprimary`,
+		equality:    `SELECT COUNT(*) FROM user_profiles_jsonb_expr WHERE attributes->>'country' = 'US'`,
+		containment: `SELECT COUNT(*) FROM user_profiles_jsonb_expr WHERE attributes @> '{"country":"US"}'`,
+	},
+	{
+		name:  "JSONB GIN jsonb_path_ops",
+		table: "user_profiles_jsonb_gin",
+		indexDDL: []string{
+			`CREATE INDEX idx_jsonb_gin_attributes ON user_profiles_jsonb_gin USING GIN (attributes jsonb_path_ops)`,
+		},
+		indexSize: `SELECT COALESCE(SUM(pg_relation_size(indexrelid)), 0) FROM pg_index
+			WHERE indrelid = 'user_profiles_jsonb_gin'::regclass AND NOT indisprimary`,
+		equality:    `SELECT COUNT(*) FROM user_profiles_jsonb_gin WHERE attributes->>'country' = 'US'`,
+		containment: `SELECT COUNT(*) FROM user_profiles_jsonb_gin WHERE attributes @> '{"country":"US"}'`,
+	},
+}
+
+// (Re)create a JSONB study table from the current user_profiles data
+func setupJSONBStrategy(ctx context.Context, db *sql.DB, s jsonbStrategy) error {
+	if s.table == "user_profiles" {
+		return nil
+	}
+	statements := []string{
+		"DROP TABLE IF EXISTS " + s.table,
+		"CREATE TABLE " + s.table + " AS " + store.JSONBProjection(rules.AllAttributes()),
+		"ALTER TABLE " + s.table + " ADD PRIMARY KEY (user_id)",
+	}
+	statements = append(statements, s.indexDDL...)
+	statements = append(statements, "ANALYZE "+s.table)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// Copying and indexing a large table can outlast the per-query statement timeout
+	if err := store.UnboundedStatements(ctx, tx); err != nil {
+		return err
+	}
+	for _, q := range statements {
+		if _, err := tx.ExecContext(ctx, q); err != nil {
+			return fmt.Errorf("%s: %w", s.name, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// Compare JSONB indexing strategies against the denormalized columns
+func jsonbStudy(ctx context.Context, db *sql.DB, timeout time.Duration) error {
+	fmt.Fprintln(out, "\n📊 JSONB study: ->> expression vs GIN jsonb_path_ops vs columns (country = 'US')")
+	fmt.Fprintln(out, strings.Repeat("-", 50))
+	fmt.Fprintf(out, "%-26s %10s %14s %14s\n", "Strategy", "Index size", "Equality", "Containment")
+
+	var baseline time.Duration
+	for _, s := range jsonbStrategies {
+		if err := setupJSONBStrategy(ctx, db, s); err != nil {
+			return err
+		}
+
+		var indexBytes int64
+		if err := db.QueryRowContext(ctx, s.indexSize).Scan(&indexBytes); err != nil {
+			return fmt.Errorf("%s index size: %w", s.name, err)
+		}
+		eqCount, eqDuration, err := bench.RunWithTimeout(ctx, countQuery(db, s.equality), timeout)
+		if err != nil {
+			return fmt.Errorf("%s equality query: %w", s.name, err)
+		}
+		containsCount, containsDuration, err := bench.RunWithTimeout(ctx, countQuery(db, s.containment), timeout)
+		if err != nil {
+			return fmt.Errorf("%s containment query: %w", s.name, err)
+		}
+		if eqCount != containsCount {
+			fmt.Fprintf(out, "⚠️  %s: equality matched %d users, containment %d\n", s.name, eqCount, containsCount)
+		}
+
+		fmt.Fprintf(out, "%-26s %10s %14v %14v\n", s.name, formatBytes(indexBytes), eqDuration, containsDuration)
+		if baseline == 0 {
+			baseline = eqDuration
+		} else if baseline > 0 {
+			fmt.Fprintf(out, "   vs columns: equality %.1fx, containment %.1fx slower\n",
+				float64(eqDuration)/float64(baseline), float64(containsDuration)/float64(baseline))
+		}
+	}
+	return nil
+}
+
+func countQuery(db *sql.DB, query string) bench.QueryFunc {
+	return func(ctx context.Context) (int, time.Duration, error) {
+		return store.TimeCount(ctx, db, query)
+	}
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,69 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"audience-poc/internal/store"
+)
+
+// Annotation of the commands that run as services (serve): they log JSON
+// unless --log-format says otherwise
+const serviceAnnotation = "service"
+
+// --log-format, or json for a service left at the default
+func logFormat(cmd *cobra.Command, format string) string {
+	if format == "" && cmd.Annotations[serviceAnnotation] != "" {
+		return "json"
+	}
+	return format
+}
+
+// Route diagnostics through slog. Plain keeps the standard log output
+// ("2006/01/02 15:04:05 WARN msg key=value"); text and json switch to
+// structured handlers for log aggregators, which also add the request ID and
+// tenant of the request a line was logged for. Everything goes to stderr.
+func configureLogging(level, format string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid --log-level %q, expected debug, info, warn or error", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch format {
+	case "", "plain":
+		slog.SetLogLoggerLevel(lvl)
+	case "text":
+		slog.SetDefault(slog.New(contextHandler{slog.NewTextHandler(os.Stderr, opts)}))
+	case "json":
+		slog.SetDefault(slog.New(contextHandler{slog.NewJSONHandler(os.Stderr, opts)}))
+	default:
+		return fmt.Errorf("unknown --log-format %q, expected plain, text or json", format)
+	}
+	return nil
+}
+
+// Adds the request_id and tenant of the context a line is logged with. The
+// plain format can't take it: the standard log output would loop back into slog.
+type contextHandler struct{ slog.Handler }
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id, ok := requestIDFrom(ctx); ok {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if tenant, ok := store.TenantFrom(ctx); ok {
+		r.AddAttrs(slog.String("tenant", tenant))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
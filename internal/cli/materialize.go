@@ -0,0 +1,263 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"audience-poc/internal/bench"
+	"audience-poc/internal/store"
+)
+
+// Count a stored audience from its materialization when that is fresh, and
+// with live otherwise; hit reports which one answered
+func materializedCount(db store.Querier, id int64, rule string, maxAge time.Duration, live bench.QueryFunc, hit *bool) bench.QueryFunc {
+	return func(ctx context.Context) (int, time.Duration, error) {
+		start := time.Now()
+		m, err := store.LoadMaterialization(ctx, db, id)
+		switch {
+		case err == nil && m.Fresh(rule, maxAge):
+			*hit = true
+			return int(m.Members), time.Since(start), nil
+		case err != nil && !errors.Is(err, store.ErrNotMaterialized):
+			return 0, 0, err
+		}
+		*hit = false
+		return live(ctx)
+	}
+}
+
+// CLI: audiences materialize/refresh/dematerialize
+
+func newAudienceMaterializeCmd(cfg *Config) *cobra.Command {
+	return &cobra.Command{
+		Use:   "materialize ID",
+		Short: "Precompute the members of a stored audience, so serve can answer from them",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			id, err := parseAudienceID(args[0])
+			if err != nil {
+				return err
+			}
+			ctx := cmd.Context()
+			db, err := connectAudiences(ctx, cfg)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+			m, err := store.RefreshMaterialization(ctx, db, id, false)
+			if err != nil {
+				return fmt.Errorf("failed to materialize audience %d: %w", id, err)
+			}
+			fmt.Fprintf(out, "🧊 Materialized audience %d: %d members in %v\n", id, m.Members, m.Duration.Round(time.Millisecond))
+			return nil
+		},
+	}
+}
+
+func newAudienceRefreshCmd(cfg *Config) *cobra.Command {
+	var concurrently bool
+	var every time.Duration
+	cmd := &cobra.Command{
+		Use:   "refresh [ID...]",
+		Short: "Recompute materialized audiences, all of them unless ids are given",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if every < 0 {
+				return errors.New("--every must not be negative")
+			}
+			ids := make([]int64, len(args))
+			for i, arg := range args {
+				id, err := parseAudienceID(arg)
+				if err != nil {
+					return err
+				}
+				ids[i] = id
+			}
+			ctx := cmd.Context()
+			db, err := connectAudiences(ctx, cfg)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+			for {
+				if err := refreshMaterializations(ctx, db, ids, concurrently, cfg.QueryTimeout); err != nil {
+					if every == 0 || ctx.Err() != nil {
+						return err
+					}
+					// A failed round is logged, the schedule carries on
+					slog.Error("refresh round failed", "err", err)
+				}
+				if every == 0 {
+					return nil
+				}
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-time.After(every):
+				}
+			}
+		},
+	}
+	cmd.Flags().BoolVar(&concurrently, "concurrently", false, "write only the members who joined or left instead of rewriting them all")
+	cmd.Flags().DurationVar(&every, "every", 0, "keep refreshing at this interval (0 refreshes once and exits)")
+	return cmd
+}
+
+// Refresh ids, or every materialized audience when there are none, and print
+// the outcome; an audience that fails is reported and the others carry on
+func refreshMaterializations(ctx context.Context, db *sql.DB, ids []int64, concurrently bool, timeout time.Duration) error {
+	if len(ids) == 0 {
+		listCtx, cancel := bench.QueryContext(ctx, timeout)
+		ms, err := store.ListMaterializations(listCtx, db)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to list materializations: %w", err)
+		}
+		for _, m := range ms {
+			ids = append(ids, m.AudienceID)
+		}
+	}
+
+	var failed []string
+	tw := tabwriter.NewWriter(summaryOut, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tMEMBERS\tWRITTEN\tDURATION")
+	for _, id := range ids {
+		m, err := store.RefreshMaterialization(ctx, db, id, concurrently)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("audience %d: %v", id, err))
+			continue
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%v\n", id, m.Members, m.Written, m.Duration.Round(time.Millisecond))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func newAudienceDematerializeCmd(cfg *Config) *cobra.Command {
+	return &cobra.Command{
+		Use:   "dematerialize ID",
+		Short: "Drop the precomputed members of a stored audience",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			id, err := parseAudienceID(args[0])
+			if err != nil {
+				return err
+			}
+			ctx := cmd.Context()
+			db, err := connectAudiences(ctx, cfg)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+			if err := store.DropMaterialization(ctx, db, id); err != nil {
+				return fmt.Errorf("failed to dematerialize audience %d: %w", id, err)
+			}
+			fmt.Fprintf(out, "🗑️  Dropped the materialization of audience %d\n", id)
+			return nil
+		},
+	}
+}
+
+// Benchmark: live counts against materialized ones
+
+type materializeTiming struct {
+	live, read        bench.Stats
+	plain, concurrent time.Duration
+	liveCount         int
+	members           int64
+}
+
+// Prefix of the scratch audiences the benchmark materializes and deletes
+const materializeBenchPrefix = "bench_materialize_"
+
+// Materialize each rule as a scratch audience and compare reading it with a
+// live count, against what a refresh costs. The concurrent refresh follows the
+// plain one with no data change in between, so it shows the cost of the diff
+// alone; real churn adds its writes on top.
+func materializeBenchmark(ctx context.Context, db *sql.DB, cases []benchCase, opts bench.Options) error {
+	fmt.Fprintln(out, "\n📊 Materialized audiences (median latency)")
+	fmt.Fprintln(out, strings.Repeat("-", 50))
+	if err := store.EnsureSchema(ctx, db); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "%-14s %12s %12s %12s %14s %12s\n", "Test", "Live", "Materialized", "REFRESH", "CONCURRENTLY", "Break-even")
+	var failed []string
+	for _, c := range cases {
+		t, err := materializeCase(ctx, db, c, opts)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", c.name, err))
+			continue
+		}
+		// Reads per refresh for the refresh to cost less than counting live each time
+		breakEven := "never"
+		if saved := t.live.Median - t.read.Median; saved > 0 {
+			breakEven = fmt.Sprintf("%.0f reads", math.Ceil(float64(t.concurrent)/float64(saved)))
+		}
+		fmt.Fprintf(out, "%-14s %12v %12v %12v %14v %12s\n", c.name,
+			t.live.Median, t.read.Median, t.plain.Round(time.Millisecond), t.concurrent.Round(time.Millisecond), breakEven)
+		if t.liveCount != int(t.members) {
+			fmt.Fprintf(out, "⚠️  %s: live and materialized disagree on the count: %d vs %d\n", c.name, t.liveCount, t.members)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func materializeCase(ctx context.Context, db *sql.DB, c benchCase, opts bench.Options) (materializeTiming, error) {
+	var t materializeTiming
+	a, err := store.CreateAudience(ctx, db, store.AudienceSpec{Name: materializeBenchPrefix + c.name, Rule: c.rule, Owner: "bench"})
+	if err != nil {
+		return t, fmt.Errorf("create scratch audience: %w", err)
+	}
+	// Drops the materialization with it
+	defer func() {
+		if err := store.DeleteAudience(context.WithoutCancel(ctx), db, a.ID); err != nil {
+			slog.Warn("failed to delete scratch audience", "audience_id", a.ID, "err", err)
+		}
+	}()
+
+	m, err := store.RefreshMaterialization(ctx, db, a.ID, false)
+	if err != nil {
+		return t, err
+	}
+	t.plain, t.members = m.Duration, m.Members
+	if m, err = store.RefreshMaterialization(ctx, db, a.ID, true); err != nil {
+		return t, err
+	}
+	t.concurrent = m.Duration
+
+	live := bench.Run(ctx, optimizedCount(db, c.rule), opts)
+	if live.Err != nil {
+		return t, fmt.Errorf("live count: %w", live.Err)
+	}
+	var hit bool
+	read := bench.Run(ctx, materializedCount(db, a.ID, c.rule, time.Duration(math.MaxInt64), optimizedCount(db, c.rule), &hit), opts)
+	switch {
+	case read.Err != nil:
+		return t, fmt.Errorf("materialized count: %w", read.Err)
+	case !hit:
+		return t, errors.New("the materialization was not used")
+	}
+	t.live, t.read, t.liveCount = live.Stats, read.Stats, live.Count
+	return t, nil
+}
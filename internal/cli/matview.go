@@ -0,0 +1,187 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"audience-poc/internal/bench"
+	"audience-poc/internal/rules"
+	"audience-poc/internal/store"
+)
+
+// Scratch copy refreshed at each size, so readers of the real view are never blocked
+const matviewScratch = "matview_refresh_bench"
+
+// Optionally schema-qualified; inlined into DDL, so nothing else is accepted
+var relationName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+var relationKinds = map[string]string{
+	"r": "plain table",
+	"p": "partitioned table",
+	"v": "view",
+	"f": "foreign table",
+}
+
+type refreshTiming struct {
+	users int
+	// Refresh duration and the slowest read issued while it ran
+	plain, plainRead           time.Duration
+	concurrent, concurrentRead time.Duration
+}
+
+// Benchmark REFRESH MATERIALIZED VIEW, plain and CONCURRENTLY, as the dataset grows
+func matviewBenchmark(ctx context.Context, db *sql.DB, name string, userCount int, interval, timeout time.Duration) error {
+	fmt.Fprintf(out, "\n📊 Materialized view refresh: %s\n", name)
+	fmt.Fprintln(out, strings.Repeat("-", 50))
+
+	var kind string
+	err := db.QueryRowContext(ctx, `SELECT relkind::text FROM pg_class WHERE oid = to_regclass($1)`, name).Scan(&kind)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		if err := createProfilesMatview(ctx, db, name); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "🆕 Created %s from user_attributes\n", name)
+	case err != nil:
+		return fmt.Errorf("look up %s: %w", name, err)
+	case kind != "m":
+		what := relationKinds[kind]
+		if what == "" {
+			what = "relation of kind " + kind
+		}
+		fmt.Fprintf(out, "⏭️  %s is a %s, not a materialized view: nothing to refresh, skipping\n", name, what)
+		return nil
+	}
+
+	var definition string
+	if err := db.QueryRowContext(ctx, `SELECT pg_get_viewdef(to_regclass($1))`, name).Scan(&definition); err != nil {
+		return fmt.Errorf("read definition of %s: %w", name, err)
+	}
+	definition = strings.TrimSuffix(strings.TrimSpace(definition), ";")
+
+	sizes, cutoffs, err := sizeCutoffs(ctx, db, userCount)
+	if err != nil {
+		return err
+	}
+	if len(sizes) == 0 {
+		return fmt.Errorf("need at least 1000 users, have %d", userCount)
+	}
+	defer db.ExecContext(context.Background(), `DROP MATERIALIZED VIEW IF EXISTS `+matviewScratch)
+
+	var timings []refreshTiming
+	for i, cutoff := range cutoffs {
+		t, err := refreshAtSize(ctx, db, definition, cutoff, timeout)
+		if err != nil {
+			return fmt.Errorf("%d users: %w", int(sizes[i]), err)
+		}
+		t.users = int(sizes[i])
+		timings = append(timings, t)
+	}
+	printRefreshTimings(timings, interval)
+	return nil
+}
+
+func createProfilesMatview(ctx context.Context, db *sql.DB, name string) error {
+	err := execUnbounded(ctx, db,
+		`CREATE MATERIALIZED VIEW `+name+` AS `+store.ProfilesProjection(rules.AllAttributes()),
+		// REFRESH ... CONCURRENTLY needs a unique index
+		`CREATE UNIQUE INDEX ON `+name+` (user_id)`,
+	)
+	if err != nil {
+		return fmt.Errorf("create %s: %w", name, err)
+	}
+	return nil
+}
+
+// Run setup statements in one transaction without the per-query statement timeout
+func execUnbounded(ctx context.Context, db *sql.DB, statements ...string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := store.UnboundedStatements(ctx, tx); err != nil {
+		return err
+	}
+	for _, q := range statements {
+		if _, err := tx.ExecContext(ctx, q); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Rebuild the scratch view over users up to cutoff and time both refresh modes on it
+func refreshAtSize(ctx context.Context, db *sql.DB, definition string, cutoff int64, timeout time.Duration) (refreshTiming, error) {
+	var t refreshTiming
+	err := execUnbounded(ctx, db,
+		`DROP MATERIALIZED VIEW IF EXISTS `+matviewScratch,
+		fmt.Sprintf(`CREATE MATERIALIZED VIEW %s AS SELECT * FROM (%s) v WHERE v.user_id <= %d`, matviewScratch, definition, cutoff),
+		`CREATE UNIQUE INDEX ON `+matviewScratch+` (user_id)`,
+		`ANALYZE `+matviewScratch,
+	)
+	if err != nil {
+		return t, err
+	}
+
+	if t.plain, t.plainRead, err = timedRefresh(ctx, db, `REFRESH MATERIALIZED VIEW `+matviewScratch, timeout); err != nil {
+		return t, err
+	}
+	if t.concurrent, t.concurrentRead, err = timedRefresh(ctx, db, `REFRESH MATERIALIZED VIEW CONCURRENTLY `+matviewScratch, timeout); err != nil {
+		return t, err
+	}
+	return t, nil
+}
+
+// Run a refresh while another connection keeps reading the view; a plain
+// refresh holds an exclusive lock, so those reads wait for it to finish
+func timedRefresh(ctx context.Context, db *sql.DB, stmt string, timeout time.Duration) (time.Duration, time.Duration, error) {
+	probeCtx, stopProbe := context.WithCancel(ctx)
+	probeDone := make(chan struct{})
+	var maxRead time.Duration
+	go func() {
+		defer close(probeDone)
+		for probeCtx.Err() == nil {
+			_, d, err := store.TimeCount(probeCtx, db, `SELECT COUNT(*) FROM (SELECT 1 FROM `+matviewScratch+` LIMIT 1) s`)
+			if err != nil {
+				return
+			}
+			maxRead = max(maxRead, d)
+		}
+	}()
+
+	runCtx, cancel := bench.QueryContext(ctx, timeout)
+	start := time.Now()
+	_, err := db.ExecContext(runCtx, stmt)
+	refresh := time.Since(start)
+	cancel()
+
+	stopProbe()
+	<-probeDone
+	return refresh, maxRead, err
+}
+
+func printRefreshTimings(timings []refreshTiming, interval time.Duration) {
+	fmt.Fprintf(out, "%10s %12s %14s %14s %14s\n", "Users", "REFRESH", "Read blocked", "CONCURRENTLY", "Read blocked")
+	for _, t := range timings {
+		fmt.Fprintf(out, "%10d %12v %14v %14v %14v\n", t.users,
+			t.plain.Round(time.Millisecond), t.plainRead.Round(time.Millisecond),
+			t.concurrent.Round(time.Millisecond), t.concurrentRead.Round(time.Millisecond))
+	}
+
+	// Reads see the snapshot taken when the last refresh started
+	last := timings[len(timings)-1]
+	fmt.Fprintf(out, "\nWorst-case staleness refreshing every %v: %v (CONCURRENTLY), %v (plain, reads blocked up to %v)\n",
+		interval, (interval + last.concurrent).Round(time.Millisecond),
+		(interval + last.plain).Round(time.Millisecond), last.plainRead.Round(time.Millisecond))
+	if last.users < extrapolationTarget {
+		// A refresh rewrites every row, so it scales linearly with the dataset
+		projected := time.Duration(float64(last.concurrent) / float64(last.users) * extrapolationTarget)
+		fmt.Fprintf(out, "CONCURRENTLY at %dM users (linear): ~%v\n", extrapolationTarget/1000000, projected.Round(time.Second))
+	}
+}
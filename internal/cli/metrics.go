@@ -0,0 +1,117 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"audience-poc/internal/bench"
+	"audience-poc/internal/store"
+)
+
+// 5ms .. ~20s: the optimized model sits in the low milliseconds, EAV in seconds
+var durationBuckets = prometheus.ExponentialBuckets(0.005, 2, 13)
+
+type benchMetrics struct {
+	duration *prometheus.HistogramVec
+	count    *prometheus.GaugeVec
+	failures *prometheus.CounterVec
+}
+
+func newBenchMetrics(reg prometheus.Registerer) *benchMetrics {
+	m := &benchMetrics{
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "audience_query_duration_seconds",
+			Help:    "Execution time of audience count queries.",
+			Buckets: durationBuckets,
+		}, []string{"model", "test"}),
+		count: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "audience_query_result_count",
+			Help: "Users matched by the last successful run of each audience query.",
+		}, []string{"model", "test"}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "audience_query_failures_total",
+			Help: "Audience count queries that failed or timed out.",
+		}, []string{"model", "test"}),
+	}
+	reg.MustRegister(m.duration, m.count, m.failures)
+	return m
+}
+
+// Record every successful run of fn in the duration histogram
+func (m *benchMetrics) observed(fn bench.QueryFunc, model, test string) bench.QueryFunc {
+	hist := m.duration.WithLabelValues(model, test)
+	return func(ctx context.Context) (int, time.Duration, error) {
+		count, duration, err := fn(ctx)
+		if err == nil {
+			hist.Observe(duration.Seconds())
+		}
+		return count, duration, err
+	}
+}
+
+// One pass over the cases for both models
+func (m *benchMetrics) collect(ctx context.Context, db store.Querier, cases []benchCase, opts bench.Options) {
+	for _, c := range cases {
+		type modelQuery struct {
+			name string
+			fn   bench.QueryFunc
+		}
+		models := []modelQuery{{"optimized", optimizedCount(db, c.rule)}}
+		if c.withEAV {
+			models = append(models, modelQuery{"eav", eavCount(db, c.rule)})
+		}
+		for _, model := range models {
+			r := bench.Run(c.scope(ctx), m.observed(model.fn, model.name, c.name), opts)
+			if r.Err != nil {
+				m.failures.WithLabelValues(model.name, c.name).Inc()
+				slog.Warn("query failed", "test", c.name, "model", model.name, "rule", c.rule, "err", r.Err)
+				continue
+			}
+			m.count.WithLabelValues(model.name, c.name).Set(float64(r.Count))
+		}
+	}
+}
+
+// Re-run the benchmark every interval and expose the results on addr/metrics until ctx is done
+func serveMetrics(ctx context.Context, db store.Querier, addr string, interval time.Duration, cases []benchCase, opts bench.Options) error {
+	reg := prometheus.NewRegistry()
+	m := newBenchMetrics(reg)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- srv.ListenAndServe() }()
+	fmt.Fprintf(out, "📡 Serving metrics on %s/metrics, benchmarking every %v\n", addr, interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		start := time.Now()
+		m.collect(ctx, db, cases, opts)
+		if ctx.Err() == nil {
+			slog.Info("benchmark round finished", "duration", time.Since(start).Round(time.Millisecond))
+		}
+
+		select {
+		case <-ctx.Done():
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			return srv.Shutdown(shutdownCtx)
+		case err := <-serveErr:
+			if errors.Is(err, http.ErrServerClosed) {
+				return nil
+			}
+			return fmt.Errorf("metrics server: %w", err)
+		case <-ticker.C:
+		}
+	}
+}
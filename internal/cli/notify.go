@@ -0,0 +1,239 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/redis/go-redis/v9"
+
+	"audience-poc/internal/store"
+)
+
+// Header carrying the hex HMAC-SHA256 of a webhook body, with --webhook-secret-file
+const signatureHeader = "X-Audience-Signature"
+
+// Body of a trigger notification, the same on a webhook, Redis and NATS. The id
+// is the same on every delivery attempt, so receivers can drop duplicates.
+type triggerEvent struct {
+	ID            string    `json:"id"`
+	Event         string    `json:"event"`
+	TriggerID     int64     `json:"trigger_id"`
+	AudienceID    int64     `json:"audience_id"`
+	Audience      string    `json:"audience"`
+	Tenant        string    `json:"tenant"`
+	Condition     string    `json:"condition"`
+	Threshold     float64   `json:"threshold"`
+	PreviousUsers int64     `json:"previous_users"`
+	Users         int64     `json:"users"`
+	ChangePercent *float64  `json:"change_percent"` // null when the previous size was 0
+	TakenAt       time.Time `json:"taken_at"`
+}
+
+func newTriggerEvent(t store.Trigger, a store.Audience, previous, users int64, takenAt time.Time) triggerEvent {
+	e := triggerEvent{
+		ID:            fmt.Sprintf("%d-%d", t.ID, takenAt.UnixMilli()),
+		Event:         "audience.trigger",
+		TriggerID:     t.ID,
+		AudienceID:    a.ID,
+		Audience:      a.Name,
+		Tenant:        a.Tenant,
+		Condition:     t.Condition,
+		Threshold:     t.Threshold,
+		PreviousUsers: previous,
+		Users:         users,
+		TakenAt:       takenAt,
+	}
+	if previous > 0 {
+		change := float64(users-previous) / float64(previous) * 100
+		e.ChangePercent = &change
+	}
+	return e
+}
+
+// Delivers trigger events: POSTs to allowed webhooks, retried with a doubling
+// wait on network errors, 408, 429 and 5xx, PUBLISH on the tenant's Redis
+// channels, or a JetStream publish on the tenant's NATS subjects. Redis drops
+// an event no one is subscribed to; JetStream acknowledges it once stored, and
+// is retried like a webhook until it does, with the event id as the message
+// id so the stream drops a retry it already has. Targets are checked again
+// here, since triggers stored before the allowlist changed may point anywhere.
+type notifier struct {
+	client   *http.Client
+	rdb      *redis.Client       // nil without --redis
+	js       jetstream.JetStream // nil without --nats
+	secret   []byte              // nil for unsigned webhooks
+	attempts int
+	backoff  time.Duration
+	targets  store.TriggerTargets
+}
+
+type notifyOptions struct {
+	secretFile string
+	timeout    time.Duration
+	attempts   int
+	allow      []string // --trigger-webhook-allow
+}
+
+func newNotifier(opts notifyOptions, rdb *redis.Client, js jetstream.JetStream) (*notifier, error) {
+	if opts.timeout <= 0 || opts.attempts < 1 {
+		return nil, errors.New("--webhook-timeout must be positive and --webhook-attempts at least 1")
+	}
+	targets, err := store.ParseTriggerTargets(opts.allow)
+	if err != nil {
+		return nil, fmt.Errorf("--trigger-webhook-allow: %w", err)
+	}
+	client := &http.Client{
+		Timeout: opts.timeout,
+		// A redirect could lead anywhere the allowlist doesn't; it is reported as its status instead
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	n := &notifier{client: client, rdb: rdb, js: js, attempts: opts.attempts, backoff: time.Second, targets: targets}
+	if opts.secretFile != "" {
+		raw, err := os.ReadFile(opts.secretFile)
+		if err != nil {
+			return nil, fmt.Errorf("--webhook-secret-file: %w", err)
+		}
+		n.secret = []byte(strings.TrimSpace(string(raw)))
+		if len(n.secret) == 0 {
+			return nil, fmt.Errorf("--webhook-secret-file %s is empty", opts.secretFile)
+		}
+	}
+	return n, nil
+}
+
+// Deliver an event for each of the audience's triggers its new size fires.
+// A delivery that fails is logged and not tried again on the next round, which
+// compares against the snapshot just recorded.
+func fireTriggers(ctx context.Context, n *notifier, triggers []store.Trigger, a store.Audience, previous, users int64, takenAt time.Time) (sent, failed int) {
+	for _, t := range triggers {
+		if !t.Fires(previous, users) {
+			continue
+		}
+		if err := n.notify(ctx, t.Target, newTriggerEvent(t, a, previous, users, takenAt)); err != nil {
+			failed++
+			slog.WarnContext(ctx, "trigger notification failed", "trigger_id", t.ID, "audience_id", a.ID, "err", err)
+			continue
+		}
+		sent++
+		slog.Info("trigger fired", "trigger_id", t.ID, "audience_id", a.ID, "condition", t.Condition,
+			"threshold", t.Threshold, "previous_users", previous, "users", users)
+	}
+	return sent, failed
+}
+
+// A webhook answer other than 2xx
+type webhookStatusError int
+
+func (e webhookStatusError) Error() string { return fmt.Sprintf("webhook answered %d", int(e)) }
+
+// The receiver may accept the event later; other 4xx won't change on a retry
+func retryableDelivery(err error) bool {
+	var status webhookStatusError
+	if !errors.As(err, &status) {
+		return true
+	}
+	return status == http.StatusRequestTimeout || status == http.StatusTooManyRequests || status >= 500
+}
+
+func (n *notifier) notify(ctx context.Context, target string, e triggerEvent) error {
+	if err := n.targets.Check(target); err != nil {
+		return err
+	}
+	scheme, dest, err := store.ParseTriggerTarget(target)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	deliver := func() error { return n.post(ctx, dest, body) }
+	switch scheme {
+	case "redis":
+		if n.rdb == nil {
+			return fmt.Errorf("%s needs --redis", target)
+		}
+		return n.rdb.Publish(ctx, store.TriggerChannel(e.Tenant, dest), body).Err()
+	case "nats":
+		if n.js == nil {
+			return fmt.Errorf("%s needs --nats", target)
+		}
+		deliver = func() error {
+			_, err := n.js.Publish(ctx, store.TriggerSubject(e.Tenant, dest), body, jetstream.WithMsgID(e.ID))
+			return err
+		}
+	}
+	wait := n.backoff
+	for attempt := 1; ; attempt++ {
+		err := deliver()
+		if err == nil || attempt == n.attempts || !retryableDelivery(err) {
+			return err
+		}
+		slog.WarnContext(ctx, "trigger delivery failed, retrying", "trigger_id", e.TriggerID, "scheme", scheme, "attempt", attempt, "wait", wait, "err", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+// Connect to the NATS server nats:SUBJECT triggers publish on. A stream has to
+// store the trigger subjects already, or no publish would ever be acknowledged.
+func connectTriggerNATS(ctx context.Context, url string, timeout time.Duration) (*nats.Conn, jetstream.JetStream, error) {
+	nc, err := nats.Connect(url, nats.Name("audience-poc snapshots"), nats.Timeout(timeout))
+	if err != nil {
+		return nil, nil, fmt.Errorf("--nats %s: %w", url, err)
+	}
+	js, err := jetstream.New(nc, jetstream.WithDefaultTimeout(timeout))
+	if err == nil {
+		_, err = js.StreamNameBySubject(ctx, store.TriggerSubjects+".>")
+	}
+	if err != nil {
+		nc.Close()
+		if errors.Is(err, jetstream.ErrStreamNotFound) {
+			return nil, nil, fmt.Errorf("--nats %s: no JetStream stream stores %s.> subjects", url, store.TriggerSubjects)
+		}
+		return nil, nil, fmt.Errorf("--nats %s: %w", url, err)
+	}
+	return nc, js, nil
+}
+
+func (n *notifier) post(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.secret != nil {
+		mac := hmac.New(sha256.New, n.secret)
+		mac.Write(body)
+		req.Header.Set(signatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	// Drained so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return webhookStatusError(resp.StatusCode)
+	}
+	return nil
+}
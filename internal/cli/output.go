@@ -0,0 +1,135 @@
+package cli
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"audience-poc/internal/bench"
+	"audience-poc/internal/store"
+)
+
+// attrs (e.g. "test", name, "rule", rule) are attached to the warning logged on failure
+func printBenchResult(label string, r bench.Result, attrs ...any) {
+	if r.TimedOut {
+		fmt.Fprintf(out, "%-17s ⏱️  timed out\n", label+":")
+		slog.Warn("query timed out", append([]any{"model", label}, attrs...)...)
+		return
+	}
+	if r.Err != nil {
+		slog.Warn("query failed", append([]any{"model", label, "err", r.Err}, attrs...)...)
+		return
+	}
+	s := r.Stats
+	var retried string
+	if r.Retries > 0 {
+		retried = fmt.Sprintf(", %d runs retried", r.Retries)
+	}
+	fmt.Fprintf(out, "%-17s %6d users, median %v (min %v, p95 %v, p99 %v, max %v, stddev %v%s)\n",
+		label+":", r.Count, s.Median, s.Min, s.P95, s.P99, s.Max, s.StdDev.Round(time.Microsecond), retried)
+}
+
+// Approximate count next to the exact one it stands in for
+func printEstimate(est store.Estimate, exact bench.Result) {
+	how := "planner estimate"
+	if est.Method == store.EstimateSample {
+		how = fmt.Sprintf("±%d, %s of %g%% of blocks", est.Margin, est.Method, est.SamplePercent)
+	}
+	line := fmt.Sprintf("%-17s ≈%d users (%s) in %v", "Estimate:", est.Count, how, est.Duration.Round(time.Microsecond))
+	if exact.Err == nil && exact.Count > 0 {
+		line += fmt.Sprintf(", %+.1f%% off the exact count", estimateError(est, exact.Count)*100)
+	}
+	fmt.Fprintln(out, line)
+}
+
+// Relative error of an estimate against the exact count
+func estimateError(est store.Estimate, exact int) float64 {
+	return float64(est.Count-int64(exact)) / float64(exact)
+}
+
+// Speedup of the optimized model over another one, by median latency, with its confidence
+func printSpeedup(label string, other, optimized bench.Result) {
+	if other.Err != nil || optimized.Err != nil {
+		return
+	}
+	if e, ok := bench.EstimateSpeedup(other.Samples, optimized.Samples); ok {
+		fmt.Fprintf(out, "⚡ %-15s %s\n", label+":", e)
+	}
+}
+
+func printLoadResult(model string, workload []workloadEntry, r bench.LoadResult) {
+	target := "closed loop"
+	if r.TargetQPS > 0 {
+		target = fmt.Sprintf("target %.0f qps", r.TargetQPS)
+	}
+	subject := workload[0].Rule
+	if len(workload) > 1 {
+		subject = fmt.Sprintf("%d-rule workload", len(workload))
+	}
+	fmt.Fprintf(out, "\n📊 Load test: %d workers, %s, %s model, %s\n", r.Workers, target, model, subject)
+	fmt.Fprintln(out, strings.Repeat("-", 50))
+	fmt.Fprintf(out, "Throughput:       %.1f queries/sec (%d queries in %v)\n",
+		r.Throughput(), r.Queries, r.Elapsed.Round(time.Millisecond))
+	if r.Dropped > 0 {
+		fmt.Fprintf(out, "⚠️  %d requests dropped: all workers busy, the target rate was not sustained\n", r.Dropped)
+	}
+	if r.Queries > 0 {
+		s := r.Stats
+		fmt.Fprintf(out, "Latency:          median %v (min %v, p95 %v, p99 %v, max %v, stddev %v)\n",
+			s.Median, s.Min, s.P95, s.P99, s.Max, s.StdDev.Round(time.Microsecond))
+		printHistogram(r.Histogram, r.Queries)
+	}
+	if len(r.PerQuery) > 1 {
+		for _, q := range r.PerQuery {
+			fmt.Fprintf(out, "   %-20s %6d queries, median %v, p95 %v", q.Name, q.Queries, q.Stats.Median, q.Stats.P95)
+			if q.Errors > 0 {
+				fmt.Fprintf(out, ", %d errors", q.Errors)
+			}
+			fmt.Fprintln(out)
+		}
+	}
+
+	poolLimit := "unlimited"
+	if r.MaxOpenConn > 0 {
+		poolLimit = fmt.Sprint(r.MaxOpenConn)
+	}
+	fmt.Fprintf(out, "Pool:             max %s open connections, peak %d in use, %d waits totalling %v\n",
+		poolLimit, r.PeakInUse, r.PoolWaits, r.PoolWaited.Round(time.Millisecond))
+	if r.MaxOpenConn > 0 && r.Saturation > 0 {
+		fmt.Fprintf(out, "Pool saturated:   %.0f%% of the time every connection was busy\n", 100*r.Saturation)
+	}
+	if r.MaxOpenConn > 0 && r.Workers > r.MaxOpenConn {
+		fmt.Fprintf(out, "⚠️  %d workers share %d connections, latency includes pool contention\n",
+			r.Workers, r.MaxOpenConn)
+	}
+
+	if r.ErrorCount > 0 {
+		fmt.Fprintf(out, "❌ Errors:         %d\n", r.ErrorCount)
+		messages := make([]string, 0, len(r.Errors))
+		for msg := range r.Errors {
+			messages = append(messages, msg)
+		}
+		sort.Slice(messages, func(i, j int) bool { return r.Errors[messages[i]] > r.Errors[messages[j]] })
+		for _, msg := range messages {
+			fmt.Fprintf(out, "   %6d × %s\n", r.Errors[msg], msg)
+		}
+	}
+}
+
+// Latency histogram as bars scaled to the fullest bucket
+func printHistogram(buckets []bench.HistogramBucket, total int) {
+	const width = 30
+	fullest := 0
+	for _, b := range buckets {
+		fullest = max(fullest, b.Count)
+	}
+	for _, b := range buckets {
+		bar := 0
+		if fullest > 0 {
+			bar = (b.Count*width + fullest - 1) / fullest
+		}
+		fmt.Fprintf(out, "   ≤ %-8v %-*s %6d (%4.1f%%)\n", b.UpperBound, width, strings.Repeat("█", bar), b.Count, 100*float64(b.Count)/float64(total))
+	}
+}
@@ -0,0 +1,250 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"audience-poc/internal/bench"
+	"audience-poc/internal/rules"
+	"audience-poc/internal/store"
+)
+
+// One audience of an overlap request: an inline rule or a stored audience
+type overlapInput struct {
+	Rule       string `json:"rule,omitempty"`
+	AudienceID int64  `json:"audience_id,omitempty"`
+}
+
+type overlapRequest struct {
+	Audiences []overlapInput `json:"audiences"`
+}
+
+type overlapAudience struct {
+	Label      string `json:"label"` // A, B, C, ...
+	AudienceID int64  `json:"audience_id,omitempty"`
+	Name       string `json:"name,omitempty"`
+	Rule       string `json:"rule"`
+	Count      int64  `json:"count"`
+	Exclusive  int64  `json:"exclusive"` // in this audience only
+}
+
+type overlapPair struct {
+	A            string  `json:"a"`
+	B            string  `json:"b"`
+	Intersection int64   `json:"intersection"`
+	AMinusB      int64   `json:"a_minus_b"`
+	BMinusA      int64   `json:"b_minus_a"`
+	Jaccard      float64 `json:"jaccard"`
+}
+
+type overlapResponse struct {
+	Audiences    []overlapAudience `json:"audiences"`
+	Union        int64             `json:"union"`
+	Intersection int64             `json:"intersection"`
+	Pairs        []overlapPair     `json:"pairs"`
+	DurationMS   float64           `json:"duration_ms"`
+}
+
+var errInvalidOverlap = errors.New("invalid overlap request")
+
+// Rule and label of every input, parsed; stored audiences are labelled with their name too
+func resolveOverlap(ctx context.Context, db *sql.DB, inputs []overlapInput, timeout time.Duration) ([]overlapAudience, []*rules.Rule, error) {
+	if len(inputs) < 2 || len(inputs) > store.MaxOverlapAudiences {
+		return nil, nil, fmt.Errorf("%w: need 2 to %d audiences, got %d", errInvalidOverlap, store.MaxOverlapAudiences, len(inputs))
+	}
+	audiences := make([]overlapAudience, len(inputs))
+	parsed := make([]*rules.Rule, len(inputs))
+	for i, in := range inputs {
+		a := overlapAudience{Label: string(rune('A' + i)), AudienceID: in.AudienceID, Rule: in.Rule}
+		var tenant string
+		if (in.Rule == "") == (in.AudienceID == 0) {
+			return nil, nil, fmt.Errorf("%w: audience %s: %v", errInvalidOverlap, a.Label, errRuleOrAudience)
+		}
+		if in.AudienceID != 0 {
+			queryCtx, cancel := bench.QueryContext(ctx, timeout)
+			stored, err := store.GetAudience(queryCtx, db, in.AudienceID)
+			cancel()
+			if err != nil {
+				return nil, nil, fmt.Errorf("audience %d: %w", in.AudienceID, err)
+			}
+			a.Name, a.Rule, tenant = stored.Name, stored.Rule, stored.Tenant
+		}
+		rule, err := rules.Parse(a.Rule)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: audience %s: %v", errInvalidOverlap, a.Label, err)
+		}
+		if tenant != "" {
+			rule = rule.ForTenant(tenant)
+		}
+		audiences[i], parsed[i] = a, rule
+	}
+	return audiences, parsed, nil
+}
+
+func computeOverlap(ctx context.Context, db *sql.DB, audiences []overlapAudience, parsed []*rules.Rule, timeout time.Duration, retry *bench.Retry) (overlapResponse, error) {
+	var o store.Overlap
+	_, duration, err := retry.Run(ctx, func(ctx context.Context) (int, time.Duration, error) {
+		var err error
+		var d time.Duration
+		o, d, err = store.ComputeOverlap(ctx, db, parsed)
+		return 0, d, err
+	}, timeout)
+	if err != nil {
+		return overlapResponse{}, err
+	}
+	res := overlapResponse{
+		Audiences:    audiences,
+		Union:        o.Union,
+		Intersection: o.Intersection,
+		Pairs:        []overlapPair{},
+		DurationMS:   float64(duration.Microseconds()) / 1000,
+	}
+	for i := range res.Audiences {
+		res.Audiences[i].Count, res.Audiences[i].Exclusive = o.Sizes[i], o.Exclusive[i]
+	}
+	for _, p := range o.Pairs {
+		res.Pairs = append(res.Pairs, overlapPair{
+			A:            audiences[p.A].Label,
+			B:            audiences[p.B].Label,
+			Intersection: p.Intersection,
+			AMinusB:      o.Difference(p),
+			BMinusA:      o.ReverseDifference(p),
+			Jaccard:      o.Jaccard(p),
+		})
+	}
+	return res, nil
+}
+
+// POST /audiences/overlap: intersection, union and difference sizes of 2 or more audiences
+func overlapHandler(route *store.Router, timeout time.Duration, retry *bench.Retry, m *apiMetrics) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req overlapRequest
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{fmt.Sprintf("invalid request body: %v", err)})
+			return
+		}
+		// Stored audiences from the primary, the sizes from a replica
+		db := route.Primary()
+		audiences, parsed, err := resolveOverlap(r.Context(), db, req.Audiences, timeout)
+		if err == nil {
+			db = route.Read()
+			var res overlapResponse
+			if res, err = computeOverlap(r.Context(), db, audiences, parsed, timeout, retry); err == nil {
+				m.observe(r.Context(), "optimized", "overlap", nil, time.Duration(res.DurationMS*float64(time.Millisecond)), len(res.Audiences))
+				writeJSON(w, http.StatusOK, res)
+				return
+			}
+		}
+
+		var status int
+		switch {
+		case errors.Is(err, errInvalidOverlap):
+			status = http.StatusBadRequest
+		case errors.Is(err, store.ErrAudienceNotFound):
+			status = http.StatusNotFound
+		default:
+			status = queryErrorStatus(r.Context(), db, err)
+			slog.WarnContext(r.Context(), "overlap query failed", "status", status, "err", err)
+			writeJSON(w, status, errorResponse{http.StatusText(status)})
+			return
+		}
+		writeJSON(w, status, errorResponse{err.Error()})
+	}
+}
+
+func newOverlapCmd(cfg *Config) *cobra.Command {
+	var inputs []overlapInput
+	cmd := &cobra.Command{
+		Use:   "overlap",
+		Short: "Report how 2 or more audiences overlap: intersections, union and differences",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			db, err := connect(ctx, *cfg)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+			audiences, parsed, err := resolveOverlap(ctx, db, inputs, cfg.QueryTimeout)
+			if err != nil {
+				return err
+			}
+			res, err := computeOverlap(ctx, db, audiences, parsed, cfg.QueryTimeout, nil)
+			if err != nil {
+				return fmt.Errorf("overlap query failed: %w", err)
+			}
+			printOverlap(res)
+			return nil
+		},
+	}
+	// Both flags append to one list, so audiences keep their command-line order (A, B, ...)
+	cmd.Flags().Func("rule", "audience rule to compare, repeatable", func(s string) error {
+		if _, err := rules.Parse(s); err != nil {
+			return err
+		}
+		inputs = append(inputs, overlapInput{Rule: s})
+		return nil
+	})
+	cmd.Flags().Func("audience", "stored audience id to compare, repeatable", func(s string) error {
+		id, err := parseAudienceID(s)
+		if err != nil {
+			return err
+		}
+		inputs = append(inputs, overlapInput{AudienceID: id})
+		return nil
+	})
+	bindTenantFlag(cmd.Flags(), cfg)
+	return cmd
+}
+
+func printOverlap(res overlapResponse) {
+	fmt.Fprintf(summaryOut, "🔀 Overlap of %d audiences (one query, %.1fms)\n", len(res.Audiences), res.DurationMS)
+	for _, a := range res.Audiences {
+		name := a.Rule
+		if a.Name != "" {
+			name = fmt.Sprintf("%s [%d]: %s", a.Name, a.AudienceID, a.Rule)
+		}
+		fmt.Fprintf(summaryOut, "  %s  %10d users  %s\n", a.Label, a.Count, name)
+	}
+	fmt.Fprintln(summaryOut)
+	sizes := map[string]int64{}
+	for _, a := range res.Audiences {
+		sizes[a.Label] = a.Count
+	}
+	for _, p := range res.Pairs {
+		fmt.Fprintf(summaryOut, "  %s ∩ %s  %10d users  (%s of %s, %s of %s, Jaccard %.2f)\n",
+			p.A, p.B, p.Intersection, share(p.Intersection, sizes[p.A]), p.A, share(p.Intersection, sizes[p.B]), p.B, p.Jaccard)
+		fmt.Fprintf(summaryOut, "  %s − %s  %10d users\n", p.A, p.B, p.AMinusB)
+		fmt.Fprintf(summaryOut, "  %s − %s  %10d users\n", p.B, p.A, p.BMinusA)
+	}
+	fmt.Fprintln(summaryOut)
+	labels := make([]string, len(res.Audiences))
+	for i, a := range res.Audiences {
+		labels[i] = a.Label
+		if len(res.Audiences) > 2 {
+			fmt.Fprintf(summaryOut, "  only %s  %7d users\n", a.Label, a.Exclusive)
+		}
+	}
+	fmt.Fprintf(summaryOut, "  %s  %10d users in any\n", strings.Join(labels, " ∪ "), res.Union)
+	if len(res.Audiences) > 2 {
+		fmt.Fprintf(summaryOut, "  %s  %10d users in all\n", strings.Join(labels, " ∩ "), res.Intersection)
+	}
+}
+
+func share(part, whole int64) string {
+	if whole == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", float64(part)/float64(whole)*100)
+}
@@ -0,0 +1,138 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"audience-poc/internal/bench"
+)
+
+const paginationLimit = 100
+
+// Page depths swept by the pagination benchmark
+var paginationOffsets = []int{0, 1000, 100000}
+
+type pageResult struct {
+	offset   int
+	rows     int
+	duration time.Duration
+}
+
+// Drain a page query, returning the number of rows and the last user_id seen
+func fetchPage(ctx context.Context, db *sql.DB, query string, args ...interface{}) (int, int64, time.Duration, error) {
+	start := time.Now()
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer rows.Close()
+
+	var count int
+	var lastID int64
+	for rows.Next() {
+		if err := rows.Scan(&lastID); err != nil {
+			return 0, 0, 0, err
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return 0, 0, 0, err
+	}
+	return count, lastID, time.Since(start), nil
+}
+
+// OFFSET pagination - the database still walks every skipped row
+func offsetPaginationQuery(ctx context.Context, db *sql.DB, offset int) (int, time.Duration, error) {
+	query := `
+		SELECT user_id
+		FROM user_profiles
+		WHERE country = 'US'
+		ORDER BY user_id
+		LIMIT $1 OFFSET $2`
+
+	count, _, duration, err := fetchPage(ctx, db, query, paginationLimit, offset)
+	return count, duration, err
+}
+
+// Keyset pagination - seeks straight to the cursor via the primary key
+func keysetPaginationQuery(ctx context.Context, db *sql.DB, afterID int64) (int, time.Duration, error) {
+	query := `
+		SELECT user_id
+		FROM user_profiles
+		WHERE country = 'US'
+		  AND user_id > $1
+		ORDER BY user_id
+		LIMIT $2`
+
+	count, _, duration, err := fetchPage(ctx, db, query, afterID, paginationLimit)
+	return count, duration, err
+}
+
+// Find the keyset cursor equivalent to an OFFSET, outside of the timed path
+func keysetCursorAt(ctx context.Context, db *sql.DB, offset int) (int64, error) {
+	if offset == 0 {
+		return 0, nil
+	}
+	var cursor int64
+	err := db.QueryRowContext(ctx, `
+		SELECT user_id
+		FROM user_profiles
+		WHERE country = 'US'
+		ORDER BY user_id
+		LIMIT 1 OFFSET $1`, offset-1).Scan(&cursor)
+	if err == sql.ErrNoRows {
+		// Past the end of the audience: both strategies return an empty page
+		err = db.QueryRowContext(ctx, `SELECT COALESCE(MAX(user_id), 0) FROM user_profiles`).Scan(&cursor)
+	}
+	return cursor, err
+}
+
+// Compare OFFSET and keyset pagination at increasing page depths
+func paginationBenchmark(ctx context.Context, db *sql.DB, timeout time.Duration) error {
+	fmt.Fprintf(out, "\n📊 Pagination: OFFSET vs keyset (LIMIT %d, country = 'US')\n", paginationLimit)
+	fmt.Fprintln(out, strings.Repeat("-", 50))
+	fmt.Fprintf(out, "%-10s %12s %12s %8s\n", "Offset", "OFFSET", "Keyset", "Rows")
+
+	var offsetResults, keysetResults []pageResult
+	for _, offset := range paginationOffsets {
+		cursor, err := keysetCursorAt(ctx, db, offset)
+		if err != nil {
+			return fmt.Errorf("keyset cursor at offset %d: %w", offset, err)
+		}
+
+		offsetRows, offsetDuration, err := bench.RunWithTimeout(ctx, func(ctx context.Context) (int, time.Duration, error) {
+			return offsetPaginationQuery(ctx, db, offset)
+		}, timeout)
+		if err != nil {
+			return fmt.Errorf("OFFSET page at %d: %w", offset, err)
+		}
+		keysetRows, keysetDuration, err := bench.RunWithTimeout(ctx, func(ctx context.Context) (int, time.Duration, error) {
+			return keysetPaginationQuery(ctx, db, cursor)
+		}, timeout)
+		if err != nil {
+			return fmt.Errorf("keyset page at %d: %w", offset, err)
+		}
+		if offsetRows != keysetRows {
+			fmt.Fprintf(out, "⚠️  Page at offset %d differs: OFFSET returned %d rows, keyset %d\n",
+				offset, offsetRows, keysetRows)
+		}
+
+		offsetResults = append(offsetResults, pageResult{offset, offsetRows, offsetDuration})
+		keysetResults = append(keysetResults, pageResult{offset, keysetRows, keysetDuration})
+		fmt.Fprintf(out, "%-10d %12v %12v %8d\n", offset, offsetDuration, keysetDuration, offsetRows)
+	}
+
+	first, last := 0, len(paginationOffsets)-1
+	if offsetResults[first].duration > 0 && keysetResults[first].duration > 0 {
+		fmt.Fprintf(out, "📈 OFFSET degradation: %.1fx from offset %d to %d\n",
+			float64(offsetResults[last].duration)/float64(offsetResults[first].duration),
+			paginationOffsets[first], paginationOffsets[last])
+		fmt.Fprintf(out, "📉 Keyset degradation: %.1fx from offset %d to %d\n",
+			float64(keysetResults[last].duration)/float64(keysetResults[first].duration),
+			paginationOffsets[first], paginationOffsets[last])
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"audience-poc/internal/bench"
+	"audience-poc/internal/store"
+)
+
+func layoutCount(db store.Querier, table, rule string) bench.QueryFunc {
+	return func(ctx context.Context) (int, time.Duration, error) {
+		query, args, err := store.OptimizedCountSQLOn(table, rule)
+		if err != nil {
+			return 0, 0, err
+		}
+		return store.TimeCount(ctx, db, query, args...)
+	}
+}
+
+// Relations a plan reads: the partitions left after pruning, or the table itself
+func scannedRelations(p *store.QueryPlan) int {
+	seen := map[string]bool{}
+	for _, s := range p.Scans() {
+		if s.Relation != "" {
+			seen[s.Relation] = true
+		}
+	}
+	return len(seen)
+}
+
+// Compare partitioning layouts of the optimized model on the same rules. Each
+// copy is dropped once measured, so at most one doubles the database's size.
+func comparePartitioning(ctx context.Context, db *sql.DB, cases []benchCase, opts bench.Options) error {
+	fmt.Fprintln(out, "\n📊 Partitioning layouts (median latency, partitions scanned)")
+	fmt.Fprintln(out, strings.Repeat("-", 50))
+
+	layouts := store.ProfileLayouts
+	table := make([][]bench.Result, len(layouts))
+	scanned := make([][]int, len(layouts))
+	for i, l := range layouts {
+		if l.Table != "user_profiles" {
+			fmt.Fprintf(out, "🔨 Building %s (%s)...\n", l.Table, l.Name)
+		}
+		if err := store.SetupProfileLayout(ctx, db, l); err != nil {
+			return err
+		}
+		if partitions, size, err := store.LayoutSize(ctx, db, l.Table); err != nil {
+			slog.Warn("failed to size partitioning layout", "table", l.Table, "err", err)
+		} else {
+			fmt.Fprintf(out, "   %d partitions, %s with indexes\n", partitions, formatBytes(size))
+		}
+
+		table[i] = make([]bench.Result, len(cases))
+		scanned[i] = make([]int, len(cases))
+		build := func(rule string) (string, []interface{}, error) { return store.OptimizedCountSQLOn(l.Table, rule) }
+		for ci, c := range cases {
+			table[i][ci] = bench.Run(ctx, layoutCount(db, l.Table, c.rule), opts)
+			if plan, err := explainRule(ctx, db, build, c.rule, opts.Timeout); err == nil {
+				scanned[i][ci] = scannedRelations(plan)
+			}
+		}
+		if err := store.DropProfileLayout(context.WithoutCancel(ctx), db, l); err != nil {
+			slog.Warn("failed to drop partitioning layout", "table", l.Table, "err", err)
+		}
+	}
+
+	fmt.Fprintf(out, "\n%-14s", "Test")
+	for _, l := range layouts {
+		fmt.Fprintf(out, " %22s", l.Name)
+	}
+	fmt.Fprintln(out)
+
+	var failed []string
+	for ci, c := range cases {
+		fmt.Fprintf(out, "%-14s", c.name)
+		best, bestMedian := -1, int64(0)
+		for li := range layouts {
+			r := table[li][ci]
+			switch {
+			case r.TimedOut:
+				fmt.Fprintf(out, " %22s", "timed out")
+			case r.Err != nil:
+				fmt.Fprintf(out, " %22s", "error")
+				failed = append(failed, fmt.Sprintf("%s/%s: %v", layouts[li].Name, c.name, r.Err))
+			default:
+				fmt.Fprintf(out, " %22s", fmt.Sprintf("%v (%d)", r.Stats.Median, scanned[li][ci]))
+				if best < 0 || int64(r.Stats.Median) < bestMedian {
+					best, bestMedian = li, int64(r.Stats.Median)
+				}
+			}
+		}
+		fmt.Fprintln(out)
+
+		if best >= 0 {
+			fmt.Fprintf(out, "%-14s 🏆 %s\n", "", layouts[best].Name)
+		}
+		if counts := strategyCounts(table, ci); len(counts) > 1 {
+			fmt.Fprintf(out, "⚠️  %s: layouts disagree on the count: %v\n", c.name, counts)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,322 @@
+package cli
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"time"
+
+	"audience-poc/internal/bench"
+	"audience-poc/internal/store"
+)
+
+// Stable machine-readable benchmark output for CI dashboards
+type jsonReport struct {
+	DatasetSize int              `json:"dataset_size"`
+	Iterations  int              `json:"iterations"`
+	Warmup      int              `json:"warmup"`
+	DiscardCold bool             `json:"discard_cold"`
+	Tests       []jsonTestResult `json:"tests"`
+	Speedups    []jsonSpeedup    `json:"speedups"`
+	Load        []jsonLoad       `json:"load,omitempty"`
+	Estimates   []jsonEstimate   `json:"estimates,omitempty"`
+	BitmapIndex *jsonBitmapIndex `json:"bitmap_index,omitempty"`
+	ClickHouse  *jsonClickHouse  `json:"clickhouse,omitempty"`
+	Savings     *jsonSavings     `json:"savings,omitempty"`
+}
+
+type jsonTestResult struct {
+	TestName   string  `json:"test_name"`
+	Model      string  `json:"model"`
+	Rule       string  `json:"rule"`
+	Count      int     `json:"count"`
+	DurationMS float64 `json:"duration_ms"` // median
+	MinMS      float64 `json:"min_ms"`
+	P95MS      float64 `json:"p95_ms"`
+	P99MS      float64 `json:"p99_ms"`
+	MaxMS      float64 `json:"max_ms"`
+	StdDevMS   float64 `json:"stddev_ms"`
+	ColdMS     float64 `json:"cold_ms,omitempty"` // first warm-up run
+	Runs       int     `json:"runs"`
+	TimedOut   bool    `json:"timed_out"`
+	Error      string  `json:"error,omitempty"`
+	Retries    int     `json:"retries,omitempty"` // runs that needed a retry
+	// Raw runs, so a later run can test against this one with --baseline
+	SamplesMS []float64 `json:"samples_ms,omitempty"`
+	// Optimized model only
+	Scans     []store.ScanAccess `json:"scans,omitempty"`
+	UsesIndex *bool              `json:"uses_index,omitempty"`
+	// SQL models with --pg-stat-statements
+	Statements *jsonStatements `json:"pg_stat_statements,omitempty"`
+}
+
+// Speedup of the optimized model over the baseline model
+type jsonSpeedup struct {
+	TestName    string  `json:"test_name"`
+	Baseline    string  `json:"baseline"` // eav or jsonb
+	Speedup     float64 `json:"speedup"`
+	CILow       float64 `json:"ci_low"`
+	CIHigh      float64 `json:"ci_high"`
+	PValue      float64 `json:"p_value"`
+	Significant bool    `json:"significant"`
+	CountsMatch bool    `json:"counts_match"`
+}
+
+// Approximate count of a test with --estimate, next to the exact one
+type jsonEstimate struct {
+	TestName      string  `json:"test_name"`
+	Method        string  `json:"method"`
+	Count         int64   `json:"estimated_count"`
+	Margin        int64   `json:"margin,omitempty"` // 95% half-width, sampled estimates only
+	SamplePercent float64 `json:"sample_percent,omitempty"`
+	SampledRows   int64   `json:"sampled_rows,omitempty"`
+	DurationMS    float64 `json:"duration_ms"`
+	ExactCount    int     `json:"exact_count"`
+	Error         float64 `json:"error"` // (estimate - exact) / exact
+}
+
+// The in-memory index behind the bitmap model, as last loaded
+type jsonBitmapIndex struct {
+	Users     int     `json:"users"`
+	LoadMS    float64 `json:"load_ms"`
+	SizeBytes uint64  `json:"size_bytes"`
+	Refreshes int64   `json:"refreshes"` // reloads after the initial one
+}
+
+// The ClickHouse copy behind the clickhouse model
+type jsonClickHouse struct {
+	Users     int64   `json:"users"`
+	LoadMS    float64 `json:"load_ms"`
+	SizeBytes int64   `json:"size_bytes"` // compressed, on disk
+}
+
+// Load test against one model
+type loadRun struct {
+	model string
+	bench.LoadResult
+}
+
+type jsonLoad struct {
+	Model         string          `json:"model"`
+	Workers       int             `json:"workers"`
+	TargetQPS     float64         `json:"target_qps,omitempty"`
+	ElapsedMS     float64         `json:"elapsed_ms"`
+	Queries       int             `json:"queries"`
+	ThroughputQPS float64         `json:"throughput_qps"`
+	MedianMS      float64         `json:"median_ms"`
+	P95MS         float64         `json:"p95_ms"`
+	P99MS         float64         `json:"p99_ms"`
+	MaxMS         float64         `json:"max_ms"`
+	Histogram     []jsonBucket    `json:"histogram"`
+	Rules         []jsonLoadQuery `json:"rules"`
+	Errors        int             `json:"errors"`
+	Dropped       int             `json:"dropped"`
+	PoolWaits     int64           `json:"pool_waits"`
+	PoolWaitMS    float64         `json:"pool_wait_ms"`
+	MaxOpenConns  int             `json:"max_open_conns"`
+	PeakInUse     int             `json:"peak_in_use"`
+	Saturation    float64         `json:"pool_saturation"` // share of the run with every connection busy
+}
+
+type jsonBucket struct {
+	LeMS  float64 `json:"le_ms"`
+	Count int     `json:"count"`
+}
+
+type jsonLoadQuery struct {
+	Name     string  `json:"name"`
+	Queries  int     `json:"queries"`
+	Errors   int     `json:"errors"`
+	MedianMS float64 `json:"median_ms"`
+	P95MS    float64 `json:"p95_ms"`
+}
+
+func jsonLoadResult(l loadRun) jsonLoad {
+	res := jsonLoad{
+		Model:         l.model,
+		Workers:       l.Workers,
+		TargetQPS:     l.TargetQPS,
+		ElapsedMS:     ms(l.Elapsed),
+		Queries:       l.Queries,
+		ThroughputQPS: l.Throughput(),
+		MedianMS:      ms(l.Stats.Median),
+		P95MS:         ms(l.Stats.P95),
+		P99MS:         ms(l.Stats.P99),
+		MaxMS:         ms(l.Stats.Max),
+		Histogram:     []jsonBucket{},
+		Errors:        l.ErrorCount,
+		Dropped:       l.Dropped,
+		PoolWaits:     l.PoolWaits,
+		PoolWaitMS:    ms(l.PoolWaited),
+		MaxOpenConns:  l.MaxOpenConn,
+		PeakInUse:     l.PeakInUse,
+		Saturation:    l.Saturation,
+	}
+	for _, b := range l.Histogram {
+		res.Histogram = append(res.Histogram, jsonBucket{LeMS: ms(b.UpperBound), Count: b.Count})
+	}
+	for _, q := range l.PerQuery {
+		res.Rules = append(res.Rules, jsonLoadQuery{
+			Name:     q.Name,
+			Queries:  q.Queries,
+			Errors:   q.Errors,
+			MedianMS: ms(q.Stats.Median),
+			P95MS:    ms(q.Stats.P95),
+		})
+	}
+	return res
+}
+
+type jsonSavings struct {
+	TimeSavedPerDaySeconds float64            `json:"time_saved_per_day_seconds"`
+	CostSavedPerDayUSD     *float64           `json:"cost_saved_per_day_usd,omitempty"`
+	PerRuleSeconds         map[string]float64 `json:"per_rule_seconds"`
+}
+
+func ms(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+
+func jsonResult(testName, model, rule string, r bench.Result) jsonTestResult {
+	res := jsonTestResult{
+		TestName:   testName,
+		Model:      model,
+		Rule:       rule,
+		Count:      r.Count,
+		DurationMS: ms(r.Stats.Median),
+		MinMS:      ms(r.Stats.Min),
+		P95MS:      ms(r.Stats.P95),
+		P99MS:      ms(r.Stats.P99),
+		MaxMS:      ms(r.Stats.Max),
+		StdDevMS:   ms(r.Stats.StdDev),
+		ColdMS:     ms(r.Cold),
+		Runs:       r.Stats.Runs,
+		TimedOut:   r.TimedOut,
+		Retries:    r.Retries,
+	}
+	if r.Err != nil {
+		res.Error = r.Err.Error()
+	}
+	for _, d := range r.Samples {
+		res.SamplesMS = append(res.SamplesMS, ms(d))
+	}
+	return res
+}
+
+func buildJSONReport(userCount int, opts bench.Options, results []caseResult, loads []loadRun, savings *dailySavings, bitmaps *bitmapBackend, clickhouse *clickhouseBackend) jsonReport {
+	report := jsonReport{
+		DatasetSize: userCount,
+		Iterations:  opts.Iterations,
+		Warmup:      opts.Warmup,
+		DiscardCold: !opts.KeepCold,
+		Tests:       []jsonTestResult{},
+		Speedups:    []jsonSpeedup{},
+	}
+	for _, r := range results {
+		if r.withEAV {
+			eav := jsonResult(r.name, "eav", r.rule, r.eav)
+			eav.Statements = jsonStatementsOf(r.statements["eav"])
+			report.Tests = append(report.Tests, eav)
+		}
+		optimized := jsonResult(r.name, "optimized", r.rule, r.optimized)
+		optimized.Statements = jsonStatementsOf(r.statements["optimized"])
+		if r.optimizedScans != nil {
+			usesIndex := store.UsesIndex(r.optimizedScans)
+			optimized.Scans, optimized.UsesIndex = r.optimizedScans, &usesIndex
+		}
+		report.Tests = append(report.Tests, optimized)
+		if r.estimate != nil && r.optimized.Err == nil && r.optimized.Count > 0 {
+			report.Estimates = append(report.Estimates, jsonEstimate{
+				TestName:      r.name,
+				Method:        r.estimate.Method,
+				Count:         r.estimate.Count,
+				Margin:        r.estimate.Margin,
+				SamplePercent: r.estimate.SamplePercent,
+				SampledRows:   r.estimate.Sampled,
+				DurationMS:    ms(r.estimate.Duration),
+				ExactCount:    r.optimized.Count,
+				Error:         estimateError(*r.estimate, r.optimized.Count),
+			})
+		}
+		if r.withJSONB {
+			jsonb := jsonResult(r.name, "jsonb", r.rule, r.jsonb)
+			jsonb.Statements = jsonStatementsOf(r.statements["jsonb"])
+			report.Tests = append(report.Tests, jsonb)
+		}
+		if r.withBitmap {
+			report.Tests = append(report.Tests, jsonResult(r.name, "bitmap", r.rule, r.bitmap))
+		}
+		if r.withClickHouse {
+			report.Tests = append(report.Tests, jsonResult(r.name, "clickhouse", r.rule, r.clickhouse))
+		}
+
+		for _, b := range []struct {
+			model       string
+			result      bench.Result
+			ran         bool
+			countsMatch bool
+		}{{"eav", r.eav, r.withEAV, r.countsMatch}, {"jsonb", r.jsonb, r.withJSONB, r.jsonbMatch}} {
+			if !b.ran || b.result.Err != nil || r.optimized.Err != nil {
+				continue
+			}
+			if e, ok := bench.EstimateSpeedup(b.result.Samples, r.optimized.Samples); ok {
+				report.Speedups = append(report.Speedups, jsonSpeedup{
+					TestName:    r.name,
+					Baseline:    b.model,
+					Speedup:     e.Median,
+					CILow:       e.CILow,
+					CIHigh:      e.CIHigh,
+					PValue:      e.PValue,
+					Significant: e.Significant,
+					CountsMatch: b.countsMatch,
+				})
+			}
+		}
+	}
+
+	if bitmaps != nil {
+		ix := bitmaps.current()
+		report.BitmapIndex = &jsonBitmapIndex{
+			Users:     ix.Users,
+			LoadMS:    ms(ix.LoadDuration),
+			SizeBytes: ix.SizeBytes(),
+			Refreshes: bitmaps.refreshes.Load(),
+		}
+	}
+	if clickhouse != nil {
+		report.ClickHouse = &jsonClickHouse{
+			Users:     clickhouse.load.Users,
+			LoadMS:    ms(clickhouse.load.Duration),
+			SizeBytes: clickhouse.load.Bytes,
+		}
+	}
+
+	for _, l := range loads {
+		report.Load = append(report.Load, jsonLoadResult(l))
+	}
+
+	if savings != nil {
+		js := &jsonSavings{
+			TimeSavedPerDaySeconds: savings.total.Seconds(),
+			PerRuleSeconds:         map[string]float64{},
+		}
+		names := make([]string, 0, len(savings.perRule))
+		for name := range savings.perRule {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			js.PerRuleSeconds[name] = savings.perRule[name].Seconds()
+		}
+		if savings.hasCost {
+			dollars := savings.dollars
+			js.CostSavedPerDayUSD = &dollars
+		}
+		report.Savings = js
+	}
+	return report
+}
+
+func writeJSONReport(w io.Writer, report jsonReport) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
@@ -0,0 +1,121 @@
+package cli
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Header (gRPC metadata key) carrying a request's ID, taken from the caller
+// when it sends one and echoed in the response
+const requestIDHeader = "X-Request-ID"
+
+// IDs from callers are kept when they are short and safe to log
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+type requestIDKey struct{}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func requestIDFrom(ctx context.Context) (string, bool) {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id, id != ""
+}
+
+// The caller's ID if it is valid, a random one otherwise
+func requestID(fromCaller string) string {
+	if validRequestID.MatchString(fromCaller) {
+		return fromCaller
+	}
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// Probes and scrapes come every few seconds; their requests are only logged at debug
+func routineRequest(path string) bool {
+	return path == "/healthz" || path == "/readyz" || path == "/metrics" || strings.HasPrefix(path, "/grpc.health.v1.Health/")
+}
+
+// Status of a response, for the request log
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// For http.ResponseController
+func (r *statusRecorder) Unwrap() http.ResponseWriter { return r.ResponseWriter }
+
+// Give every request an ID, which every log line of the request carries, and
+// log it once it has been answered
+func requestLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := requestID(r.Header.Get(requestIDHeader))
+		w.Header().Set(requestIDHeader, id)
+		ctx := withRequestID(r.Context(), id)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		level := slog.LevelInfo
+		if routineRequest(r.URL.Path) {
+			level = slog.LevelDebug
+		}
+		slog.Log(ctx, level, "request", "transport", "http", "method", r.Method, "path", r.URL.Path,
+			"status", rec.status, "duration_ms", ms(time.Since(start)))
+	})
+}
+
+// The call's context with its request ID, sent back in the response headers
+func callRequestID(ctx context.Context) (context.Context, metadata.MD) {
+	var fromCaller string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(requestIDHeader); len(v) > 0 {
+			fromCaller = v[0]
+		}
+	}
+	id := requestID(fromCaller)
+	return withRequestID(ctx, id), metadata.Pairs(requestIDHeader, id)
+}
+
+func logCall(ctx context.Context, method string, start time.Time, err error) {
+	level := slog.LevelInfo
+	if routineRequest(method) {
+		level = slog.LevelDebug
+	}
+	slog.Log(ctx, level, "request", "transport", "grpc", "method", method,
+		"code", status.Code(err).String(), "duration_ms", ms(time.Since(start)))
+}
+
+func requestLogUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	ctx, header := callRequestID(ctx)
+	grpc.SetHeader(ctx, header)
+	resp, err := handler(ctx, req)
+	logCall(ctx, info.FullMethod, start, err)
+	return resp, err
+}
+
+func requestLogStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	ctx, header := callRequestID(ss.Context())
+	ss.SetHeader(header)
+	err := handler(srv, contextStream{ServerStream: ss, ctx: ctx})
+	logCall(ctx, info.FullMethod, start, err)
+	return err
+}
@@ -0,0 +1,446 @@
+// Package cli is the audience-poc command line: the benchmark and the
+// commands that prepare the database or serve rule evaluation.
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+	"github.com/spf13/cobra"
+
+	"audience-poc/internal/bench"
+	"audience-poc/internal/config"
+	"audience-poc/internal/store"
+)
+
+// Run the command line in os.Args and return the process exit code
+func Execute() int {
+	db, err := config.FromEnv()
+	if err != nil {
+		slog.Error("invalid configuration", "err", err)
+		return 1
+	}
+	cfg := &Config{DB: db}
+	var shutdownTracing func(context.Context) error
+	root := newRootCmd(cfg, &shutdownTracing)
+
+	// Bare flags (and no arguments at all) still mean "run the benchmark"
+	args := os.Args[1:]
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") && args[0] != "-h" && args[0] != "--help" {
+		args = append([]string{"bench"}, args...)
+	}
+	root.SetArgs(args)
+
+	// Ctrl+C or SIGTERM cancels in-flight queries instead of leaving them running
+	// on the server (serve drains them first); a second one exits at once
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	context.AfterFunc(ctx, stop)
+	err = root.ExecuteContext(ctx)
+	if shutdownTracing != nil {
+		// Flush buffered spans, even when interrupted
+		flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := shutdownTracing(flushCtx); err != nil {
+			slog.Warn("failed to flush traces", "err", err)
+		}
+		cancel()
+	}
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	return 0
+}
+
+func newRootCmd(cfg *Config, shutdownTracing *func(context.Context) error) *cobra.Command {
+	var dbFlags *config.Flags
+	root := &cobra.Command{
+		Use:           "audience-poc",
+		Short:         "Benchmark audience rules on an EAV schema vs denormalized profiles",
+		SilenceErrors: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			// Flags parsed fine, so later errors are not usage errors
+			cmd.SilenceUsage = true
+			if err := dbFlags.Apply(&cfg.DB); err != nil {
+				return fmt.Errorf("invalid database configuration: %w", err)
+			}
+			if err := configureLogging(cfg.LogLevel, logFormat(cmd, cfg.LogFormat)); err != nil {
+				return fmt.Errorf("invalid configuration: %w", err)
+			}
+			shutdown, err := configureTracing(cmd.Context(), cfg.OTLPEndpoint)
+			if err != nil {
+				return fmt.Errorf("invalid tracing configuration: %w", err)
+			}
+			*shutdownTracing = shutdown
+			if cfg.Tenant != "" {
+				if err := requirePostgres(cfg, "--tenant"); err != nil {
+					return err
+				}
+				if err := store.ValidTenant(cfg.Tenant); err != nil {
+					return fmt.Errorf("invalid --tenant: %w", err)
+				}
+				cmd.SetContext(store.WithTenant(cmd.Context(), cfg.Tenant))
+			}
+			return nil
+		},
+	}
+	dbFlags = config.BindFlags(root.PersistentFlags(), cfg.DB)
+	bindGlobalFlags(root.PersistentFlags(), cfg)
+	root.AddCommand(newBenchCmd(cfg), newSeedCmd(cfg), newMigrateCmd(cfg), newSyncCmd(cfg), newServeCmd(cfg), newAudiencesCmd(cfg), newSnapshotsCmd(cfg), newOverlapCmd(cfg), newEvaluateBatchCmd(cfg), newExportCmd(cfg), newSchemaCmd(cfg), newTenantsCmd(cfg), newVerifyCmd(cfg), newImportCmd(cfg))
+	return root
+}
+
+func newBenchCmd(cfg *Config) *cobra.Command {
+	var ruleFrequency string
+	cmd := &cobra.Command{
+		Use:   "bench",
+		Short: "Benchmark both models and print a report (the default command)",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := cfg.validateBench(ruleFrequency); err != nil {
+				return fmt.Errorf("invalid configuration: %w", err)
+			}
+			boundStatements(cmd, cfg)
+			return runBench(cmd.Context(), *cfg)
+		},
+	}
+	bindBenchFlags(cmd.Flags(), cfg, &ruleFrequency)
+	cmd.AddCommand(newBenchCompareCmd(), newBenchSweepCmd(cfg))
+	return cmd
+}
+
+func newSeedCmd(cfg *Config) *cobra.Command {
+	var users int
+	var distribution, csvPath, csvMapping string
+	cmd := &cobra.Command{
+		Use:   "seed",
+		Short: "Create the schema if needed and replace the dataset",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := requirePostgres(cfg, "seed"); err != nil {
+				return err
+			}
+			if users < 1 {
+				return errors.New("--users must be at least 1")
+			}
+			dist, err := store.ParseDistribution(distribution)
+			if err != nil {
+				return fmt.Errorf("invalid --distribution: %w", err)
+			}
+			ctx := cmd.Context()
+			db, err := connect(ctx, *cfg)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			start := time.Now()
+			if csvPath == "" {
+				if err := store.Seed(ctx, db, users, dist); err != nil {
+					return fmt.Errorf("failed to seed data: %w", err)
+				}
+				fmt.Fprintf(out, "🌱 Seeded %d synthetic users (%s) in %v\n", users, dist, time.Since(start).Round(time.Millisecond))
+				return nil
+			}
+			mapping, err := store.LoadCSVMapping(csvMapping)
+			if err != nil {
+				return fmt.Errorf("invalid CSV mapping: %w", err)
+			}
+			rows, err := store.SeedFromCSV(ctx, db, csvPath, mapping)
+			if err != nil {
+				return fmt.Errorf("failed to load CSV: %w", err)
+			}
+			fmt.Fprintf(out, "📥 Loaded %d users from %s in %v\n", rows, csvPath, time.Since(start))
+			return nil
+		},
+	}
+	cmd.Flags().IntVar(&users, "users", 100000, "number of synthetic users to generate")
+	cmd.Flags().StringVar(&distribution, "distribution", string(store.Zipf), "attribute distribution: zipf (production-like skew) or uniform (matches init.sql)")
+	cmd.Flags().StringVar(&csvPath, "from-csv", "", "load users from this CSV file instead of generating them")
+	cmd.Flags().StringVar(&csvMapping, "csv-mapping", "", "JSON file mapping profile attributes to CSV column names")
+	cmd.MarkFlagsMutuallyExclusive("users", "from-csv")
+	cmd.MarkFlagsMutuallyExclusive("distribution", "from-csv")
+	return cmd
+}
+
+func newMigrateCmd(cfg *Config) *cobra.Command {
+	var opts store.MigrateOptions
+	cmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Rebuild user_profiles from the EAV tables in resumable batches",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := requirePostgres(cfg, "migrate"); err != nil {
+				return err
+			}
+			if opts.BatchSize < 1 {
+				return errors.New("--batch-size must be at least 1")
+			}
+			ctx := cmd.Context()
+			db, err := connect(ctx, *cfg)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			start := time.Now()
+			res, err := store.Migrate(ctx, db, opts)
+			if res.Resumed {
+				fmt.Fprintf(out, "⏯️  Resumed after user_id %d\n", res.ResumedFrom)
+			}
+			if err != nil {
+				if ctx.Err() != nil {
+					fmt.Fprintf(out, "⏸️  Interrupted after %d users, run migrate again to resume\n", res.Total)
+				}
+				return fmt.Errorf("migration failed: %w", err)
+			}
+			fmt.Fprintf(out, "🔁 Migrated %d users into user_profiles in %v (%d in total)\n",
+				res.Users, time.Since(start).Round(time.Millisecond), res.Total)
+			return nil
+		},
+	}
+	cmd.Flags().IntVar(&opts.BatchSize, "batch-size", store.DefaultMigrateBatch, "users pivoted per transaction")
+	cmd.Flags().BoolVar(&opts.Restart, "restart", false, "discard the checkpoint of an unfinished migration and start over")
+	return cmd
+}
+
+func newSyncCmd(cfg *Config) *cobra.Command {
+	opts := syncOptions{batchSize: store.DefaultSyncBatch, pollInterval: time.Second}
+	cmd := &cobra.Command{
+		Use:   "sync",
+		Short: "Keep user_profiles up to date by applying queued EAV changes",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := requirePostgres(cfg, "sync"); err != nil {
+				return err
+			}
+			if opts.batchSize < 1 {
+				return errors.New("--batch-size must be at least 1")
+			}
+			if opts.pollInterval <= 0 {
+				return errors.New("--poll-interval must be positive")
+			}
+			ctx := cmd.Context()
+			db, err := connect(ctx, *cfg)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			// Installs the change-capture trigger on databases created before it existed
+			if err := store.EnsureSchema(ctx, db); err != nil {
+				return err
+			}
+			if cfg.RedisAddr != "" {
+				opts.rdb = redis.NewClient(&redis.Options{Addr: cfg.RedisAddr})
+				defer opts.rdb.Close()
+			}
+			return runSync(ctx, db, opts, cfg.QueryTimeout)
+		},
+	}
+	f := cmd.Flags()
+	f.IntVar(&opts.batchSize, "batch-size", opts.batchSize, "queued changes applied per transaction")
+	f.DurationVar(&opts.pollInterval, "poll-interval", opts.pollInterval, "wait between polls once the queue is empty")
+	f.StringVar(&opts.metricsAddr, "metrics-addr", "", "serve sync lag metrics on this address, e.g. :9091")
+	f.BoolVar(&opts.once, "once", false, "apply the queued changes and exit")
+	f.StringVar(&cfg.RedisAddr, "redis", "", "Redis of serve's count cache, cleared after every round that applied changes (empty disables it)")
+	return cmd
+}
+
+// Health check deadline of a replica; one slower than this gets no reads
+const replicaCheckTimeout = 2 * time.Second
+
+func newServeCmd(cfg *Config) *cobra.Command {
+	var addr, grpcAddr, tenantHeader, tenantTokens string
+	var webhookAllow []string
+	var clientOpts clientOptions
+	var replicaCheck, maxAge, shutdownDelay, shutdownTimeout time.Duration
+	cmd := &cobra.Command{
+		Use:         "serve",
+		Short:       "Serve the audience counting API over HTTP (and optionally gRPC)",
+		Args:        cobra.NoArgs,
+		Annotations: map[string]string{serviceAnnotation: "true"},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := cfg.validateEstimates(); err != nil {
+				return fmt.Errorf("invalid configuration: %w", err)
+			}
+			// A TTL of 0 would keep counts forever if an invalidation were missed
+			if cfg.RedisAddr != "" && cfg.RedisTTL <= 0 {
+				return errors.New("invalid configuration: --redis-ttl must be positive")
+			}
+			if replicaCheck <= 0 {
+				return errors.New("invalid configuration: --replica-check-interval must be positive")
+			}
+			if maxAge < 0 {
+				return errors.New("invalid configuration: --materialized-max-age must not be negative")
+			}
+			if shutdownDelay < 0 || shutdownTimeout <= 0 {
+				return errors.New("invalid configuration: --shutdown-delay must not be negative and --shutdown-timeout must be positive")
+			}
+			if err := cfg.validateRetry(); err != nil {
+				return fmt.Errorf("invalid configuration: %w", err)
+			}
+			tenants, err := newTenantAuth(cfg, tenantHeader, tenantTokens)
+			if err != nil {
+				return fmt.Errorf("invalid configuration: %w", err)
+			}
+			// Both would read Authorization: Bearer
+			if clientOpts.secretFile != "" && tenantTokens != "" {
+				return errors.New("invalid configuration: set one of --jwt-secret-file and --tenant-tokens")
+			}
+			clients, err := newClientAuth(clientOpts)
+			if err != nil {
+				return fmt.Errorf("invalid configuration: %w", err)
+			}
+			if tenants == nil && clients.bindsTenants() {
+				return errors.New("invalid configuration: client tenants in --api-clients are only supported with the postgres driver")
+			}
+			targets, err := store.ParseTriggerTargets(webhookAllow)
+			if err != nil {
+				return fmt.Errorf("invalid configuration: --trigger-webhook-allow: %w", err)
+			}
+			boundStatements(cmd, cfg)
+			// No ping: /readyz reports the database, so the service can start before it
+			route, err := store.OpenRouter(cfg.DB)
+			if err != nil {
+				return fmt.Errorf("failed to connect to database: %w", err)
+			}
+			defer route.Close()
+			db := route.Primary()
+			if err := registerAttributes(cmd.Context(), db, *cfg); err != nil {
+				slog.Warn("rules can only use built-in attributes until restart", "err", err)
+			}
+			// Keeps routing reads to healthy replicas while requests drain: the
+			// servers' context ends when draining starts, this one only once both
+			// servers have returned and the deferred calls run
+			watchCtx, stopWatch := context.WithCancel(context.WithoutCancel(cmd.Context()))
+			defer stopWatch()
+			go route.WatchReplicas(watchCtx, replicaCheck, replicaCheckTimeout)
+			sd := newShutdown(shutdownDelay, shutdownTimeout)
+			ctx, cancel := sd.watch(cmd.Context())
+			defer cancel()
+			// One breaker for both APIs, since they share the database
+			retry := cfg.retry()
+			if cfg.BreakerThreshold > 0 {
+				retry.Breaker = &bench.Breaker{Threshold: cfg.BreakerThreshold, Cooldown: cfg.BreakerCooldown}
+			}
+			reg := prometheus.NewRegistry()
+			m := newAPIMetrics(reg, route, retry.Breaker, cfg.DB.DBName)
+			if clients != nil {
+				clients.metrics = m
+			}
+			var cache *countCache
+			if cfg.RedisAddr != "" {
+				rdb := redis.NewClient(&redis.Options{Addr: cfg.RedisAddr})
+				defer rdb.Close()
+				cache = &countCache{rdb: rdb, ttl: cfg.RedisTTL, metrics: m}
+			}
+			// The deferred closes run once both servers have drained
+			if grpcAddr == "" {
+				return serveAPI(ctx, route, addr, cfg.QueryTimeout, retry, cfg.Estimates, cache, maxAge, reg, m, sd, clients, tenants, targets)
+			}
+
+			// Either server failing takes the other one down
+			errs := make(chan error, 2)
+			go func() {
+				errs <- serveAPI(ctx, route, addr, cfg.QueryTimeout, retry, cfg.Estimates, cache, maxAge, reg, m, sd, clients, tenants, targets)
+			}()
+			go func() {
+				errs <- serveGRPC(ctx, route, grpcAddr, cfg.QueryTimeout, retry, cache, maxAge, m, sd, clients, tenants)
+			}()
+			err = <-errs
+			cancel()
+			return errors.Join(err, <-errs)
+		},
+	}
+	cmd.Flags().StringVar(&addr, "addr", ":8080", "HTTP listen address")
+	cmd.Flags().StringVar(&grpcAddr, "grpc-addr", "", "also serve the gRPC AudienceService on this address, e.g. :9091")
+	cmd.Flags().DurationVar(&replicaCheck, "replica-check-interval", 5*time.Second, "how often the --db-replicas are pinged to decide which take reads")
+	cmd.Flags().DurationVar(&shutdownDelay, "shutdown-delay", 0, "on SIGTERM, keep serving this long with /readyz failing so load balancers stop routing here, e.g. 5s on Kubernetes")
+	cmd.Flags().DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "how long in-flight requests may take to finish on shutdown before they are cancelled")
+	cmd.Flags().StringVar(&tenantHeader, "tenant-header", "", "take each request's tenant from this header (gRPC metadata), set by a gateway that authenticated the caller, e.g. X-Tenant-ID")
+	cmd.Flags().StringVar(&tenantTokens, "tenant-tokens", "", "JSON file of bearer tokens to tenants; requests authenticate with Authorization: Bearer <token> (default: every request is the default tenant's)")
+	cmd.Flags().StringVar(&clientOpts.clientsFile, "api-clients", "", "JSON file of API clients with their keys and rate limits; requests authenticate with an X-API-Key header")
+	cmd.Flags().StringVar(&clientOpts.secretFile, "jwt-secret-file", "", "file of the HS256 secret of JWTs accepted as Authorization: Bearer <token>, whose sub names the client")
+	cmd.Flags().Float64Var(&clientOpts.rate, "rate-limit", 0, "requests per second each client may make on average, unless --api-clients sets its own (0 for no limit)")
+	cmd.Flags().IntVar(&clientOpts.burst, "rate-burst", 0, "requests a client may make at once above --rate-limit (default a second's worth)")
+	bindWebhookAllowFlag(cmd.Flags(), &webhookAllow)
+	cmd.Flags().DurationVar(&maxAge, "materialized-max-age", 15*time.Minute, "answer for a stored audience from its materialization while it was refreshed this recently (0 always counts live)")
+	bindRetryFlags(cmd.Flags(), cfg)
+	cmd.Flags().IntVar(&cfg.BreakerThreshold, "breaker-threshold", 5, "failed queries in a row that open the circuit breaker, 0 disables it")
+	cmd.Flags().DurationVar(&cfg.BreakerCooldown, "breaker-cooldown", 10*time.Second, "how long an open circuit breaker sheds queries before letting one through to probe")
+	bindEstimateFlags(cmd.Flags(), cfg)
+	bindRedisFlags(cmd.Flags(), cfg, "cache exact counts in this Redis")
+	return cmd
+}
+
+// The server-side statement timeout backs up --query-timeout a little later,
+// so timeouts are still reported by the client but a query whose client died
+// or lost its connection can't keep running on the server
+const statementTimeoutMargin = 5 * time.Second
+
+// Derive the statement timeout of query-serving commands from --query-timeout,
+// unless one was configured explicitly (0 included)
+func boundStatements(cmd *cobra.Command, cfg *Config) {
+	if cmd.Flags().Changed("db-statement-timeout") || os.Getenv("DB_STATEMENT_TIMEOUT") != "" || cfg.QueryTimeout <= 0 {
+		return
+	}
+	cfg.DB.StatementTimeout = cfg.QueryTimeout + statementTimeoutMargin
+}
+
+func requirePostgres(cfg *Config, command string) error {
+	if cfg.DB.Driver != "postgres" {
+		return fmt.Errorf("%s is only supported with the postgres driver", command)
+	}
+	return nil
+}
+
+// Open the pool and check the database answers
+func connect(ctx context.Context, cfg Config) (*sql.DB, error) {
+	db, err := store.Open(cfg.DB)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+
+	pingCtx, cancel := bench.QueryContext(ctx, cfg.QueryTimeout)
+	err = db.PingContext(pingCtx)
+	cancel()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("database is not responding: %w", err)
+	}
+
+	fmt.Fprintf(out, "✅ Connected to %s via %s\n", store.Active().Name(), store.StoreOf(db).Name())
+	if err := registerAttributes(ctx, db, cfg); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Make attributes added by schema sync usable in rules (PostgreSQL only)
+func registerAttributes(ctx context.Context, db *sql.DB, cfg Config) error {
+	if cfg.DB.Driver != "postgres" {
+		return nil
+	}
+	regCtx, cancel := bench.QueryContext(ctx, cfg.QueryTimeout)
+	defer cancel()
+	n, err := store.RegisterAttributes(regCtx, db)
+	if err != nil {
+		return fmt.Errorf("failed to load registered attributes: %w", err)
+	}
+	if n > 0 {
+		slog.Debug("registered attributes loaded", "attributes", n)
+	}
+	return nil
+}
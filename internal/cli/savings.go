@@ -0,0 +1,90 @@
+package cli
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Parse "simple=50000,complex_or=12000" into executions per day by rule name
+func parseRuleFrequencies(s string) (map[string]float64, error) {
+	freqs := map[string]float64{}
+	if strings.TrimSpace(s) == "" {
+		return freqs, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid rule frequency %q, expected name=count", pair)
+		}
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || f < 0 {
+			return nil, fmt.Errorf("invalid frequency for rule %q: %q", name, value)
+		}
+		freqs[name] = f
+	}
+	return freqs, nil
+}
+
+// Measured EAV and optimized latency of one benchmarked rule
+type ruleDelta struct {
+	eav       time.Duration
+	optimized time.Duration
+}
+
+type dailySavings struct {
+	perRule      map[string]time.Duration
+	total        time.Duration
+	dollars      float64
+	hasCost      bool
+	unknownRules []string
+	unmeasured   []string
+}
+
+// Sum over rules of frequency × (EAV - optimized) latency, optionally priced per CPU-second.
+// Query wall time is used as a proxy for database CPU time.
+func estimateDailySavings(freqs map[string]float64, deltas map[string]ruleDelta, costPerCPUSecond float64) dailySavings {
+	s := dailySavings{perRule: map[string]time.Duration{}, hasCost: costPerCPUSecond > 0}
+	for name, freq := range freqs {
+		d, ok := deltas[name]
+		if !ok {
+			s.unknownRules = append(s.unknownRules, name)
+			continue
+		}
+		if d.eav <= 0 || d.optimized <= 0 {
+			s.unmeasured = append(s.unmeasured, name)
+			continue
+		}
+		saved := time.Duration(freq * float64(d.eav-d.optimized))
+		s.perRule[name] = saved
+		s.total += saved
+	}
+	s.dollars = s.total.Seconds() * costPerCPUSecond
+	sort.Strings(s.unknownRules)
+	sort.Strings(s.unmeasured)
+	return s
+}
+
+func printDailySavings(s dailySavings, freqs map[string]float64) {
+	fmt.Fprintln(out, "\n💰 Estimated query time saved per day:")
+	names := make([]string, 0, len(s.perRule))
+	for name := range s.perRule {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "   %-12s %10.0f runs/day  %v saved\n", name, freqs[name], s.perRule[name].Round(time.Millisecond))
+	}
+	fmt.Fprintf(out, "Time saved/day:   %v\n", s.total.Round(time.Second))
+	if s.hasCost {
+		fmt.Fprintf(out, "Cost saved/day:   $%.2f\n", s.dollars)
+	}
+	for _, name := range s.unknownRules {
+		fmt.Fprintf(out, "⚠️  Unknown rule %q in --rule-frequency, skipped\n", name)
+	}
+	for _, name := range s.unmeasured {
+		fmt.Fprintf(out, "⚠️  Rule %q has no EAV/optimized measurement, skipped\n", name)
+	}
+}
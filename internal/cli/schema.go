@@ -0,0 +1,95 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"audience-poc/internal/store"
+)
+
+func newSchemaCmd(cfg *Config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "schema",
+		Short: "Manage the attributes of the optimized model",
+		Args:  cobra.NoArgs,
+	}
+	cmd.AddCommand(newSchemaSyncCmd(cfg), newSchemaAdviseCmd(cfg))
+	return cmd
+}
+
+func newSchemaSyncCmd(cfg *Config) *cobra.Command {
+	opts := store.SchemaSyncOptions{MaxColumns: store.DefaultMaxAttributeColumns}
+	cmd := &cobra.Command{
+		Use:   "sync",
+		Short: "Register new user_attributes keys as user_profiles columns or overflow fields",
+		Long: `Find user_attributes keys that are neither built in nor registered, infer their
+type from their values, and add each one to user_profiles as an indexed column (or a
+field of the overflow JSONB column past --max-columns), backfilled from the EAV rows.
+Registered attributes can be used in rules by every other command.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := requirePostgres(cfg, "schema sync"); err != nil {
+				return err
+			}
+			if opts.MaxColumns < 1 {
+				return errors.New("--max-columns must be at least 1")
+			}
+			ctx := cmd.Context()
+			db, err := connect(ctx, *cfg)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			start := time.Now()
+			found, err := store.SyncSchema(ctx, db, opts)
+			printNewAttributes(found, opts.DryRun)
+			if err != nil {
+				return fmt.Errorf("schema sync failed: %w", err)
+			}
+			fmt.Fprintf(summaryOut, "🧬 Schema sync took %v\n", time.Since(start).Round(time.Millisecond))
+			return nil
+		},
+	}
+	f := cmd.Flags()
+	f.BoolVar(&opts.Overflow, "overflow", false, "put every new attribute in the overflow JSONB column instead of a column of its own")
+	f.IntVar(&opts.MaxColumns, "max-columns", opts.MaxColumns, "attribute columns user_profiles may have before new attributes overflow")
+	f.BoolVar(&opts.DryRun, "dry-run", false, "only report the attributes that would be added")
+	return cmd
+}
+
+func printNewAttributes(found []store.NewAttribute, dryRun bool) {
+	if len(found) == 0 {
+		fmt.Fprintln(summaryOut, "✅ Every user_attributes key is already registered")
+		return
+	}
+	added := 0
+	for _, a := range found {
+		if a.Skipped == "" {
+			added++
+		}
+	}
+	verb := "Added"
+	if dryRun {
+		verb = "Would add"
+	}
+	fmt.Fprintf(summaryOut, "🧬 %s %d of %d new user_attributes keys\n", verb, added, len(found))
+	tw := tabwriter.NewWriter(summaryOut, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "attribute\ttype\tstorage\tindex\trows\tusers")
+	for _, a := range found {
+		if a.Skipped != "" {
+			fmt.Fprintf(tw, "%s\t-\tskipped: %s\t\t%d\t%d\n", a.Name, a.Skipped, a.Rows, a.Users)
+			continue
+		}
+		storage, index := "column", a.Index
+		if a.Overflow {
+			storage, index = "overflow", "idx_overflow"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\n", a.Name, a.Type, storage, index, a.Rows, a.Users)
+	}
+	tw.Flush()
+}
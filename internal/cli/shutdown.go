@@ -0,0 +1,53 @@
+package cli
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Graceful shutdown of serve. On SIGTERM or Ctrl+C /readyz turns 503 at once,
+// the servers keep accepting for delay so load balancers take the instance out
+// of rotation, then they stop accepting and give in-flight requests up to
+// timeout to finish before their queries are cancelled
+type shutdown struct {
+	delay    time.Duration
+	timeout  time.Duration
+	draining chan struct{} // closed when shutdown starts
+}
+
+func newShutdown(delay, timeout time.Duration) *shutdown {
+	return &shutdown{delay: delay, timeout: timeout, draining: make(chan struct{})}
+}
+
+func (s *shutdown) isDraining() bool {
+	select {
+	case <-s.draining:
+		return true
+	default:
+	}
+	return false
+}
+
+// Context of the servers: done delay after parent, or when cancelled, e.g.
+// because one of the servers failed. It doesn't carry parent's cancellation,
+// so the servers keep accepting during delay; once it is done they stop
+// accepting and drain.
+func (s *shutdown) watch(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.WithoutCancel(parent))
+	go func() {
+		select {
+		case <-parent.Done():
+		case <-ctx.Done():
+			return
+		}
+		close(s.draining)
+		slog.Info("shutting down: unready, then draining", "delay", s.delay.String(), "timeout", s.timeout.String())
+		select {
+		case <-time.After(s.delay):
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+	return ctx, cancel
+}
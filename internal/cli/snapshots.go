@@ -0,0 +1,241 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/redis/go-redis/v9"
+	"github.com/robfig/cron/v3"
+	"github.com/spf13/cobra"
+
+	"audience-poc/internal/bench"
+	"audience-poc/internal/store"
+)
+
+func newSnapshotsCmd(cfg *Config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "snapshots",
+		Short: "Record stored audience sizes on a schedule and report their trend",
+		Args:  cobra.NoArgs,
+	}
+	cmd.AddCommand(newSnapshotsRunCmd(cfg), newSnapshotsReportCmd(cfg))
+	bindTenantFlag(cmd.PersistentFlags(), cfg)
+	return cmd
+}
+
+func newSnapshotsRunCmd(cfg *Config) *cobra.Command {
+	var spec, redisAddr, natsURL string
+	var once bool
+	notify := notifyOptions{timeout: 10 * time.Second, attempts: 3}
+	cmd := &cobra.Command{
+		Use:   "run",
+		Short: "Evaluate every stored audience on a cron schedule, record the counts and fire their triggers",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			schedule, err := cron.ParseStandard(spec)
+			if err != nil {
+				return fmt.Errorf("invalid --schedule %q: %w", spec, err)
+			}
+			var rdb *redis.Client
+			if redisAddr != "" {
+				rdb = redis.NewClient(&redis.Options{Addr: redisAddr})
+				defer rdb.Close()
+			}
+			ctx := cmd.Context()
+			var js jetstream.JetStream
+			if natsURL != "" {
+				nc, stream, err := connectTriggerNATS(ctx, natsURL, notify.timeout)
+				if err != nil {
+					return err
+				}
+				defer nc.Close()
+				js = stream
+			}
+			n, err := newNotifier(notify, rdb, js)
+			if err != nil {
+				return err
+			}
+			db, err := connectAudiences(ctx, cfg)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+			if once {
+				return takeSnapshots(ctx, db, n, cfg.QueryTimeout)
+			}
+			return runSnapshots(ctx, db, n, schedule, cfg.QueryTimeout)
+		},
+	}
+	f := cmd.Flags()
+	f.StringVar(&spec, "schedule", "0 6 * * *", "cron schedule (minute hour day month weekday, or @daily, @every 1h)")
+	f.BoolVar(&once, "once", false, "take one round of snapshots now and exit, for an external scheduler")
+	f.StringVar(&redisAddr, "redis", "", "Redis that redis:CHANNEL triggers publish on, e.g. localhost:6379")
+	f.StringVar(&natsURL, "nats", "", "NATS server whose JetStream nats:SUBJECT triggers publish to, e.g. nats://localhost:4222")
+	f.StringVar(&notify.secretFile, "webhook-secret-file", "", "file holding the key webhook bodies are signed with, in the "+signatureHeader+" header")
+	f.DurationVar(&notify.timeout, "webhook-timeout", notify.timeout, "deadline of one webhook request or NATS publish")
+	f.IntVar(&notify.attempts, "webhook-attempts", notify.attempts, "tries per webhook or NATS delivery before it is given up")
+	bindWebhookAllowFlag(f, &notify.allow)
+	return cmd
+}
+
+// Take a round of snapshots at every tick of the schedule until ctx is done
+func runSnapshots(ctx context.Context, db *sql.DB, n *notifier, schedule cron.Schedule, timeout time.Duration) error {
+	for {
+		next := schedule.Next(time.Now())
+		fmt.Fprintf(out, "⏰ Next snapshot at %s\n", next.Format(time.DateTime))
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Until(next)):
+		}
+		// A failed round is logged, the schedule carries on
+		if err := takeSnapshots(ctx, db, n, timeout); err != nil && ctx.Err() == nil {
+			slog.Error("snapshot round failed", "err", err)
+		}
+	}
+}
+
+// Count every stored audience against the optimized model and record the
+// results under one timestamp; audiences whose query fails are skipped.
+// Triggers are checked against each audience's previous snapshot, so an
+// audience's first snapshot fires none.
+func takeSnapshots(ctx context.Context, db *sql.DB, n *notifier, timeout time.Duration) error {
+	listCtx, cancel := bench.QueryContext(ctx, timeout)
+	defer cancel()
+	audiences, err := store.ListAudiences(listCtx, db, "")
+	if err != nil {
+		return fmt.Errorf("failed to list audiences: %w", err)
+	}
+	all, err := store.ListTriggers(listCtx, db, 0)
+	if err != nil {
+		return fmt.Errorf("failed to list triggers: %w", err)
+	}
+	triggers := map[int64][]store.Trigger{}
+	for _, t := range all {
+		triggers[t.AudienceID] = append(triggers[t.AudienceID], t)
+	}
+
+	takenAt := time.Now()
+	var recorded, failed, sent, undelivered int
+	for _, a := range audiences {
+		count, duration, err := bench.RunWithTimeout(store.WithTenant(ctx, a.Tenant), optimizedCount(db, a.Rule), timeout)
+		var previous int64
+		var hasPrevious bool
+		if err == nil {
+			writeCtx, cancel := bench.QueryContext(ctx, timeout)
+			if len(triggers[a.ID]) > 0 {
+				previous, hasPrevious, err = store.LatestSnapshotUsers(writeCtx, db, a.ID)
+			}
+			if err == nil {
+				err = store.RecordSnapshot(writeCtx, db, store.Snapshot{
+					AudienceID: a.ID,
+					Rule:       a.Rule,
+					Users:      int64(count),
+					Duration:   duration,
+					TakenAt:    takenAt,
+				})
+			}
+			cancel()
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			failed++
+			slog.Warn("audience snapshot failed", "audience_id", a.ID, "name", a.Name, "err", err)
+			continue
+		}
+		recorded++
+		if hasPrevious {
+			ok, notOK := fireTriggers(ctx, n, triggers[a.ID], a, previous, int64(count), takenAt)
+			sent += ok
+			undelivered += notOK
+		}
+	}
+	fmt.Fprintf(out, "📸 Recorded %d audience snapshots in %v", recorded, time.Since(takenAt).Round(time.Millisecond))
+	if failed > 0 {
+		fmt.Fprintf(out, ", %d failed", failed)
+	}
+	if sent > 0 {
+		fmt.Fprintf(out, ", %d notifications sent", sent)
+	}
+	if undelivered > 0 {
+		fmt.Fprintf(out, ", %d undelivered", undelivered)
+	}
+	fmt.Fprintln(out)
+	return nil
+}
+
+func newSnapshotsReportCmd(cfg *Config) *cobra.Command {
+	var period string
+	var since time.Duration
+	var audienceID int64
+	cmd := &cobra.Command{
+		Use:   "report",
+		Short: "Show audience sizes per period and their change",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if since <= 0 {
+				return errors.New("--since must be positive")
+			}
+			ctx := cmd.Context()
+			db, err := connectAudiences(ctx, cfg)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			queryCtx, cancel := bench.QueryContext(ctx, cfg.QueryTimeout)
+			defer cancel()
+			points, err := store.SnapshotTrend(queryCtx, db, period, time.Now().Add(-since), audienceID)
+			if err != nil {
+				return fmt.Errorf("failed to load snapshots: %w", err)
+			}
+			printTrend(points, period)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&period, "period", "week", "bucket snapshots by day, week or month")
+	cmd.Flags().DurationVar(&since, "since", 12*7*24*time.Hour, "how far back to report")
+	cmd.Flags().Int64Var(&audienceID, "audience", 0, "only this audience id")
+	return cmd
+}
+
+// One table per audience: size at the end of each period and the change from the period before
+func printTrend(points []store.TrendPoint, period string) {
+	if len(points) == 0 {
+		fmt.Fprintln(summaryOut, "No snapshots in this range; record some with `snapshots run`")
+		return
+	}
+	for start := 0; start < len(points); {
+		end := start + 1
+		for end < len(points) && points[end].AudienceID == points[start].AudienceID {
+			end++
+		}
+		if start > 0 {
+			fmt.Fprintln(summaryOut)
+		}
+		fmt.Fprintf(summaryOut, "📈 %s (audience %d)\n", points[start].Name, points[start].AudienceID)
+		tw := tabwriter.NewWriter(summaryOut, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintf(tw, "%s\tusers\tchange\t\n", period)
+		for i := start; i < end; i++ {
+			p, change := points[i], "-"
+			if i > start {
+				prev := points[i-1]
+				change = fmt.Sprintf("%+d", p.Users-prev.Users)
+				if prev.Users > 0 {
+					change += fmt.Sprintf(" (%+.1f%%)", float64(p.Users-prev.Users)/float64(prev.Users)*100)
+				}
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%s\t\n", p.Period.Format(time.DateOnly), p.Users, change)
+		}
+		tw.Flush()
+		start = end
+	}
+}
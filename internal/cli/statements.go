@@ -0,0 +1,81 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"audience-poc/internal/bench"
+	"audience-poc/internal/store"
+)
+
+// Server-side totals of a test's runs with --pg-stat-statements
+type jsonStatements struct {
+	Statements     int     `json:"statements"` // more than 1 when other sessions ran queries too
+	Calls          int64   `json:"calls"`
+	Rows           int64   `json:"rows"`
+	TotalExecMS    float64 `json:"total_exec_ms"`
+	SharedBlksHit  int64   `json:"shared_blks_hit"`
+	SharedBlksRead int64   `json:"shared_blks_read"`
+	HitRatio       float64 `json:"hit_ratio"`
+}
+
+func jsonStatementsOf(s *store.StatementStats) *jsonStatements {
+	if s == nil {
+		return nil
+	}
+	return &jsonStatements{
+		Statements:     s.Statements,
+		Calls:          s.Calls,
+		Rows:           s.Rows,
+		TotalExecMS:    ms(s.ExecTime),
+		SharedBlksHit:  s.SharedHit,
+		SharedBlksRead: s.SharedRead,
+		HitRatio:       s.HitRatio(),
+	}
+}
+
+// Resets pg_stat_statements before a model's runs and reads it after, so the
+// totals are the server's view of exactly those runs; nil measures without it
+type statementTracker struct {
+	db      *sql.DB
+	timeout time.Duration
+}
+
+func (t *statementTracker) run(ctx context.Context, fn bench.QueryFunc, opts bench.Options) (bench.Result, *store.StatementStats) {
+	if t == nil {
+		return bench.Run(ctx, fn, opts), nil
+	}
+	resetCtx, cancel := bench.QueryContext(ctx, t.timeout)
+	err := store.ResetStatementStats(resetCtx, t.db)
+	cancel()
+	if err != nil {
+		slog.Warn("failed to reset pg_stat_statements", "err", err)
+		return bench.Run(ctx, fn, opts), nil
+	}
+	r := bench.Run(ctx, fn, opts)
+	readCtx, cancel := bench.QueryContext(ctx, t.timeout)
+	defer cancel()
+	s, err := store.ReadStatementStats(readCtx, t.db)
+	if err != nil {
+		slog.Warn("failed to read pg_stat_statements", "err", err)
+		return r, nil
+	}
+	return r, &s
+}
+
+func printStatements(s store.StatementStats) {
+	if s.Calls == 0 {
+		fmt.Fprintf(out, "%-17s no statements recorded\n", "Server stats:")
+		return
+	}
+	line := fmt.Sprintf("%-17s %d calls, %v exec per call, %d rows, %d blocks hit, %d read (%.1f%% cached)",
+		"Server stats:", s.Calls, (s.ExecTime / time.Duration(s.Calls)).Round(time.Microsecond),
+		s.Rows, s.SharedHit, s.SharedRead, s.HitRatio()*100)
+	if s.Statements > 1 {
+		line += fmt.Sprintf(", %d statements: other sessions ran queries too", s.Statements)
+	}
+	fmt.Fprintln(out, line)
+}
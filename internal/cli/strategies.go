@@ -0,0 +1,144 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"audience-poc/internal/bench"
+	"audience-poc/internal/store"
+)
+
+// A way of serving optimized-model queries. Setup runs inside a transaction
+// that is rolled back afterwards, so strategies never leak into each other
+// or into the real schema.
+type optimizedStrategy struct {
+	name  string
+	setup []string
+}
+
+// Registered strategies, compared side by side with --compare-strategies
+var optimizedStrategies = []optimizedStrategy{
+	{
+		name: "Full scan",
+		setup: []string{
+			`SET LOCAL enable_indexscan = off`,
+			`SET LOCAL enable_indexonlyscan = off`,
+			`SET LOCAL enable_bitmapscan = off`,
+		},
+	},
+	{
+		// A regular composite b-tree, with the partial indexes out of the way
+		name: "B-tree index",
+		setup: []string{
+			`DROP INDEX idx_has_purchased`,
+			`DROP INDEX idx_high_spender`,
+			`CREATE INDEX idx_strategy_btree_purchase ON user_profiles (has_purchased, total_spend)`,
+			`SET LOCAL enable_seqscan = off`,
+		},
+	},
+	{
+		// Only purchasers are indexed, so spend-based segments read a fraction of the rows
+		name: "Partial index",
+		setup: []string{
+			`CREATE INDEX idx_strategy_partial_purchase ON user_profiles (total_spend) WHERE has_purchased = true`,
+			`SET LOCAL enable_seqscan = off`,
+		},
+	},
+}
+
+// Run every case against one strategy inside a rolled-back transaction
+func runStrategy(ctx context.Context, db *sql.DB, s optimizedStrategy, cases []benchCase, opts bench.Options) ([]bench.Result, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Index builds on a large table can outlast the per-query statement timeout
+	if err := store.UnboundedStatements(ctx, tx); err != nil {
+		return nil, err
+	}
+	for _, q := range s.setup {
+		if _, err := tx.ExecContext(ctx, q); err != nil {
+			return nil, fmt.Errorf("%s setup: %w", s.name, err)
+		}
+	}
+
+	results := make([]bench.Result, len(cases))
+	for i, c := range cases {
+		results[i] = bench.Run(ctx, optimizedCount(tx, c.rule), opts)
+	}
+	return results, nil
+}
+
+// Compare the registered strategies on the same rules
+func compareStrategies(ctx context.Context, db *sql.DB, cases []benchCase, opts bench.Options) error {
+	fmt.Fprintln(out, "\n📊 Optimized strategies (median latency)")
+	fmt.Fprintln(out, strings.Repeat("-", 50))
+
+	table := make([][]bench.Result, len(optimizedStrategies))
+	for i, s := range optimizedStrategies {
+		results, err := runStrategy(ctx, db, s, cases, opts)
+		if err != nil {
+			return err
+		}
+		table[i] = results
+	}
+
+	fmt.Fprintf(out, "%-14s", "Test")
+	for _, s := range optimizedStrategies {
+		fmt.Fprintf(out, " %16s", s.name)
+	}
+	fmt.Fprintln(out)
+
+	var failed []string
+	for ci, c := range cases {
+		fmt.Fprintf(out, "%-14s", c.name)
+		best, bestMedian := -1, int64(0)
+		for si := range optimizedStrategies {
+			r := table[si][ci]
+			switch {
+			case r.TimedOut:
+				fmt.Fprintf(out, " %16s", "timed out")
+			case r.Err != nil:
+				fmt.Fprintf(out, " %16s", "error")
+				failed = append(failed, fmt.Sprintf("%s/%s: %v", optimizedStrategies[si].name, c.name, r.Err))
+			default:
+				fmt.Fprintf(out, " %16v", r.Stats.Median)
+				if best < 0 || int64(r.Stats.Median) < bestMedian {
+					best, bestMedian = si, int64(r.Stats.Median)
+				}
+			}
+		}
+		fmt.Fprintln(out)
+
+		if best >= 0 {
+			fmt.Fprintf(out, "%-14s 🏆 %s\n", "", optimizedStrategies[best].name)
+		}
+		if counts := strategyCounts(table, ci); len(counts) > 1 {
+			fmt.Fprintf(out, "⚠️  %s: strategies disagree on the count: %v\n", c.name, counts)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// Distinct counts returned by the strategies for one case
+func strategyCounts(table [][]bench.Result, caseIndex int) []int {
+	seen := map[int]bool{}
+	var counts []int
+	for _, results := range table {
+		r := results[caseIndex]
+		if r.Err != nil || seen[r.Count] {
+			continue
+		}
+		seen[r.Count] = true
+		counts = append(counts, r.Count)
+	}
+	return counts
+}
@@ -0,0 +1,392 @@
+package cli
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"audience-poc/internal/bench"
+	"audience-poc/internal/rules"
+	"audience-poc/internal/store"
+)
+
+// Latency the optimized model has to stay under, as in the extrapolation
+const sweepTarget = 2 * time.Second
+
+type sweepOptions struct {
+	sizes        []int // ascending
+	distribution store.Distribution
+	// Seed the largest size once and delete users down to each smaller one, instead of seeding every size
+	truncate bool
+	opts     bench.Options
+	rules    []string
+	format   string
+	outFile  string
+}
+
+// One model and test at one dataset size
+type sweepPoint struct {
+	Users    int     `json:"users"`
+	TestName string  `json:"test_name"`
+	Model    string  `json:"model"`
+	Count    int     `json:"count"`
+	MedianMS float64 `json:"median_ms"`
+	P95MS    float64 `json:"p95_ms"`
+	TimedOut bool    `json:"timed_out,omitempty"`
+	Error    string  `json:"error,omitempty"`
+	// Not run because the model already timed out or failed at a smaller size
+	Skipped bool `json:"skipped,omitempty"`
+}
+
+// How one model's latency grew over the sweep
+type sweepCurve struct {
+	TestName string   `json:"test_name"`
+	Model    string   `json:"model"`
+	Exponent *float64 `json:"exponent,omitempty"` // log-log slope, see bench.ScalingExponent; nil under two points
+	BestFit  string   `json:"best_fit,omitempty"`
+	R2       float64  `json:"r2,omitempty"`
+	// Smallest size whose median reached sweepTarget or that timed out; 0 if none
+	BreaksAt int `json:"breaks_at,omitempty"`
+}
+
+type sweepReport struct {
+	Sizes  []int        `json:"sizes"`
+	Points []sweepPoint `json:"points"`
+	Curves []sweepCurve `json:"curves"`
+}
+
+func newBenchSweepCmd(cfg *Config) *cobra.Command {
+	o := sweepOptions{opts: bench.Options{Warmup: 1, Iterations: 5}}
+	var distribution string
+	cmd := &cobra.Command{
+		Use:   "sweep",
+		Short: "Re-seed the dataset at several sizes and measure every model at each, for latency-vs-users curves",
+		Long: `Seed the synthetic dataset at each --sizes, run the benchmark rules against the
+EAV, optimized and JSONB models, and report how each model's latency grows with the
+number of users. This replaces the dataset, like seed.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := requirePostgres(cfg, "bench sweep"); err != nil {
+				return err
+			}
+			var err error
+			if o.distribution, err = store.ParseDistribution(distribution); err != nil {
+				return fmt.Errorf("invalid --distribution: %w", err)
+			}
+			if err := o.validate(); err != nil {
+				return err
+			}
+			o.opts.Timeout, o.opts.Retry = cfg.QueryTimeout, cfg.retry()
+			if o.format == "json" {
+				out, summaryOut = io.Discard, io.Discard
+			}
+			return runSweep(cmd.Context(), *cfg, o)
+		},
+	}
+	f := cmd.Flags()
+	f.Func("sizes", "dataset sizes in users, e.g. 100k,1m,5m,10m (required)", func(s string) error {
+		for _, part := range strings.Split(s, ",") {
+			n, err := parseUserCount(part)
+			if err != nil {
+				return err
+			}
+			o.sizes = append(o.sizes, n)
+		}
+		return nil
+	})
+	cmd.MarkFlagRequired("sizes")
+	f.StringVar(&distribution, "distribution", string(store.Zipf), "attribute distribution: zipf (production-like skew) or uniform (matches init.sql)")
+	f.BoolVar(&o.truncate, "truncate", false, "seed the largest size once and delete users down to each smaller one, instead of seeding every size")
+	f.Func("rule", "audience rule to measure instead of the built-in tests, repeatable", func(s string) error {
+		if _, err := rules.Parse(s); err != nil {
+			return err
+		}
+		o.rules = append(o.rules, s)
+		return nil
+	})
+	f.IntVar(&o.opts.Iterations, "iterations", o.opts.Iterations, "measured runs per query and size")
+	f.IntVar(&o.opts.Warmup, "warmup", o.opts.Warmup, "warm-up runs per query and size")
+	f.StringVar(&o.format, "format", "text", "output format: text or json")
+	f.StringVar(&o.outFile, "out-file", "", "also write the curves to this file, as CSV (.csv) or JSON (.json)")
+	return cmd
+}
+
+func (o *sweepOptions) validate() error {
+	sort.Ints(o.sizes)
+	for i, n := range o.sizes {
+		if i > 0 && n == o.sizes[i-1] {
+			return fmt.Errorf("--sizes lists %d twice", n)
+		}
+	}
+	switch {
+	case len(o.sizes) < 2:
+		return errors.New("--sizes needs at least 2 sizes to draw a curve")
+	case o.opts.Iterations < 1 || o.opts.Warmup < 0:
+		return errors.New("--iterations must be at least 1 and --warmup non-negative")
+	case o.format != "text" && o.format != "json":
+		return fmt.Errorf("unknown --format %q, expected text or json", o.format)
+	}
+	if o.outFile != "" {
+		if ext := strings.ToLower(filepath.Ext(o.outFile)); ext != ".csv" && ext != ".json" {
+			return fmt.Errorf("--out-file %q must end in .csv or .json", o.outFile)
+		}
+	}
+	return nil
+}
+
+// 100k, 1m, 2.5M or a plain number of users
+func parseUserCount(s string) (int, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	multiplier := 1.0
+	switch {
+	case strings.HasSuffix(s, "k"):
+		s, multiplier = s[:len(s)-1], 1e3
+	case strings.HasSuffix(s, "m"):
+		s, multiplier = s[:len(s)-1], 1e6
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	n := int(f * multiplier)
+	if err != nil || n < 1000 {
+		return 0, fmt.Errorf("invalid size %q: expected at least 1000 users, e.g. 100k or 1m", s)
+	}
+	return n, nil
+}
+
+func runSweep(ctx context.Context, cfg Config, o sweepOptions) error {
+	db, err := connect(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	cases := benchCasesFor(o.rules)
+	fmt.Fprintf(out, "📐 Size sweep over %s users, %d rules, %d measured runs per query\n",
+		joinSizes(o.sizes), len(cases), o.opts.Iterations)
+	fmt.Fprintln(out, strings.Repeat("=", 60))
+
+	// Smallest first when seeding each size, so a failing model is found early;
+	// largest first when deleting down from it
+	order := append([]int(nil), o.sizes...)
+	if o.truncate {
+		sort.Sort(sort.Reverse(sort.IntSlice(order)))
+	}
+	report := sweepReport{Sizes: o.sizes}
+	broken := map[string]bool{} // test/model that timed out or failed at a smaller size
+	for i, n := range order {
+		start := time.Now()
+		if o.truncate && i > 0 {
+			err = store.TruncateUsers(ctx, db, n)
+		} else {
+			err = store.Seed(ctx, db, n, o.distribution)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to prepare %d users: %w", n, err)
+		}
+		fmt.Fprintf(out, "\n🌱 %d users ready in %v\n", n, time.Since(start).Round(time.Millisecond))
+
+		for _, c := range cases {
+			for _, m := range sweepModels(c) {
+				p := sweepPoint{Users: n, TestName: c.name, Model: m.name}
+				key := c.name + "/" + m.name
+				// Only meaningful going up: a model that broke at a smaller size is skipped after it
+				if broken[key] && !o.truncate {
+					p.Skipped = true
+					report.Points = append(report.Points, p)
+					continue
+				}
+				r := bench.Run(ctx, m.query(db, c.rule), o.opts)
+				printBenchResult(fmt.Sprintf("%s %s", c.label, m.label), r, "test", c.name, "users", n)
+				p.Count, p.TimedOut = r.Count, r.TimedOut
+				p.MedianMS, p.P95MS = ms(r.Stats.Median), ms(r.Stats.P95)
+				if r.Err != nil && !r.TimedOut {
+					p.Error = r.Err.Error()
+				}
+				broken[key] = r.Err != nil || r.TimedOut
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				report.Points = append(report.Points, p)
+			}
+		}
+	}
+
+	sort.SliceStable(report.Points, func(i, j int) bool { return report.Points[i].Users < report.Points[j].Users })
+	report.Curves = sweepCurves(cases, report.Points)
+	printSweep(report, cases)
+	if o.format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	}
+	if o.outFile != "" {
+		if err := writeSweepFile(o.outFile, report); err != nil {
+			return fmt.Errorf("failed to write %s: %w", o.outFile, err)
+		}
+	}
+	return nil
+}
+
+type sweepModel struct {
+	name, label string
+	query       func(store.Querier, string) bench.QueryFunc
+}
+
+// The SQL models; seeding always builds user_profiles_jsonb
+func sweepModels(c benchCase) []sweepModel {
+	var models []sweepModel
+	if c.withEAV {
+		models = append(models, sweepModel{"eav", "EAV", eavCount})
+	}
+	return append(models, sweepModel{"optimized", "optimized", optimizedCount}, sweepModel{"jsonb", "JSONB", jsonbCount})
+}
+
+func sweepCurves(cases []benchCase, points []sweepPoint) []sweepCurve {
+	var curves []sweepCurve
+	for _, c := range cases {
+		for _, m := range sweepModels(c) {
+			curve := sweepCurve{TestName: c.name, Model: m.name}
+			var sizes []float64
+			var latencies []time.Duration
+			for _, p := range points {
+				if p.TestName != c.name || p.Model != m.name || p.Skipped {
+					continue
+				}
+				median := time.Duration(p.MedianMS * float64(time.Millisecond))
+				if curve.BreaksAt == 0 && (p.TimedOut || median >= sweepTarget) {
+					curve.BreaksAt = p.Users
+				}
+				if p.Error == "" {
+					sizes = append(sizes, float64(p.Users))
+					latencies = append(latencies, median)
+				}
+			}
+			if e := bench.ScalingExponent(sizes, latencies); !math.IsNaN(e) {
+				curve.Exponent = &e
+			}
+			// Two points fit any line exactly, so a fit says nothing until there are three
+			if len(sizes) >= 3 {
+				best := bench.FitGrowth(bench.GrowthModels[0], sizes, latencies, sizes[len(sizes)-1])
+				for _, gm := range bench.GrowthModels[1:] {
+					if fit := bench.FitGrowth(gm, sizes, latencies, sizes[len(sizes)-1]); fit.R2 > best.R2 {
+						best = fit
+					}
+				}
+				curve.BestFit, curve.R2 = best.Model.Name, best.R2
+			}
+			curves = append(curves, curve)
+		}
+	}
+	return curves
+}
+
+// One table per test, sizes down and models across, then how each model scaled
+func printSweep(report sweepReport, cases []benchCase) {
+	fmt.Fprintln(summaryOut, "\n📐 Median latency by dataset size")
+	fmt.Fprintln(summaryOut, strings.Repeat("-", 50))
+	for _, c := range cases {
+		models := sweepModels(c)
+		fmt.Fprintf(summaryOut, "\n%s (%s)\n", c.label, c.rule)
+		tw := tabwriter.NewWriter(summaryOut, 0, 0, 2, ' ', tabwriter.AlignRight)
+		header := "USERS\t"
+		for _, m := range models {
+			header += strings.ToUpper(m.name) + "\t"
+		}
+		fmt.Fprintln(tw, header)
+		for _, n := range report.Sizes {
+			row := fmt.Sprintf("%d\t", n)
+			for _, m := range models {
+				row += sweepCell(report.Points, n, c.name, m.name) + "\t"
+			}
+			fmt.Fprintln(tw, row)
+		}
+		tw.Flush()
+		for _, curve := range report.Curves {
+			if curve.TestName != c.name {
+				continue
+			}
+			line := fmt.Sprintf("  %-10s too few points to fit", curve.Model+":")
+			if curve.Exponent != nil {
+				line = fmt.Sprintf("  %-10s grows as n^%.2f", curve.Model+":", *curve.Exponent)
+			}
+			if curve.BestFit != "" {
+				line += fmt.Sprintf(", best fit %s (R²=%.3f)", curve.BestFit, curve.R2)
+			}
+			if curve.BreaksAt > 0 {
+				line += fmt.Sprintf(", ❌ over %v from %d users", sweepTarget, curve.BreaksAt)
+			} else {
+				line += fmt.Sprintf(", ✅ under %v at every size", sweepTarget)
+			}
+			fmt.Fprintln(summaryOut, line)
+		}
+	}
+}
+
+func sweepCell(points []sweepPoint, users int, test, model string) string {
+	for _, p := range points {
+		if p.Users != users || p.TestName != test || p.Model != model {
+			continue
+		}
+		switch {
+		case p.Skipped:
+			return "-"
+		case p.TimedOut:
+			return "timeout"
+		case p.Error != "":
+			return "error"
+		}
+		return fmt.Sprintf("%.1fms", p.MedianMS)
+	}
+	return ""
+}
+
+// CSV is one row per point, for plotting; JSON is the whole report
+func writeSweepFile(path string, report sweepReport) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	} else {
+		cw := csv.NewWriter(f)
+		cw.Write([]string{"users", "test_name", "model", "count", "median_ms", "p95_ms", "timed_out", "error", "skipped"})
+		for _, p := range report.Points {
+			cw.Write([]string{
+				strconv.Itoa(p.Users), p.TestName, p.Model, strconv.Itoa(p.Count),
+				strconv.FormatFloat(p.MedianMS, 'f', 3, 64), strconv.FormatFloat(p.P95MS, 'f', 3, 64),
+				strconv.FormatBool(p.TimedOut), p.Error, strconv.FormatBool(p.Skipped),
+			})
+		}
+		cw.Flush()
+		err = cw.Error()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func joinSizes(sizes []int) string {
+	parts := make([]string, len(sizes))
+	for i, n := range sizes {
+		parts[i] = strconv.Itoa(n)
+	}
+	return strings.Join(parts, ", ")
+}
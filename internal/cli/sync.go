@@ -0,0 +1,161 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
+
+	"audience-poc/internal/bench"
+	"audience-poc/internal/store"
+)
+
+type syncOptions struct {
+	batchSize    int
+	pollInterval time.Duration
+	metricsAddr  string
+	once         bool // drain the queue and exit instead of tailing it
+	// serve's count cache, emptied after every round that changed profiles; nil without --redis
+	rdb *redis.Client
+}
+
+type syncMetrics struct {
+	lag      prometheus.Gauge
+	pending  prometheus.Gauge
+	changes  prometheus.Counter
+	users    prometheus.Counter
+	failures prometheus.Counter
+	// Count cache clears and the keys they dropped
+	invalidations prometheus.Counter
+	invalidated   prometheus.Counter
+}
+
+func newSyncMetrics(reg prometheus.Registerer) *syncMetrics {
+	m := &syncMetrics{
+		lag: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "audience_sync_lag_seconds",
+			Help: "Age of the oldest EAV change not yet applied to user_profiles.",
+		}),
+		pending: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "audience_sync_pending_changes",
+			Help: "EAV changes queued in user_attributes_changes.",
+		}),
+		changes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "audience_sync_applied_changes_total",
+			Help: "EAV changes applied to user_profiles.",
+		}),
+		users: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "audience_sync_users_total",
+			Help: "Users re-pivoted into user_profiles.",
+		}),
+		failures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "audience_sync_failures_total",
+			Help: "Sync batches that failed and were retried.",
+		}),
+		invalidations: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "audience_sync_cache_invalidations_total",
+			Help: "Times the Redis count cache was cleared after applying changes.",
+		}),
+		invalidated: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "audience_sync_cache_invalidated_keys_total",
+			Help: "Cached counts dropped by cache invalidations.",
+		}),
+	}
+	reg.MustRegister(m.lag, m.pending, m.changes, m.users, m.failures, m.invalidations, m.invalidated)
+	return m
+}
+
+// Apply EAV changes to user_profiles until ctx is done (or the queue is empty with once)
+func runSync(ctx context.Context, db *sql.DB, opts syncOptions, timeout time.Duration) error {
+	reg := prometheus.NewRegistry()
+	m := newSyncMetrics(reg)
+	if opts.metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+		srv := &http.Server{Addr: opts.metricsAddr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("metrics server failed", "err", err)
+			}
+		}()
+		defer func() {
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			srv.Shutdown(shutdownCtx)
+		}()
+		fmt.Fprintf(out, "📡 Serving sync metrics on %s/metrics\n", opts.metricsAddr)
+	}
+	fmt.Fprintf(out, "🔄 Applying user_attributes changes to user_profiles, %d per batch\n", opts.batchSize)
+
+	var applied int64
+	for {
+		lagCtx, cancel := bench.QueryContext(ctx, timeout)
+		lag, err := store.SyncLagOf(lagCtx, db)
+		cancel()
+		if err == nil {
+			m.lag.Set(lag.Oldest.Seconds())
+			m.pending.Set(float64(lag.Pending))
+		} else if ctx.Err() == nil {
+			slog.Warn("sync lag query failed", "err", err)
+		}
+
+		// Drain the backlog batch by batch, then wait for new changes
+		var round int64
+		for ctx.Err() == nil {
+			batchCtx, cancel := bench.QueryContext(ctx, timeout)
+			b, err := store.SyncChanges(batchCtx, db, opts.batchSize)
+			cancel()
+			if err != nil {
+				if ctx.Err() != nil {
+					break
+				}
+				m.failures.Inc()
+				slog.Warn("sync batch failed", "err", err)
+				if opts.once {
+					return fmt.Errorf("sync: %w", err)
+				}
+				break
+			}
+			if b.Changes == 0 {
+				break
+			}
+			applied += b.Changes
+			round += b.Changes
+			m.changes.Add(float64(b.Changes))
+			m.users.Add(float64(b.Users))
+			slog.Debug("sync batch applied", "changes", b.Changes, "users", b.Users)
+		}
+		// Once per round rather than per batch, so a long backlog doesn't keep the cache cold
+		if round > 0 && opts.rdb != nil {
+			cacheCtx, cancel := bench.QueryContext(ctx, timeout)
+			dropped, err := invalidateCounts(cacheCtx, opts.rdb)
+			cancel()
+			m.invalidated.Add(float64(dropped))
+			if err != nil {
+				// Entries left behind still expire with --redis-ttl
+				slog.Warn("count cache invalidation failed", "err", err)
+			} else {
+				m.invalidations.Inc()
+				slog.Debug("count cache invalidated", "keys", dropped)
+			}
+		}
+
+		if opts.once && ctx.Err() == nil {
+			fmt.Fprintf(out, "✅ Applied %d changes, user_profiles is up to date\n", applied)
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			fmt.Fprintf(out, "⏹️  Stopped after applying %d changes\n", applied)
+			return nil
+		case <-time.After(opts.pollInterval):
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package cli
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"audience-poc/internal/rules"
+	"audience-poc/internal/store"
+)
+
+// A request naming a tenant its caller isn't bound to
+var errForeignTenant = errors.New("forbidden")
+
+// How serve tells which tenant a request is for. A caller serve authenticated
+// acts for the tenant its key or JWT is bound to, whatever the request claims.
+// Otherwise, with neither a header nor tokens every request is the default
+// tenant's; a nil tenantAuth (MySQL, which has no tenants) leaves requests unrestricted.
+type tenantAuth struct {
+	header string            // set by a gateway that authenticated the caller, e.g. X-Tenant-ID
+	tokens map[string]string // bearer token to tenant, from --tenant-tokens
+}
+
+// --tenant-tokens is a JSON object of bearer tokens to tenants
+func newTenantAuth(cfg *Config, header, tokensFile string) (*tenantAuth, error) {
+	if cfg.DB.Driver != "postgres" {
+		if header != "" || tokensFile != "" {
+			return nil, errors.New("--tenant-header and --tenant-tokens are only supported with the postgres driver")
+		}
+		return nil, nil
+	}
+	if header != "" && tokensFile != "" {
+		return nil, errors.New("set one of --tenant-header and --tenant-tokens")
+	}
+	a := &tenantAuth{header: header}
+	if tokensFile == "" {
+		return a, nil
+	}
+	raw, err := os.ReadFile(tokensFile)
+	if err != nil {
+		return nil, fmt.Errorf("--tenant-tokens: %w", err)
+	}
+	if err := json.Unmarshal(raw, &a.tokens); err != nil {
+		return nil, fmt.Errorf("--tenant-tokens %s: %w", tokensFile, err)
+	}
+	if len(a.tokens) == 0 {
+		return nil, fmt.Errorf("--tenant-tokens %s has no tokens", tokensFile)
+	}
+	for token, tenant := range a.tokens {
+		if token == "" {
+			return nil, fmt.Errorf("--tenant-tokens %s: empty token", tokensFile)
+		}
+		if err := store.ValidTenant(tenant); err != nil {
+			return nil, fmt.Errorf("--tenant-tokens %s: %w", tokensFile, err)
+		}
+	}
+	return a, nil
+}
+
+// Tenant a request with the given headers (gRPC metadata for gRPC) names, ""
+// when it names none. Tokens are compared in constant time, so response times
+// don't give them away.
+func (a *tenantAuth) claimed(header func(name string) string) (string, error) {
+	switch {
+	case a.tokens != nil:
+		token, ok := strings.CutPrefix(header("Authorization"), "Bearer ")
+		if !ok {
+			return "", nil
+		}
+		for t, tenant := range a.tokens {
+			if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+				return tenant, nil
+			}
+		}
+		return "", errors.New("unknown bearer token")
+	case a.header != "":
+		tenant := header(a.header)
+		if tenant == "" {
+			return "", nil
+		}
+		return tenant, store.ValidTenant(tenant)
+	}
+	return "", nil
+}
+
+// Tenant of a request from ctx's caller with the given headers. Fails with
+// errForeignTenant when the caller may not act for the tenant named.
+func (a *tenantAuth) tenant(ctx context.Context, header func(name string) string) (string, error) {
+	claimed, err := a.claimed(header)
+	if err != nil {
+		return "", err
+	}
+	p, authenticated := principalFrom(ctx)
+	switch {
+	case p.tenant != "":
+		if claimed != "" && claimed != p.tenant {
+			return "", fmt.Errorf("%w: client %s may not act for tenant %s", errForeignTenant, p.client, claimed)
+		}
+		return p.tenant, nil
+	case authenticated && a.header != "":
+		// The header is only trusted from a gateway; a caller serve
+		// authenticated itself could name any tenant in it
+		return "", fmt.Errorf("%w: client %s belongs to no tenant; give it one in --api-clients or a tenant claim", errForeignTenant, p.client)
+	case claimed != "":
+		return claimed, nil
+	case a.tokens != nil:
+		return "", errors.New("missing or unknown bearer token")
+	case a.header != "":
+		return "", fmt.Errorf("missing %s header", a.header)
+	}
+	return store.DefaultTenant, nil
+}
+
+// Restrict every request to its tenant, or answer 401 when it has none and
+// 403 when it names one its caller may not act for
+func (a *tenantAuth) middleware(next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant, err := a.tenant(r.Context(), r.Header.Get)
+		if errors.Is(err, errForeignTenant) {
+			writeJSON(w, http.StatusForbidden, errorResponse{err.Error()})
+			return
+		}
+		if err != nil {
+			if a.tokens != nil {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			writeJSON(w, http.StatusUnauthorized, errorResponse{err.Error()})
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(store.WithTenant(r.Context(), tenant)))
+	})
+}
+
+// The call restricted to its tenant; health checks need none
+func (a *tenantAuth) callContext(ctx context.Context, method string) (context.Context, error) {
+	if a == nil || strings.HasPrefix(method, "/grpc.health.v1.Health/") {
+		return ctx, nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	tenant, err := a.tenant(ctx, func(name string) string {
+		if v := md.Get(name); len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	})
+	if errors.Is(err, errForeignTenant) {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	return store.WithTenant(ctx, tenant), nil
+}
+
+func (a *tenantAuth) unary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := a.callContext(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (a *tenantAuth) stream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := a.callContext(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, contextStream{ServerStream: ss, ctx: ctx})
+}
+
+// A server stream with the context an interceptor gave the call, e.g. its tenant
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s contextStream) Context() context.Context { return s.ctx }
+
+// CLI: tenants list/assign/rls
+
+func newTenantsCmd(cfg *Config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "tenants",
+		Short: "List tenants, move users between them and manage row-level security (PostgreSQL only)",
+		Args:  cobra.NoArgs,
+	}
+	rls := &cobra.Command{
+		Use:   "rls",
+		Short: "Turn the per-tenant row-level security policies on or off",
+		Args:  cobra.NoArgs,
+	}
+	rls.AddCommand(
+		newTenantPoliciesCmd(cfg, "enable", "Confine sessions to the tenant in their audience.tenant setting", store.EnableTenantPolicies),
+		newTenantPoliciesCmd(cfg, "disable", "Drop the row-level security policies", store.DisableTenantPolicies),
+	)
+	cmd.AddCommand(newTenantListCmd(cfg), newTenantAssignCmd(cfg), rls)
+	return cmd
+}
+
+func newTenantListCmd(cfg *Config) *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "Show every tenant with its users and audiences",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := requirePostgres(cfg, "tenants"); err != nil {
+				return err
+			}
+			ctx := cmd.Context()
+			db, err := connectAudiences(ctx, cfg)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+			tenants, err := store.ListTenants(ctx, db)
+			if err != nil {
+				return fmt.Errorf("failed to list tenants: %w", err)
+			}
+			tw := tabwriter.NewWriter(summaryOut, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(tw, "TENANT\tUSERS\tAUDIENCES")
+			for _, t := range tenants {
+				fmt.Fprintf(tw, "%s\t%d\t%d\n", t.Tenant, t.Users, t.Audiences)
+			}
+			return tw.Flush()
+		},
+	}
+}
+
+func newTenantAssignCmd(cfg *Config) *cobra.Command {
+	var rule string
+	cmd := &cobra.Command{
+		Use:   "assign TENANT",
+		Short: "Move the users matching --rule to a tenant",
+		Long: `Move every user matching --rule, whichever tenant they belong to now, to TENANT,
+in user_profiles and in the EAV users table so sync and migrate keep them there.
+Materializations of the tenants the users left and of TENANT go stale, so serve
+counts those audiences live until audiences refresh rebuilds them.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := requirePostgres(cfg, "tenants"); err != nil {
+				return err
+			}
+			if err := store.ValidTenant(args[0]); err != nil {
+				return err
+			}
+			parsed, err := rules.Parse(rule)
+			if err != nil {
+				return err
+			}
+			ctx := cmd.Context()
+			db, err := connectAudiences(ctx, cfg)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+			moved, stale, err := store.AssignTenant(ctx, db, args[0], parsed)
+			if err != nil {
+				return fmt.Errorf("failed to assign users to %s: %w", args[0], err)
+			}
+			if moved > 0 {
+				clearCachedCounts(ctx, cfg)
+			}
+			fmt.Fprintf(summaryOut, "🏷️  Moved %d users to tenant %s, %d materializations stale\n", moved, args[0], stale)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&rule, "rule", "", "users to move, e.g. \"country = 'DE'\"")
+	cmd.Flags().StringVar(&cfg.RedisAddr, "redis", "", "Redis of serve's count cache, cleared once users moved (empty disables it)")
+	return cmd
+}
+
+func newTenantPoliciesCmd(cfg *Config, use, short string, apply func(context.Context, *sql.DB) error) *cobra.Command {
+	return &cobra.Command{
+		Use:   use,
+		Short: short,
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := requirePostgres(cfg, "tenants"); err != nil {
+				return err
+			}
+			ctx := cmd.Context()
+			db, err := connectAudiences(ctx, cfg)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+			if err := apply(ctx, db); err != nil {
+				return fmt.Errorf("failed to %s row-level security: %w", use, err)
+			}
+			fmt.Fprintf(summaryOut, "🔒 Row-level security policies %sd\n", use)
+			return nil
+		},
+	}
+}
@@ -0,0 +1,122 @@
+package cli
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"audience-poc/internal/store"
+)
+
+const testJWTSecret = "0123456789abcdef0123456789abcdef"
+
+// Clients a and b bound to their tenants, and ops bound to none
+func testClientAuth(t *testing.T) *clientAuth {
+	t.Helper()
+	dir := t.TempDir()
+	clients := filepath.Join(dir, "clients.json")
+	err := os.WriteFile(clients, []byte(`{
+		"a":   {"keys": ["key-a"], "tenant": "tenant-a"},
+		"b":   {"keys": ["key-b"], "tenant": "tenant-b"},
+		"ops": {"keys": ["key-ops"]}
+	}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := filepath.Join(dir, "secret")
+	if err := os.WriteFile(secret, []byte(testJWTSecret), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := newClientAuth(clientOptions{clientsFile: clients, secretFile: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func signTestJWT(t *testing.T, claims map[string]any) string {
+	t.Helper()
+	enc := func(v any) string {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(raw)
+	}
+	signed := enc(map[string]string{"alg": "HS256", "typ": "JWT"}) + "." + enc(claims)
+	mac := hmac.New(sha256.New, []byte(testJWTSecret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestTenantBoundToClient(t *testing.T) {
+	clients := testClientAuth(t)
+	tenants := &tenantAuth{header: "X-Tenant-ID"}
+	handler := clients.middleware(tenants.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant, _ := store.TenantFrom(r.Context())
+		w.Write([]byte(tenant))
+	})))
+
+	for _, c := range []struct {
+		name    string
+		headers map[string]string
+		status  int
+		tenant  string
+	}{
+		{"client A sends tenant B", map[string]string{apiKeyHeader: "key-a", "X-Tenant-ID": "tenant-b"}, http.StatusForbidden, ""},
+		{"client A sends its own tenant", map[string]string{apiKeyHeader: "key-a", "X-Tenant-ID": "tenant-a"}, http.StatusOK, "tenant-a"},
+		{"client A sends no tenant", map[string]string{apiKeyHeader: "key-a"}, http.StatusOK, "tenant-a"},
+		{"unbound client sends a tenant", map[string]string{apiKeyHeader: "key-ops", "X-Tenant-ID": "tenant-a"}, http.StatusForbidden, ""},
+		{"JWT of tenant B sends tenant A", map[string]string{
+			"Authorization": "Bearer " + signTestJWT(t, map[string]any{"sub": "svc", "tenant": "tenant-b"}),
+			"X-Tenant-ID":   "tenant-a",
+		}, http.StatusForbidden, ""},
+		{"JWT of tenant B", map[string]string{
+			"Authorization": "Bearer " + signTestJWT(t, map[string]any{"sub": "svc", "tenant": "tenant-b"}),
+		}, http.StatusOK, "tenant-b"},
+		{"JWT claiming another tenant than its client's", map[string]string{
+			"Authorization": "Bearer " + signTestJWT(t, map[string]any{"sub": "a", "tenant": "tenant-b"}),
+		}, http.StatusUnauthorized, ""},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/audiences", nil)
+			for k, v := range c.headers {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != c.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, c.status, rec.Body)
+			}
+			if c.status == http.StatusOK && rec.Body.String() != c.tenant {
+				t.Errorf("tenant %q, want %q", rec.Body, c.tenant)
+			}
+		})
+	}
+}
+
+func TestTenantBoundToClientGRPC(t *testing.T) {
+	clients := testClientAuth(t)
+	tenants := &tenantAuth{header: "X-Tenant-ID"}
+	const method = "/audience.v1.AudienceService/Count"
+	md := metadata.Pairs(strings.ToLower(apiKeyHeader), "key-a", "x-tenant-id", "tenant-b")
+	ctx, err := clients.admit(metadata.NewIncomingContext(context.Background(), md), method)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tenants.callContext(ctx, method); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("got %v, want PermissionDenied", err)
+	}
+}
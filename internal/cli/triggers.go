@@ -0,0 +1,208 @@
+package cli
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"audience-poc/internal/bench"
+	"audience-poc/internal/store"
+)
+
+// HTTP: /audiences/{id}/triggers
+
+func registerTriggerRoutes(mux *http.ServeMux, db *sql.DB, timeout time.Duration, targets store.TriggerTargets) {
+	mux.HandleFunc("POST /audiences/{id}/triggers", func(w http.ResponseWriter, r *http.Request) {
+		id, ok := audienceID(w, r)
+		if !ok {
+			return
+		}
+		var spec store.TriggerSpec
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&spec); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{fmt.Sprintf("invalid request body: %v", err)})
+			return
+		}
+		if err := spec.Validate(targets); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{err.Error()})
+			return
+		}
+		ctx, cancel := bench.QueryContext(r.Context(), timeout)
+		defer cancel()
+		t, err := store.CreateTrigger(ctx, db, id, spec, targets)
+		if err != nil {
+			writeAudienceError(w, r, db, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, t)
+	})
+	mux.HandleFunc("GET /audiences/{id}/triggers", func(w http.ResponseWriter, r *http.Request) {
+		id, ok := audienceID(w, r)
+		if !ok {
+			return
+		}
+		ctx, cancel := bench.QueryContext(r.Context(), timeout)
+		defer cancel()
+		// An empty list doesn't tell a missing audience apart, so look it up first
+		if _, err := store.GetAudience(ctx, db, id); err != nil {
+			writeAudienceError(w, r, db, err)
+			return
+		}
+		triggers, err := store.ListTriggers(ctx, db, id)
+		if err != nil {
+			writeAudienceError(w, r, db, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, triggers)
+	})
+	mux.HandleFunc("DELETE /audiences/{id}/triggers/{trigger}", func(w http.ResponseWriter, r *http.Request) {
+		id, ok := audienceID(w, r)
+		if !ok {
+			return
+		}
+		triggerID, err := strconv.ParseInt(r.PathValue("trigger"), 10, 64)
+		if err != nil || triggerID < 1 {
+			writeJSON(w, http.StatusBadRequest, errorResponse{fmt.Sprintf("invalid trigger id %q", r.PathValue("trigger"))})
+			return
+		}
+		ctx, cancel := bench.QueryContext(r.Context(), timeout)
+		defer cancel()
+		if err := store.DeleteTrigger(ctx, db, id, triggerID); err != nil {
+			writeAudienceError(w, r, db, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// Webhook hosts and URL prefixes triggers may deliver to, for serve, `audiences
+// triggers add` and `snapshots run`
+func bindWebhookAllowFlag(f *pflag.FlagSet, allow *[]string) {
+	f.StringSliceVar(allow, "trigger-webhook-allow", nil,
+		"host (hooks.example.com) or URL prefix (https://hooks.example.com/audiences/) trigger webhooks may target, repeatable; none allows only redis:CHANNEL and nats:SUBJECT")
+}
+
+// CLI: audiences triggers add/list/delete
+
+func newTriggersCmd(cfg *Config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "triggers",
+		Short: "Attach notifications to stored audiences, fired by `snapshots run` when their size changes",
+		Args:  cobra.NoArgs,
+	}
+	cmd.AddCommand(newTriggerAddCmd(cfg), newTriggerListCmd(cfg), newTriggerDeleteCmd(cfg))
+	return cmd
+}
+
+func newTriggerAddCmd(cfg *Config) *cobra.Command {
+	var spec store.TriggerSpec
+	var allow []string
+	cmd := &cobra.Command{
+		Use:   "add AUDIENCE_ID",
+		Short: "Notify a webhook, Redis channel or NATS subject when the audience's size crosses a threshold or changes",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			id, err := parseAudienceID(args[0])
+			if err != nil {
+				return err
+			}
+			targets, err := store.ParseTriggerTargets(allow)
+			if err != nil {
+				return fmt.Errorf("--trigger-webhook-allow: %w", err)
+			}
+			if err := spec.Validate(targets); err != nil {
+				return err
+			}
+			ctx := cmd.Context()
+			db, err := connectAudiences(ctx, cfg)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+			t, err := store.CreateTrigger(ctx, db, id, spec, targets)
+			if err != nil {
+				return fmt.Errorf("failed to add trigger to audience %d: %w", id, err)
+			}
+			fmt.Fprintf(summaryOut, "🔔 Trigger %d on audience %d: %s\n", t.ID, t.AudienceID, describeTrigger(t))
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&spec.Condition, "condition", "", "above, below (a number of users) or change (a percentage since the previous snapshot)")
+	cmd.Flags().Float64Var(&spec.Threshold, "threshold", 0, "users for above and below, percent for change")
+	cmd.Flags().StringVar(&spec.Target, "target", "", "webhook URL, redis:CHANNEL to publish on audiences:TENANT:CHANNEL, or nats:SUBJECT to publish on audiences.TENANT.SUBJECT")
+	bindWebhookAllowFlag(cmd.Flags(), &allow)
+	return cmd
+}
+
+func describeTrigger(t store.Trigger) string {
+	if t.Condition == store.TriggerChange {
+		return fmt.Sprintf("size changes by more than %g%% → %s", t.Threshold, t.Target)
+	}
+	return fmt.Sprintf("size goes %s %g users → %s", t.Condition, t.Threshold, t.Target)
+}
+
+func newTriggerListCmd(cfg *Config) *cobra.Command {
+	return &cobra.Command{
+		Use:   "list [AUDIENCE_ID]",
+		Short: "List the triggers of one audience, or of every audience",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var id int64
+			if len(args) == 1 {
+				var err error
+				if id, err = parseAudienceID(args[0]); err != nil {
+					return err
+				}
+			}
+			ctx := cmd.Context()
+			db, err := connectAudiences(ctx, cfg)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+			triggers, err := store.ListTriggers(ctx, db, id)
+			if err != nil {
+				return fmt.Errorf("failed to list triggers: %w", err)
+			}
+			tw := tabwriter.NewWriter(summaryOut, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(tw, "ID\tAUDIENCE\tCONDITION\tTHRESHOLD\tTARGET")
+			for _, t := range triggers {
+				fmt.Fprintf(tw, "%d\t%d\t%s\t%g\t%s\n", t.ID, t.AudienceID, t.Condition, t.Threshold, t.Target)
+			}
+			return tw.Flush()
+		},
+	}
+}
+
+func newTriggerDeleteCmd(cfg *Config) *cobra.Command {
+	return &cobra.Command{
+		Use:   "delete TRIGGER_ID",
+		Short: "Detach a trigger",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			id, err := strconv.ParseInt(args[0], 10, 64)
+			if err != nil || id < 1 {
+				return fmt.Errorf("invalid trigger id %q", args[0])
+			}
+			ctx := cmd.Context()
+			db, err := connectAudiences(ctx, cfg)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+			if err := store.DeleteTrigger(ctx, db, 0, id); err != nil {
+				return fmt.Errorf("failed to delete trigger %d: %w", id, err)
+			}
+			fmt.Fprintf(out, "🗑️  Deleted trigger %d\n", id)
+			return nil
+		},
+	}
+}
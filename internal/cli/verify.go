@@ -0,0 +1,211 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"audience-poc/internal/bench"
+	"audience-poc/internal/rules"
+	"audience-poc/internal/store"
+)
+
+// Check that another model matched the same audience as the optimized one. A
+// speedup between two queries that count different users is meaningless, so
+// callers should only report one when this returns true.
+func verifyCounts(testName, model string, other, optimized bench.Result) bool {
+	if other.TimedOut || optimized.TimedOut {
+		fmt.Fprintf(out, "⚠️  %s: a query timed out, %s counts cannot be compared\n", testName, model)
+		return false
+	}
+	if other.Err != nil || optimized.Err != nil {
+		return false
+	}
+	if other.Count != optimized.Count {
+		fmt.Fprintf(out, "❌ %s: count mismatch, %s matched %d users but optimized matched %d (diff %+d)\n",
+			testName, model, other.Count, optimized.Count, optimized.Count-other.Count)
+		return false
+	}
+	fmt.Fprintf(out, "✅ Counts match:   %6d users (%s)\n", other.Count, model)
+	return true
+}
+
+// CLI: verify
+
+type verifyOptions struct {
+	rules        []string
+	workloadFile string
+	examples     int
+	members      bool
+}
+
+func newVerifyCmd(cfg *Config) *cobra.Command {
+	var opts verifyOptions
+	cmd := &cobra.Command{
+		Use:   "verify",
+		Short: "Check the EAV and optimized models match the same users for a corpus of rules",
+		Long: `Count every rule against the EAV and optimized models and report the rules
+whose counts differ, with the number of users only one model matches and a
+sample of them showing the rule's attributes in user_attributes and in
+user_profiles. The rules are the benchmark's, or --rule and --workload.
+Exits non-zero when any rule differs, so it can gate a migration.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if opts.examples < 0 {
+				return errors.New("--examples must not be negative")
+			}
+			corpus, err := verifyCorpus(opts)
+			if err != nil {
+				return err
+			}
+			ctx := cmd.Context()
+			db, err := connect(ctx, *cfg)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+			return runVerify(ctx, db, corpus, opts, cfg.QueryTimeout)
+		},
+	}
+	cmd.Flags().Func("rule", "rule to verify instead of the benchmark's, repeatable", func(s string) error {
+		if _, err := rules.Parse(s); err != nil {
+			return err
+		}
+		opts.rules = append(opts.rules, s)
+		return nil
+	})
+	cmd.Flags().StringVar(&opts.workloadFile, "workload", "", "also verify the rules of this --workload file")
+	cmd.Flags().IntVar(&opts.examples, "examples", 5, "differing users shown per model and rule")
+	cmd.Flags().BoolVar(&opts.members, "members", false, "compare the matched users even when the counts agree, to find users missing on one side and extra on the other")
+	bindTenantFlag(cmd.Flags(), cfg)
+	return cmd
+}
+
+// The benchmark rules unless --rule or --workload name others
+func verifyCorpus(opts verifyOptions) ([]workloadEntry, error) {
+	var corpus []workloadEntry
+	for i, rule := range opts.rules {
+		corpus = append(corpus, workloadEntry{Name: fmt.Sprintf("rule_%d", i+1), Rule: rule})
+	}
+	if opts.workloadFile != "" {
+		entries, err := loadWorkload(opts.workloadFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --workload: %w", err)
+		}
+		corpus = append(corpus, entries...)
+	}
+	if len(corpus) == 0 {
+		for _, c := range benchCases {
+			corpus = append(corpus, workloadEntry{Name: c.name, Rule: c.rule})
+		}
+	}
+	return corpus, nil
+}
+
+// Each count, and each rule's drill-down, runs under timeout
+func runVerify(ctx context.Context, db *sql.DB, corpus []workloadEntry, opts verifyOptions, timeout time.Duration) error {
+	fmt.Fprintf(out, "🔎 Verifying %d rules against the EAV and optimized models\n", len(corpus))
+	var differ, failed int
+	for _, e := range corpus {
+		rule, _ := rules.Parse(e.Rule)
+		eav, err := verifyCount(ctx, db, store.EAVCount, e.Rule, timeout)
+		if err != nil {
+			slog.Warn("EAV count failed", "rule", e.Name, "err", err)
+			failed++
+			continue
+		}
+		optimized, err := verifyCount(ctx, db, store.OptimizedCount, e.Rule, timeout)
+		if err != nil {
+			slog.Warn("optimized count failed", "rule", e.Name, "err", err)
+			failed++
+			continue
+		}
+		if eav == optimized && !opts.members {
+			fmt.Fprintf(summaryOut, "✅ %s: %d users in both models\n", e.Name, eav)
+			continue
+		}
+		diffCtx, cancel := bench.QueryContext(ctx, timeout)
+		diff, err := store.DiffModels(diffCtx, db, rule, opts.examples)
+		if err == nil {
+			err = printModelDiff(diffCtx, db, e, rule, eav, optimized, diff)
+		}
+		cancel()
+		if err != nil {
+			slog.Warn("failed to compare the models' users", "rule", e.Name, "err", err)
+			failed++
+			continue
+		}
+		if eav != optimized || diff.OnlyEAV > 0 || diff.OnlyOptimized > 0 {
+			differ++
+		}
+	}
+	if differ > 0 || failed > 0 {
+		return fmt.Errorf("%d of %d rules differ between the models, %d could not be verified", differ, len(corpus), failed)
+	}
+	fmt.Fprintf(summaryOut, "✅ All %d rules match the same users in both models\n", len(corpus))
+	return nil
+}
+
+func verifyCount(ctx context.Context, db *sql.DB, count func(context.Context, store.Querier, string) (int, time.Duration, error), rule string, timeout time.Duration) (int, error) {
+	ctx, cancel := bench.QueryContext(ctx, timeout)
+	defer cancel()
+	n, _, err := count(ctx, db, rule)
+	return n, err
+}
+
+func printModelDiff(ctx context.Context, db *sql.DB, e workloadEntry, rule *rules.Rule, eav, optimized int, diff store.ModelDiff) error {
+	if eav == optimized && diff.OnlyEAV == 0 && diff.OnlyOptimized == 0 {
+		fmt.Fprintf(summaryOut, "✅ %s: the same %d users in both models\n", e.Name, eav)
+		return nil
+	}
+	if eav == optimized {
+		fmt.Fprintf(summaryOut, "❌ %s: both models matched %d users, but not the same ones\n", e.Name, eav)
+	} else {
+		fmt.Fprintf(summaryOut, "❌ %s: count mismatch, EAV matched %d users but optimized matched %d (diff %+d)\n",
+			e.Name, eav, optimized, optimized-eav)
+	}
+	fmt.Fprintf(summaryOut, "   rule: %s\n", e.Rule)
+	attrs := rule.Attributes()
+	for _, side := range []struct {
+		label    string
+		count    int64
+		examples []int64
+	}{
+		{"only in EAV", diff.OnlyEAV, diff.EAVExamples},
+		{"only in optimized", diff.OnlyOptimized, diff.OptimizedExamples},
+	} {
+		fmt.Fprintf(summaryOut, "   %-17s %d users\n", side.label+":", side.count)
+		for _, id := range side.examples {
+			v, err := store.ReadUserValues(ctx, db, id, attrs)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(summaryOut, "     user %-10d EAV: %s\n", id, formatValues(attrs, v.EAV, "(none)"))
+			if !v.HasProfile {
+				fmt.Fprintf(summaryOut, "     %-15s user_profiles: no row\n", "")
+				continue
+			}
+			fmt.Fprintf(summaryOut, "     %-15s user_profiles: %s\n", "", formatValues(attrs, v.Profile, "NULL"))
+		}
+	}
+	return nil
+}
+
+// attr=value for each attribute, missing for the ones without a value
+func formatValues(attrs []rules.Attribute, values map[string]string, missing string) string {
+	parts := make([]string, len(attrs))
+	for i, a := range attrs {
+		v, ok := values[a.Name]
+		if !ok {
+			v = missing
+		}
+		parts[i] = a.Name + "=" + v
+	}
+	return strings.Join(parts, " ")
+}
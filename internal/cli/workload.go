@@ -0,0 +1,64 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"audience-poc/internal/bench"
+	"audience-poc/internal/rules"
+	"audience-poc/internal/store"
+)
+
+// One rule of a --workload file, e.g. {"name": "us", "rule": "country = 'US'", "weight": 120}
+type workloadEntry struct {
+	Name   string  `json:"name"`
+	Rule   string  `json:"rule"`
+	Weight float64 `json:"weight"` // share of the requests, relative to the other entries; default 1
+}
+
+// Read a JSON array of workload entries and check every rule compiles
+func loadWorkload(path string) ([]workloadEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []workloadEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%s: no rules", path)
+	}
+	for i := range entries {
+		e := &entries[i]
+		if _, err := rules.Parse(e.Rule); err != nil {
+			return nil, fmt.Errorf("%s entry %d: %w", path, i+1, err)
+		}
+		if e.Name == "" {
+			e.Name = fmt.Sprintf("rule_%d", i+1)
+		}
+		switch {
+		case e.Weight < 0:
+			return nil, fmt.Errorf("%s entry %d: negative weight", path, i+1)
+		case e.Weight == 0:
+			e.Weight = 1
+		}
+	}
+	return entries, nil
+}
+
+// Benchmark adapter of each model the load test can target
+var loadModels = map[string]func(db store.Querier, rule string) bench.QueryFunc{
+	"optimized": optimizedCount,
+	"eav":       eavCount,
+	"jsonb":     jsonbCount,
+}
+
+func workloadQueries(db store.Querier, model string, workload []workloadEntry) []bench.LoadQuery {
+	queries := make([]bench.LoadQuery, len(workload))
+	for i, e := range workload {
+		queries[i] = bench.LoadQuery{Name: e.Name, Fn: loadModels[model](db, e.Rule), Weight: e.Weight}
+	}
+	return queries
+}
@@ -0,0 +1,364 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.10
+// 	protoc        (unknown)
+// source: audience/v1/audience.proto
+
+package audiencev1
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type CountRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Rule in the audience DSL, e.g. "country = 'US' AND has_purchased = true"
+	Rule string `protobuf:"bytes,1,opt,name=rule,proto3" json:"rule,omitempty"`
+	// Stored audience to evaluate instead of rule; set exactly one of them
+	AudienceId    int64 `protobuf:"varint,2,opt,name=audience_id,json=audienceId,proto3" json:"audience_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CountRequest) Reset() {
+	*x = CountRequest{}
+	mi := &file_audience_v1_audience_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CountRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CountRequest) ProtoMessage() {}
+
+func (x *CountRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_audience_v1_audience_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CountRequest.ProtoReflect.Descriptor instead.
+func (*CountRequest) Descriptor() ([]byte, []int) {
+	return file_audience_v1_audience_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *CountRequest) GetRule() string {
+	if x != nil {
+		return x.Rule
+	}
+	return ""
+}
+
+func (x *CountRequest) GetAudienceId() int64 {
+	if x != nil {
+		return x.AudienceId
+	}
+	return 0
+}
+
+type CountResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// The evaluated rule, the stored one when audience_id was given
+	Rule       string  `protobuf:"bytes,1,opt,name=rule,proto3" json:"rule,omitempty"`
+	Count      int64   `protobuf:"varint,2,opt,name=count,proto3" json:"count,omitempty"`
+	DurationMs float64 `protobuf:"fixed64,3,opt,name=duration_ms,json=durationMs,proto3" json:"duration_ms,omitempty"`
+	AudienceId int64   `protobuf:"varint,4,opt,name=audience_id,json=audienceId,proto3" json:"audience_id,omitempty"`
+	// Served from the server's count cache rather than a query
+	Cached        bool `protobuf:"varint,5,opt,name=cached,proto3" json:"cached,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CountResponse) Reset() {
+	*x = CountResponse{}
+	mi := &file_audience_v1_audience_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CountResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CountResponse) ProtoMessage() {}
+
+func (x *CountResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_audience_v1_audience_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CountResponse.ProtoReflect.Descriptor instead.
+func (*CountResponse) Descriptor() ([]byte, []int) {
+	return file_audience_v1_audience_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *CountResponse) GetRule() string {
+	if x != nil {
+		return x.Rule
+	}
+	return ""
+}
+
+func (x *CountResponse) GetCount() int64 {
+	if x != nil {
+		return x.Count
+	}
+	return 0
+}
+
+func (x *CountResponse) GetDurationMs() float64 {
+	if x != nil {
+		return x.DurationMs
+	}
+	return 0
+}
+
+func (x *CountResponse) GetAudienceId() int64 {
+	if x != nil {
+		return x.AudienceId
+	}
+	return 0
+}
+
+func (x *CountResponse) GetCached() bool {
+	if x != nil {
+		return x.Cached
+	}
+	return false
+}
+
+type ListMembersRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Rule  string                 `protobuf:"bytes,1,opt,name=rule,proto3" json:"rule,omitempty"`
+	// Stored audience to export instead of rule; set exactly one of them
+	AudienceId int64 `protobuf:"varint,4,opt,name=audience_id,json=audienceId,proto3" json:"audience_id,omitempty"`
+	// User IDs per streamed message; 0 means the server default
+	BatchSize int32 `protobuf:"varint,2,opt,name=batch_size,json=batchSize,proto3" json:"batch_size,omitempty"`
+	// Resume after this user ID, taken from the cursor of the last message received
+	AfterUserId   int64 `protobuf:"varint,3,opt,name=after_user_id,json=afterUserId,proto3" json:"after_user_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListMembersRequest) Reset() {
+	*x = ListMembersRequest{}
+	mi := &file_audience_v1_audience_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListMembersRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListMembersRequest) ProtoMessage() {}
+
+func (x *ListMembersRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_audience_v1_audience_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListMembersRequest.ProtoReflect.Descriptor instead.
+func (*ListMembersRequest) Descriptor() ([]byte, []int) {
+	return file_audience_v1_audience_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *ListMembersRequest) GetRule() string {
+	if x != nil {
+		return x.Rule
+	}
+	return ""
+}
+
+func (x *ListMembersRequest) GetAudienceId() int64 {
+	if x != nil {
+		return x.AudienceId
+	}
+	return 0
+}
+
+func (x *ListMembersRequest) GetBatchSize() int32 {
+	if x != nil {
+		return x.BatchSize
+	}
+	return 0
+}
+
+func (x *ListMembersRequest) GetAfterUserId() int64 {
+	if x != nil {
+		return x.AfterUserId
+	}
+	return 0
+}
+
+type ListMembersResponse struct {
+	state   protoimpl.MessageState `protogen:"open.v1"`
+	UserIds []int64                `protobuf:"varint,1,rep,packed,name=user_ids,json=userIds,proto3" json:"user_ids,omitempty"`
+	// Last user ID in this batch; pass it as after_user_id to resume
+	Cursor        int64 `protobuf:"varint,2,opt,name=cursor,proto3" json:"cursor,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListMembersResponse) Reset() {
+	*x = ListMembersResponse{}
+	mi := &file_audience_v1_audience_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListMembersResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListMembersResponse) ProtoMessage() {}
+
+func (x *ListMembersResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_audience_v1_audience_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListMembersResponse.ProtoReflect.Descriptor instead.
+func (*ListMembersResponse) Descriptor() ([]byte, []int) {
+	return file_audience_v1_audience_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *ListMembersResponse) GetUserIds() []int64 {
+	if x != nil {
+		return x.UserIds
+	}
+	return nil
+}
+
+func (x *ListMembersResponse) GetCursor() int64 {
+	if x != nil {
+		return x.Cursor
+	}
+	return 0
+}
+
+var File_audience_v1_audience_proto protoreflect.FileDescriptor
+
+const file_audience_v1_audience_proto_rawDesc = "" +
+	"\n" +
+	"\x1aaudience/v1/audience.proto\x12\vaudience.v1\"C\n" +
+	"\fCountRequest\x12\x12\n" +
+	"\x04rule\x18\x01 \x01(\tR\x04rule\x12\x1f\n" +
+	"\vaudience_id\x18\x02 \x01(\x03R\n" +
+	"audienceId\"\x93\x01\n" +
+	"\rCountResponse\x12\x12\n" +
+	"\x04rule\x18\x01 \x01(\tR\x04rule\x12\x14\n" +
+	"\x05count\x18\x02 \x01(\x03R\x05count\x12\x1f\n" +
+	"\vduration_ms\x18\x03 \x01(\x01R\n" +
+	"durationMs\x12\x1f\n" +
+	"\vaudience_id\x18\x04 \x01(\x03R\n" +
+	"audienceId\x12\x16\n" +
+	"\x06cached\x18\x05 \x01(\bR\x06cached\"\x8c\x01\n" +
+	"\x12ListMembersRequest\x12\x12\n" +
+	"\x04rule\x18\x01 \x01(\tR\x04rule\x12\x1f\n" +
+	"\vaudience_id\x18\x04 \x01(\x03R\n" +
+	"audienceId\x12\x1d\n" +
+	"\n" +
+	"batch_size\x18\x02 \x01(\x05R\tbatchSize\x12\"\n" +
+	"\rafter_user_id\x18\x03 \x01(\x03R\vafterUserId\"H\n" +
+	"\x13ListMembersResponse\x12\x19\n" +
+	"\buser_ids\x18\x01 \x03(\x03R\auserIds\x12\x16\n" +
+	"\x06cursor\x18\x02 \x01(\x03R\x06cursor2\xa5\x01\n" +
+	"\x0fAudienceService\x12>\n" +
+	"\x05Count\x12\x19.audience.v1.CountRequest\x1a\x1a.audience.v1.CountResponse\x12R\n" +
+	"\vListMembers\x12\x1f.audience.v1.ListMembersRequest\x1a .audience.v1.ListMembersResponse0\x01B2Z0audience-poc/internal/gen/audience/v1;audiencev1b\x06proto3"
+
+var (
+	file_audience_v1_audience_proto_rawDescOnce sync.Once
+	file_audience_v1_audience_proto_rawDescData []byte
+)
+
+func file_audience_v1_audience_proto_rawDescGZIP() []byte {
+	file_audience_v1_audience_proto_rawDescOnce.Do(func() {
+		file_audience_v1_audience_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_audience_v1_audience_proto_rawDesc), len(file_audience_v1_audience_proto_rawDesc)))
+	})
+	return file_audience_v1_audience_proto_rawDescData
+}
+
+var file_audience_v1_audience_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
+var file_audience_v1_audience_proto_goTypes = []any{
+	(*CountRequest)(nil),        // 0: audience.v1.CountRequest
+	(*CountResponse)(nil),       // 1: audience.v1.CountResponse
+	(*ListMembersRequest)(nil),  // 2: audience.v1.ListMembersRequest
+	(*ListMembersResponse)(nil), // 3: audience.v1.ListMembersResponse
+}
+var file_audience_v1_audience_proto_depIdxs = []int32{
+	0, // 0: audience.v1.AudienceService.Count:input_type -> audience.v1.CountRequest
+	2, // 1: audience.v1.AudienceService.ListMembers:input_type -> audience.v1.ListMembersRequest
+	1, // 2: audience.v1.AudienceService.Count:output_type -> audience.v1.CountResponse
+	3, // 3: audience.v1.AudienceService.ListMembers:output_type -> audience.v1.ListMembersResponse
+	2, // [2:4] is the sub-list for method output_type
+	0, // [0:2] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_audience_v1_audience_proto_init() }
+func file_audience_v1_audience_proto_init() {
+	if File_audience_v1_audience_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_audience_v1_audience_proto_rawDesc), len(file_audience_v1_audience_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   4,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_audience_v1_audience_proto_goTypes,
+		DependencyIndexes: file_audience_v1_audience_proto_depIdxs,
+		MessageInfos:      file_audience_v1_audience_proto_msgTypes,
+	}.Build()
+	File_audience_v1_audience_proto = out.File
+	file_audience_v1_audience_proto_goTypes = nil
+	file_audience_v1_audience_proto_depIdxs = nil
+}
@@ -0,0 +1,171 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.6.2
+// - protoc             (unknown)
+// source: audience/v1/audience.proto
+
+package audiencev1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	AudienceService_Count_FullMethodName       = "/audience.v1.AudienceService/Count"
+	AudienceService_ListMembers_FullMethodName = "/audience.v1.AudienceService/ListMembers"
+)
+
+// AudienceServiceClient is the client API for AudienceService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Audience rules evaluated against the optimized (user_profiles) model
+type AudienceServiceClient interface {
+	// Number of users matching a rule
+	Count(ctx context.Context, in *CountRequest, opts ...grpc.CallOption) (*CountResponse, error)
+	// Matching user IDs in ascending order, streamed in batches
+	ListMembers(ctx context.Context, in *ListMembersRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ListMembersResponse], error)
+}
+
+type audienceServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAudienceServiceClient(cc grpc.ClientConnInterface) AudienceServiceClient {
+	return &audienceServiceClient{cc}
+}
+
+func (c *audienceServiceClient) Count(ctx context.Context, in *CountRequest, opts ...grpc.CallOption) (*CountResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CountResponse)
+	err := c.cc.Invoke(ctx, AudienceService_Count_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *audienceServiceClient) ListMembers(ctx context.Context, in *ListMembersRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ListMembersResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &AudienceService_ServiceDesc.Streams[0], AudienceService_ListMembers_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ListMembersRequest, ListMembersResponse]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type AudienceService_ListMembersClient = grpc.ServerStreamingClient[ListMembersResponse]
+
+// AudienceServiceServer is the server API for AudienceService service.
+// All implementations must embed UnimplementedAudienceServiceServer
+// for forward compatibility.
+//
+// Audience rules evaluated against the optimized (user_profiles) model
+type AudienceServiceServer interface {
+	// Number of users matching a rule
+	Count(context.Context, *CountRequest) (*CountResponse, error)
+	// Matching user IDs in ascending order, streamed in batches
+	ListMembers(*ListMembersRequest, grpc.ServerStreamingServer[ListMembersResponse]) error
+	mustEmbedUnimplementedAudienceServiceServer()
+}
+
+// UnimplementedAudienceServiceServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedAudienceServiceServer struct{}
+
+func (UnimplementedAudienceServiceServer) Count(context.Context, *CountRequest) (*CountResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method Count not implemented")
+}
+func (UnimplementedAudienceServiceServer) ListMembers(*ListMembersRequest, grpc.ServerStreamingServer[ListMembersResponse]) error {
+	return status.Error(codes.Unimplemented, "method ListMembers not implemented")
+}
+func (UnimplementedAudienceServiceServer) mustEmbedUnimplementedAudienceServiceServer() {}
+func (UnimplementedAudienceServiceServer) testEmbeddedByValue()                         {}
+
+// UnsafeAudienceServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AudienceServiceServer will
+// result in compilation errors.
+type UnsafeAudienceServiceServer interface {
+	mustEmbedUnimplementedAudienceServiceServer()
+}
+
+func RegisterAudienceServiceServer(s grpc.ServiceRegistrar, srv AudienceServiceServer) {
+	// If the following call panics, it indicates UnimplementedAudienceServiceServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&AudienceService_ServiceDesc, srv)
+}
+
+func _AudienceService_Count_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CountRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AudienceServiceServer).Count(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AudienceService_Count_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AudienceServiceServer).Count(ctx, req.(*CountRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AudienceService_ListMembers_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ListMembersRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AudienceServiceServer).ListMembers(m, &grpc.GenericServerStream[ListMembersRequest, ListMembersResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type AudienceService_ListMembersServer = grpc.ServerStreamingServer[ListMembersResponse]
+
+// AudienceService_ServiceDesc is the grpc.ServiceDesc for AudienceService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var AudienceService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "audience.v1.AudienceService",
+	HandlerType: (*AudienceServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Count",
+			Handler:    _AudienceService_Count_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ListMembers",
+			Handler:       _AudienceService_ListMembers_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "audience/v1/audience.proto",
+}
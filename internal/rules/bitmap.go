@@ -0,0 +1,111 @@
+package rules
+
+import (
+	"errors"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// In-memory model: every predicate is the set of user_ids a posting list
+// gives for it, combined with bitmap AND, OR and ANDNOT instead of SQL.
+
+// Posting lists a rule is evaluated against. Every bitmap returned is a fresh
+// one the evaluator may modify.
+type Postings interface {
+	// Every user; NOT is taken against it
+	All() *roaring.Bitmap
+	// Users whose attribute compares true against value (op as in the DSL);
+	// users without a value never match, like a NULL column. On a set, "="
+	// matches users whose set holds value.
+	Compare(attr, op string, value interface{}) (*roaring.Bitmap, error)
+	// Users with a value for attr, a set with at least one element
+	Present(attr string) (*roaring.Bitmap, error)
+	// Members of an imported list
+	List(name string) (*roaring.Bitmap, error)
+}
+
+func (e andExpr) bitmap(p Postings) (*roaring.Bitmap, error) {
+	left, err := e.left.bitmap(p)
+	if err != nil {
+		return nil, err
+	}
+	right, err := e.right.bitmap(p)
+	if err != nil {
+		return nil, err
+	}
+	left.And(right)
+	return left, nil
+}
+func (e orExpr) bitmap(p Postings) (*roaring.Bitmap, error) {
+	left, err := e.left.bitmap(p)
+	if err != nil {
+		return nil, err
+	}
+	right, err := e.right.bitmap(p)
+	if err != nil {
+		return nil, err
+	}
+	left.Or(right)
+	return left, nil
+}
+
+// Complement within every user, so users without the attribute are included,
+// like IS NOT TRUE in the optimized model
+func (e notExpr) bitmap(p Postings) (*roaring.Bitmap, error) {
+	matched, err := e.expr.bitmap(p)
+	if err != nil {
+		return nil, err
+	}
+	all := p.All()
+	all.AndNot(matched)
+	return all, nil
+}
+func (e comparison) bitmap(p Postings) (*roaring.Bitmap, error) {
+	return p.Compare(e.attr, e.op, e.value.value())
+}
+func (e inExpr) bitmap(p Postings) (*roaring.Bitmap, error) {
+	users := roaring.New()
+	for _, v := range e.values {
+		matched, err := p.Compare(e.attr, "=", v.value())
+		if err != nil {
+			return nil, err
+		}
+		users.Or(matched)
+	}
+	return users, nil
+}
+
+// Both bounds are a range lookup on the same sorted column
+func (e betweenExpr) bitmap(p Postings) (*roaring.Bitmap, error) {
+	users, err := p.Compare(e.attr, ">=", e.low.value())
+	if err != nil {
+		return nil, err
+	}
+	below, err := p.Compare(e.attr, "<=", e.high.value())
+	if err != nil {
+		return nil, err
+	}
+	users.And(below)
+	return users, nil
+}
+func (e overlapExpr) bitmap(p Postings) (*roaring.Bitmap, error) {
+	return inExpr(e).bitmap(p)
+}
+func (e nullExpr) bitmap(p Postings) (*roaring.Bitmap, error) {
+	present, err := p.Present(e.attr)
+	if err != nil || e.not {
+		return present, err
+	}
+	all := p.All()
+	all.AndNot(present)
+	return all, nil
+}
+func (e listExpr) bitmap(p Postings) (*roaring.Bitmap, error) { return p.List(e.name) }
+
+// Users matching the rule in p
+func (r *Rule) Bitmap(p Postings) (*roaring.Bitmap, error) {
+	if r.tenant != "" {
+		return nil, errors.New("bitmap indexes have no tenants")
+	}
+	return r.expr.bitmap(p)
+}
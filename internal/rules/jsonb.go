@@ -0,0 +1,99 @@
+package rules
+
+import "encoding/json"
+
+// JSONB model: attributes live in one user_profiles_jsonb.attributes document
+// (PostgreSQL only). Equality on text, numbers, booleans and dates, and set
+// overlap, become containment so the GIN jsonb_path_ops index can serve them;
+// everything else reads the field with ->> and casts it like the EAV model does.
+
+func (e andExpr) jsonbSQL(args *Args) string {
+	return "(" + e.left.jsonbSQL(args) + " AND " + e.right.jsonbSQL(args) + ")"
+}
+func (e orExpr) jsonbSQL(args *Args) string {
+	return "(" + e.left.jsonbSQL(args) + " OR " + e.right.jsonbSQL(args) + ")"
+}
+
+// Same NULL handling as the optimized model: a missing key must count as "does not match"
+func (e notExpr) jsonbSQL(args *Args) string {
+	return "(" + e.expr.jsonbSQL(args) + ") IS NOT TRUE"
+}
+func (e comparison) jsonbSQL(args *Args) string  { return e.documentSQL(args, "attributes") }
+func (e inExpr) jsonbSQL(args *Args) string      { return e.documentSQL(args, "attributes") }
+func (e betweenExpr) jsonbSQL(args *Args) string { return e.documentSQL(args, "attributes") }
+func (e overlapExpr) jsonbSQL(args *Args) string { return e.documentSQL(args, "attributes") }
+func (e nullExpr) jsonbSQL(args *Args) string    { return e.documentSQL(args, "attributes") }
+func (e listExpr) jsonbSQL(args *Args) string    { return listMembers(args, "user_id", e.name) }
+
+// Predicates against a JSONB document column, shared with the optimized
+// model's overflow attributes
+func (e comparison) documentSQL(args *Args, doc string) string {
+	a := attribute(e.attr)
+	if e.op == "=" && a.Type != AttrTimestamp {
+		return jsonbContains(args, doc, e.attr, e.value.value())
+	}
+	return jsonField(doc, a) + " " + e.op + " " + args.Bind(e.value.value())
+}
+
+// An OR of containments, each of which can use the GIN index
+func (e inExpr) documentSQL(args *Args, doc string) string {
+	a := attribute(e.attr)
+	if a.Type == AttrTimestamp {
+		return jsonField(doc, a) + " IN (" + bindLiterals(args, e.values) + ")"
+	}
+	s := "("
+	for i, v := range e.values {
+		if i > 0 {
+			s += " OR "
+		}
+		s += jsonbContains(args, doc, e.attr, v.value())
+	}
+	return s + ")"
+}
+func (e betweenExpr) documentSQL(args *Args, doc string) string {
+	return jsonField(doc, attribute(e.attr)) + " BETWEEN " + args.Bind(e.low.value()) + " AND " + args.Bind(e.high.value())
+}
+
+// Sets are JSON arrays, so each element is a containment of a one-element array
+func (e overlapExpr) documentSQL(args *Args, doc string) string {
+	s := "("
+	for i, v := range e.values {
+		if i > 0 {
+			s += " OR "
+		}
+		s += jsonbContains(args, doc, e.attr, []interface{}{v.value()})
+	}
+	return s + ")"
+}
+
+// A missing key, a JSON null and an empty array all count as no value
+func (e nullExpr) documentSQL(args *Args, doc string) string {
+	s := "COALESCE(" + doc + "->'" + e.attr + "', 'null'::jsonb) IN ('null'::jsonb, '[]'::jsonb)"
+	if e.not {
+		return "NOT " + s
+	}
+	return s
+}
+
+// doc @> '{"attr": value}'
+func jsonbContains(args *Args, doc, attr string, value interface{}) string {
+	b, _ := json.Marshal(map[string]interface{}{attr: value})
+	return doc + " @> " + args.Bind(string(b)) + "::jsonb"
+}
+
+// Typed view of one document field; the attribute is known, so it is safe to inline
+func jsonField(doc string, a Attribute) string {
+	field := "(" + doc + "->>'" + a.Name + "')"
+	switch a.Type {
+	case AttrNumeric:
+		return field + "::numeric"
+	case AttrBool:
+		return field + "::boolean"
+	case AttrTimestamp:
+		return field + "::timestamp"
+	case AttrDate:
+		return field + "::date"
+	default:
+		return field
+	}
+}
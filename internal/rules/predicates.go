@@ -0,0 +1,87 @@
+package rules
+
+import "slices"
+
+// A leaf predicate of a rule, as an index sees it
+type Predicate struct {
+	Attribute Attribute
+	Op        string // =, !=, <, <=, >, >=, IN, BETWEEN, &&, IS NULL or IS NOT NULL
+	// SQL literal compared against, for = and the range comparisons
+	Value string
+	// Joined to the whole rule by AND only, so every matching user satisfies it
+	Required bool
+	// Under a NOT; the optimized model renders those as IS NOT TRUE, which no index serves
+	Negated bool
+}
+
+// Leaf predicates of the rule on attributes, left to right; IN AUDIENCE is
+// none, see Lists
+func (r *Rule) Predicates() []Predicate {
+	var preds []Predicate
+	var walk func(e ruleExpr, required, negated bool)
+	walk = func(e ruleExpr, required, negated bool) {
+		switch n := e.(type) {
+		case andExpr:
+			walk(n.left, required, negated)
+			walk(n.right, required, negated)
+		case orExpr:
+			walk(n.left, false, negated)
+			walk(n.right, false, negated)
+		case notExpr:
+			walk(n.expr, false, !negated)
+		case comparison:
+			preds = append(preds, Predicate{attribute(n.attr), n.op, n.value.canonical(), required, negated})
+		case inExpr:
+			preds = append(preds, Predicate{attribute(n.attr), "IN", "", required, negated})
+		case betweenExpr:
+			preds = append(preds, Predicate{attribute(n.attr), "BETWEEN", "", required, negated})
+		case overlapExpr:
+			preds = append(preds, Predicate{attribute(n.attr), "&&", "", required, negated})
+		case nullExpr:
+			op := "IS NULL"
+			if n.not {
+				op = "IS NOT NULL"
+			}
+			preds = append(preds, Predicate{attribute(n.attr), op, "", required, negated})
+		}
+	}
+	walk(r.expr, true, false)
+	return preds
+}
+
+// Distinct attributes the rule reads, in the order they first appear
+func (r *Rule) Attributes() []Attribute {
+	var attrs []Attribute
+	seen := map[string]bool{}
+	for _, p := range r.Predicates() {
+		if !seen[p.Attribute.Name] {
+			seen[p.Attribute.Name] = true
+			attrs = append(attrs, p.Attribute)
+		}
+	}
+	return attrs
+}
+
+// Distinct imported lists the rule references, in the order they first appear
+func (r *Rule) Lists() []string {
+	var lists []string
+	var walk func(e ruleExpr)
+	walk = func(e ruleExpr) {
+		switch n := e.(type) {
+		case andExpr:
+			walk(n.left)
+			walk(n.right)
+		case orExpr:
+			walk(n.left)
+			walk(n.right)
+		case notExpr:
+			walk(n.expr)
+		case listExpr:
+			if !slices.Contains(lists, n.name) {
+				lists = append(lists, n.name)
+			}
+		}
+	}
+	walk(r.expr)
+	return lists
+}
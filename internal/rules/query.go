@@ -0,0 +1,88 @@
+package rules
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// SQL text written into the program. Only untyped string constants convert to
+// it implicitly, so text concatenated at run time can't be passed to Query.SQL
+// from outside this package.
+type sqlText string
+
+// Unquoted identifiers Query.Ident accepts
+var plainIdent = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// A statement under construction: constant SQL text, validated identifiers,
+// rule predicates, and values that only reach the database as bind arguments
+type Query struct {
+	sb   strings.Builder
+	args *Args
+	err  error // first predicate that couldn't be rendered
+}
+
+func NewQuery(d Dialect) *Query { return &Query{args: NewArgs(d)} }
+
+// Append constant SQL: keywords, operators and names known when the program is written
+func (q *Query) SQL(text sqlText) *Query {
+	q.sb.WriteString(string(text))
+	return q
+}
+
+// Append a placeholder for v
+func (q *Query) Bind(v interface{}) *Query {
+	q.sb.WriteString(q.args.Bind(v))
+	return q
+}
+
+// Append a table or column name chosen at run time, such as a copy of
+// user_profiles. Names are the program's own, so anything but a plain
+// lowercase identifier is a bug rather than a query to run.
+func (q *Query) Ident(name string) *Query {
+	if !plainIdent.MatchString(name) {
+		panic(fmt.Sprintf("rules: %q is not a plain SQL identifier", name))
+	}
+	q.sb.WriteString(name)
+	return q
+}
+
+// Append the attribute read from a user_profiles row; attributes are built in
+// or validated by the registry
+func (q *Query) Profile(a Attribute) *Query {
+	q.sb.WriteString(a.ProfileExpr())
+	return q
+}
+
+// Append the rule's predicate against user_profiles
+func (q *Query) Optimized(r *Rule) *Query {
+	q.sb.WriteString(r.OptimizedSQL(q.args))
+	return q
+}
+
+// Append the rule's predicate against users u, as EXISTS on user_attributes
+func (q *Query) EAV(r *Rule) *Query {
+	q.sb.WriteString(r.EAVSQL(q.args))
+	return q
+}
+
+// Append the rule's predicate against user_profiles_jsonb. A rule the model
+// can't express, such as a tenant's, leaves the statement unusable; Err says why.
+func (q *Query) JSONB(r *Rule) *Query {
+	text, err := r.JSONBSQL(q.args)
+	if err != nil && q.err == nil {
+		q.err = err
+	}
+	q.sb.WriteString(text)
+	return q
+}
+
+// The statement and its bind arguments, in placeholder order
+func (q *Query) Build() (string, []interface{}) {
+	return q.sb.String(), q.args.Values()
+}
+
+// Why the statement can't be run, if a predicate in it couldn't be rendered
+func (q *Query) Err() error {
+	return q.err
+}
@@ -0,0 +1,192 @@
+package rules_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+
+	"audience-poc/internal/rules"
+	"audience-poc/internal/store"
+)
+
+// Values a rule may carry that would change a statement if they reached its text
+var hostileValues = []string{
+	`x' OR 1=1 --`,
+	`x'); DROP TABLE users; --`,
+	`back\slash\' OR '1'='1`,
+	`$1 OR $2`,
+	`? OR ?`,
+	`"}, "tier": "gold`,
+	`*/ OR /*`,
+}
+
+// A DSL string literal holding v, quotes doubled
+func quoted(v string) string {
+	return "'" + strings.ReplaceAll(v, "'", "''") + "'"
+}
+
+// Rules placing v in every kind of literal a compiler binds
+func hostileRules(v string) []string {
+	q := quoted(v)
+	return []string{
+		"country = " + q,
+		"NOT tier = " + q,
+		"country IN ('US', " + q + ")",
+		"country NOT IN (" + q + ")",
+		"tier > " + q,
+		"interests && ARRAY[" + q + ", 'sports']",
+		"IN AUDIENCE('crm') AND (country = " + q + " OR tier IS NULL)",
+	}
+}
+
+// Whether v reached the statement as an argument: bound as is, or inside the
+// JSON document the JSONB model binds for containment
+func bound(args []interface{}, v string) bool {
+	for _, arg := range args {
+		s, ok := arg.(string)
+		if !ok {
+			continue
+		}
+		if s == v {
+			return true
+		}
+		var doc map[string]interface{}
+		if json.Unmarshal([]byte(s), &doc) == nil && strings.Contains(fmt.Sprint(doc), v) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestValuesNeverInSQL(t *testing.T) {
+	type compiler struct {
+		name  string
+		where func(*rules.Rule) (string, []interface{}, error)
+	}
+	compilers := []compiler{{"jsonb", func(r *rules.Rule) (string, []interface{}, error) { return r.JSONBWhere(store.Postgres{}) }}}
+	for _, d := range []rules.Dialect{store.Postgres{}, store.MySQL{}} {
+		name := strings.ToLower(fmt.Sprintf("%T", d))
+		compilers = append(compilers,
+			compiler{"optimized/" + name, func(r *rules.Rule) (string, []interface{}, error) {
+				sql, args := r.OptimizedWhere(d)
+				return sql, args, nil
+			}},
+			compiler{"eav/" + name, func(r *rules.Rule) (string, []interface{}, error) {
+				sql, args := r.EAVWhere(d)
+				return sql, args, nil
+			}},
+		)
+	}
+	for _, v := range hostileValues {
+		for _, text := range hostileRules(v) {
+			rule, err := rules.Parse(text)
+			if err != nil {
+				t.Fatalf("parse %s: %v", text, err)
+			}
+			for _, scoped := range []*rules.Rule{rule, rule.ForTenant("acme")} {
+				for _, c := range compilers {
+					if c.name == "jsonb" && scoped.Tenant() != "" {
+						continue
+					}
+					sql, args, err := c.where(scoped)
+					if err != nil {
+						t.Fatalf("%s: %s: %v", c.name, text, err)
+					}
+					if strings.Contains(sql, v) {
+						t.Errorf("%s: %s: value %q in the SQL text: %s", c.name, text, v, sql)
+					}
+					if !bound(args, v) {
+						t.Errorf("%s: %s: value %q not among the arguments %v", c.name, text, v, args)
+					}
+					if !slices.Contains(args, interface{}("crm")) && strings.Contains(text, "AUDIENCE") {
+						t.Errorf("%s: %s: list name not bound: %v", c.name, text, args)
+					}
+				}
+			}
+		}
+	}
+}
+
+// Tenants are bound like any other value
+func TestTenantNeverInSQL(t *testing.T) {
+	rule, err := rules.Parse("country = 'US'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const tenant = "acme-tenant_1"
+	scoped := rule.ForTenant(tenant)
+	for _, where := range []func(rules.Dialect) (string, []interface{}){scoped.OptimizedWhere, scoped.EAVWhere} {
+		sql, args := where(store.Postgres{})
+		if strings.Contains(sql, tenant) || !slices.Contains(args, interface{}(tenant)) {
+			t.Errorf("tenant not bound: %s %v", sql, args)
+		}
+	}
+}
+
+// List names only ever reach a statement as an argument, and a name that could
+// mean anything else in SQL isn't a valid list name to begin with
+func TestListNames(t *testing.T) {
+	for _, v := range hostileValues {
+		if _, err := rules.Parse("IN AUDIENCE(" + quoted(v) + ")"); err == nil {
+			t.Errorf("list name %q accepted", v)
+		}
+	}
+}
+
+// Statements assembled with rules.Query bind what they are given, after the
+// rule's own arguments
+func TestQueryBind(t *testing.T) {
+	rule, err := rules.Parse("country = " + quoted(hostileValues[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := rules.NewQuery(store.Postgres{}).SQL(`SELECT user_id FROM user_profiles WHERE `).
+		Optimized(rule).SQL(` AND user_id > `).Bind(hostileValues[3]).SQL(` LIMIT `).Bind(10)
+	sql, args := q.Build()
+	if want := `SELECT user_id FROM user_profiles WHERE country = $1 AND user_id > $2 LIMIT $3`; sql != want {
+		t.Errorf("got %s, want %s", sql, want)
+	}
+	if fmt.Sprint(args) != fmt.Sprint([]interface{}{hostileValues[0], hostileValues[3], 10}) {
+		t.Errorf("args %v", args)
+	}
+	if q.Err() != nil {
+		t.Errorf("err %v", q.Err())
+	}
+}
+
+// Posting lists of the bitmap model, recording the values they are asked for
+type recordingPostings struct{ values []interface{} }
+
+func (p *recordingPostings) All() *roaring.Bitmap { return roaring.New() }
+func (p *recordingPostings) Compare(attr, op string, value interface{}) (*roaring.Bitmap, error) {
+	p.values = append(p.values, value)
+	return roaring.New(), nil
+}
+func (p *recordingPostings) Present(string) (*roaring.Bitmap, error) { return roaring.New(), nil }
+func (p *recordingPostings) List(name string) (*roaring.Bitmap, error) {
+	p.values = append(p.values, name)
+	return roaring.New(), nil
+}
+
+// The bitmap model has no SQL; values go to the posting lists unchanged
+func TestBitmapValues(t *testing.T) {
+	for _, v := range hostileValues {
+		for _, text := range hostileRules(v) {
+			rule, err := rules.Parse(text)
+			if err != nil {
+				t.Fatalf("parse %s: %v", text, err)
+			}
+			p := &recordingPostings{}
+			if _, err := rule.Bitmap(p); err != nil {
+				t.Fatalf("%s: %v", text, err)
+			}
+			if !slices.Contains(p.values, interface{}(v)) {
+				t.Errorf("%s: value %q not looked up as is: %v", text, v, p.values)
+			}
+		}
+	}
+}
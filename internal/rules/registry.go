@@ -0,0 +1,116 @@
+package rules
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"sync/atomic"
+)
+
+// Column of user_profiles holding registered attributes that have no column
+// of their own, as one JSONB document
+const OverflowColumn = "overflow"
+
+// An attribute rules can reference: one of the built-in Attributes or one
+// added at run time from the attribute registry
+type Attribute struct {
+	Name string
+	Type AttrType
+	// Kept in the overflow document rather than a user_profiles column
+	Overflow bool
+	// Registered rather than built in; their column names are quoted
+	Registered bool
+}
+
+// Registered attributes, replaced as a whole so parsing never sees a half-loaded registry
+var registered atomic.Pointer[map[string]Attribute]
+
+// Lowercase identifiers the tokenizer reads as one name, short enough for user_attributes.key
+var validName = regexp.MustCompile(`^[a-z_][a-z0-9_]{0,49}$`)
+
+// Whether name can be registered: a rule identifier that doesn't collide with
+// a built-in attribute, a DSL keyword or a user_profiles column of its own
+func ValidName(name string) error {
+	switch {
+	case !validName.MatchString(name):
+		return fmt.Errorf("attribute name %q must be lowercase letters, digits and underscores", name)
+	case isReservedWord(name) || name == "true" || name == "false":
+		return fmt.Errorf("attribute name %q is a rule keyword", name)
+	case name == "user_id" || name == "tenant_id" || name == OverflowColumn:
+		return fmt.Errorf("attribute name %q is a user_profiles column", name)
+	}
+	if _, ok := Attributes[name]; ok {
+		return fmt.Errorf("attribute %q is built in", name)
+	}
+	return nil
+}
+
+// Replace the registered attributes
+func Register(attrs []Attribute) error {
+	m := make(map[string]Attribute, len(attrs))
+	for _, a := range attrs {
+		if err := ValidName(a.Name); err != nil {
+			return err
+		}
+		a.Registered = true
+		m[a.Name] = a
+	}
+	registered.Store(&m)
+	return nil
+}
+
+// A built-in or registered attribute by name
+func Lookup(name string) (Attribute, bool) {
+	if typ, ok := Attributes[name]; ok {
+		return Attribute{Name: name, Type: typ}, true
+	}
+	if m := registered.Load(); m != nil {
+		a, ok := (*m)[name]
+		return a, ok
+	}
+	return Attribute{}, false
+}
+
+// Built-in and registered attributes, sorted by name
+func AllAttributes() []Attribute {
+	attrs := make([]Attribute, 0, len(Attributes))
+	for name, typ := range Attributes {
+		attrs = append(attrs, Attribute{Name: name, Type: typ})
+	}
+	if m := registered.Load(); m != nil {
+		for _, a := range *m {
+			attrs = append(attrs, a)
+		}
+	}
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].Name < attrs[j].Name })
+	return attrs
+}
+
+func ParseAttrType(s string) (AttrType, error) {
+	for _, t := range []AttrType{AttrText, AttrNumeric, AttrBool, AttrTimestamp, AttrDate, AttrSet} {
+		if t.String() == s {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown attribute type %q", s)
+}
+
+// The attribute's own user_profiles column; name is validated, so it is safe to inline
+func (a Attribute) Column() string {
+	if a.Registered {
+		return `"` + a.Name + `"`
+	}
+	return a.Name
+}
+
+// SQL reading the attribute from a user_profiles row (PostgreSQL for overflow attributes)
+func (a Attribute) ProfileExpr() string {
+	switch {
+	case !a.Overflow:
+		return a.Column()
+	case a.Type == AttrSet:
+		return "ARRAY(SELECT jsonb_array_elements_text(" + OverflowColumn + "->'" + a.Name + "'))"
+	default:
+		return jsonField(OverflowColumn, a)
+	}
+}
@@ -0,0 +1,918 @@
+// Package rules parses the audience rule DSL and compiles it to SQL for the
+// EAV and optimized models.
+package rules
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// Attribute types the rule DSL knows how to compare
+type AttrType int
+
+const (
+	AttrText AttrType = iota
+	AttrNumeric
+	AttrBool
+	AttrTimestamp
+	AttrDate
+	// Set of text values: a text[] column, one user_attributes row per element
+	AttrSet
+)
+
+func (t AttrType) String() string {
+	switch t {
+	case AttrNumeric:
+		return "numeric"
+	case AttrBool:
+		return "boolean"
+	case AttrTimestamp:
+		return "timestamp"
+	case AttrDate:
+		return "date"
+	case AttrSet:
+		return "set"
+	default:
+		return "text"
+	}
+}
+
+// Built-in attributes, available in both models: a user_profiles column and a
+// user_attributes key. More can be registered at run time, see Register.
+var Attributes = map[string]AttrType{
+	"country":        AttrText,
+	"tier":           AttrText,
+	"last_active_at": AttrTimestamp,
+	"has_purchased":  AttrBool,
+	"total_spend":    AttrNumeric,
+	"signup_date":    AttrDate,
+	"age":            AttrNumeric,
+	"interests":      AttrSet,
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+	tokLParen
+	tokRParen
+	tokComma
+	tokLBracket
+	tokRBracket
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of rule"
+	case tokString:
+		return "'" + t.text + "'"
+	default:
+		return fmt.Sprintf("%q", t.text)
+	}
+}
+
+func tokenize(rule string) ([]token, error) {
+	var tokens []token
+	runes := []rune(rule)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, token{tokLParen, "(", i})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{tokRParen, ")", i})
+			i++
+		case r == ',':
+			tokens = append(tokens, token{tokComma, ",", i})
+			i++
+		case r == '[':
+			tokens = append(tokens, token{tokLBracket, "[", i})
+			i++
+		case r == ']':
+			tokens = append(tokens, token{tokRBracket, "]", i})
+			i++
+		case r == '&':
+			if i+1 >= len(runes) || runes[i+1] != '&' {
+				return nil, fmt.Errorf("unexpected '&' at position %d, did you mean '&&'?", i)
+			}
+			tokens = append(tokens, token{tokOp, "&&", i})
+			i += 2
+		case r == '\'':
+			// SQL-style string literal; '' escapes a quote
+			start := i
+			var sb strings.Builder
+			i++
+			for {
+				if i >= len(runes) {
+					return nil, fmt.Errorf("unterminated string starting at position %d", start)
+				}
+				if runes[i] == '\'' {
+					if i+1 < len(runes) && runes[i+1] == '\'' {
+						sb.WriteRune('\'')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				sb.WriteRune(runes[i])
+				i++
+			}
+			tokens = append(tokens, token{tokString, sb.String(), start})
+		case r == '=':
+			tokens = append(tokens, token{tokOp, "=", i})
+			i++
+		case r == '!' || r == '<' || r == '>':
+			start := i
+			var op string
+			switch two := string(runes[i:min(i+2, len(runes))]); two {
+			case "!=", "<>":
+				op = "!="
+				i += 2
+			case "<=", ">=":
+				op = two
+				i += 2
+			default:
+				if r == '!' {
+					return nil, fmt.Errorf("unexpected '!' at position %d, did you mean '!='?", start)
+				}
+				op = string(r)
+				i++
+			}
+			tokens = append(tokens, token{tokOp, op, start})
+		case unicode.IsDigit(r) || r == '-' || r == '.':
+			start := i
+			i++
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			text := string(runes[start:i])
+			if _, err := strconv.ParseFloat(text, 64); err != nil {
+				return nil, fmt.Errorf("invalid number %q at position %d", text, start)
+			}
+			tokens = append(tokens, token{tokNumber, text, start})
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, token{tokIdent, string(runes[start:i]), start})
+		default:
+			return nil, fmt.Errorf("unexpected character %q at position %d", r, i)
+		}
+	}
+	return append(tokens, token{tokEOF, "", len(runes)}), nil
+}
+
+type ruleExpr interface {
+	optimizedSQL(args *Args) string
+	eavSQL(args *Args) string
+	jsonbSQL(args *Args) string
+	bitmap(p Postings) (*roaring.Bitmap, error)
+	canonical() string
+}
+
+// SQL differences the compiler has to know about
+type Dialect interface {
+	Placeholder(n int) string
+	// Cast an EAV text value to the attribute's type
+	CastValue(t AttrType, expr string) string
+	// Whether a set column shares any element with the bound values
+	SetOverlap(column string, placeholders []string) string
+	// Whether a predicate is false or unknown
+	NotTrue(predicate string) string
+	// Whether a set column has no elements, NULL included
+	EmptySet(column string) string
+}
+
+// Bind arguments collected while rendering a rule; rule values never end up in the SQL text
+type Args struct {
+	dialect Dialect
+	values  []interface{}
+}
+
+func NewArgs(d Dialect) *Args { return &Args{dialect: d} }
+
+// Append v and return its placeholder
+func (a *Args) Bind(v interface{}) string {
+	a.values = append(a.values, v)
+	return a.dialect.Placeholder(len(a.values))
+}
+
+// Arguments bound so far, in placeholder order
+func (a *Args) Values() []interface{} { return a.values }
+
+type andExpr struct{ left, right ruleExpr }
+type orExpr struct{ left, right ruleExpr }
+type notExpr struct{ expr ruleExpr }
+
+// attr <op> value
+type comparison struct {
+	attr  string
+	op    string
+	value literal
+}
+
+// attr IN (values...)
+type inExpr struct {
+	attr   string
+	values []literal
+}
+
+// attr BETWEEN low AND high, bounds included
+type betweenExpr struct {
+	attr      string
+	low, high literal
+}
+
+// attr && ARRAY[values...]: the set attribute holds at least one of values
+type overlapExpr struct {
+	attr   string
+	values []literal
+}
+
+// IN AUDIENCE('name'): the user is a member of an imported list
+type listExpr struct{ name string }
+
+// Names of imported lists, safe in a log line and a file name
+var validListName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+func ValidListName(name string) error {
+	if !validListName.MatchString(name) {
+		return fmt.Errorf("list name %q must be up to 63 lowercase letters, digits, '-' and '_'", name)
+	}
+	return nil
+}
+
+// attr IS NULL, or IS NOT NULL when not is set: whether the user has no value
+// for the attribute, an empty set included
+type nullExpr struct {
+	attr string
+	not  bool
+}
+
+type literal struct {
+	kind tokenKind // tokString, tokNumber or tokIdent (true/false)
+	text string
+}
+
+// Go value bound for the literal
+func (l literal) value() interface{} {
+	switch l.kind {
+	case tokIdent:
+		return l.text == "true"
+	case tokNumber:
+		if f, err := strconv.ParseFloat(l.text, 64); err == nil {
+			return f
+		}
+	}
+	return l.text
+}
+
+// Rule grammar:
+//
+//	expr       := orExpr
+//	orExpr     := andExpr { OR andExpr }
+//	andExpr    := unary { AND unary }
+//	unary      := NOT unary | primary
+//	primary    := '(' expr ')' | predicate
+//	predicate  := attr op value | attr [NOT] IN '(' value { ',' value } ')'
+//	            | attr [NOT] BETWEEN value AND value | attr '&&' ARRAY '[' value { ',' value } ']'
+//	            | attr IS [NOT] NULL | IN AUDIENCE '(' string ')'
+
+type ruleParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *ruleParser) peek() token { return p.tokens[p.pos] }
+
+func (p *ruleParser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *ruleParser) isKeyword(word string) bool {
+	t := p.peek()
+	return t.kind == tokIdent && strings.EqualFold(t.text, word)
+}
+
+func (p *ruleParser) errorf(t token, format string, args ...interface{}) error {
+	return fmt.Errorf("%s at position %d", fmt.Sprintf(format, args...), t.pos)
+}
+
+func (p *ruleParser) parseOr() (ruleExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("OR") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orExpr{left, right}
+	}
+	return left, nil
+}
+
+func (p *ruleParser) parseAnd() (ruleExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("AND") {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andExpr{left, right}
+	}
+	return left, nil
+}
+
+func (p *ruleParser) parseUnary() (ruleExpr, error) {
+	if p.isKeyword("NOT") {
+		p.next()
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{expr}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *ruleParser) parsePrimary() (ruleExpr, error) {
+	t := p.peek()
+	if t.kind == tokLParen {
+		p.next()
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokRParen {
+			return nil, p.errorf(closing, "expected ')' but found %s", closing)
+		}
+		return expr, nil
+	}
+	return p.parsePredicate()
+}
+
+func (p *ruleParser) parsePredicate() (ruleExpr, error) {
+	if p.isKeyword("IN") {
+		return p.parseListMembership()
+	}
+	t := p.next()
+	if t.kind != tokIdent || isReservedWord(t.text) {
+		return nil, p.errorf(t, "expected attribute name but found %s", t)
+	}
+	attr := strings.ToLower(t.text)
+	a, ok := Lookup(attr)
+	typ := a.Type
+	if !ok {
+		return nil, p.errorf(t, "unknown attribute %q (known: %s)", t.text, knownAttributes())
+	}
+
+	if p.isKeyword("IS") {
+		return p.parseNull(attr)
+	}
+	if typ == AttrSet {
+		return p.parseOverlap(attr)
+	}
+
+	negated := false
+	if p.isKeyword("NOT") {
+		p.next()
+		if !p.isKeyword("IN") && !p.isKeyword("BETWEEN") {
+			return nil, p.errorf(p.peek(), "expected IN or BETWEEN after NOT but found %s", p.peek())
+		}
+		negated = true
+	}
+	if p.isKeyword("BETWEEN") {
+		between, err := p.parseBetween(attr, typ)
+		if err != nil {
+			return nil, err
+		}
+		if negated {
+			return notExpr{between}, nil
+		}
+		return between, nil
+	}
+	if p.isKeyword("IN") {
+		p.next()
+		if open := p.next(); open.kind != tokLParen {
+			return nil, p.errorf(open, "expected '(' after IN but found %s", open)
+		}
+		values, err := p.parseList(attr, typ, tokRParen, "IN list")
+		if err != nil {
+			return nil, err
+		}
+		if negated {
+			return notExpr{inExpr{attr, values}}, nil
+		}
+		return inExpr{attr, values}, nil
+	}
+
+	op := p.next()
+	if op.kind != tokOp || op.text == "&&" {
+		return nil, p.errorf(op, "expected comparison operator after %q but found %s", attr, op)
+	}
+	if typ == AttrBool && op.text != "=" && op.text != "!=" {
+		return nil, p.errorf(op, "operator %s is not supported for boolean attribute %q", op.text, attr)
+	}
+	v, err := p.parseValue(attr, typ)
+	if err != nil {
+		return nil, err
+	}
+	return comparison{attr, op.text, v}, nil
+}
+
+// BETWEEN low AND high; the AND is part of the predicate, not a conjunction
+func (p *ruleParser) parseBetween(attr string, typ AttrType) (ruleExpr, error) {
+	between := p.next()
+	if typ == AttrBool {
+		return nil, p.errorf(between, "BETWEEN is not supported for boolean attribute %q", attr)
+	}
+	low, err := p.parseValue(attr, typ)
+	if err != nil {
+		return nil, err
+	}
+	if !p.isKeyword("AND") {
+		return nil, p.errorf(p.peek(), "expected AND in BETWEEN but found %s", p.peek())
+	}
+	p.next()
+	high, err := p.parseValue(attr, typ)
+	if err != nil {
+		return nil, err
+	}
+	return betweenExpr{attr, low, high}, nil
+}
+
+// IN AUDIENCE('name'), of the user rather than an attribute
+func (p *ruleParser) parseListMembership() (ruleExpr, error) {
+	p.next()
+	if !p.isKeyword("AUDIENCE") {
+		return nil, p.errorf(p.peek(), "expected AUDIENCE after IN but found %s", p.peek())
+	}
+	p.next()
+	if open := p.next(); open.kind != tokLParen {
+		return nil, p.errorf(open, "expected '(' after AUDIENCE but found %s", open)
+	}
+	name := p.next()
+	if name.kind != tokString {
+		return nil, p.errorf(name, "expected the list name as a string but found %s", name)
+	}
+	if err := ValidListName(name.text); err != nil {
+		return nil, p.errorf(name, "%v", err)
+	}
+	if closing := p.next(); closing.kind != tokRParen {
+		return nil, p.errorf(closing, "expected ')' after the list name but found %s", closing)
+	}
+	return listExpr{name.text}, nil
+}
+
+// IS [NOT] NULL, for every type
+func (p *ruleParser) parseNull(attr string) (ruleExpr, error) {
+	p.next()
+	not := false
+	if p.isKeyword("NOT") {
+		p.next()
+		not = true
+	}
+	if !p.isKeyword("NULL") {
+		return nil, p.errorf(p.peek(), "expected NULL after IS but found %s", p.peek())
+	}
+	p.next()
+	return nullExpr{attr, not}, nil
+}
+
+// Sets otherwise only support overlap: interests && ARRAY['sports', 'music']
+func (p *ruleParser) parseOverlap(attr string) (ruleExpr, error) {
+	op := p.next()
+	if op.kind != tokOp || op.text != "&&" {
+		return nil, p.errorf(op, "expected && after set attribute %q but found %s", attr, op)
+	}
+	if array := p.next(); array.kind != tokIdent || !strings.EqualFold(array.text, "ARRAY") {
+		return nil, p.errorf(array, "expected ARRAY after && but found %s", array)
+	}
+	if open := p.next(); open.kind != tokLBracket {
+		return nil, p.errorf(open, "expected '[' after ARRAY but found %s", open)
+	}
+	values, err := p.parseList(attr, AttrSet, tokRBracket, "ARRAY")
+	if err != nil {
+		return nil, err
+	}
+	return overlapExpr{attr, values}, nil
+}
+
+// value { ',' value } up to and including the closing token
+func (p *ruleParser) parseList(attr string, typ AttrType, closing tokenKind, what string) ([]literal, error) {
+	var values []literal
+	for {
+		v, err := p.parseValue(attr, typ)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+		sep := p.next()
+		if sep.kind == closing {
+			return values, nil
+		}
+		if sep.kind != tokComma {
+			return nil, p.errorf(sep, "expected ',' or '%s' in %s but found %s", closingText[closing], what, sep)
+		}
+	}
+}
+
+var closingText = map[tokenKind]string{tokRParen: ")", tokRBracket: "]"}
+
+// Parse a literal and check it matches the attribute type
+func (p *ruleParser) parseValue(attr string, typ AttrType) (literal, error) {
+	t := p.next()
+	switch {
+	case t.kind == tokString && (typ == AttrText || typ == AttrTimestamp || typ == AttrSet):
+		return literal{tokString, t.text}, nil
+	case t.kind == tokString && typ == AttrDate:
+		// Checked here so a typo is a rule error rather than a failed cast in SQL
+		if _, err := time.Parse(time.DateOnly, t.text); err != nil {
+			return literal{}, p.errorf(t, "invalid date %s for %q, expected YYYY-MM-DD", t, attr)
+		}
+		return literal{tokString, t.text}, nil
+	case t.kind == tokNumber && typ == AttrNumeric:
+		return literal{tokNumber, t.text}, nil
+	case t.kind == tokIdent && typ == AttrBool && (strings.EqualFold(t.text, "true") || strings.EqualFold(t.text, "false")):
+		return literal{tokIdent, strings.ToLower(t.text)}, nil
+	case t.kind == tokEOF || t.kind == tokRParen || t.kind == tokRBracket || t.kind == tokComma:
+		return literal{}, p.errorf(t, "expected value for %q but found %s", attr, t)
+	default:
+		return literal{}, p.errorf(t, "invalid value %s for %s attribute %q", t, typ, attr)
+	}
+}
+
+func isReservedWord(s string) bool {
+	switch strings.ToUpper(s) {
+	case "AND", "OR", "NOT", "IN", "BETWEEN", "ARRAY", "IS", "NULL":
+		return true
+	}
+	return false
+}
+
+func knownAttributes() string {
+	var names []string
+	for _, a := range AllAttributes() {
+		names = append(names, a.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// Optimized model: attributes are plain user_profiles columns, or fields of
+// the overflow document rendered as in the JSONB model
+func (e andExpr) optimizedSQL(args *Args) string {
+	return "(" + e.left.optimizedSQL(args) + " AND " + e.right.optimizedSQL(args) + ")"
+}
+func (e orExpr) optimizedSQL(args *Args) string {
+	return "(" + e.left.optimizedSQL(args) + " OR " + e.right.optimizedSQL(args) + ")"
+}
+
+// IS NOT TRUE rather than NOT: a NULL column makes the predicate unknown, and the EAV
+// model treats a missing attribute as "does not match", so NOT must include those users.
+func (e notExpr) optimizedSQL(args *Args) string {
+	return args.dialect.NotTrue(e.expr.optimizedSQL(args))
+}
+func (e comparison) optimizedSQL(args *Args) string {
+	a := attribute(e.attr)
+	if a.Overflow {
+		return e.documentSQL(args, OverflowColumn)
+	}
+	return a.Column() + " " + e.op + " " + args.Bind(e.value.value())
+}
+func (e inExpr) optimizedSQL(args *Args) string {
+	a := attribute(e.attr)
+	if a.Overflow {
+		return e.documentSQL(args, OverflowColumn)
+	}
+	return a.Column() + " IN (" + bindLiterals(args, e.values) + ")"
+}
+func (e betweenExpr) optimizedSQL(args *Args) string {
+	a := attribute(e.attr)
+	if a.Overflow {
+		return e.documentSQL(args, OverflowColumn)
+	}
+	return a.Column() + " BETWEEN " + args.Bind(e.low.value()) + " AND " + args.Bind(e.high.value())
+}
+
+// Served by the GIN index on the array column
+func (e overlapExpr) optimizedSQL(args *Args) string {
+	a := attribute(e.attr)
+	if a.Overflow {
+		return e.documentSQL(args, OverflowColumn)
+	}
+	return args.dialect.SetOverlap(a.Column(), bindEach(args, e.values))
+}
+
+// An empty set is NULL here too, as it has no user_attributes rows
+func (e nullExpr) optimizedSQL(args *Args) string {
+	a := attribute(e.attr)
+	switch {
+	case a.Overflow:
+		return e.documentSQL(args, OverflowColumn)
+	case a.Type == AttrSet && e.not:
+		return "NOT " + args.dialect.EmptySet(a.Column())
+	case a.Type == AttrSet:
+		return args.dialect.EmptySet(a.Column())
+	}
+	return a.Column() + nullTest(e.not)
+}
+
+func nullTest(not bool) string {
+	if not {
+		return " IS NOT NULL"
+	}
+	return " IS NULL"
+}
+
+// A semi-join on the list's members, served by their primary key
+func (e listExpr) optimizedSQL(args *Args) string { return listMembers(args, "user_id", e.name) }
+
+// The name is bound, as it is the caller's
+func listMembers(args *Args, userID, name string) string {
+	return userID + " IN (SELECT m.user_id FROM audience_list_members m JOIN audience_lists l ON l.list_id = m.list_id WHERE l.name = " +
+		args.Bind(name) + ")"
+}
+
+// Parsed rules only hold known attributes
+func attribute(name string) Attribute {
+	a, _ := Lookup(name)
+	return a
+}
+
+// EAV model: every attribute comparison is an EXISTS subquery against user_attributes
+func (e andExpr) eavSQL(args *Args) string {
+	return "(" + e.left.eavSQL(args) + " AND " + e.right.eavSQL(args) + ")"
+}
+func (e orExpr) eavSQL(args *Args) string {
+	return "(" + e.left.eavSQL(args) + " OR " + e.right.eavSQL(args) + ")"
+}
+func (e notExpr) eavSQL(args *Args) string { return "NOT (" + e.expr.eavSQL(args) + ")" }
+func (e comparison) eavSQL(args *Args) string {
+	return eavExists(e.attr, eavValue(args.dialect, e.attr)+" "+e.op+" "+args.Bind(e.value.value()))
+}
+func (e inExpr) eavSQL(args *Args) string {
+	return eavExists(e.attr, eavValue(args.dialect, e.attr)+" IN ("+bindLiterals(args, e.values)+")")
+}
+func (e betweenExpr) eavSQL(args *Args) string {
+	return eavExists(e.attr, eavValue(args.dialect, e.attr)+" BETWEEN "+args.Bind(e.low.value())+" AND "+args.Bind(e.high.value()))
+}
+
+// A set has one user_attributes row per element, so overlap is a plain IN
+func (e overlapExpr) eavSQL(args *Args) string {
+	return eavExists(e.attr, "ua.value IN ("+bindLiterals(args, e.values)+")")
+}
+
+// A missing attribute has no rows, so IS NULL is an anti-join
+func (e nullExpr) eavSQL(args *Args) string {
+	exists := eavExists(e.attr, "ua.value IS NOT NULL")
+	if e.not {
+		return exists
+	}
+	return "NOT " + exists
+}
+
+func (e listExpr) eavSQL(args *Args) string { return listMembers(args, "u.user_id", e.name) }
+
+// attr is a known attribute, so it is safe to inline
+func eavExists(attr, predicate string) string {
+	return "EXISTS (SELECT 1 FROM user_attributes ua WHERE ua.user_id = u.user_id AND ua.key = '" +
+		attr + "' AND " + predicate + ")"
+}
+
+// Typed view of ua.value. The cast is guarded by the key so the planner can
+// never apply it to values of other attributes.
+func eavValue(d Dialect, attr string) string {
+	typ := attribute(attr).Type
+	if typ == AttrText || typ == AttrSet {
+		return "ua.value"
+	}
+	return "(CASE WHEN ua.key = '" + attr + "' THEN " + d.CastValue(typ, "ua.value") + " END)"
+}
+
+// Canonical form: AND/OR operands flattened and sorted, IN lists deduplicated
+// and sorted, numbers normalized, so equivalent spellings of a rule compare equal.
+func (e andExpr) canonical() string { return canonicalJoin("AND", e) }
+func (e orExpr) canonical() string  { return canonicalJoin("OR", e) }
+func (e notExpr) canonical() string { return "NOT (" + e.expr.canonical() + ")" }
+func (e comparison) canonical() string {
+	return e.attr + " " + e.op + " " + e.value.canonical()
+}
+func (e inExpr) canonical() string {
+	return e.attr + " IN (" + canonicalList(e.values) + ")"
+}
+func (e betweenExpr) canonical() string {
+	return e.attr + " BETWEEN " + e.low.canonical() + " AND " + e.high.canonical()
+}
+func (e overlapExpr) canonical() string {
+	return e.attr + " && ARRAY[" + canonicalList(e.values) + "]"
+}
+func (e nullExpr) canonical() string { return e.attr + nullTest(e.not) }
+func (e listExpr) canonical() string {
+	return "IN AUDIENCE(" + literal{kind: tokString, text: e.name}.canonical() + ")"
+}
+
+// Deduplicated and sorted
+func canonicalList(literals []literal) string {
+	seen := map[string]bool{}
+	var values []string
+	for _, v := range literals {
+		c := v.canonical()
+		if !seen[c] {
+			seen[c] = true
+			values = append(values, c)
+		}
+	}
+	sort.Strings(values)
+	return strings.Join(values, ", ")
+}
+
+func (l literal) canonical() string {
+	switch l.kind {
+	case tokString:
+		return "'" + strings.ReplaceAll(l.text, "'", "''") + "'"
+	case tokIdent:
+		return strings.ToUpper(l.text)
+	}
+	if f, err := strconv.ParseFloat(l.text, 64); err == nil {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return l.text
+}
+
+func canonicalJoin(op string, e ruleExpr) string {
+	var terms []string
+	var collect func(ruleExpr)
+	collect = func(x ruleExpr) {
+		switch n := x.(type) {
+		case andExpr:
+			if op == "AND" {
+				collect(n.left)
+				collect(n.right)
+				return
+			}
+		case orExpr:
+			if op == "OR" {
+				collect(n.left)
+				collect(n.right)
+				return
+			}
+		}
+		terms = append(terms, x.canonical())
+	}
+	collect(e)
+	sort.Strings(terms)
+	return "(" + strings.Join(terms, " "+op+" ") + ")"
+}
+
+func bindLiterals(args *Args, values []literal) string {
+	return strings.Join(bindEach(args, values), ", ")
+}
+
+func bindEach(args *Args, values []literal) []string {
+	placeholders := make([]string, len(values))
+	for i, v := range values {
+		placeholders[i] = args.Bind(v.value())
+	}
+	return placeholders
+}
+
+// A parsed audience rule
+type Rule struct {
+	Source string
+	expr   ruleExpr
+	// Users the rule is evaluated over; empty for every tenant
+	tenant string
+}
+
+// Parse an audience rule such as
+//
+//	country = 'US' AND (tier IN ('gold','platinum') OR total_spend > 100)
+//	age BETWEEN 25 AND 34 AND interests && ARRAY['sports']
+func Parse(rule string) (*Rule, error) {
+	if strings.TrimSpace(rule) == "" {
+		return nil, fmt.Errorf("invalid rule: empty")
+	}
+	tokens, err := tokenize(rule)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rule %q: %w", rule, err)
+	}
+	p := &ruleParser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, fmt.Errorf("invalid rule %q: %w", rule, err)
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, fmt.Errorf("invalid rule %q: %w", rule, p.errorf(t, "unexpected %s", t))
+	}
+	return &Rule{Source: rule, expr: expr}, nil
+}
+
+// A copy of the rule restricted to one tenant's users
+func (r *Rule) ForTenant(tenant string) *Rule {
+	scoped := *r
+	scoped.tenant = tenant
+	return &scoped
+}
+
+// Tenant the rule is restricted to, empty when it isn't
+func (r *Rule) Tenant() string { return r.tenant }
+
+// Short stable ID of the rule's canonical form, for log lines
+func (r *Rule) Hash() string {
+	sum := sha256.Sum256([]byte(r.Canonical()))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Normalized text of the rule; equivalent rules share it, the same rule of
+// two tenants doesn't
+func (r *Rule) Canonical() string {
+	if r.tenant == "" {
+		return r.expr.canonical()
+	}
+	return "tenant_id = " + literal{kind: tokString, text: r.tenant}.canonical() + " AND " + r.expr.canonical()
+}
+
+// Parameterized WHERE clause against user_profiles and its bind arguments
+func (r *Rule) OptimizedWhere(d Dialect) (string, []interface{}) {
+	args := NewArgs(d)
+	return r.OptimizedSQL(args), args.values
+}
+
+// Parameterized WHERE clause against users u, expanding each comparison into
+// an EXISTS on user_attributes, and its bind arguments
+func (r *Rule) EAVWhere(d Dialect) (string, []interface{}) {
+	args := NewArgs(d)
+	return r.EAVSQL(args), args.values
+}
+
+// Parameterized WHERE clause against user_profiles_jsonb and its bind arguments
+func (r *Rule) JSONBWhere(d Dialect) (string, []interface{}, error) {
+	args := NewArgs(d)
+	where, err := r.JSONBSQL(args)
+	if err != nil {
+		return "", nil, err
+	}
+	return where, args.values, nil
+}
+
+// Render the optimized predicate, binding values into args after any already there
+func (r *Rule) OptimizedSQL(args *Args) string {
+	if r.tenant == "" {
+		return r.expr.optimizedSQL(args)
+	}
+	return "tenant_id = " + args.Bind(r.tenant) + " AND (" + r.expr.optimizedSQL(args) + ")"
+}
+
+// Render the EAV predicate, binding values into args after any already there
+func (r *Rule) EAVSQL(args *Args) string {
+	if r.tenant == "" {
+		return r.expr.eavSQL(args)
+	}
+	return "u.tenant_id = " + args.Bind(r.tenant) + " AND (" + r.expr.eavSQL(args) + ")"
+}
+
+// Render the JSONB predicate, binding values into args after any already there.
+// user_profiles_jsonb has no tenants, so a tenant's rule can't be rendered.
+func (r *Rule) JSONBSQL(args *Args) (string, error) {
+	if r.tenant != "" {
+		return "", errors.New("the JSONB model has no tenants")
+	}
+	return r.expr.jsonbSQL(args), nil
+}
@@ -0,0 +1,156 @@
+package rules_test
+
+import (
+	"fmt"
+	"testing"
+
+	"audience-poc/internal/rules"
+	"audience-poc/internal/store"
+)
+
+type sqlCase struct {
+	name   string
+	rule   string
+	tenant string // restrict the rule to this tenant first, as serve does
+
+	optimized string // WHERE clause on user_profiles
+	eav       string // WHERE clause on users u
+	args      []interface{}
+}
+
+// The integration suite counts most of these rules against a real database
+var sqlCases = []sqlCase{
+	{
+		name: "equality", rule: "country = 'US'",
+		optimized: `country = $1`,
+		eav:       `EXISTS (SELECT 1 FROM user_attributes ua WHERE ua.user_id = u.user_id AND ua.key = 'country' AND ua.value = $1)`,
+		args:      []interface{}{"US"},
+	},
+	{
+		name: "exclusion", rule: "country = 'US' AND NOT has_purchased = true",
+		optimized: `(country = $1 AND (has_purchased = $2) IS NOT TRUE)`,
+		eav: `(EXISTS (SELECT 1 FROM user_attributes ua WHERE ua.user_id = u.user_id AND ua.key = 'country' AND ua.value = $1) ` +
+			`AND NOT (EXISTS (SELECT 1 FROM user_attributes ua WHERE ua.user_id = u.user_id AND ua.key = 'has_purchased' ` +
+			`AND (CASE WHEN ua.key = 'has_purchased' THEN ua.value::boolean END) = $2)))`,
+		args: []interface{}{"US", true},
+	},
+	{
+		name: "or", rule: "tier IN ('gold','platinum') OR total_spend > 100",
+		optimized: `(tier IN ($1, $2) OR total_spend > $3)`,
+		eav: `(EXISTS (SELECT 1 FROM user_attributes ua WHERE ua.user_id = u.user_id AND ua.key = 'tier' AND ua.value IN ($1, $2)) ` +
+			`OR EXISTS (SELECT 1 FROM user_attributes ua WHERE ua.user_id = u.user_id AND ua.key = 'total_spend' ` +
+			`AND (CASE WHEN ua.key = 'total_spend' THEN ua.value::numeric END) > $3))`,
+		args: []interface{}{"gold", "platinum", 100},
+	},
+	{
+		name: "between_and_set", rule: "age BETWEEN 25 AND 34 AND interests && ARRAY['sports']",
+		optimized: `(age BETWEEN $1 AND $2 AND interests && ARRAY[$3]::text[])`,
+		eav: `(EXISTS (SELECT 1 FROM user_attributes ua WHERE ua.user_id = u.user_id AND ua.key = 'age' ` +
+			`AND (CASE WHEN ua.key = 'age' THEN ua.value::numeric END) BETWEEN $1 AND $2) ` +
+			`AND EXISTS (SELECT 1 FROM user_attributes ua WHERE ua.user_id = u.user_id AND ua.key = 'interests' AND ua.value IN ($3)))`,
+		args: []interface{}{25, 34, "sports"},
+	},
+	{
+		name: "not_missing_value", rule: "NOT tier = 'gold'",
+		optimized: `(tier = $1) IS NOT TRUE`,
+		eav:       `NOT (EXISTS (SELECT 1 FROM user_attributes ua WHERE ua.user_id = u.user_id AND ua.key = 'tier' AND ua.value = $1))`,
+		args:      []interface{}{"gold"},
+	},
+	{
+		name: "nested_not", rule: "signup_date > '2024-01-01' AND NOT (country = 'DE' OR total_spend < 100)",
+		optimized: `(signup_date > $1 AND ((country = $2 OR total_spend < $3)) IS NOT TRUE)`,
+		eav: `(EXISTS (SELECT 1 FROM user_attributes ua WHERE ua.user_id = u.user_id AND ua.key = 'signup_date' ` +
+			`AND (CASE WHEN ua.key = 'signup_date' THEN ua.value::date END) > $1) ` +
+			`AND NOT ((EXISTS (SELECT 1 FROM user_attributes ua WHERE ua.user_id = u.user_id AND ua.key = 'country' AND ua.value = $2) ` +
+			`OR EXISTS (SELECT 1 FROM user_attributes ua WHERE ua.user_id = u.user_id AND ua.key = 'total_spend' ` +
+			`AND (CASE WHEN ua.key = 'total_spend' THEN ua.value::numeric END) < $3))))`,
+		args: []interface{}{"2024-01-01", "DE", 100},
+	},
+	{
+		name: "not_in", rule: "country NOT IN ('US','DE')",
+		optimized: `(country IN ($1, $2)) IS NOT TRUE`,
+		eav:       `NOT (EXISTS (SELECT 1 FROM user_attributes ua WHERE ua.user_id = u.user_id AND ua.key = 'country' AND ua.value IN ($1, $2)))`,
+		args:      []interface{}{"US", "DE"},
+	},
+	{
+		name: "not_between", rule: "total_spend NOT BETWEEN 50 AND 200",
+		optimized: `(total_spend BETWEEN $1 AND $2) IS NOT TRUE`,
+		eav: `NOT (EXISTS (SELECT 1 FROM user_attributes ua WHERE ua.user_id = u.user_id AND ua.key = 'total_spend' ` +
+			`AND (CASE WHEN ua.key = 'total_spend' THEN ua.value::numeric END) BETWEEN $1 AND $2))`,
+		args: []interface{}{50, 200},
+	},
+	{
+		name: "is_null", rule: "tier IS NULL",
+		optimized: `tier IS NULL`,
+		eav:       `NOT EXISTS (SELECT 1 FROM user_attributes ua WHERE ua.user_id = u.user_id AND ua.key = 'tier' AND ua.value IS NOT NULL)`,
+	},
+	{
+		name: "empty_set_is_null", rule: "interests IS NULL",
+		optimized: `(interests IS NULL OR cardinality(interests) = 0)`,
+		eav:       `NOT EXISTS (SELECT 1 FROM user_attributes ua WHERE ua.user_id = u.user_id AND ua.key = 'interests' AND ua.value IS NOT NULL)`,
+	},
+	{
+		name: "is_not_null", rule: "has_purchased IS NOT NULL AND NOT has_purchased = false",
+		optimized: `(has_purchased IS NOT NULL AND (has_purchased = $1) IS NOT TRUE)`,
+		eav: `(EXISTS (SELECT 1 FROM user_attributes ua WHERE ua.user_id = u.user_id AND ua.key = 'has_purchased' AND ua.value IS NOT NULL) ` +
+			`AND NOT (EXISTS (SELECT 1 FROM user_attributes ua WHERE ua.user_id = u.user_id AND ua.key = 'has_purchased' ` +
+			`AND (CASE WHEN ua.key = 'has_purchased' THEN ua.value::boolean END) = $1)))`,
+		args: []interface{}{false},
+	},
+	{
+		name: "in_audience", rule: "IN AUDIENCE('crm') AND country = 'US'",
+		optimized: `(user_id IN (SELECT m.user_id FROM audience_list_members m JOIN audience_lists l ON l.list_id = m.list_id WHERE l.name = $1) AND country = $2)`,
+		eav: `(u.user_id IN (SELECT m.user_id FROM audience_list_members m JOIN audience_lists l ON l.list_id = m.list_id WHERE l.name = $1) ` +
+			`AND EXISTS (SELECT 1 FROM user_attributes ua WHERE ua.user_id = u.user_id AND ua.key = 'country' AND ua.value = $2))`,
+		args: []interface{}{"crm", "US"},
+	},
+	{
+		name: "not_in_audience", rule: "NOT IN AUDIENCE('crm')",
+		optimized: `(user_id IN (SELECT m.user_id FROM audience_list_members m JOIN audience_lists l ON l.list_id = m.list_id WHERE l.name = $1)) IS NOT TRUE`,
+		eav:       `NOT (u.user_id IN (SELECT m.user_id FROM audience_list_members m JOIN audience_lists l ON l.list_id = m.list_id WHERE l.name = $1))`,
+		args:      []interface{}{"crm"},
+	},
+	{
+		name: "tenant", rule: "country = 'US'", tenant: "acme",
+		optimized: `tenant_id = $1 AND (country = $2)`,
+		eav:       `u.tenant_id = $1 AND (EXISTS (SELECT 1 FROM user_attributes ua WHERE ua.user_id = u.user_id AND ua.key = 'country' AND ua.value = $2))`,
+		args:      []interface{}{"acme", "US"},
+	},
+	{
+		name: "tenant_in_audience", rule: "IN AUDIENCE('crm') OR tier IS NULL", tenant: "acme",
+		optimized: `tenant_id = $1 AND ((user_id IN (SELECT m.user_id FROM audience_list_members m JOIN audience_lists l ON l.list_id = m.list_id WHERE l.name = $2) OR tier IS NULL))`,
+		eav: `u.tenant_id = $1 AND ((u.user_id IN (SELECT m.user_id FROM audience_list_members m JOIN audience_lists l ON l.list_id = m.list_id WHERE l.name = $2) ` +
+			`OR NOT EXISTS (SELECT 1 FROM user_attributes ua WHERE ua.user_id = u.user_id AND ua.key = 'tier' AND ua.value IS NOT NULL)))`,
+		args: []interface{}{"acme", "crm"},
+	},
+}
+
+func TestRuleSQL(t *testing.T) {
+	for _, c := range sqlCases {
+		t.Run(c.name, func(t *testing.T) {
+			rule, err := rules.Parse(c.rule)
+			if err != nil {
+				t.Fatalf("parse %q: %v", c.rule, err)
+			}
+			if c.tenant != "" {
+				rule = rule.ForTenant(c.tenant)
+			}
+			for _, m := range []struct {
+				model, want string
+				where       func(rules.Dialect) (string, []interface{})
+			}{
+				{"optimized", c.optimized, rule.OptimizedWhere},
+				{"eav", c.eav, rule.EAVWhere},
+			} {
+				got, args := m.where(store.Postgres{})
+				if got != m.want {
+					t.Errorf("%s SQL:\n got: %s\nwant: %s", m.model, got, m.want)
+				}
+				// Numbers parse to different Go types, which bind the same
+				if fmt.Sprint(args) != fmt.Sprint(c.args) {
+					t.Errorf("%s args: got %v, want %v", m.model, args, c.args)
+				}
+			}
+		})
+	}
+}
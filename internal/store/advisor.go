@@ -0,0 +1,350 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+
+	"audience-poc/internal/rules"
+)
+
+// Postgres truncates longer identifiers, which would make advice names collide silently
+const maxIdentifierLength = 63
+
+// A rule of the workload the advisor reads, with the optimized model's plan when it could be explained
+type AdvisedRule struct {
+	Name   string
+	Rule   string
+	Weight float64
+	Plan   *QueryPlan
+}
+
+// An index of user_profiles, as pg_indexes describes it
+type ExistingIndex struct {
+	Name      string
+	Method    string // btree, gin, brin...
+	Key       string // leading key column or expression
+	Predicate string // WHERE clause of a partial index, empty otherwise
+	Def       string // the CREATE INDEX statement
+}
+
+// An index the advisor recommends for user_profiles
+type IndexAdvice struct {
+	Name string
+	DDL  string
+	Kind string // btree, partial or gin
+	// Workload rules with a predicate the index serves, and their summed weight
+	Rules  []string
+	Weight float64
+	// Of those, the rules whose plan scans user_profiles sequentially
+	SeqScanRules []string
+	// Existing index that already serves the same predicates; such advice is reported, not recommended
+	CoveredBy string
+
+	method, key, predicate string
+}
+
+// Indexes of user_profiles, partitioned ones included (PostgreSQL only)
+func ProfileIndexes(ctx context.Context, db Querier) ([]ExistingIndex, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT indexname, indexdef FROM pg_indexes
+		WHERE schemaname = current_schema() AND tablename = 'user_profiles'
+		ORDER BY indexname`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var indexes []ExistingIndex
+	for rows.Next() {
+		var name, def string
+		if err := rows.Scan(&name, &def); err != nil {
+			return nil, err
+		}
+		if ix, ok := parseIndexDef(name, def); ok {
+			indexes = append(indexes, ix)
+		}
+	}
+	return indexes, rows.Err()
+}
+
+// Split "CREATE INDEX n ON t USING method (key, ...) WHERE predicate" as pg_indexes prints it
+func parseIndexDef(name, def string) (ExistingIndex, bool) {
+	i := strings.Index(def, " USING ")
+	if i < 0 {
+		return ExistingIndex{}, false
+	}
+	rest := def[i+len(" USING "):]
+	open := strings.IndexByte(rest, '(')
+	if open < 0 {
+		return ExistingIndex{}, false
+	}
+	ix := ExistingIndex{Name: name, Def: def, Method: strings.ToLower(strings.TrimSpace(rest[:open]))}
+	depth, keys := 0, ""
+	for j := open; j < len(rest); j++ {
+		switch rest[j] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		}
+		if depth == 0 {
+			keys, rest = rest[open+1:j], rest[j+1:]
+			break
+		}
+	}
+	ix.Key = leadingKey(keys)
+	if w := strings.Index(rest, " WHERE "); w >= 0 {
+		ix.Predicate = strings.TrimSpace(rest[w+len(" WHERE "):])
+	}
+	return ix, true
+}
+
+// First entry of an index's key list, without its operator class
+func leadingKey(keys string) string {
+	depth := 0
+	for i, r := range keys {
+		if r == '(' {
+			depth++
+		} else if r == ')' {
+			depth--
+		} else if r == ',' && depth == 0 {
+			keys = keys[:i]
+			break
+		}
+	}
+	keys = strings.TrimSpace(keys)
+	if !strings.HasSuffix(keys, ")") {
+		if sp := strings.LastIndexByte(keys, ' '); sp > 0 && strings.HasSuffix(keys[sp+1:], "_ops") {
+			keys = keys[:sp]
+		}
+	}
+	return keys
+}
+
+// Comparable text of a key or predicate: pg_indexes adds parentheses, casts
+// of literals and quoting the rule compiler doesn't, and spells booleans lowercase
+func normalizeIndexSQL(s string) string {
+	s = strings.ToLower(s)
+	s = strings.NewReplacer("::text", "", "::bpchar", "", "::numeric", "", "::date", "", "::timestamp without time zone", "").Replace(s)
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '(' || r == ')' || r == '"' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// One predicate of a rule the candidate index would serve
+type indexUse struct {
+	rule    *AdvisedRule
+	filters []string // partial-index predicates every user the rule matches satisfies
+}
+
+// Recommend user_profiles indexes for the predicates of a workload: GIN for
+// set attributes and overflow containment, b-tree for the rest, or a partial
+// b-tree when every rule using a column also requires the same boolean
+// flag or numeric lower bound. Advice an existing index already covers has CoveredBy
+// set. Advice is sorted by the weight of the rules it serves.
+func AdviseIndexes(workload []AdvisedRule, existing []ExistingIndex) ([]IndexAdvice, error) {
+	type candidate struct {
+		method, key, name string
+		uses              []indexUse
+	}
+	candidates := map[string]*candidate{}
+	var order []string
+	add := func(method, key, name string, u indexUse) {
+		id := method + " " + key
+		c, ok := candidates[id]
+		if !ok {
+			c = &candidate{method: method, key: key, name: name}
+			candidates[id] = c
+			order = append(order, id)
+		}
+		c.uses = append(c.uses, u)
+	}
+
+	for i := range workload {
+		r := &workload[i]
+		rule, err := rules.Parse(r.Rule)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", r.Name, err)
+		}
+		preds := rule.Predicates()
+		var flags []string
+		for _, p := range preds {
+			if p.Required && !p.Negated && !p.Attribute.Overflow && p.Attribute.Type == rules.AttrBool && p.Op == "=" {
+				flags = append(flags, p.Attribute.Column()+" = "+p.Value)
+			}
+		}
+		for _, p := range preds {
+			a := p.Attribute
+			if p.Negated || p.Op == "!=" || p.Op == "IS NULL" || p.Op == "IS NOT NULL" {
+				continue
+			}
+			overflowContains := a.Overflow && (p.Op == "&&" || (p.Op == "=" || p.Op == "IN") && a.Type != rules.AttrTimestamp)
+			switch {
+			case overflowContains:
+				add("gin", rules.OverflowColumn+" jsonb_path_ops", "idx_advise_"+rules.OverflowColumn, indexUse{rule: r})
+			case a.Overflow:
+				add("btree", "("+a.ProfileExpr()+")", "idx_advise_"+rules.OverflowColumn+"_"+a.Name, indexUse{rule: r})
+			case a.Type == rules.AttrSet:
+				add("gin", a.Column(), "idx_advise_"+a.Name, indexUse{rule: r})
+			default:
+				u := indexUse{rule: r}
+				if p.Required {
+					u.filters = append(u.filters, flags...)
+					// Date and time cutoffs move with every run, so only numeric bounds
+					if a.Type == rules.AttrNumeric && (p.Op == ">" || p.Op == ">=") {
+						u.filters = append(u.filters, a.Column()+" "+p.Op+" "+p.Value)
+					}
+				}
+				add("btree", a.Column(), "idx_advise_"+a.Name, u)
+			}
+		}
+	}
+
+	advice := make([]IndexAdvice, 0, len(order))
+	for _, id := range order {
+		c := candidates[id]
+		adv := IndexAdvice{Name: c.name, Kind: c.method, method: c.method, key: c.key}
+		if c.method == "btree" {
+			if filter := commonFilter(c.uses); filter != "" {
+				adv.Kind, adv.predicate = "partial", filter
+				adv.Name += partialSuffix(filter, c.key)
+			}
+		}
+		if len(adv.Name) > maxIdentifierLength {
+			adv.Name = adv.Name[:maxIdentifierLength]
+		}
+		adv.DDL = "CREATE INDEX IF NOT EXISTS " + adv.Name + " ON user_profiles USING " + adv.method + " (" + adv.key + ")"
+		if adv.predicate != "" {
+			adv.DDL += " WHERE " + adv.predicate
+		}
+
+		seen := map[string]bool{}
+		for _, u := range c.uses {
+			if seen[u.rule.Name] {
+				continue
+			}
+			seen[u.rule.Name] = true
+			adv.Rules = append(adv.Rules, u.rule.Name)
+			adv.Weight += u.rule.Weight
+			if u.rule.Plan != nil && seqScansProfiles(u.rule.Plan) {
+				adv.SeqScanRules = append(adv.SeqScanRules, u.rule.Name)
+			}
+		}
+		adv.CoveredBy = coveringIndex(adv, existing)
+		advice = append(advice, adv)
+	}
+	sort.SliceStable(advice, func(i, j int) bool { return advice[i].Weight > advice[j].Weight })
+	return advice, nil
+}
+
+// The partial-index predicate every use shares, the first in sorted order
+// when there are several, or "" when the uses have none in common
+func commonFilter(uses []indexUse) string {
+	common := map[string]bool{}
+	for _, f := range uses[0].filters {
+		common[f] = true
+	}
+	for _, u := range uses[1:] {
+		has := map[string]bool{}
+		for _, f := range u.filters {
+			has[f] = true
+		}
+		for f := range common {
+			if !has[f] {
+				delete(common, f)
+			}
+		}
+	}
+	filters := make([]string, 0, len(common))
+	for f := range common {
+		filters = append(filters, f)
+	}
+	sort.Strings(filters)
+	if len(filters) == 0 {
+		return ""
+	}
+	return filters[0]
+}
+
+// Name suffix of a partial index: _where_flag, _where_not_flag, _true or
+// _false for the key's own flag, or _above_bound
+func partialSuffix(filter, key string) string {
+	f := strings.Fields(filter)
+	switch {
+	case f[1] == "=" && f[0] == key:
+		return "_" + strings.ToLower(f[2])
+	case f[1] == "=" && f[2] == "FALSE":
+		return "_where_not_" + strings.Trim(f[0], `"`)
+	case f[1] == "=":
+		return "_where_" + strings.Trim(f[0], `"`)
+	}
+	bound := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, strings.ToLower(strings.Join(f[2:], " ")))
+	return "_above_" + strings.Trim(bound, "_")
+}
+
+// An existing index with the advice's leading key serves it when it is not
+// partial or has the same predicate. BRIN serves b-tree range scans, and is
+// kept over the advice as deliberate.
+func coveringIndex(adv IndexAdvice, existing []ExistingIndex) string {
+	key := normalizeIndexSQL(leadingKey(adv.key))
+	for _, ix := range existing {
+		if normalizeIndexSQL(ix.Key) != key {
+			continue
+		}
+		switch {
+		case adv.method == "gin" && ix.Method != "gin":
+			continue
+		case adv.method == "btree" && ix.Method != "btree" && ix.Method != "brin":
+			continue
+		}
+		if ix.Predicate == "" || normalizeIndexSQL(ix.Predicate) == normalizeIndexSQL(adv.predicate) {
+			return ix.Name
+		}
+	}
+	return ""
+}
+
+// Whether the plan reads user_profiles, or one of its partitions, with a sequential scan
+func seqScansProfiles(p *QueryPlan) bool {
+	for _, s := range p.Scans() {
+		if s.ScanType == "Seq Scan" && strings.HasPrefix(s.Relation, "user_profiles") && !strings.HasPrefix(s.Relation, "user_profiles_jsonb") {
+			return true
+		}
+	}
+	return false
+}
+
+// Parent of every partition index attached to one of the given indexes of
+// user_profiles, by partition index name (PostgreSQL only)
+func PartitionIndexParents(ctx context.Context, db Querier, parents []string) (map[string]string, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT c.relname, p.relname
+		FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		JOIN pg_class p ON p.oid = i.inhparent
+		WHERE p.relkind = 'I' AND p.relname = ANY($1)`, pq.Array(parents))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	m := map[string]string{}
+	for rows.Next() {
+		var child, parent string
+		if err := rows.Scan(&child, &parent); err != nil {
+			return nil, err
+		}
+		m[child] = parent
+	}
+	return m, rows.Err()
+}
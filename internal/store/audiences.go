@@ -0,0 +1,163 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+
+	"audience-poc/internal/rules"
+)
+
+var (
+	ErrAudienceNotFound = errors.New("audience not found")
+	ErrAudienceExists   = errors.New("an audience with this name already exists")
+)
+
+// A named, stored audience rule (PostgreSQL only). Names are unique per
+// tenant, and every rule evaluation of the audience is restricted to its tenant.
+type Audience struct {
+	ID        int64     `json:"id"`
+	Tenant    string    `json:"tenant"`
+	Name      string    `json:"name"`
+	Rule      string    `json:"rule"`
+	Owner     string    `json:"owner"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// The editable fields of an audience
+type AudienceSpec struct {
+	Name  string `json:"name"`
+	Rule  string `json:"rule"`
+	Owner string `json:"owner"`
+}
+
+func (s AudienceSpec) Validate() error {
+	switch {
+	case s.Name == "":
+		return errors.New("audience name is required")
+	case s.Owner == "":
+		return errors.New("audience owner is required")
+	}
+	_, err := rules.Parse(s.Rule)
+	return err
+}
+
+const audienceColumns = `audience_id, tenant_id, name, rule, owner, created_at, updated_at`
+
+func scanAudience(row interface{ Scan(...interface{}) error }) (Audience, error) {
+	var a Audience
+	err := row.Scan(&a.ID, &a.Tenant, &a.Name, &a.Rule, &a.Owner, &a.CreatedAt, &a.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return a, ErrAudienceNotFound
+	}
+	return a, err
+}
+
+// Names are unique per tenant, so a clash is reported as ErrAudienceExists
+func audienceWriteError(err error) error {
+	if code, _, ok := pgError(err); ok && code == "23505" {
+		return ErrAudienceExists
+	}
+	return err
+}
+
+// Audiences belong to ctx's tenant, or DefaultTenant when it has none. Below,
+// audiences of other tenants than ctx's are reported as not found.
+func CreateAudience(ctx context.Context, db Querier, spec AudienceSpec) (Audience, error) {
+	if err := spec.Validate(); err != nil {
+		return Audience{}, err
+	}
+	tenant, ok := TenantFrom(ctx)
+	if !ok {
+		tenant = DefaultTenant
+	}
+	a, err := scanAudience(db.QueryRowContext(ctx, `
+		INSERT INTO audiences (tenant_id, name, rule, owner)
+		VALUES ($1, $2, $3, $4)
+		RETURNING `+audienceColumns, tenant, spec.Name, spec.Rule, spec.Owner))
+	return a, audienceWriteError(err)
+}
+
+// Replace every editable field of an audience
+func UpdateAudience(ctx context.Context, db Querier, id int64, spec AudienceSpec) (Audience, error) {
+	if err := spec.Validate(); err != nil {
+		return Audience{}, err
+	}
+	a, err := scanAudience(db.QueryRowContext(ctx, `
+		UPDATE audiences
+		SET name = $2, rule = $3, owner = $4, updated_at = NOW()
+		WHERE audience_id = $1 AND ($5 = '' OR tenant_id = $5)
+		RETURNING `+audienceColumns, id, spec.Name, spec.Rule, spec.Owner, ctxTenant(ctx)))
+	return a, audienceWriteError(err)
+}
+
+func GetAudience(ctx context.Context, db Querier, id int64) (Audience, error) {
+	return scanAudience(db.QueryRowContext(ctx, `
+		SELECT `+audienceColumns+`
+		FROM audiences
+		WHERE audience_id = $1 AND ($2 = '' OR tenant_id = $2)`, id, ctxTenant(ctx)))
+}
+
+// Stored audiences by id in one query; ids that don't exist are missing from the map
+func GetAudiences(ctx context.Context, db Querier, ids []int64) (map[int64]Audience, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+audienceColumns+`
+		FROM audiences
+		WHERE audience_id = ANY($1) AND ($2 = '' OR tenant_id = $2)`, pq.Array(ids), ctxTenant(ctx))
+	if err != nil {
+		return nil, classify(err)
+	}
+	defer rows.Close()
+
+	audiences := make(map[int64]Audience, len(ids))
+	for rows.Next() {
+		a, err := scanAudience(rows)
+		if err != nil {
+			return nil, err
+		}
+		audiences[a.ID] = a
+	}
+	return audiences, classify(rows.Err())
+}
+
+// Every audience in id order, or only those of owner when it is set
+func ListAudiences(ctx context.Context, db Querier, owner string) ([]Audience, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+audienceColumns+`
+		FROM audiences
+		WHERE ($1 = '' OR owner = $1) AND ($2 = '' OR tenant_id = $2)
+		ORDER BY audience_id`, owner, ctxTenant(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	audiences := []Audience{}
+	for rows.Next() {
+		a, err := scanAudience(rows)
+		if err != nil {
+			return nil, err
+		}
+		audiences = append(audiences, a)
+	}
+	return audiences, rows.Err()
+}
+
+func DeleteAudience(ctx context.Context, db Querier, id int64) error {
+	res, err := db.ExecContext(ctx, `DELETE FROM audiences WHERE audience_id = $1 AND ($2 = '' OR tenant_id = $2)`, id, ctxTenant(ctx))
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrAudienceNotFound
+	}
+	return nil
+}
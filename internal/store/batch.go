@@ -0,0 +1,90 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"audience-poc/internal/rules"
+)
+
+// Rules accepted by one batch evaluation
+const MaxBatchAudiences = 1000
+
+// Rules counted per statement, which keeps bind arguments well under the
+// 65535 both databases allow and a single statement a size the planner copes with
+const batchPassRules = 100
+
+// Counts of a batch of rules, in request order
+type BatchCounts struct {
+	Counts   []int64
+	Distinct int // rules left after equivalent spellings were merged
+	Passes   int // statements, each one scan of user_profiles
+	Duration time.Duration
+}
+
+// Count every rule against the optimized model in as few scans as possible.
+// Rules with the same canonical form share one aggregate; the rest are split
+// into passes of batchPassRules, each a single SELECT with one filtered COUNT
+// per rule. There is no WHERE: a batch of this size covers most users, and one
+// sequential scan evaluating every predicate beats a round trip per audience.
+func BatchCount(ctx context.Context, db Querier, audiences []*rules.Rule) (BatchCounts, error) {
+	if len(audiences) == 0 || len(audiences) > MaxBatchAudiences {
+		return BatchCounts{}, fmt.Errorf("a batch needs 1 to %d audiences, got %d", MaxBatchAudiences, len(audiences))
+	}
+	// Index of each request rule's aggregate
+	column := make([]int, len(audiences))
+	var distinct []*rules.Rule
+	seen := map[string]int{}
+	for i, r := range audiences {
+		r = Scope(ctx, r)
+		c := r.Canonical()
+		j, ok := seen[c]
+		if !ok {
+			j = len(distinct)
+			seen[c] = j
+			distinct = append(distinct, r)
+		}
+		column[i] = j
+	}
+
+	b := BatchCounts{Distinct: len(distinct)}
+	counts := make([]int64, len(distinct))
+	start := time.Now()
+	for lo := 0; lo < len(distinct); lo += batchPassRules {
+		hi := min(lo+batchPassRules, len(distinct))
+		q := rules.NewQuery(active).SQL(`SELECT `)
+		dest := make([]interface{}, 0, hi-lo)
+		for i, r := range distinct[lo:hi] {
+			if i > 0 {
+				q.SQL(`, `)
+			}
+			countFilter(q, r)
+			dest = append(dest, &counts[lo+i])
+		}
+		query, args, err := built(q.SQL(` FROM user_profiles`))
+		if err != nil {
+			return b, err
+		}
+		if err := db.QueryRowContext(ctx, query, args...).Scan(dest...); err != nil {
+			return b, classify(err)
+		}
+		b.Passes++
+	}
+	b.Duration = time.Since(start)
+
+	b.Counts = make([]int64, len(audiences))
+	for i, j := range column {
+		b.Counts[i] = counts[j]
+	}
+	return b, nil
+}
+
+// COUNT(*) FILTER on PostgreSQL; MySQL has no FILTER clause, so it counts a CASE that is NULL for the other users
+func countFilter(q *rules.Query, r *rules.Rule) {
+	if _, ok := active.(MySQL); ok {
+		q.SQL(`COUNT(CASE WHEN `).Optimized(r).SQL(` THEN 1 END)`)
+		return
+	}
+	q.SQL(`COUNT(*) FILTER (WHERE `).Optimized(r).SQL(`)`)
+}
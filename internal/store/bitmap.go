@@ -0,0 +1,307 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/lib/pq"
+
+	"audience-poc/internal/rules"
+)
+
+// In-memory copy of user_profiles as roaring bitmaps, so counts need no query.
+// Text, boolean and set attributes get one posting list per value (a set's
+// users are listed under each of its elements); numeric, timestamp and date
+// ones a column sorted by value, so a range is a binary search and one bulk add. An index is immutable once loaded: refreshing builds a new one.
+type BitmapIndex struct {
+	Users        int
+	LoadedAt     time.Time
+	LoadDuration time.Duration
+
+	all    *roaring.Bitmap
+	values map[string]map[interface{}]*roaring.Bitmap // text, boolean and set: value → users
+	ranges map[string]*sortedColumn                   // numeric, timestamp and date
+}
+
+type sortedColumn struct {
+	values []float64 // ascending; timestamps and dates as Unix microseconds
+	users  []uint32  // users[i] has values[i]
+	has    *roaring.Bitmap
+}
+
+// Read every profile into a new index. Bitmaps hold 32-bit ids, so a user_id
+// beyond that range fails the load rather than being truncated.
+func LoadBitmapIndex(ctx context.Context, db Querier) (*BitmapIndex, error) {
+	known := rules.AllAttributes()
+	attrs := make([]string, len(known))
+	columns := make([]string, len(known))
+	types := make(map[string]rules.AttrType, len(known))
+	for i, a := range known {
+		attrs[i], columns[i], types[a.Name] = a.Name, a.ProfileExpr(), a.Type
+	}
+	// Attributes are built in or validated by the registry, so they are safe to inline
+	query := "SELECT user_id, " + strings.Join(columns, ", ") + " FROM user_profiles"
+
+	ctx, span := startQuerySpan(ctx, "bitmap.load", query)
+	defer span.End()
+	start := time.Now()
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, spanError(span, classify(err))
+	}
+	defer rows.Close()
+
+	ix := &BitmapIndex{
+		all:    roaring.New(),
+		values: map[string]map[interface{}]*roaring.Bitmap{},
+		ranges: map[string]*sortedColumn{},
+	}
+	type entry struct {
+		value float64
+		user  uint32
+	}
+	entries := map[string][]entry{}
+	dest := make([]interface{}, len(attrs)+1)
+	var userID int64
+	dest[0] = &userID
+	for i, attr := range attrs {
+		switch types[attr] {
+		case rules.AttrText:
+			dest[i+1] = new(sql.NullString)
+			ix.values[attr] = map[interface{}]*roaring.Bitmap{}
+		case rules.AttrBool:
+			dest[i+1] = new(sql.NullBool)
+			ix.values[attr] = map[interface{}]*roaring.Bitmap{}
+		case rules.AttrNumeric:
+			dest[i+1] = new(sql.NullFloat64)
+		case rules.AttrTimestamp, rules.AttrDate:
+			dest[i+1] = new(sql.NullTime)
+		case rules.AttrSet:
+			dest[i+1] = new(setColumn)
+			ix.values[attr] = map[interface{}]*roaring.Bitmap{}
+		}
+	}
+	addValue := func(attr string, v interface{}, user uint32) {
+		users, ok := ix.values[attr][v]
+		if !ok {
+			users = roaring.New()
+			ix.values[attr][v] = users
+		}
+		users.Add(user)
+	}
+
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return nil, spanError(span, err)
+		}
+		if userID < 0 || userID > math.MaxUint32 {
+			return nil, spanError(span, fmt.Errorf("user_id %d does not fit the 32-bit bitmap index", userID))
+		}
+		user := uint32(userID)
+		ix.all.Add(user)
+		for i, attr := range attrs {
+			switch v := dest[i+1].(type) {
+			case *sql.NullString:
+				if v.Valid {
+					addValue(attr, v.String, user)
+				}
+			case *sql.NullBool:
+				if v.Valid {
+					addValue(attr, v.Bool, user)
+				}
+			case *sql.NullFloat64:
+				if v.Valid {
+					entries[attr] = append(entries[attr], entry{v.Float64, user})
+				}
+			case *sql.NullTime:
+				if v.Valid {
+					entries[attr] = append(entries[attr], entry{float64(v.Time.UnixMicro()), user})
+				}
+			case *setColumn:
+				for _, element := range *v {
+					addValue(attr, element, user)
+				}
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, spanError(span, classify(err))
+	}
+
+	for _, attr := range attrs {
+		switch types[attr] {
+		case rules.AttrNumeric, rules.AttrTimestamp, rules.AttrDate:
+		default:
+			continue
+		}
+		es := entries[attr]
+		sort.Slice(es, func(i, j int) bool { return es[i].value < es[j].value })
+		col := &sortedColumn{values: make([]float64, len(es)), users: make([]uint32, len(es)), has: roaring.New()}
+		for i, e := range es {
+			col.values[i], col.users[i] = e.value, e.user
+		}
+		col.has.AddMany(col.users)
+		ix.ranges[attr] = col
+	}
+	for _, postings := range ix.values {
+		for _, users := range postings {
+			users.RunOptimize()
+		}
+	}
+	ix.all.RunOptimize()
+	ix.Users = int(ix.all.GetCardinality())
+	ix.LoadedAt, ix.LoadDuration = time.Now(), time.Since(start)
+	return ix, nil
+}
+
+// Approximate heap held by the index
+func (ix *BitmapIndex) SizeBytes() uint64 {
+	size := ix.all.GetSizeInBytes()
+	for _, postings := range ix.values {
+		for _, users := range postings {
+			size += users.GetSizeInBytes()
+		}
+	}
+	for _, col := range ix.ranges {
+		size += uint64(len(col.values))*12 + col.has.GetSizeInBytes()
+	}
+	return size
+}
+
+// Count the users matching a rule, and how long the evaluation took
+func (ix *BitmapIndex) Count(audienceRule string) (int, time.Duration, error) {
+	rule, err := rules.Parse(audienceRule)
+	if err != nil {
+		return 0, 0, err
+	}
+	start := time.Now()
+	users, err := rule.Bitmap(ix)
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(users.GetCardinality()), time.Since(start), nil
+}
+
+func (ix *BitmapIndex) All() *roaring.Bitmap { return ix.all.Clone() }
+
+func (ix *BitmapIndex) Compare(attr, op string, value interface{}) (*roaring.Bitmap, error) {
+	if col, ok := ix.ranges[attr]; ok {
+		v, err := rangeValue(attr, value)
+		if err != nil {
+			return nil, err
+		}
+		return col.compare(op, v), nil
+	}
+	postings, ok := ix.values[attr]
+	if !ok {
+		return nil, fmt.Errorf("attribute %q is not in the bitmap index", attr)
+	}
+	users := roaring.New()
+	for key, matched := range postings {
+		if compareKeys(key, op, value) {
+			users.Or(matched)
+		}
+	}
+	return users, nil
+}
+
+func (ix *BitmapIndex) Present(attr string) (*roaring.Bitmap, error) {
+	if col, ok := ix.ranges[attr]; ok {
+		return col.has.Clone(), nil
+	}
+	postings, ok := ix.values[attr]
+	if !ok {
+		return nil, fmt.Errorf("attribute %q is not in the bitmap index", attr)
+	}
+	users := roaring.New()
+	for _, matched := range postings {
+		users.Or(matched)
+	}
+	return users, nil
+}
+
+// Imported lists live in PostgreSQL only; the index is a copy of user_profiles
+func (ix *BitmapIndex) List(name string) (*roaring.Bitmap, error) {
+	return nil, fmt.Errorf("list %q: imported lists are not in the bitmap index", name)
+}
+
+// Text compares by byte order, as under the C collation
+func compareKeys(key interface{}, op string, value interface{}) bool {
+	if op == "=" || op == "!=" {
+		return (key == value) == (op == "=")
+	}
+	k, kok := key.(string)
+	v, vok := value.(string)
+	if !kok || !vok {
+		return false
+	}
+	switch op {
+	case "<":
+		return k < v
+	case "<=":
+		return k <= v
+	case ">":
+		return k > v
+	case ">=":
+		return k >= v
+	}
+	return false
+}
+
+func (c *sortedColumn) compare(op string, v float64) *roaring.Bitmap {
+	// First position holding a value >= v, and > v
+	ge := sort.Search(len(c.values), func(i int) bool { return c.values[i] >= v })
+	gt := sort.Search(len(c.values), func(i int) bool { return c.values[i] > v })
+	users := roaring.New()
+	switch op {
+	case "=":
+		users.AddMany(c.users[ge:gt])
+	case "!=":
+		users = roaring.AndNot(c.has, roaring.BitmapOf(c.users[ge:gt]...))
+	case "<":
+		users.AddMany(c.users[:ge])
+	case "<=":
+		users.AddMany(c.users[:gt])
+	case ">":
+		users.AddMany(c.users[gt:])
+	case ">=":
+		users.AddMany(c.users[ge:])
+	}
+	return users
+}
+
+// A set column: a PostgreSQL text[] or a MySQL JSON array. NULL scans as no elements.
+type setColumn []string
+
+func (s *setColumn) Scan(src interface{}) error {
+	if b, ok := src.([]byte); ok && len(b) > 0 && b[0] == '[' {
+		return json.Unmarshal(b, (*[]string)(s))
+	}
+	return (*pq.StringArray)(s).Scan(src)
+}
+
+// Timestamp layouts a rule literal may use, as PostgreSQL would read them
+var timestampLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999", "2006-01-02 15:04:05.999999", time.DateOnly}
+
+// A rule value on the sorted column's scale
+func rangeValue(attr string, value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case string:
+		for _, layout := range timestampLayouts {
+			if t, err := time.Parse(layout, v); err == nil {
+				return float64(t.UnixMicro()), nil
+			}
+		}
+		return 0, fmt.Errorf("invalid timestamp %q for %q", v, attr)
+	}
+	return 0, fmt.Errorf("invalid value %v for %q", value, attr)
+}
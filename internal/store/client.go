@@ -0,0 +1,294 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/lib/pq"
+
+	"audience-poc/internal/config"
+)
+
+// Client library the database is reached through. Queries go through
+// database/sql whichever it is, so *sql.DB and *sql.Tx (and Querier) work the
+// same; a Store covers what database/sql leaves to the driver.
+type Store interface {
+	// As --db-client spells it
+	Name() string
+	// A pool for cfg, sized by its pool settings
+	Open(cfg config.DB, d Dialect) (*sql.DB, error)
+	// Stream the rows send is called with into table with COPY FROM STDIN, as
+	// part of tx, which must have been started on conn (PostgreSQL only)
+	CopyIn(ctx context.Context, conn *sql.Conn, tx *sql.Tx, table string, cols []string, rows func(send func(values ...interface{}) error) error) error
+}
+
+func StoreFor(cfg config.DB) (Store, error) {
+	switch cfg.Client {
+	case "", "pq":
+		return PQ{}, nil
+	case "pgx":
+		return PGX{}, nil
+	case "mysql":
+		return MySQLClient{}, nil
+	default:
+		return nil, fmt.Errorf("unknown client %q, expected pq, pgx or mysql", cfg.Client)
+	}
+}
+
+// The Store db was opened with
+func StoreOf(db *sql.DB) Store {
+	switch db.Driver().(type) {
+	case *stdlib.Driver:
+		return PGX{}
+	case *mysql.MySQLDriver, mysql.MySQLDriver:
+		return MySQLClient{}
+	}
+	return PQ{}
+}
+
+// SQLSTATE and message of a PostgreSQL server error from either client library
+func pgError(err error) (code, message string, ok bool) {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return string(pqErr.Code), pqErr.Message, true
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code, pgErr.Message, true
+	}
+	return "", "", false
+}
+
+func openSQL(driverName, dsn string, cfg config.DB) (*sql.DB, error) {
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	return db, nil
+}
+
+// PostgreSQL through lib/pq, which is in maintenance mode
+type PQ struct{}
+
+func (PQ) Name() string { return "pq" }
+
+func (PQ) Open(cfg config.DB, d Dialect) (*sql.DB, error) {
+	return openSQL("postgres", d.DSN(cfg), cfg)
+}
+
+// lib/pq allows one COPY at a time per connection
+func (PQ) CopyIn(ctx context.Context, _ *sql.Conn, tx *sql.Tx, table string, cols []string, rows func(send func(values ...interface{}) error) error) error {
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn(table, cols...))
+	if err != nil {
+		return err
+	}
+	err = rows(func(values ...interface{}) error {
+		_, err := stmt.ExecContext(ctx, values...)
+		return err
+	})
+	if err == nil {
+		_, err = stmt.ExecContext(ctx)
+	}
+	if err != nil {
+		stmt.Close()
+		return err
+	}
+	return stmt.Close()
+}
+
+// PostgreSQL through a pgxpool behind database/sql. pgx reads results in the
+// binary format for the types database/sql has a Go type for (integers,
+// booleans, floats, dates and timestamps), where lib/pq parses text.
+type PGX struct{}
+
+func (PGX) Name() string { return "pgx" }
+
+// Closes the pgx pool along with the *sql.DB, which stdlib leaves to its caller
+type poolConnector struct {
+	driver.Connector
+	pool *pgxpool.Pool
+}
+
+func (c poolConnector) Close() error {
+	c.pool.Close()
+	return nil
+}
+
+// database/sql pools the connections it takes from pgxpool, so only the pool
+// size and connection age are configured on pgxpool and idle ones are left to it
+func (PGX) Open(cfg config.DB, d Dialect) (*sql.DB, error) {
+	pc, err := pgxpool.ParseConfig(d.DSN(cfg))
+	if err != nil {
+		return nil, err
+	}
+	pc.MaxConns = math.MaxInt32
+	if cfg.MaxOpenConns > 0 {
+		pc.MaxConns = int32(min(cfg.MaxOpenConns, math.MaxInt32))
+	}
+	if cfg.ConnMaxLifetime > 0 {
+		pc.MaxConnLifetime = cfg.ConnMaxLifetime
+	}
+	// A connection taken from pgxpool or handed from one database/sql caller
+	// to the next carries the new caller's tenant
+	pc.PrepareConn = func(ctx context.Context, conn *pgx.Conn) (bool, error) {
+		err := setTenant(ctx, conn)
+		return err == nil, err
+	}
+	// Connections are made on first use, as with sql.Open
+	pool, err := pgxpool.NewWithConfig(context.Background(), pc)
+	if err != nil {
+		return nil, err
+	}
+	db := sql.OpenDB(poolConnector{Connector: stdlib.GetPoolConnector(pool, stdlib.OptionResetSession(setTenant)), pool: pool})
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(0)
+	return db, nil
+}
+
+// Point the session's audience.tenant setting, which the row-level security
+// policies read, at ctx's tenant; a round trip only when it changes
+func setTenant(ctx context.Context, conn *pgx.Conn) error {
+	tenant, _ := TenantFrom(ctx)
+	data := conn.PgConn().CustomData()
+	if current, ok := data[tenantSetting].(string); ok && current == tenant {
+		return nil
+	}
+	if _, err := conn.Exec(ctx, `SELECT set_config('`+tenantSetting+`', $1, false)`, tenant); err != nil {
+		return err
+	}
+	data[tenantSetting] = tenant
+	return nil
+}
+
+// One COPY in the text format, streamed over the raw connection as send is
+// called, rather than one database/sql round trip per row
+func (PGX) CopyIn(ctx context.Context, conn *sql.Conn, tx *sql.Tx, table string, cols []string, rows func(send func(values ...interface{}) error) error) error {
+	quoted := make([]string, len(cols))
+	for i, c := range cols {
+		quoted[i] = pgx.Identifier{c}.Sanitize()
+	}
+	copySQL := "COPY " + pgx.Identifier{table}.Sanitize() + " (" + strings.Join(quoted, ", ") + ") FROM STDIN"
+
+	return conn.Raw(func(driverConn interface{}) error {
+		c, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return fmt.Errorf("COPY: connection is %T, not pgx", driverConn)
+		}
+		pr, pw := io.Pipe()
+		produced := make(chan error, 1)
+		go func() {
+			w := bufio.NewWriterSize(pw, 64<<10)
+			var line []byte
+			err := rows(func(values ...interface{}) error {
+				var err error
+				if line, err = appendCopyRow(line[:0], values); err != nil {
+					return err
+				}
+				_, err = w.Write(line)
+				return err
+			})
+			if err == nil {
+				err = w.Flush()
+			}
+			pw.CloseWithError(err)
+			produced <- err
+		}()
+		_, err := c.Conn().PgConn().CopyFrom(ctx, pr, copySQL)
+		// Unblocks the producer if the server gave up first
+		pr.CloseWithError(errors.New("COPY ended"))
+		if perr := <-produced; perr != nil && !errors.Is(perr, io.ErrClosedPipe) {
+			return perr
+		}
+		return err
+	})
+}
+
+// One row of COPY text format: tab-separated, \N for NULL, backslash escapes
+func appendCopyRow(line []byte, values []interface{}) ([]byte, error) {
+	for i, v := range values {
+		if i > 0 {
+			line = append(line, '\t')
+		}
+		s, null, err := copyText(v)
+		if err != nil {
+			return nil, err
+		}
+		if null {
+			line = append(line, `\N`...)
+			continue
+		}
+		for j := 0; j < len(s); j++ {
+			switch b := s[j]; b {
+			case '\\':
+				line = append(line, `\\`...)
+			case '\t':
+				line = append(line, `\t`...)
+			case '\n':
+				line = append(line, `\n`...)
+			case '\r':
+				line = append(line, `\r`...)
+			default:
+				line = append(line, b)
+			}
+		}
+	}
+	return append(line, '\n'), nil
+}
+
+func copyText(v interface{}) (s string, null bool, err error) {
+	switch v := v.(type) {
+	case nil:
+		return "", true, nil
+	case string:
+		return v, false, nil
+	case []byte:
+		return string(v), false, nil
+	case bool:
+		return strconv.FormatBool(v), false, nil
+	case int:
+		return strconv.Itoa(v), false, nil
+	case int64:
+		return strconv.FormatInt(v, 10), false, nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), false, nil
+	case time.Time:
+		return v.Format("2006-01-02 15:04:05.999999"), false, nil
+	case driver.Valuer:
+		dv, err := v.Value()
+		if err != nil {
+			return "", false, err
+		}
+		return copyText(dv)
+	}
+	return "", false, fmt.Errorf("COPY: unsupported value %T", v)
+}
+
+// MySQL through go-sql-driver/mysql
+type MySQLClient struct{}
+
+func (MySQLClient) Name() string { return "mysql" }
+
+func (MySQLClient) Open(cfg config.DB, d Dialect) (*sql.DB, error) {
+	return openSQL("mysql", d.DSN(cfg), cfg)
+}
+
+func (MySQLClient) CopyIn(context.Context, *sql.Conn, *sql.Tx, string, []string, func(func(...interface{}) error) error) error {
+	return errors.New("COPY is only supported with the postgres driver")
+}
@@ -0,0 +1,217 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Profile attributes a CSV import can populate, in user_profiles column order
+var csvAttributes = []string{"user_id", "country", "tier", "last_active_at", "has_purchased", "total_spend", "signup_date", "age", "interests"}
+
+// Attributes a CSV may leave out entirely; every user is loaded without them
+var csvOptional = map[string]bool{"signup_date": true, "age": true, "interests": true}
+
+// Separates the elements of a set attribute within its cell
+const csvSetSeparator = ";"
+
+// Maps a profile attribute to the CSV column holding its value
+type CSVMapping map[string]string
+
+// Load the attribute -> column mapping; unmapped attributes keep their own name
+func LoadCSVMapping(path string) (CSVMapping, error) {
+	mapping := CSVMapping{}
+	for _, attr := range csvAttributes {
+		mapping[attr] = attr
+	}
+	if path == "" {
+		return mapping, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read mapping: %w", err)
+	}
+	var overrides map[string]string
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		return nil, fmt.Errorf("parse mapping %s: %w", path, err)
+	}
+	for attr, column := range overrides {
+		if _, ok := mapping[attr]; !ok {
+			return nil, fmt.Errorf("mapping %s: unknown attribute %q (expected one of %s)",
+				path, attr, strings.Join(csvAttributes, ", "))
+		}
+		mapping[attr] = column
+	}
+	return mapping, nil
+}
+
+// Resolve each attribute to its position in the CSV header
+func csvColumnIndexes(header []string, mapping CSVMapping) ([]int, error) {
+	positions := make(map[string]int, len(header))
+	for i, name := range header {
+		positions[strings.TrimSpace(name)] = i
+	}
+
+	indexes := make([]int, len(csvAttributes))
+	var missing []string
+	for i, attr := range csvAttributes {
+		pos, ok := positions[mapping[attr]]
+		if !ok {
+			indexes[i] = -1
+			if !csvOptional[attr] {
+				missing = append(missing, mapping[attr])
+			}
+			continue
+		}
+		indexes[i] = pos
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("CSV header is missing columns: %s", strings.Join(missing, ", "))
+	}
+	return indexes, nil
+}
+
+// Replace the dataset in both models with the rows of a CSV file.
+// Rows are streamed into a staging table with COPY and then fanned out
+// into users/user_attributes (EAV), user_profiles (optimized) and
+// user_profiles_jsonb.
+func SeedFromCSV(ctx context.Context, db *sql.DB, path string, mapping CSVMapping) (int64, error) {
+	if err := EnsureSchema(ctx, db); err != nil {
+		return 0, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.ReuseRecord = true
+	header, err := r.Read()
+	if err != nil {
+		return 0, fmt.Errorf("read CSV header: %w", err)
+	}
+	indexes, err := csvColumnIndexes(header, mapping)
+	if err != nil {
+		return 0, err
+	}
+
+	// COPY runs on the connection itself
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		CREATE TEMP TABLE csv_import (
+			user_id TEXT,
+			country TEXT,
+			tier TEXT,
+			last_active_at TEXT,
+			has_purchased TEXT,
+			total_spend TEXT,
+			signup_date TEXT,
+			age TEXT,
+			interests TEXT
+		) ON COMMIT DROP`); err != nil {
+		return 0, fmt.Errorf("create staging table: %w", err)
+	}
+
+	var rows int64
+	values := make([]interface{}, len(csvAttributes))
+	err = StoreOf(db).CopyIn(ctx, conn, tx, "csv_import", csvAttributes, func(send func(values ...interface{}) error) error {
+		for {
+			record, err := r.Read()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("read CSV row %d: %w", rows+2, err)
+			}
+			for i, idx := range indexes {
+				if idx < 0 {
+					values[i] = nil
+				} else if v := strings.TrimSpace(record[idx]); v != "" {
+					values[i] = v
+				} else {
+					values[i] = nil
+				}
+			}
+			if err := send(values...); err != nil {
+				return fmt.Errorf("COPY row %d: %w", rows+2, err)
+			}
+			rows++
+		}
+	})
+	if err != nil {
+		return 0, fmt.Errorf("stage CSV rows: %w", err)
+	}
+
+	statements := append(slices.Clone(clearDatasetStatements),
+		`INSERT INTO users (user_id) SELECT user_id::bigint FROM csv_import`,
+		`INSERT INTO user_attributes (user_id, key, value)
+		 SELECT c.user_id::bigint, a.key, a.value
+		 FROM csv_import c
+		 CROSS JOIN LATERAL (VALUES
+			('country', c.country),
+			('tier', c.tier),
+			('last_active_at', c.last_active_at),
+			('has_purchased', c.has_purchased),
+			('total_spend', c.total_spend),
+			('signup_date', c.signup_date),
+			('age', c.age)
+		 ) AS a(key, value)
+		 WHERE a.value IS NOT NULL`,
+		// One row per element of the set
+		`INSERT INTO user_attributes (user_id, key, value)
+		 SELECT DISTINCT c.user_id::bigint, 'interests', trim(i.value)
+		 FROM csv_import c
+		 CROSS JOIN LATERAL unnest(string_to_array(c.interests, '`+csvSetSeparator+`')) AS i(value)
+		 WHERE trim(i.value) <> ''`,
+		`INSERT INTO user_profiles (`+strings.Join(seedProfileColumns, ", ")+`)
+		 SELECT c.user_id::bigint, c.country, c.tier, c.last_active_at::timestamp,
+		        c.has_purchased::boolean, c.total_spend::decimal, c.signup_date::date, c.age::smallint,
+		        (SELECT array_agg(DISTINCT trim(i.value) ORDER BY trim(i.value))
+		         FROM unnest(string_to_array(c.interests, '`+csvSetSeparator+`')) AS i(value)
+		         WHERE trim(i.value) <> '')
+		 FROM csv_import c`,
+	)
+	if err := setChangeCapture(ctx, tx, false); err != nil {
+		return 0, err
+	}
+	for _, q := range statements {
+		if _, err := tx.ExecContext(ctx, q); err != nil {
+			return 0, fmt.Errorf("load CSV into models: %w", err)
+		}
+	}
+	if err := setChangeCapture(ctx, tx, true); err != nil {
+		return 0, err
+	}
+	if err := RefreshJSONBProfiles(ctx, tx); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	// Refresh planner statistics so selectivity reflects the real data
+	for _, table := range []string{"users", "user_attributes", "user_profiles", "user_profiles_jsonb"} {
+		if _, err := db.ExecContext(ctx, "ANALYZE "+table); err != nil {
+			return rows, fmt.Errorf("analyze %s: %w", table, err)
+		}
+	}
+	return rows, nil
+}
@@ -0,0 +1,87 @@
+// Package store holds everything that talks to the database: SQL dialects,
+// the client libraries, the two schemas and their count queries, seeding and
+// EXPLAIN parsing.
+package store
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+
+	"audience-poc/internal/config"
+)
+
+// Satisfied by both *sql.DB and *sql.Tx
+type Querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// A statement the server aborted for exceeding its statement timeout. It
+// matches context.DeadlineExceeded, so callers report it like a client-side timeout.
+type StatementTimeoutError struct{ Err error }
+
+func (e *StatementTimeoutError) Error() string { return "server statement timeout: " + e.Err.Error() }
+func (e *StatementTimeoutError) Unwrap() []error {
+	return []error{e.Err, context.DeadlineExceeded}
+}
+
+func classify(err error) error {
+	if err != nil && active.IsStatementTimeout(err) {
+		return &StatementTimeoutError{Err: err}
+	}
+	return err
+}
+
+// Whether a query that failed with err may succeed if run again: the
+// connection dropped or was refused, or the server gave up on the statement
+// for a transient reason such as a serialization failure or deadlock.
+// Timeouts and cancellations are left to the caller.
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return active.IsTransientError(err)
+}
+
+// Lift the session's statement timeout for the rest of tx, for setup steps
+// such as index builds that are expected to outlast a single query (PostgreSQL only)
+func UnboundedStatements(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `SET LOCAL statement_timeout = 0`)
+	return err
+}
+
+// Open a pool for cfg through its client and make its dialect the active one
+func Open(cfg config.DB) (*sql.DB, error) {
+	d, err := DialectFor(cfg.Driver)
+	if err != nil {
+		return nil, err
+	}
+	s, err := StoreFor(cfg)
+	if err != nil {
+		return nil, err
+	}
+	db, err := s.Open(cfg, d)
+	if err != nil {
+		return nil, err
+	}
+
+	active = d
+	return db, nil
+}
@@ -0,0 +1,296 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"audience-poc/internal/config"
+	"audience-poc/internal/rules"
+)
+
+// Database-specific bits of the benchmark: how to connect, how to write
+// placeholders and casts, and how to EXPLAIN ANALYZE a query
+type Dialect interface {
+	rules.Dialect
+	Name() string
+	DSN(cfg config.DB) string
+	ExplainAnalyze(ctx context.Context, db Querier, query string, args ...interface{}) (*QueryPlan, error)
+	// Whether err is the server aborting a statement for exceeding the statement timeout
+	IsStatementTimeout(err error) bool
+	// Whether the server rejected or aborted a statement for reasons a retry can get past
+	IsTransientError(err error) bool
+}
+
+// Dialect used by the query builders; Open switches it to the configured driver
+var active Dialect = Postgres{}
+
+func Active() Dialect { return active }
+
+func DialectFor(driver string) (Dialect, error) {
+	switch driver {
+	case "", "postgres":
+		return Postgres{}, nil
+	case "mysql":
+		return MySQL{}, nil
+	default:
+		return nil, fmt.Errorf("unknown driver %q, expected postgres or mysql", driver)
+	}
+}
+
+// PostgreSQL via lib/pq or pgx
+type Postgres struct{}
+
+func (Postgres) Name() string             { return "PostgreSQL" }
+func (Postgres) Placeholder(n int) string { return "$" + strconv.Itoa(n) }
+
+// DSN in libpq key=value form, which both clients parse
+func (Postgres) DSN(c config.DB) string {
+	dsn := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		dsnValue(c.Host), c.Port, dsnValue(c.User), dsnValue(c.Password), dsnValue(c.DBName), dsnValue(c.SSLMode))
+	// Unknown keys are sent as run-time parameters, so this sets the session's statement_timeout
+	if c.StatementTimeout > 0 {
+		dsn += fmt.Sprintf(" statement_timeout=%d", c.StatementTimeout.Milliseconds())
+	}
+	return dsn
+}
+
+func (Postgres) CastValue(typ rules.AttrType, expr string) string {
+	switch typ {
+	case rules.AttrNumeric:
+		return expr + "::numeric"
+	case rules.AttrBool:
+		return expr + "::boolean"
+	case rules.AttrTimestamp:
+		return expr + "::timestamp"
+	case rules.AttrDate:
+		return expr + "::date"
+	default:
+		return expr
+	}
+}
+
+// text[] && ARRAY[...], which the GIN index on the column serves
+func (Postgres) SetOverlap(column string, placeholders []string) string {
+	return column + " && ARRAY[" + strings.Join(placeholders, ", ") + "]::text[]"
+}
+
+func (Postgres) NotTrue(predicate string) string { return "(" + predicate + ") IS NOT TRUE" }
+
+func (Postgres) EmptySet(column string) string {
+	return "(" + column + " IS NULL OR cardinality(" + column + ") = 0)"
+}
+
+// query_canceled is also what a client-side cancel produces, so check the reason too
+func (Postgres) IsStatementTimeout(err error) bool {
+	code, message, ok := pgError(err)
+	return ok && code == "57014" && strings.Contains(message, "statement timeout")
+}
+
+// serialization_failure, deadlock_detected, too_many_connections, the
+// connection_exception class and the server shutting down or starting up, or
+// a pgx error from before the statement was sent
+func (Postgres) IsTransientError(err error) bool {
+	code, _, ok := pgError(err)
+	if !ok {
+		return pgconn.SafeToRetry(err)
+	}
+	switch code {
+	case "40001", "40P01", "53300", "57P01", "57P02", "57P03":
+		return true
+	}
+	return strings.HasPrefix(code, "08")
+}
+
+func (Postgres) ExplainAnalyze(ctx context.Context, db Querier, query string, args ...interface{}) (*QueryPlan, error) {
+	var raw []byte
+	if err := db.QueryRowContext(ctx, "EXPLAIN (ANALYZE, FORMAT JSON) "+query, args...).Scan(&raw); err != nil {
+		return nil, err
+	}
+	return ParseExplainJSON(raw)
+}
+
+// MySQL 8 via go-sql-driver/mysql
+type MySQL struct{}
+
+func (MySQL) Name() string           { return "MySQL" }
+func (MySQL) Placeholder(int) string { return "?" }
+
+// DSN in go-sql-driver form; sslmode is mapped onto the driver's tls setting
+func (MySQL) DSN(c config.DB) string {
+	cfg := mysql.NewConfig()
+	cfg.User = c.User
+	cfg.Passwd = c.Password
+	cfg.Net = "tcp"
+	cfg.Addr = net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+	cfg.DBName = c.DBName
+	cfg.ParseTime = true
+	// MySQL's closest equivalent of statement_timeout; it only applies to SELECT
+	if c.StatementTimeout > 0 {
+		cfg.Params = map[string]string{"max_execution_time": strconv.FormatInt(c.StatementTimeout.Milliseconds(), 10)}
+	}
+	switch c.SSLMode {
+	case "", "disable":
+		cfg.TLSConfig = "false"
+	case "verify-ca", "verify-full":
+		cfg.TLSConfig = "true"
+	default:
+		cfg.TLSConfig = "skip-verify"
+	}
+	return cfg.FormatDSN()
+}
+
+func (MySQL) CastValue(typ rules.AttrType, expr string) string {
+	switch typ {
+	case rules.AttrNumeric:
+		return "CAST(" + expr + " AS DECIMAL(20,6))"
+	case rules.AttrBool:
+		// Stored as 'true'/'false' text; MySQL has no boolean cast
+		return "(" + expr + " = 'true')"
+	case rules.AttrTimestamp:
+		return "CAST(" + expr + " AS DATETIME)"
+	case rules.AttrDate:
+		return "CAST(" + expr + " AS DATE)"
+	default:
+		return expr
+	}
+}
+
+// Sets are JSON arrays; JSON_OVERLAPS can use the multi-valued index (8.0.17+)
+func (MySQL) SetOverlap(column string, placeholders []string) string {
+	return "JSON_OVERLAPS(" + column + ", JSON_ARRAY(" + strings.Join(placeholders, ", ") + "))"
+}
+
+func (MySQL) NotTrue(predicate string) string { return "(" + predicate + ") IS NOT TRUE" }
+
+func (MySQL) EmptySet(column string) string {
+	return "(" + column + " IS NULL OR JSON_LENGTH(" + column + ") = 0)"
+}
+
+// ER_QUERY_TIMEOUT: max_execution_time exceeded
+func (MySQL) IsStatementTimeout(err error) bool {
+	var myErr *mysql.MySQLError
+	return errors.As(err, &myErr) && myErr.Number == 3024
+}
+
+// ER_LOCK_DEADLOCK, ER_LOCK_WAIT_TIMEOUT and ER_CON_COUNT_ERROR
+func (MySQL) IsTransientError(err error) bool {
+	var myErr *mysql.MySQLError
+	if !errors.As(err, &myErr) {
+		return errors.Is(err, mysql.ErrInvalidConn)
+	}
+	switch myErr.Number {
+	case 1213, 1205, 1040:
+		return true
+	}
+	return false
+}
+
+// MySQL 8.0.18+ prints EXPLAIN ANALYZE as an indented text tree
+func (MySQL) ExplainAnalyze(ctx context.Context, db Querier, query string, args ...interface{}) (*QueryPlan, error) {
+	rows, err := db.QueryContext(ctx, "EXPLAIN ANALYZE "+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sb strings.Builder
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return nil, err
+		}
+		sb.WriteString(line)
+		sb.WriteByte('\n')
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return ParseMySQLExplain(sb.String())
+}
+
+var (
+	mysqlPlanLine = regexp.MustCompile(`^(\s*)-> (.*?)\s*(?:\(cost=[^)]*?rows=([\d.e+]+)\))?\s*\(actual time=([\d.]+)\.\.([\d.]+) rows=([\d.e+]+) loops=(\d+)\)`)
+	mysqlScanOn   = regexp.MustCompile(`^(.*?) on (\S+)(?: using (\S+))?`)
+)
+
+// Map MySQL access types onto the PostgreSQL node names the rest of the tool understands
+func mysqlNodeType(access string) string {
+	lower := strings.ToLower(access)
+	switch {
+	case strings.HasPrefix(lower, "table scan"):
+		return "Seq Scan"
+	case strings.HasPrefix(lower, "covering index"):
+		return "Index Only Scan"
+	case strings.Contains(lower, "index scan"), strings.Contains(lower, "index lookup"),
+		strings.Contains(lower, "index range scan"):
+		return "Index Scan"
+	default:
+		return access
+	}
+}
+
+func ParseMySQLExplain(text string) (*QueryPlan, error) {
+	type frame struct {
+		node  *PlanNode
+		depth int
+	}
+	var root *PlanNode
+	var stack []frame
+	var execution time.Duration
+
+	for _, line := range strings.Split(text, "\n") {
+		m := mysqlPlanLine.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		node := &PlanNode{NodeType: m[2]}
+		if s := mysqlScanOn.FindStringSubmatch(m[2]); s != nil && mysqlNodeType(s[1]) != s[1] {
+			node.NodeType = mysqlNodeType(s[1])
+			node.RelationName = s[2]
+			node.IndexName = s[3]
+		}
+		node.PlanRows, _ = strconv.ParseFloat(m[3], 64)
+		node.ActualRows, _ = strconv.ParseFloat(m[6], 64)
+		node.ActualLoops, _ = strconv.ParseFloat(m[7], 64)
+
+		depth := len(m[1])
+		for len(stack) > 0 && stack[len(stack)-1].depth >= depth {
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) == 0 {
+			if root != nil {
+				return nil, fmt.Errorf("parse EXPLAIN output: multiple plan roots")
+			}
+			root = node
+			if end, err := strconv.ParseFloat(m[5], 64); err == nil {
+				execution = msToDuration(end)
+			}
+		} else {
+			parent := stack[len(stack)-1].node
+			parent.Plans = append(parent.Plans, *node)
+			node = &parent.Plans[len(parent.Plans)-1]
+		}
+		stack = append(stack, frame{node, depth})
+	}
+	if root == nil {
+		return nil, fmt.Errorf("parse EXPLAIN output: no plan lines found")
+	}
+	return newQueryPlan(*root, 0, execution), nil
+}
+
+// Quote a DSN value so passwords with spaces or quotes survive
+func dsnValue(v string) string {
+	if v != "" && !strings.ContainsAny(v, ` '\`) {
+		return v
+	}
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+}
@@ -0,0 +1,144 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"audience-poc/internal/rules"
+)
+
+// Ways to approximate a count (PostgreSQL only)
+const (
+	EstimateSample  = "tablesample" // count matches in a TABLESAMPLE SYSTEM block sample
+	EstimatePlanner = "planner"     // the planner's row estimate from EXPLAIN, no execution
+)
+
+type EstimateOptions struct {
+	Method string
+	// Target half-width of the 95% interval relative to the count, e.g. 0.05 for ±5%
+	MaxError float64
+}
+
+// An approximate count of the optimized model
+type Estimate struct {
+	Count  int64
+	Method string
+	// Half-width of the 95% interval; 0 for planner estimates, which have none
+	Margin        int64
+	SamplePercent float64 // share of blocks read by the last sample
+	Sampled       int64   // rows in the last sample
+	Duration      time.Duration
+}
+
+// Relative 95% margin of the estimate, NaN when it has none
+func (e Estimate) RelativeMargin() float64 {
+	if e.Method != EstimateSample || e.Count == 0 {
+		return math.NaN()
+	}
+	return float64(e.Margin) / float64(e.Count)
+}
+
+// z of a two-sided 95% interval
+const z95 = 1.96
+
+// The sample starts at 1% of the blocks and grows until the margin is within
+// MaxError. Past 10% an exact count through the indexes is usually as fast,
+// so the estimate stops there and reports whatever margin it reached.
+const (
+	initialSamplePercent = 1.0
+	maxSamplePercent     = 10.0
+	maxSampleAttempts    = 4
+)
+
+func EstimateCount(ctx context.Context, db Querier, audienceRule string, opts EstimateOptions) (Estimate, error) {
+	rule, err := rules.Parse(audienceRule)
+	if err != nil {
+		return Estimate{}, err
+	}
+	rule = Scope(ctx, rule)
+	start := time.Now()
+	var est Estimate
+	switch opts.Method {
+	case EstimatePlanner:
+		est, err = plannerEstimate(ctx, db, rule)
+	case EstimateSample:
+		est, err = sampleEstimate(ctx, db, rule, opts.MaxError)
+	default:
+		return Estimate{}, fmt.Errorf("unknown estimate method %q, expected %s or %s", opts.Method, EstimateSample, EstimatePlanner)
+	}
+	est.Method, est.Duration = opts.Method, time.Since(start)
+	return est, classify(err)
+}
+
+// Row estimate of the filtered scan, from statistics alone
+func plannerEstimate(ctx context.Context, db Querier, rule *rules.Rule) (Estimate, error) {
+	query, args := rules.NewQuery(active).SQL(`EXPLAIN (FORMAT JSON) SELECT 1 FROM user_profiles WHERE `).Optimized(rule).Build()
+	var raw []byte
+	if err := db.QueryRowContext(ctx, query, args...).Scan(&raw); err != nil {
+		return Estimate{}, err
+	}
+	plan, err := ParseExplainJSON(raw)
+	if err != nil {
+		return Estimate{}, err
+	}
+	return Estimate{Count: int64(math.Round(plan.Root.PlanRows))}, nil
+}
+
+// Share of matching rows in a block sample, scaled to the table's row count.
+// The margin treats sampled rows as independent; rows clustered by block
+// (e.g. loaded in attribute order) make the real error larger.
+func sampleEstimate(ctx context.Context, db Querier, rule *rules.Rule, maxError float64) (Estimate, error) {
+	var total float64
+	if err := db.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(GREATEST(c.reltuples, 0)), 0)
+		FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		WHERE i.inhparent = 'user_profiles'::regclass`).Scan(&total); err != nil {
+		return Estimate{}, err
+	}
+
+	var est Estimate
+	percent := initialSamplePercent
+	for attempt := 0; attempt < maxSampleAttempts; attempt++ {
+		query, args := rules.NewQuery(active).SQL(`
+			SELECT COUNT(*) FILTER (WHERE `).Optimized(rule).SQL(`), COUNT(*)
+			FROM user_profiles TABLESAMPLE SYSTEM (`).Bind(percent).SQL(`)`).Build()
+		var matched, sampled int64
+		if err := db.QueryRowContext(ctx, query, args...).Scan(&matched, &sampled); err != nil {
+			return Estimate{}, err
+		}
+		est = Estimate{SamplePercent: percent, Sampled: sampled}
+		if sampled == 0 {
+			percent = math.Min(maxSamplePercent, percent*10)
+			continue
+		}
+
+		share := float64(matched) / float64(sampled)
+		population := total
+		if population <= 0 {
+			// Never analyzed: scale the sample by its own size instead
+			population = float64(sampled) * 100 / percent
+		}
+		est.Count = int64(math.Round(share * population))
+		est.Margin = int64(math.Ceil(z95 * math.Sqrt(share*(1-share)/float64(sampled)) * population))
+		if matched == 0 {
+			// Rule of three: with no match in n rows the share is below 3/n at 95%
+			est.Margin = int64(math.Ceil(3 / float64(sampled) * population))
+		}
+		if matched > 0 && float64(est.Margin) <= maxError*float64(est.Count) || percent >= maxSamplePercent {
+			return est, nil
+		}
+
+		// Rows needed for the target margin at this share; none matched yet means
+		// the share is below 1/sampled, so try a sample ten times larger
+		grow := 10.0
+		if matched > 0 {
+			needed := z95 * z95 * (1 - share) / (share * maxError * maxError)
+			grow = math.Max(2, needed/float64(sampled)*1.2)
+		}
+		percent = math.Min(maxSamplePercent, percent*grow)
+	}
+	return est, nil
+}
@@ -0,0 +1,153 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// One node of an EXPLAIN (FORMAT JSON) plan
+type PlanNode struct {
+	NodeType     string     `json:"Node Type"`
+	RelationName string     `json:"Relation Name"`
+	IndexName    string     `json:"Index Name"`
+	PlanRows     float64    `json:"Plan Rows"`
+	ActualRows   float64    `json:"Actual Rows"`
+	ActualLoops  float64    `json:"Actual Loops"`
+	Plans        []PlanNode `json:"Plans"`
+}
+
+// Parsed EXPLAIN ANALYZE result
+type QueryPlan struct {
+	PlanningTime  time.Duration
+	ExecutionTime time.Duration
+	Root          PlanNode
+	ScanTypes     []string // distinct scan node types, in plan order
+}
+
+// Scan node types that read through an index
+var indexScanTypes = map[string]bool{
+	"Index Scan":        true,
+	"Index Only Scan":   true,
+	"Bitmap Index Scan": true,
+}
+
+// Whether any relation in the plan was read with an index
+func (p *QueryPlan) UsesIndexScan() bool {
+	for _, t := range p.ScanTypes {
+		if indexScanTypes[t] {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether any relation in the plan was read with a sequential scan
+func (p *QueryPlan) UsesSeqScan() bool {
+	for _, t := range p.ScanTypes {
+		if t == "Seq Scan" {
+			return true
+		}
+	}
+	return false
+}
+
+// How one scan node read its data. Bitmap scans show up as two entries:
+// the Bitmap Index Scan carries the index, the Bitmap Heap Scan the table.
+type ScanAccess struct {
+	ScanType  string `json:"scan_type"`
+	Relation  string `json:"relation,omitempty"`
+	IndexName string `json:"index,omitempty"`
+}
+
+// Every distinct scan in the plan, in plan order
+func (p *QueryPlan) Scans() []ScanAccess {
+	var scans []ScanAccess
+	seen := map[ScanAccess]bool{}
+	walkPlan(p.Root, func(n PlanNode) {
+		if !strings.HasSuffix(n.NodeType, "Scan") {
+			return
+		}
+		s := ScanAccess{ScanType: n.NodeType, Relation: n.RelationName, IndexName: n.IndexName}
+		if !seen[s] {
+			seen[s] = true
+			scans = append(scans, s)
+		}
+	})
+	return scans
+}
+
+// Names of the indexes the plan read through, deduplicated
+func (p *QueryPlan) IndexNames() []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, s := range p.Scans() {
+		if s.IndexName != "" && !seen[s.IndexName] {
+			seen[s.IndexName] = true
+			names = append(names, s.IndexName)
+		}
+	}
+	return names
+}
+
+// Run EXPLAIN ANALYZE on a parameterized statement in the active dialect and parse the plan
+func Explain(ctx context.Context, db Querier, query string, args ...interface{}) (*QueryPlan, error) {
+	plan, err := active.ExplainAnalyze(ctx, db, query, args...)
+	return plan, classify(err)
+}
+
+// PostgreSQL EXPLAIN (ANALYZE, FORMAT JSON) output
+func ParseExplainJSON(raw []byte) (*QueryPlan, error) {
+	var doc []struct {
+		Plan          PlanNode `json:"Plan"`
+		PlanningTime  float64  `json:"Planning Time"`
+		ExecutionTime float64  `json:"Execution Time"`
+	}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("parse EXPLAIN output: %w", err)
+	}
+	if len(doc) == 0 {
+		return nil, fmt.Errorf("parse EXPLAIN output: empty plan")
+	}
+
+	return newQueryPlan(doc[0].Plan, msToDuration(doc[0].PlanningTime), msToDuration(doc[0].ExecutionTime)), nil
+}
+
+func newQueryPlan(root PlanNode, planning, execution time.Duration) *QueryPlan {
+	plan := &QueryPlan{
+		PlanningTime:  planning,
+		ExecutionTime: execution,
+		Root:          root,
+	}
+	seen := map[string]bool{}
+	walkPlan(plan.Root, func(n PlanNode) {
+		if strings.HasSuffix(n.NodeType, "Scan") && !seen[n.NodeType] {
+			seen[n.NodeType] = true
+			plan.ScanTypes = append(plan.ScanTypes, n.NodeType)
+		}
+	})
+	return plan
+}
+
+func walkPlan(n PlanNode, visit func(PlanNode)) {
+	visit(n)
+	for _, child := range n.Plans {
+		walkPlan(child, visit)
+	}
+}
+
+func msToDuration(ms float64) time.Duration {
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+// Whether any of the scans read through an index
+func UsesIndex(scans []ScanAccess) bool {
+	for _, s := range scans {
+		if indexScanTypes[s.ScanType] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"strconv"
+	"strings"
+	"time"
+
+	"audience-poc/internal/rules"
+)
+
+// A user_profiles row as plain values, one per attribute: nil, string, bool,
+// float64, time.Time or []string
+type Profile struct {
+	UserID int64
+	Values []interface{}
+}
+
+// Scan targets reading attrs' ProfileExpr columns; profileValues turns them into plain values
+func profileScanners(attrs []rules.Attribute) []interface{} {
+	dest := make([]interface{}, len(attrs))
+	for i, a := range attrs {
+		switch a.Type {
+		case rules.AttrBool:
+			dest[i] = new(sql.NullBool)
+		case rules.AttrNumeric:
+			dest[i] = new(sql.NullFloat64)
+		case rules.AttrTimestamp, rules.AttrDate:
+			dest[i] = new(sql.NullTime)
+		case rules.AttrSet:
+			dest[i] = new(setColumn)
+		default:
+			dest[i] = new(sql.NullString)
+		}
+	}
+	return dest
+}
+
+// Copied out, so the scanners can be reused for the next row
+func profileValues(dest []interface{}) []interface{} {
+	values := make([]interface{}, len(dest))
+	for i, d := range dest {
+		switch v := d.(type) {
+		case *setColumn:
+			values[i] = append([]string{}, *v...)
+		case driver.Valuer:
+			// NULL or the plain value
+			values[i], _ = v.Value()
+		}
+	}
+	return values
+}
+
+// Next page of profiles matching a rule after a cursor, in user_id order,
+// with a value for each of attrs
+func ProfilesAfter(ctx context.Context, db Querier, rule *rules.Rule, attrs []rules.Attribute, after int64, limit int) ([]Profile, error) {
+	q := rules.NewQuery(active).SQL(`SELECT user_id`)
+	for _, a := range attrs {
+		q.SQL(`, `).Profile(a)
+	}
+	query, args := q.SQL(`
+		FROM user_profiles
+		WHERE user_id > `).Bind(after).SQL(` AND (`).Optimized(Scope(ctx, rule)).SQL(`)
+		ORDER BY user_id
+		LIMIT `).Bind(limit).Build()
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, classify(err)
+	}
+	defer rows.Close()
+
+	var userID int64
+	dest := append([]interface{}{&userID}, profileScanners(attrs)...)
+	profiles := make([]Profile, 0, limit)
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return nil, classify(err)
+		}
+		profiles = append(profiles, Profile{UserID: userID, Values: profileValues(dest[1:])})
+	}
+	return profiles, classify(rows.Err())
+}
+
+// A value as seed --from-csv reads it back: empty for NULL, sets joined by
+// csvSetSeparator, dates as YYYY-MM-DD and timestamps in RFC 3339
+func CSVValue(a rules.Attribute, v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case time.Time:
+		if a.Type == rules.AttrDate {
+			return v.Format(time.DateOnly)
+		}
+		return v.Format(time.RFC3339Nano)
+	case []string:
+		return strings.Join(v, csvSetSeparator)
+	}
+	return ""
+}
+
+// A value for encoding/json, with dates as YYYY-MM-DD
+func JSONValue(a rules.Attribute, v interface{}) interface{} {
+	if t, ok := v.(time.Time); ok && a.Type == rules.AttrDate {
+		return t.Format(time.DateOnly)
+	}
+	return v
+}
@@ -0,0 +1,339 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"audience-poc/internal/rules"
+)
+
+var (
+	ErrListNotFound = errors.New("list not found")
+	ErrListTaken    = errors.New("a list with this name belongs to another tenant")
+)
+
+// A static list of users imported from a file, e.g. a DMP export (PostgreSQL
+// only), that rules reference as IN AUDIENCE('name'). Names are global, so a
+// rule means the same list whichever tenant evaluates it; members are only
+// ever users of the list's tenant.
+type List struct {
+	ID         int64     `json:"id"`
+	Tenant     string    `json:"tenant"`
+	Name       string    `json:"name"`
+	Source     string    `json:"source"` // base name of the file imported
+	Members    int64     `json:"members"`
+	ImportedAt time.Time `json:"imported_at"`
+}
+
+// Outcome of one import
+type ListImport struct {
+	List List
+	Rows int64 // user ids read from the file, duplicates included
+	// Distinct ids that are no user of the list's tenant, and were dropped
+	Unknown int64
+	// Materializations of rules referencing the list, stale until refreshed
+	Stale    int64
+	Duration time.Duration
+}
+
+// Formats ImportList reads
+const (
+	ListCSV    = "csv"    // a header naming the column, or one bare id per line
+	ListNDJSON = "ndjson" // one object per line, or one bare id
+)
+
+// Replace the members of list name with the user ids in the file at path,
+// streamed into a staging table with COPY and kept if they are users of ctx's
+// tenant (DefaultTenant without one). column names the CSV column or NDJSON
+// field holding the id. The old members stay visible until the new ones commit,
+// and the materializations that counted them go stale in the same transaction.
+func ImportList(ctx context.Context, db *sql.DB, name, path, format, column string) (ListImport, error) {
+	var res ListImport
+	if err := rules.ValidListName(name); err != nil {
+		return res, err
+	}
+	if format != ListCSV && format != ListNDJSON {
+		return res, fmt.Errorf("unknown list format %q, expected csv or ndjson", format)
+	}
+	tenant, ok := TenantFrom(ctx)
+	if !ok {
+		tenant = DefaultTenant
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return res, err
+	}
+	defer f.Close()
+
+	start := time.Now()
+	// COPY runs on the connection itself
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return res, err
+	}
+	defer conn.Close()
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return res, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `CREATE TEMP TABLE list_import (user_id BIGINT) ON COMMIT DROP`); err != nil {
+		return res, fmt.Errorf("create staging table: %w", err)
+	}
+	err = StoreOf(db).CopyIn(ctx, conn, tx, "list_import", []string{"user_id"}, func(send func(values ...interface{}) error) error {
+		read := readCSVIDs
+		if format == ListNDJSON {
+			read = readNDJSONIDs
+		}
+		return read(f, column, func(id int64) error {
+			res.Rows++
+			return send(id)
+		})
+	})
+	if err != nil {
+		return res, fmt.Errorf("stage %s: %w", path, err)
+	}
+
+	res.List = List{Tenant: tenant, Name: name, Source: filepath.Base(path)}
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO audience_lists (name, tenant_id, source, member_count, imported_at)
+		VALUES ($1, $2, $3, 0, NOW())
+		ON CONFLICT (name) DO UPDATE SET source = EXCLUDED.source, imported_at = EXCLUDED.imported_at
+		WHERE audience_lists.tenant_id = EXCLUDED.tenant_id
+		RETURNING list_id, imported_at`, name, tenant, res.List.Source).Scan(&res.List.ID, &res.List.ImportedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return res, ErrListTaken
+	}
+	if err != nil {
+		return res, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM audience_list_members WHERE list_id = $1`, res.List.ID); err != nil {
+		return res, err
+	}
+	inserted, err := tx.ExecContext(ctx, `
+		INSERT INTO audience_list_members (list_id, user_id)
+		SELECT DISTINCT $1::bigint, s.user_id
+		FROM list_import s
+		JOIN user_profiles p ON p.user_id = s.user_id AND p.tenant_id = $2`, res.List.ID, tenant)
+	if err != nil {
+		return res, fmt.Errorf("load members: %w", err)
+	}
+	if res.List.Members, err = inserted.RowsAffected(); err != nil {
+		return res, err
+	}
+	var distinct int64
+	if err := tx.QueryRowContext(ctx, `SELECT COUNT(DISTINCT user_id) FROM list_import`).Scan(&distinct); err != nil {
+		return res, err
+	}
+	res.Unknown = distinct - res.List.Members
+	if _, err := tx.ExecContext(ctx, `UPDATE audience_lists SET member_count = $2 WHERE list_id = $1`, res.List.ID, res.List.Members); err != nil {
+		return res, err
+	}
+	if res.Stale, err = staleListMaterializations(ctx, tx, name); err != nil {
+		return res, err
+	}
+	if err := tx.Commit(); err != nil {
+		return res, err
+	}
+	res.Duration = time.Since(start)
+	return res, nil
+}
+
+// The column named column, or the only one when the first line is a bare id
+// rather than a header
+func readCSVIDs(r io.Reader, column string, emit func(int64) error) error {
+	cr := csv.NewReader(r)
+	cr.ReuseRecord = true
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read CSV header: %w", err)
+	}
+	idx := -1
+	if len(header) == 1 {
+		if id, err := parseUserID(header[0]); err == nil {
+			idx = 0
+			if err := emit(id); err != nil {
+				return err
+			}
+		}
+	}
+	for i, h := range header {
+		if idx < 0 && strings.EqualFold(strings.TrimSpace(h), column) {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		return fmt.Errorf("CSV header has no %q column", column)
+	}
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read CSV: %w", err)
+		}
+		line, _ := cr.FieldPos(0)
+		if idx >= len(record) || strings.TrimSpace(record[idx]) == "" {
+			continue
+		}
+		id, err := parseUserID(record[idx])
+		if err != nil {
+			return fmt.Errorf("CSV line %d: %w", line, err)
+		}
+		if err := emit(id); err != nil {
+			return err
+		}
+	}
+}
+
+// Objects with the id in field column, or bare ids; numbers and numeric strings both work
+func readNDJSONIDs(r io.Reader, column string, emit func(int64) error) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	for line := 1; sc.Scan(); line++ {
+		raw := bytes.TrimSpace(sc.Bytes())
+		if len(raw) == 0 {
+			continue
+		}
+		if raw[0] == '{' {
+			var obj map[string]json.RawMessage
+			if err := json.Unmarshal(raw, &obj); err != nil {
+				return fmt.Errorf("NDJSON line %d: %w", line, err)
+			}
+			field, ok := obj[column]
+			if !ok {
+				return fmt.Errorf("NDJSON line %d has no %q field", line, column)
+			}
+			raw = field
+		}
+		id, err := parseUserID(strings.Trim(string(raw), `"`))
+		if err != nil {
+			return fmt.Errorf("NDJSON line %d: %w", line, err)
+		}
+		if err := emit(id); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+func parseUserID(s string) (int64, error) {
+	id, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid user id %q", s)
+	}
+	return id, nil
+}
+
+// Lists of ctx's tenant, or of every tenant, by name
+func ListLists(ctx context.Context, db Querier) ([]List, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT list_id, tenant_id, name, source, member_count, imported_at
+		FROM audience_lists
+		WHERE $1 = '' OR tenant_id = $1
+		ORDER BY name`, ctxTenant(ctx))
+	if err != nil {
+		return nil, classify(err)
+	}
+	defer rows.Close()
+
+	lists := []List{}
+	for rows.Next() {
+		var l List
+		if err := rows.Scan(&l.ID, &l.Tenant, &l.Name, &l.Source, &l.Members, &l.ImportedAt); err != nil {
+			return nil, err
+		}
+		lists = append(lists, l)
+	}
+	return lists, classify(rows.Err())
+}
+
+// Drop a list and its members, and return how many materializations went
+// stale. Rules referencing it match no one until it is imported again.
+func DeleteList(ctx context.Context, db *sql.DB, name string) (int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var deleted int64
+	err = tx.QueryRowContext(ctx, `
+		WITH l AS (
+			DELETE FROM audience_lists
+			WHERE name = $1 AND ($2 = '' OR tenant_id = $2)
+			RETURNING list_id
+		), m AS (
+			DELETE FROM audience_list_members WHERE list_id IN (SELECT list_id FROM l)
+		)
+		SELECT COUNT(*) FROM l`, name, ctxTenant(ctx)).Scan(&deleted)
+	if err != nil {
+		return 0, classify(err)
+	}
+	if deleted == 0 {
+		return 0, ErrListNotFound
+	}
+	stale, err := staleListMaterializations(ctx, tx, name)
+	if err != nil {
+		return 0, err
+	}
+	return stale, tx.Commit()
+}
+
+// Clear the rule of every materialization whose rule references list, so
+// Fresh fails and serve counts live until the next refresh rebuilds it. Lists
+// are global, so this spans tenants. Rules are only found by parsing them.
+func staleListMaterializations(ctx context.Context, db Querier, list string) (int64, error) {
+	rows, err := db.QueryContext(ctx, `SELECT audience_id, rule FROM audience_materializations WHERE rule <> ''`)
+	if err != nil {
+		return 0, classify(err)
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		var text string
+		if err := rows.Scan(&id, &text); err != nil {
+			return 0, err
+		}
+		// Materialized rules parsed when they were refreshed; one that no
+		// longer does can't be served fresh either
+		rule, err := rules.Parse(text)
+		if err == nil && slices.Contains(rule.Lists(), list) {
+			ids = append(ids, id)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, classify(err)
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	res, err := db.ExecContext(ctx, `UPDATE audience_materializations SET rule = '' WHERE audience_id = ANY($1)`, pq.Array(ids))
+	if err != nil {
+		return 0, classify(err)
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,223 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"audience-poc/internal/rules"
+)
+
+var ErrNotMaterialized = errors.New("audience is not materialized")
+
+// Precomputed membership of a stored audience (PostgreSQL only). A materialized
+// view can't take bind parameters, so members live in audience_members, filled
+// by the same parameterized query as a live count.
+type Materialization struct {
+	AudienceID int64
+	Rule       string // as materialized; an edited audience no longer matches, nor does "" once a list it uses changed
+	Members    int64
+	// Rows the last refresh inserted or deleted, and how long it took
+	Written     int64
+	Duration    time.Duration
+	RefreshedAt time.Time
+	Age         time.Duration // by the database clock, when loaded
+}
+
+// Whether the materialization can stand in for a live evaluation of rule
+func (m Materialization) Fresh(rule string, maxAge time.Duration) bool {
+	return m.Rule == rule && m.Age <= maxAge
+}
+
+// Recompute the members of a stored audience, in one transaction so readers
+// keep seeing the previous members until it commits. A plain refresh rewrites
+// every member; a concurrent one diffs against the live result and writes only
+// users who joined or left, as REFRESH MATERIALIZED VIEW CONCURRENTLY does.
+// Refreshes of one audience queue behind each other, and the audience can't be
+// edited while one runs.
+func RefreshMaterialization(ctx context.Context, db *sql.DB, id int64, concurrently bool) (Materialization, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return Materialization{}, err
+	}
+	defer tx.Rollback()
+	if err := UnboundedStatements(ctx, tx); err != nil {
+		return Materialization{}, err
+	}
+
+	// NO KEY lets snapshots keep referencing the audience meanwhile
+	m := Materialization{AudienceID: id}
+	var tenant string
+	err = tx.QueryRowContext(ctx, `
+		SELECT rule, tenant_id FROM audiences
+		WHERE audience_id = $1 AND ($2 = '' OR tenant_id = $2)
+		FOR NO KEY UPDATE`, id, ctxTenant(ctx)).Scan(&m.Rule, &tenant)
+	if errors.Is(err, sql.ErrNoRows) {
+		return m, ErrAudienceNotFound
+	}
+	if err != nil {
+		return m, classify(err)
+	}
+	rule, err := rules.Parse(m.Rule)
+	if err != nil {
+		return m, err
+	}
+	rule = rule.ForTenant(tenant)
+
+	start := time.Now()
+	if concurrently {
+		m.Members, m.Written, err = diffMembers(ctx, tx, id, rule)
+	} else {
+		m.Members, m.Written, err = rewriteMembers(ctx, tx, id, rule)
+	}
+	if err != nil {
+		return m, classify(err)
+	}
+	m.Duration = time.Since(start)
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO audience_materializations (audience_id, rule, member_count, rows_written, duration_ms, refreshed_at)
+		VALUES ($1, $2, $3, $4, $5, NOW())
+		ON CONFLICT (audience_id) DO UPDATE
+		SET rule = EXCLUDED.rule, member_count = EXCLUDED.member_count, rows_written = EXCLUDED.rows_written,
+		    duration_ms = EXCLUDED.duration_ms, refreshed_at = EXCLUDED.refreshed_at
+		RETURNING refreshed_at`,
+		id, m.Rule, m.Members, m.Written, float64(m.Duration.Microseconds())/1000).Scan(&m.RefreshedAt)
+	if err != nil {
+		return m, classify(err)
+	}
+	return m, tx.Commit()
+}
+
+func rewriteMembers(ctx context.Context, tx *sql.Tx, id int64, rule *rules.Rule) (members, written int64, err error) {
+	res, err := tx.ExecContext(ctx, `DELETE FROM audience_members WHERE audience_id = $1`, id)
+	if err != nil {
+		return 0, 0, err
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return 0, 0, err
+	}
+	query, args := rules.NewQuery(active).SQL(`
+		INSERT INTO audience_members (audience_id, user_id)
+		SELECT `).Bind(id).SQL(`::bigint, user_id
+		FROM user_profiles
+		WHERE `).Optimized(rule).Build()
+	if res, err = tx.ExecContext(ctx, query, args...); err != nil {
+		return 0, 0, err
+	}
+	members, err = res.RowsAffected()
+	return members, deleted + members, err
+}
+
+// One statement, so the deletes and inserts both see the members as they were
+func diffMembers(ctx context.Context, tx *sql.Tx, id int64, rule *rules.Rule) (members, written int64, err error) {
+	query, args := rules.NewQuery(active).SQL(`
+		WITH matching AS (
+			SELECT user_id FROM user_profiles WHERE `).Optimized(rule).SQL(`
+		),
+		gone AS (
+			DELETE FROM audience_members m
+			WHERE m.audience_id = `).Bind(id).SQL(`
+			  AND NOT EXISTS (SELECT 1 FROM matching WHERE matching.user_id = m.user_id)
+			RETURNING 1
+		),
+		added AS (
+			INSERT INTO audience_members (audience_id, user_id)
+			SELECT `).Bind(id).SQL(`::bigint, user_id FROM matching
+			ON CONFLICT DO NOTHING
+			RETURNING 1
+		)
+		SELECT (SELECT COUNT(*) FROM matching), (SELECT COUNT(*) FROM gone) + (SELECT COUNT(*) FROM added)`).Build()
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&members, &written)
+	return members, written, err
+}
+
+// The audience's materialization, or ErrNotMaterialized when it has none or
+// the database predates materializations
+func LoadMaterialization(ctx context.Context, db Querier, id int64) (Materialization, error) {
+	m := Materialization{AudienceID: id}
+	var durationMS, ageSeconds float64
+	err := db.QueryRowContext(ctx, `
+		SELECT rule, member_count, rows_written, duration_ms, refreshed_at, EXTRACT(EPOCH FROM NOW() - refreshed_at)
+		FROM audience_materializations
+		WHERE audience_id = $1`, id).Scan(&m.Rule, &m.Members, &m.Written, &durationMS, &m.RefreshedAt, &ageSeconds)
+	if code, _, ok := pgError(err); errors.Is(err, sql.ErrNoRows) || ok && code == "42P01" {
+		return m, ErrNotMaterialized
+	}
+	if err != nil {
+		return m, classify(err)
+	}
+	m.Duration = time.Duration(durationMS * float64(time.Millisecond))
+	m.Age = time.Duration(ageSeconds * float64(time.Second))
+	return m, nil
+}
+
+// Every materialization of ctx's tenant's audiences in audience id order
+func ListMaterializations(ctx context.Context, db Querier) ([]Materialization, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT audience_id, rule, member_count, rows_written, duration_ms, refreshed_at, EXTRACT(EPOCH FROM NOW() - refreshed_at)
+		FROM audience_materializations
+		WHERE $1 = '' OR audience_id IN (SELECT audience_id FROM audiences WHERE tenant_id = $1)
+		ORDER BY audience_id`, ctxTenant(ctx))
+	if err != nil {
+		return nil, classify(err)
+	}
+	defer rows.Close()
+
+	var ms []Materialization
+	for rows.Next() {
+		var m Materialization
+		var durationMS, ageSeconds float64
+		if err := rows.Scan(&m.AudienceID, &m.Rule, &m.Members, &m.Written, &durationMS, &m.RefreshedAt, &ageSeconds); err != nil {
+			return nil, err
+		}
+		m.Duration = time.Duration(durationMS * float64(time.Millisecond))
+		m.Age = time.Duration(ageSeconds * float64(time.Second))
+		ms = append(ms, m)
+	}
+	return ms, classify(rows.Err())
+}
+
+// Drop an audience's materialization; its members go with it
+func DropMaterialization(ctx context.Context, db Querier, id int64) error {
+	res, err := db.ExecContext(ctx, `
+		DELETE FROM audience_materializations
+		WHERE audience_id = $1 AND ($2 = '' OR audience_id IN (SELECT audience_id FROM audiences WHERE tenant_id = $2))`, id, ctxTenant(ctx))
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotMaterialized
+	}
+	return nil
+}
+
+// Next page of materialized members after a cursor, in user_id order
+func MaterializedMembersAfter(ctx context.Context, db Querier, id, after int64, limit int) ([]int64, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT user_id
+		FROM audience_members
+		WHERE audience_id = $1 AND user_id > $2
+		ORDER BY user_id
+		LIMIT $3`, id, after, limit)
+	if err != nil {
+		return nil, classify(err)
+	}
+	defer rows.Close()
+
+	ids := make([]int64, 0, limit)
+	for rows.Next() {
+		var userID int64
+		if err := rows.Scan(&userID); err != nil {
+			return nil, classify(err)
+		}
+		ids = append(ids, userID)
+	}
+	return ids, classify(rows.Err())
+}
@@ -0,0 +1,263 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"audience-poc/internal/rules"
+)
+
+// user_profiles columns the pivot of attrs fills, in the order it selects them
+func profileColumns(attrs []rules.Attribute) []string {
+	cols := []string{"user_id", "tenant_id"}
+	overflow := false
+	for _, a := range attrs {
+		if a.Overflow {
+			overflow = true
+			continue
+		}
+		cols = append(cols, a.Column())
+	}
+	if overflow {
+		cols = append(cols, rules.OverflowColumn)
+	}
+	return cols
+}
+
+// user_attributes pivoted into the shape of user_profiles
+func ProfilesProjection(attrs []rules.Attribute) string {
+	return profilesPivot(attrs) + `
+	GROUP BY u.user_id`
+}
+
+// One column per attribute, overflow attributes folded into one document
+func profilesPivot(attrs []rules.Attribute) string {
+	var b strings.Builder
+	b.WriteString("\n\tSELECT u.user_id, u.tenant_id")
+	var overflow []string
+	for _, a := range attrs {
+		if a.Overflow {
+			overflow = append(overflow, "'"+a.Name+"'", pivotValue(a))
+			continue
+		}
+		fmt.Fprintf(&b, ",\n\t       %s AS %s", pivotValue(a), a.Column())
+	}
+	if len(overflow) > 0 {
+		fmt.Fprintf(&b, ",\n\t       NULLIF(jsonb_strip_nulls(%s), '{}') AS %s", jsonbObject(overflow), rules.OverflowColumn)
+	}
+	b.WriteString("\n\tFROM users u\n\tLEFT JOIN user_attributes ua ON ua.user_id = u.user_id")
+	return b.String()
+}
+
+// An attribute's typed value out of a user's user_attributes rows.
+// a.Name is validated, so it is safe to inline.
+func pivotValue(a rules.Attribute) string {
+	when := "CASE WHEN ua.key = '" + a.Name + "' THEN "
+	switch a.Type {
+	case rules.AttrText:
+		return "MAX(" + when + "ua.value END)"
+	case rules.AttrBool:
+		return "bool_or(" + when + "ua.value::boolean END)"
+	case rules.AttrSet:
+		return "array_agg(ua.value ORDER BY ua.value) FILTER (WHERE ua.key = '" + a.Name + "')"
+	default:
+		return "MAX(" + when + Postgres{}.CastValue(a.Type, "ua.value") + " END)"
+	}
+}
+
+// jsonb_build_object takes at most 100 arguments, so longer key/value lists are concatenated
+func jsonbObject(pairs []string) string {
+	var parts []string
+	for len(pairs) > 0 {
+		n := min(len(pairs), 100)
+		parts = append(parts, "jsonb_build_object("+strings.Join(pairs[:n], ", ")+")")
+		pairs = pairs[n:]
+	}
+	if len(parts) == 0 {
+		return "'{}'::jsonb"
+	}
+	return strings.Join(parts, " || ")
+}
+
+// user_profiles as one document per user; absent attributes are left out of the document
+func JSONBProjection(attrs []rules.Attribute) string {
+	var pairs []string
+	overflow := false
+	for _, a := range attrs {
+		if a.Overflow {
+			overflow = true
+			continue
+		}
+		pairs = append(pairs, "'"+a.Name+"'", a.Column())
+	}
+	doc := "jsonb_strip_nulls(" + jsonbObject(pairs) + ")"
+	if overflow {
+		doc += " || COALESCE(" + rules.OverflowColumn + ", '{}')"
+	}
+	return `
+	SELECT user_id, ` + doc + ` AS attributes
+	FROM user_profiles`
+}
+
+// Rebuild the JSONB model from user_profiles
+func RefreshJSONBProfiles(ctx context.Context, db Querier) error {
+	attrs, err := profileAttributes(ctx, db)
+	if err != nil {
+		return err
+	}
+	if _, err := db.ExecContext(ctx, `TRUNCATE user_profiles_jsonb`); err != nil {
+		return fmt.Errorf("clear user_profiles_jsonb: %w", err)
+	}
+	if _, err := db.ExecContext(ctx, `INSERT INTO user_profiles_jsonb (user_id, attributes) `+JSONBProjection(attrs)); err != nil {
+		return fmt.Errorf("fill user_profiles_jsonb: %w", err)
+	}
+	return nil
+}
+
+const (
+	DefaultMigrateBatch = 10000
+	// Checkpoint row of the EAV → user_profiles migration
+	migrationName = "user_profiles"
+)
+
+type MigrateOptions struct {
+	BatchSize int  // users pivoted per transaction
+	Restart   bool // discard an unfinished run's checkpoint and start over
+}
+
+type MigrateResult struct {
+	Users       int64 // pivoted by this run
+	Total       int64 // pivoted since the migration started, including resumed runs
+	Resumed     bool
+	ResumedFrom int64 // last user_id done before this run
+}
+
+// Rebuild user_profiles and user_profiles_jsonb from the EAV tables in batches
+// of consecutive user_ids. Each batch commits together with its checkpoint, so
+// an interrupted run loses at most the batch in flight and the next run
+// resumes after the last committed user_id. A finished migration starts over.
+func Migrate(ctx context.Context, db *sql.DB, opts MigrateOptions) (MigrateResult, error) {
+	var res MigrateResult
+	if opts.BatchSize < 1 {
+		opts.BatchSize = DefaultMigrateBatch
+	}
+	if err := EnsureSchema(ctx, db); err != nil {
+		return res, err
+	}
+	attrs, err := profileAttributes(ctx, db)
+	if err != nil {
+		return res, err
+	}
+
+	var completed sql.NullTime
+	err = db.QueryRowContext(ctx,
+		`SELECT last_user_id, users_done, completed_at FROM migration_checkpoints WHERE name = $1`,
+		migrationName).Scan(&res.ResumedFrom, &res.Total, &completed)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return res, fmt.Errorf("read checkpoint: %w", err)
+	default:
+		res.Resumed = !completed.Valid && !opts.Restart
+	}
+	if !res.Resumed {
+		res.ResumedFrom, res.Total = 0, 0
+		if err := startMigration(ctx, db); err != nil {
+			return res, err
+		}
+	}
+
+	cursor := res.ResumedFrom
+	for {
+		last, users, err := migrateBatch(ctx, db, attrs, cursor, opts.BatchSize)
+		if err != nil {
+			return res, fmt.Errorf("migrate users after %d: %w", cursor, err)
+		}
+		if users == 0 {
+			break
+		}
+		before := res.Total
+		cursor = last
+		res.Users += users
+		res.Total += users
+		if res.Total/seedProgressEvery > before/seedProgressEvery {
+			slog.Info("migrating", "users", res.Total, "last_user_id", cursor)
+		}
+	}
+
+	if _, err := db.ExecContext(ctx,
+		`UPDATE migration_checkpoints SET completed_at = NOW() WHERE name = $1`, migrationName); err != nil {
+		return res, fmt.Errorf("complete checkpoint: %w", err)
+	}
+	for _, table := range []string{"user_profiles", "user_profiles_jsonb"} {
+		if _, err := db.ExecContext(ctx, "ANALYZE "+table); err != nil {
+			return res, fmt.Errorf("analyze %s: %w", table, err)
+		}
+	}
+	return res, nil
+}
+
+// Empty both target models and reset the checkpoint, atomically
+func startMigration(ctx context.Context, db *sql.DB) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `TRUNCATE user_profiles, user_profiles_jsonb`); err != nil {
+		return fmt.Errorf("clear user_profiles: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO migration_checkpoints (name, last_user_id, users_done, started_at, updated_at)
+		VALUES ($1, 0, 0, NOW(), NOW())
+		ON CONFLICT (name) DO UPDATE SET last_user_id = 0, users_done = 0,
+			started_at = NOW(), updated_at = NOW(), completed_at = NULL`, migrationName); err != nil {
+		return fmt.Errorf("reset checkpoint: %w", err)
+	}
+	return tx.Commit()
+}
+
+// Pivot the next batch of users after cursor and advance the checkpoint in
+// the same transaction; returns the batch's last user_id and its size
+func migrateBatch(ctx context.Context, db *sql.DB, attrs []rules.Attribute, cursor int64, size int) (int64, int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	var last sql.NullInt64
+	var users int64
+	if err := tx.QueryRowContext(ctx, `
+		SELECT MAX(user_id), COUNT(*)
+		FROM (SELECT user_id FROM users WHERE user_id > $1 ORDER BY user_id LIMIT $2) batch`,
+		cursor, size).Scan(&last, &users); err != nil {
+		return 0, 0, fmt.Errorf("find batch: %w", err)
+	}
+	if users == 0 {
+		return cursor, 0, nil
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO user_profiles (`+strings.Join(profileColumns(attrs), ", ")+`)
+		`+profilesPivot(attrs)+`
+		WHERE u.user_id > $1 AND u.user_id <= $2
+		GROUP BY u.user_id`, cursor, last.Int64); err != nil {
+		return 0, 0, fmt.Errorf("pivot user_attributes: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO user_profiles_jsonb (user_id, attributes) `+JSONBProjection(attrs)+`
+		WHERE user_id > $1 AND user_id <= $2`, cursor, last.Int64); err != nil {
+		return 0, 0, fmt.Errorf("fill user_profiles_jsonb: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE migration_checkpoints
+		SET last_user_id = $2, users_done = users_done + $3, updated_at = NOW()
+		WHERE name = $1`, migrationName, last.Int64, users); err != nil {
+		return 0, 0, fmt.Errorf("save checkpoint: %w", err)
+	}
+	return last.Int64, users, tx.Commit()
+}
@@ -0,0 +1,126 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"audience-poc/internal/rules"
+)
+
+// Audiences compared at once; the pairs grow quadratically with the count
+const MaxOverlapAudiences = 6
+
+// Sizes of a set of audiences and how they overlap, from the optimized model
+type Overlap struct {
+	Sizes        []int64 // per audience
+	Exclusive    []int64 // users in that audience and none of the others
+	Union        int64   // users in at least one
+	Intersection int64   // users in all of them
+	Pairs        []OverlapPair
+}
+
+type OverlapPair struct {
+	A, B         int // audience indexes
+	Intersection int64
+}
+
+// Users in A but not in B
+func (o Overlap) Difference(p OverlapPair) int64 { return o.Sizes[p.A] - p.Intersection }
+
+// Users in B but not in A
+func (o Overlap) ReverseDifference(p OverlapPair) int64 { return o.Sizes[p.B] - p.Intersection }
+
+// Intersection over union of a pair, 0 when both are empty
+func (o Overlap) Jaccard(p OverlapPair) float64 {
+	union := o.Sizes[p.A] + o.Sizes[p.B] - p.Intersection
+	if union == 0 {
+		return 0
+	}
+	return float64(p.Intersection) / float64(union)
+}
+
+// Compute every size in one pass over the users matching at least one rule.
+// Each rule is rendered once per aggregate it appears in, so the statement
+// only uses positional placeholders and runs on both dialects.
+func ComputeOverlap(ctx context.Context, db Querier, audiences []*rules.Rule) (Overlap, time.Duration, error) {
+	n := len(audiences)
+	if n < 2 || n > MaxOverlapAudiences {
+		return Overlap{}, 0, fmt.Errorf("overlap needs 2 to %d audiences, got %d", MaxOverlapAudiences, n)
+	}
+	scoped := make([]*rules.Rule, n)
+	for i, r := range audiences {
+		scoped[i] = Scope(ctx, r)
+	}
+	q := rules.NewQuery(active).SQL(`
+		SELECT `)
+	match := func(i int) { q.SQL(`(`).Optimized(scoped[i]).SQL(`)`) }
+	// Users matching every rule in in and none in out
+	count := func(in, out []int) {
+		q.SQL(`COUNT(CASE WHEN `)
+		for k, i := range in {
+			if k > 0 {
+				q.SQL(` AND `)
+			}
+			match(i)
+		}
+		for _, j := range out {
+			// NOT would turn NULL into NULL and drop the row, IS NOT TRUE keeps it
+			q.SQL(` AND `)
+			match(j)
+			q.SQL(` IS NOT TRUE`)
+		}
+		q.SQL(` THEN 1 END),
+		       `)
+	}
+
+	// Column order: sizes, exclusives, intersection of all, pairs, then the union in WHERE
+	all := make([]int, n)
+	for i := range all {
+		all[i] = i
+		count([]int{i}, nil)
+	}
+	for i := 0; i < n; i++ {
+		others := append(append([]int{}, all[:i]...), all[i+1:]...)
+		count([]int{i}, others)
+	}
+	count(all, nil)
+	var pairs []OverlapPair
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			count([]int{i, j}, nil)
+			pairs = append(pairs, OverlapPair{A: i, B: j})
+		}
+	}
+	q.SQL(`COUNT(*)
+		FROM user_profiles
+		WHERE `)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			q.SQL(` OR `)
+		}
+		match(i)
+	}
+	query, args, err := built(q)
+	if err != nil {
+		return Overlap{}, 0, err
+	}
+
+	o := Overlap{Sizes: make([]int64, n), Exclusive: make([]int64, n), Pairs: pairs}
+	dest := make([]interface{}, 0, 2*n+1+len(pairs)+1)
+	for i := range o.Sizes {
+		dest = append(dest, &o.Sizes[i])
+	}
+	for i := range o.Exclusive {
+		dest = append(dest, &o.Exclusive[i])
+	}
+	dest = append(dest, &o.Intersection)
+	for i := range o.Pairs {
+		dest = append(dest, &o.Pairs[i].Intersection)
+	}
+	dest = append(dest, &o.Union)
+
+	start := time.Now()
+	err = db.QueryRowContext(ctx, query, args...).Scan(dest...)
+	return o, time.Since(start), classify(err)
+}
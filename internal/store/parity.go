@@ -0,0 +1,202 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"audience-poc/internal/rules"
+)
+
+// Users a rule matches in only one of the EAV and optimized models
+type ModelDiff struct {
+	OnlyEAV       int64
+	OnlyOptimized int64
+	// Lowest user_ids of each side, as many as were asked for
+	EAVExamples       []int64
+	OptimizedExamples []int64
+}
+
+// EAV matches without a matching user_profiles row, a missing row included;
+// limit 0 counts them
+func onlyEAVQuery(rule *rules.Rule, limit int) (string, []interface{}) {
+	q := rules.NewQuery(active)
+	if limit == 0 {
+		q.SQL(`SELECT COUNT(*)`)
+	} else {
+		q.SQL(`SELECT u.user_id`)
+	}
+	q.SQL(`
+		FROM users u
+		WHERE (`).EAV(rule).SQL(`)
+			AND NOT EXISTS (
+				SELECT 1 FROM user_profiles p
+				WHERE p.user_id = u.user_id AND (`).Optimized(rule).SQL(`))`)
+	if limit > 0 {
+		q.SQL(`
+		ORDER BY u.user_id
+		LIMIT `).Bind(limit)
+	}
+	return q.Build()
+}
+
+// user_profiles matches the EAV tables don't match, the other way round
+func onlyOptimizedQuery(rule *rules.Rule, limit int) (string, []interface{}) {
+	q := rules.NewQuery(active)
+	if limit == 0 {
+		q.SQL(`SELECT COUNT(*)`)
+	} else {
+		q.SQL(`SELECT p.user_id`)
+	}
+	q.SQL(`
+		FROM user_profiles p
+		WHERE (`).Optimized(rule).SQL(`)
+			AND NOT EXISTS (
+				SELECT 1 FROM users u
+				WHERE u.user_id = p.user_id AND (`).EAV(rule).SQL(`))`)
+	if limit > 0 {
+		q.SQL(`
+		ORDER BY p.user_id
+		LIMIT `).Bind(limit)
+	}
+	return q.Build()
+}
+
+// Compare the users rule matches in the two models, with up to examples
+// user_ids of each side that differ. Equal counts can still hide users
+// missing on one side and extra on the other, which this finds.
+func DiffModels(ctx context.Context, db Querier, rule *rules.Rule, examples int) (ModelDiff, error) {
+	rule = Scope(ctx, rule)
+	var d ModelDiff
+	for _, side := range []struct {
+		build    func(*rules.Rule, int) (string, []interface{})
+		count    *int64
+		examples *[]int64
+	}{
+		{onlyEAVQuery, &d.OnlyEAV, &d.EAVExamples},
+		{onlyOptimizedQuery, &d.OnlyOptimized, &d.OptimizedExamples},
+	} {
+		query, args := side.build(rule, 0)
+		if err := db.QueryRowContext(ctx, query, args...).Scan(side.count); err != nil {
+			return d, classify(err)
+		}
+		if *side.count == 0 || examples <= 0 {
+			continue
+		}
+		query, args = side.build(rule, examples)
+		ids, err := queryUserIDs(ctx, db, query, args...)
+		if err != nil {
+			return d, err
+		}
+		*side.examples = ids
+	}
+	return d, nil
+}
+
+func queryUserIDs(ctx context.Context, db Querier, query string, args ...interface{}) ([]int64, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, classify(err)
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, classify(err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, classify(rows.Err())
+}
+
+// One user's values of some attributes in both models, as text for display
+type UserValues struct {
+	UserID     int64
+	EAV        map[string]string // values of a set joined with commas; absent when the user has none
+	HasProfile bool
+	Profile    map[string]string // "NULL" for a NULL column
+}
+
+// The attrs of a user in user_attributes and in user_profiles, to show why a
+// rule matched them in one model only
+func ReadUserValues(ctx context.Context, db Querier, userID int64, attrs []rules.Attribute) (UserValues, error) {
+	v := UserValues{UserID: userID, EAV: map[string]string{}, Profile: map[string]string{}}
+	if len(attrs) == 0 {
+		// A rule of IN AUDIENCE only reads no attributes; whether the profile exists still tells
+		query, args := rules.NewQuery(active).SQL(`SELECT EXISTS (SELECT 1 FROM user_profiles WHERE user_id = `).Bind(userID).SQL(`)`).Build()
+		return v, classify(db.QueryRowContext(ctx, query, args...).Scan(&v.HasProfile))
+	}
+	q := rules.NewQuery(active).SQL(`
+		SELECT ua.key, ua.value FROM user_attributes ua
+		WHERE ua.user_id = `).Bind(userID).SQL(` AND ua.key IN (`)
+	for i, a := range attrs {
+		if i > 0 {
+			q.SQL(`, `)
+		}
+		q.Bind(a.Name)
+	}
+	query, args := q.SQL(`)
+		ORDER BY ua.key, ua.value`).Build()
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return v, classify(err)
+	}
+	defer rows.Close()
+	values := map[string][]string{}
+	for rows.Next() {
+		var key string
+		var value sql.NullString
+		if err := rows.Scan(&key, &value); err != nil {
+			return v, classify(err)
+		}
+		values[key] = append(values[key], value.String)
+	}
+	if err := rows.Err(); err != nil {
+		return v, classify(err)
+	}
+	for key, vs := range values {
+		v.EAV[key] = strings.Join(vs, ",")
+	}
+
+	q = rules.NewQuery(active).SQL(`SELECT `)
+	for i, a := range attrs {
+		if i > 0 {
+			q.SQL(`, `)
+		}
+		q.Profile(a)
+	}
+	query, args = q.SQL(`
+		FROM user_profiles
+		WHERE user_id = `).Bind(userID).Build()
+	cols := make([]interface{}, len(attrs))
+	ptrs := make([]interface{}, len(attrs))
+	for i := range cols {
+		ptrs[i] = &cols[i]
+	}
+	switch err := db.QueryRowContext(ctx, query, args...).Scan(ptrs...); {
+	case err == sql.ErrNoRows:
+		return v, nil
+	case err != nil:
+		return v, classify(err)
+	}
+	v.HasProfile = true
+	for i, a := range attrs {
+		v.Profile[a.Name] = displayValue(cols[i])
+	}
+	return v, nil
+}
+
+func displayValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.Format(time.DateTime)
+	}
+	return fmt.Sprint(v)
+}
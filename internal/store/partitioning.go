@@ -0,0 +1,135 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// List partitions of the country layout; rarer values share the default partition
+const maxListPartitions = 32
+
+// A physical layout of the optimized model's table, compared with --compare-partitioning
+type ProfileLayout struct {
+	Name  string
+	Table string
+	// Column the copy is list-partitioned by, one partition per frequent value; empty for none
+	ListBy string
+}
+
+// user_profiles itself is hash-partitioned by user_id; the others are copies
+// of it, built by SetupProfileLayout with the same data and indexes
+var ProfileLayouts = []ProfileLayout{
+	{Name: "Hash by user_id", Table: "user_profiles"},
+	{Name: "Unpartitioned", Table: "user_profiles_unpartitioned"},
+	{Name: "List by country", Table: "user_profiles_partitioned", ListBy: "country"},
+}
+
+// "CREATE [UNIQUE] INDEX name ON [ONLY] table USING", as pg_indexes prints it
+var indexDefHead = regexp.MustCompile(`^CREATE (UNIQUE )?INDEX (\S+) ON (ONLY )?\S+ USING `)
+
+// (Re)create a layout's copy of user_profiles: the table, its partitions, the
+// current rows and every non-unique index of user_profiles, in one transaction
+func SetupProfileLayout(ctx context.Context, db *sql.DB, l ProfileLayout) error {
+	if l.Table == "user_profiles" {
+		return nil
+	}
+	indexes, err := ProfileIndexes(ctx, db)
+	if err != nil {
+		return fmt.Errorf("list user_profiles indexes: %w", err)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// Copying and indexing a large table can outlast the per-query statement timeout
+	if err := UnboundedStatements(ctx, tx); err != nil {
+		return err
+	}
+
+	create := "CREATE TABLE " + l.Table + " (LIKE user_profiles INCLUDING DEFAULTS)"
+	statements := []string{"DROP TABLE IF EXISTS " + l.Table}
+	if l.ListBy == "" {
+		statements = append(statements, create, "ALTER TABLE "+l.Table+" ADD PRIMARY KEY (user_id)")
+	} else {
+		values, err := frequentValues(ctx, tx, l.ListBy)
+		if err != nil {
+			return fmt.Errorf("%s partitions: %w", l.Name, err)
+		}
+		statements = append(statements, create+" PARTITION BY LIST ("+l.ListBy+")")
+		for i, v := range values {
+			statements = append(statements, fmt.Sprintf("CREATE TABLE %s_%d PARTITION OF %s FOR VALUES IN (%s)",
+				l.Table, i, l.Table, pq.QuoteLiteral(v)))
+		}
+		// A unique user_id index would have to include the partition key, and NULLs rule out a primary key
+		statements = append(statements,
+			"CREATE TABLE "+l.Table+"_default PARTITION OF "+l.Table+" DEFAULT",
+			"CREATE INDEX "+l.Table+"_user_id ON "+l.Table+" (user_id)")
+	}
+	statements = append(statements, "INSERT INTO "+l.Table+" SELECT * FROM user_profiles")
+	for _, ix := range indexes {
+		m := indexDefHead.FindStringSubmatch(ix.Def)
+		if m == nil || m[1] != "" {
+			continue
+		}
+		name := ix.Name + "_" + strings.TrimPrefix(l.Table, "user_profiles_")
+		if len(name) > maxIdentifierLength {
+			name = name[:maxIdentifierLength]
+		}
+		statements = append(statements, "CREATE INDEX "+name+" ON "+l.Table+" USING "+ix.Def[len(m[0]):])
+	}
+	statements = append(statements, "ANALYZE "+l.Table)
+
+	for _, q := range statements {
+		if _, err := tx.ExecContext(ctx, q); err != nil {
+			return fmt.Errorf("%s: %w", l.Name, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// Most common non-NULL values of a user_profiles column, most frequent first
+func frequentValues(ctx context.Context, db Querier, column string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `SELECT `+column+` FROM user_profiles WHERE `+column+` IS NOT NULL
+		GROUP BY 1 ORDER BY COUNT(*) DESC, 1 LIMIT $1`, maxListPartitions)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var values []string
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
+
+// Drop a layout's copy; user_profiles itself is left alone
+func DropProfileLayout(ctx context.Context, db Querier, l ProfileLayout) error {
+	if l.Table == "user_profiles" {
+		return nil
+	}
+	_, err := db.ExecContext(ctx, "DROP TABLE IF EXISTS "+l.Table)
+	return err
+}
+
+// Leaf partitions of a layout's table and its total size with indexes. A
+// plain table has no partition tree, so it counts as one partition.
+func LayoutSize(ctx context.Context, db Querier, table string) (int, int64, error) {
+	var partitions int
+	var bytes int64
+	err := db.QueryRowContext(ctx, `
+		SELECT GREATEST(COUNT(*) FILTER (WHERE isleaf), 1),
+		       COALESCE(SUM(pg_total_relation_size(relid)), pg_total_relation_size($1::regclass))
+		FROM pg_partition_tree($1::regclass)`, table).Scan(&partitions, &bytes)
+	return partitions, bytes, err
+}
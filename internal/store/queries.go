@@ -0,0 +1,231 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"audience-poc/internal/rules"
+)
+
+// Run a COUNT query and time it
+func TimeCount(ctx context.Context, db Querier, query string, args ...interface{}) (int, time.Duration, error) {
+	execCtx, exec := startQuerySpan(ctx, "db.execute", query)
+	start := time.Now()
+	row := db.QueryRowContext(execCtx, query, args...)
+	spanError(exec, classify(row.Err()))
+	exec.End()
+
+	_, scan := tracer.Start(ctx, "db.scan")
+	var count int
+	err := classify(row.Scan(&count))
+	duration := time.Since(start)
+	if err == nil {
+		scan.SetAttributes(attribute.Int("db.response.returned_rows", 1))
+	}
+	spanError(scan, err)
+	scan.End()
+
+	return count, duration, err
+}
+
+// Every statement below is assembled with rules.Query, which takes constant
+// SQL, checked identifiers and rule predicates, and binds every value it is given
+
+// A statement builder for one model, failing when the model can't express the rule
+type buildFunc func(*rules.Rule) (string, []interface{}, error)
+
+// The statement q holds, or why it has none
+func built(q *rules.Query) (string, []interface{}, error) {
+	query, args := q.Build()
+	return query, args, q.Err()
+}
+
+func eavCountQuery(rule *rules.Rule) (string, []interface{}, error) {
+	return built(rules.NewQuery(active).SQL(`
+		SELECT COUNT(DISTINCT u.user_id)
+		FROM users u
+		WHERE `).EAV(rule))
+}
+
+func optimizedCountQuery(rule *rules.Rule) (string, []interface{}, error) {
+	return built(rules.NewQuery(active).SQL(`
+		SELECT COUNT(*)
+		FROM user_profiles
+		WHERE `).Optimized(rule))
+}
+
+func jsonbCountQuery(rule *rules.Rule) (string, []interface{}, error) {
+	return built(rules.NewQuery(active).SQL(`
+		SELECT COUNT(*)
+		FROM user_profiles_jsonb
+		WHERE `).JSONB(rule))
+}
+
+func countSQL(audienceRule string, build buildFunc) (string, []interface{}, error) {
+	rule, err := rules.Parse(audienceRule)
+	if err != nil {
+		return "", nil, err
+	}
+	return build(rule)
+}
+
+// Parameterized COUNT query for a rule against the old EAV model
+func EAVCountSQL(audienceRule string) (string, []interface{}, error) {
+	return countSQL(audienceRule, eavCountQuery)
+}
+
+// Parameterized COUNT query for a rule against the optimized model
+func OptimizedCountSQL(audienceRule string) (string, []interface{}, error) {
+	return countSQL(audienceRule, optimizedCountQuery)
+}
+
+// Parameterized COUNT query for a rule against a copy of user_profiles, such
+// as a partitioning layout; table must be a plain identifier, and is inlined
+func OptimizedCountSQLOn(table, audienceRule string) (string, []interface{}, error) {
+	return countSQL(audienceRule, func(rule *rules.Rule) (string, []interface{}, error) {
+		return built(rules.NewQuery(active).SQL(`
+		SELECT COUNT(*)
+		FROM `).Ident(table).SQL(`
+		WHERE `).Optimized(rule))
+	})
+}
+
+// Parameterized COUNT query for a rule against the JSONB model (PostgreSQL only)
+func JSONBCountSQL(audienceRule string) (string, []interface{}, error) {
+	return countSQL(audienceRule, jsonbCountQuery)
+}
+
+// Evaluate a rule against one model under an audience.count span, with the
+// parse, compile, execute and scan phases as children
+func tracedCount(ctx context.Context, db Querier, model, audienceRule string, build buildFunc) (int, time.Duration, error) {
+	ctx, span := tracer.Start(ctx, "audience.count", trace.WithAttributes(
+		attribute.String("audience.model", model),
+		attribute.String("audience.rule", audienceRule),
+	))
+	defer span.End()
+
+	rule, err := parseRule(ctx, audienceRule)
+	if err != nil {
+		return 0, 0, spanError(span, err)
+	}
+	query, args, err := compileRule(ctx, model, Scope(ctx, rule), build)
+	if err != nil {
+		return 0, 0, spanError(span, err)
+	}
+	count, duration, err := TimeCount(ctx, db, query, args...)
+	if err != nil {
+		return 0, 0, spanError(span, err)
+	}
+	span.SetAttributes(attribute.Int("audience.count", count))
+	return count, duration, nil
+}
+
+// Old EAV model - slow query
+func EAVCount(ctx context.Context, db Querier, audienceRule string) (int, time.Duration, error) {
+	return tracedCount(ctx, db, "eav", audienceRule, eavCountQuery)
+}
+
+// New optimized model - fast query
+func OptimizedCount(ctx context.Context, db Querier, audienceRule string) (int, time.Duration, error) {
+	return tracedCount(ctx, db, "optimized", audienceRule, optimizedCountQuery)
+}
+
+// JSONB model - one document per user behind a GIN index
+func JSONBCount(ctx context.Context, db Querier, audienceRule string) (int, time.Duration, error) {
+	return tracedCount(ctx, db, "jsonb", audienceRule, jsonbCountQuery)
+}
+
+// Whether the JSONB model is available: PostgreSQL with user_profiles_jsonb created
+func HasJSONBModel(ctx context.Context, db Querier) (bool, error) {
+	if active.Name() != (Postgres{}).Name() {
+		return false, nil
+	}
+	var exists bool
+	err := db.QueryRowContext(ctx, `SELECT to_regclass('user_profiles_jsonb') IS NOT NULL`).Scan(&exists)
+	return exists, err
+}
+
+// EAV count restricted to users up to a cutoff id
+func EAVCountUpTo(ctx context.Context, db Querier, audienceRule string, cutoff int64) (int, time.Duration, error) {
+	rule, err := rules.Parse(audienceRule)
+	if err != nil {
+		return 0, 0, err
+	}
+	query, args := rules.NewQuery(active).SQL(`
+		SELECT COUNT(DISTINCT u.user_id)
+		FROM users u
+		WHERE u.user_id <= `).Bind(cutoff).SQL(` AND (`).EAV(rule).SQL(`)`).Build()
+	return TimeCount(ctx, db, query, args...)
+}
+
+// Optimized count restricted to users up to a cutoff id
+func OptimizedCountUpTo(ctx context.Context, db Querier, audienceRule string, cutoff int64) (int, time.Duration, error) {
+	rule, err := rules.Parse(audienceRule)
+	if err != nil {
+		return 0, 0, err
+	}
+	query, args := rules.NewQuery(active).SQL(`
+		SELECT COUNT(*)
+		FROM user_profiles
+		WHERE user_id <= `).Bind(cutoff).SQL(` AND (`).Optimized(rule).SQL(`)`).Build()
+	return TimeCount(ctx, db, query, args...)
+}
+
+// user_id of the n-th user, so "user_id <= cutoff" selects a prefix of the real data
+func UserCutoff(ctx context.Context, db Querier, n int) (int64, error) {
+	query, args := rules.NewQuery(active).SQL(`SELECT user_id FROM users ORDER BY user_id LIMIT 1 OFFSET `).Bind(n - 1).Build()
+	var cutoff int64
+	err := db.QueryRowContext(ctx, query, args...).Scan(&cutoff)
+	return cutoff, err
+}
+
+func CountUsers(ctx context.Context, db Querier) (int, error) {
+	var n int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM users").Scan(&n)
+	return n, err
+}
+
+// Next page of matching user_ids after a cursor, in user_id order (keyset pagination)
+func MembersAfter(ctx context.Context, db Querier, rule *rules.Rule, after int64, limit int) ([]int64, error) {
+	ctx, span := tracer.Start(ctx, "audience.members", trace.WithAttributes(
+		attribute.String("audience.model", "optimized"),
+		attribute.Int64("audience.after_user_id", after),
+	))
+	defer span.End()
+
+	query, args, err := compileRule(ctx, "optimized", Scope(ctx, rule), func(rule *rules.Rule) (string, []interface{}, error) {
+		return built(rules.NewQuery(active).SQL(`
+		SELECT user_id
+		FROM user_profiles
+		WHERE user_id > `).Bind(after).SQL(` AND (`).Optimized(rule).SQL(`)
+		ORDER BY user_id
+		LIMIT `).Bind(limit))
+	})
+	if err != nil {
+		return nil, spanError(span, err)
+	}
+	execCtx, exec := startQuerySpan(ctx, "db.execute", query)
+	rows, err := db.QueryContext(execCtx, query, args...)
+	spanError(exec, classify(err))
+	exec.End()
+	if err != nil {
+		return nil, spanError(span, classify(err))
+	}
+	defer rows.Close()
+
+	_, scan := tracer.Start(ctx, "db.scan")
+	defer scan.End()
+	ids := make([]int64, 0, limit)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, spanError(span, spanError(scan, classify(err)))
+		}
+		ids = append(ids, id)
+	}
+	scan.SetAttributes(attribute.Int("db.response.returned_rows", len(ids)))
+	return ids, spanError(span, spanError(scan, classify(rows.Err())))
+}
@@ -0,0 +1,266 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+
+	"github.com/lib/pq"
+
+	"audience-poc/internal/rules"
+)
+
+// Attribute columns user_profiles may have, built-in ones included, before
+// schema sync puts new attributes in the overflow document instead
+const DefaultMaxAttributeColumns = 64
+
+// How an attribute is kept in the optimized model, as attribute_registry.storage
+const (
+	storageColumn   = "column"
+	storageOverflow = "overflow"
+)
+
+// Attributes added to attribute_registry by schema sync, without the built-in ones
+func registeredAttributes(ctx context.Context, db Querier) ([]rules.Attribute, error) {
+	rows, err := db.QueryContext(ctx, `SELECT name, type, storage FROM attribute_registry ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var attrs []rules.Attribute
+	for rows.Next() {
+		var a rules.Attribute
+		var typ, storage string
+		if err := rows.Scan(&a.Name, &typ, &storage); err != nil {
+			return nil, err
+		}
+		if a.Type, err = rules.ParseAttrType(typ); err != nil {
+			return nil, fmt.Errorf("attribute_registry %q: %w", a.Name, err)
+		}
+		a.Overflow, a.Registered = storage == storageOverflow, true
+		attrs = append(attrs, a)
+	}
+	return attrs, rows.Err()
+}
+
+// Built-in attributes and the registry's, as the database has them now
+func profileAttributes(ctx context.Context, db Querier) ([]rules.Attribute, error) {
+	attrs, err := registeredAttributes(ctx, db)
+	if err != nil {
+		return nil, fmt.Errorf("read attribute_registry: %w", err)
+	}
+	for name, typ := range rules.Attributes {
+		attrs = append(attrs, rules.Attribute{Name: name, Type: typ})
+	}
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].Name < attrs[j].Name })
+	return attrs, nil
+}
+
+// Make the registry's attributes known to the rule parser and return how many
+// there are. A database without the registry table has none (PostgreSQL only).
+func RegisterAttributes(ctx context.Context, db Querier) (int, error) {
+	attrs, err := registeredAttributes(ctx, db)
+	if code, _, ok := pgError(err); ok && code == "42P01" {
+		attrs, err = nil, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("read attribute_registry: %w", err)
+	}
+	return len(attrs), rules.Register(attrs)
+}
+
+type SchemaSyncOptions struct {
+	// Put every new attribute in the overflow document rather than a column
+	Overflow bool
+	// Attribute columns user_profiles may have before new attributes overflow
+	MaxColumns int
+	// Report what would be added without changing anything
+	DryRun bool
+}
+
+// A user_attributes key the registry didn't know yet
+type NewAttribute struct {
+	rules.Attribute
+	Rows, Users int64
+	Index       string // built on the new column; empty for overflow attributes
+	Skipped     string // why the key can't be used in rules, when it can't
+}
+
+// Register every user_attributes key that is neither built in nor registered.
+// Each one's type is inferred from its values: several rows for one user make
+// a set, otherwise the narrowest of boolean, numeric, date, timestamp and text
+// that all of them parse as. An attribute gets a user_profiles column and an
+// index while there are fewer than MaxColumns, then goes to the overflow
+// JSONB document. Columns and the JSONB model are backfilled from the EAV rows,
+// one transaction per attribute, so a failure leaves earlier ones registered.
+func SyncSchema(ctx context.Context, db *sql.DB, opts SchemaSyncOptions) ([]NewAttribute, error) {
+	if opts.MaxColumns < 1 {
+		opts.MaxColumns = DefaultMaxAttributeColumns
+	}
+	if err := EnsureSchema(ctx, db); err != nil {
+		return nil, err
+	}
+	attrs, err := profileAttributes(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	known := make([]string, len(attrs))
+	columns := 0
+	for i, a := range attrs {
+		known[i] = a.Name
+		if !a.Overflow {
+			columns++
+		}
+	}
+	found, err := discoverAttributes(ctx, db, known)
+	if err != nil {
+		return nil, fmt.Errorf("discover attributes: %w", err)
+	}
+
+	added := 0
+	for i := range found {
+		a := &found[i]
+		if err := rules.ValidName(a.Name); err != nil {
+			a.Skipped = err.Error()
+			continue
+		}
+		a.Registered = true
+		a.Overflow = opts.Overflow || columns >= opts.MaxColumns
+		if !a.Overflow {
+			columns++
+			a.Index = "idx_attr_" + a.Name
+		}
+		if opts.DryRun {
+			continue
+		}
+		if err := addAttribute(ctx, db, *a); err != nil {
+			return found[:i], fmt.Errorf("add attribute %q: %w", a.Name, err)
+		}
+		added++
+	}
+	if added > 0 {
+		for _, table := range []string{"user_profiles", "user_profiles_jsonb"} {
+			if _, err := db.ExecContext(ctx, "ANALYZE "+table); err != nil {
+				return found, fmt.Errorf("analyze %s: %w", table, err)
+			}
+		}
+	}
+	return found, nil
+}
+
+// Keys of user_attributes not in known, with what their values parse as
+func discoverAttributes(ctx context.Context, db Querier, known []string) ([]NewAttribute, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT key, COUNT(*), COUNT(DISTINCT user_id), COUNT(value),
+		       bool_and(value IS NULL OR value IN ('true', 'false')),
+		       bool_and(value IS NULL OR value ~ '^-?[0-9]+(\.[0-9]+)?$'),
+		       bool_and(value IS NULL OR value ~ '^[0-9]{4}-[0-9]{2}-[0-9]{2}$'),
+		       bool_and(value IS NULL OR value ~ '^[0-9]{4}-[0-9]{2}-[0-9]{2}[ T][0-9]{2}:[0-9]{2}')
+		FROM user_attributes
+		WHERE key IS NOT NULL AND NOT key = ANY($1)
+		GROUP BY key
+		ORDER BY key`, pq.Array(known))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var found []NewAttribute
+	for rows.Next() {
+		var a NewAttribute
+		var values int64
+		var boolean, numeric, date, timestamp bool
+		if err := rows.Scan(&a.Name, &a.Rows, &a.Users, &values, &boolean, &numeric, &date, &timestamp); err != nil {
+			return nil, err
+		}
+		switch {
+		case a.Rows > a.Users:
+			a.Type = rules.AttrSet
+		case values == 0:
+			a.Type = rules.AttrText
+		case boolean:
+			a.Type = rules.AttrBool
+		case numeric:
+			a.Type = rules.AttrNumeric
+		case date:
+			a.Type = rules.AttrDate
+		case timestamp:
+			a.Type = rules.AttrTimestamp
+		default:
+			a.Type = rules.AttrText
+		}
+		found = append(found, a)
+	}
+	return found, rows.Err()
+}
+
+func columnType(t rules.AttrType) string {
+	switch t {
+	case rules.AttrNumeric:
+		return "NUMERIC"
+	case rules.AttrBool:
+		return "BOOLEAN"
+	case rules.AttrTimestamp:
+		return "TIMESTAMP"
+	case rules.AttrDate:
+		return "DATE"
+	case rules.AttrSet:
+		return "TEXT[]"
+	default:
+		return "TEXT"
+	}
+}
+
+// Add the attribute's column and index, or its overflow field, fill both
+// models from user_attributes and register it, in one transaction. The ALTER
+// holds user_profiles until commit, so a concurrent sync waits for it.
+func addAttribute(ctx context.Context, db *sql.DB, a NewAttribute) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := UnboundedStatements(ctx, tx); err != nil {
+		return err
+	}
+
+	// One row per user holding the attribute, typed as the pivot would
+	values := `(SELECT ua.user_id, ` + pivotValue(a.Attribute) + ` AS value
+		FROM user_attributes ua WHERE ua.key = '` + a.Name + `' GROUP BY ua.user_id) v`
+	field := `jsonb_strip_nulls(jsonb_build_object('` + a.Name + `', v.value))`
+	var statements []string
+	if a.Overflow {
+		statements = append(statements,
+			`UPDATE user_profiles p SET `+rules.OverflowColumn+` = COALESCE(p.`+rules.OverflowColumn+`, '{}') || `+field+`
+			FROM `+values+` WHERE p.user_id = v.user_id`)
+	} else {
+		method := "btree"
+		if a.Type == rules.AttrSet {
+			method = "GIN"
+		}
+		statements = append(statements,
+			`ALTER TABLE user_profiles ADD COLUMN IF NOT EXISTS `+a.Column()+` `+columnType(a.Type),
+			`UPDATE user_profiles p SET `+a.Column()+` = v.value FROM `+values+` WHERE p.user_id = v.user_id`,
+			// Built after the backfill, which is faster than maintaining it row by row
+			`CREATE INDEX IF NOT EXISTS `+a.Index+` ON user_profiles USING `+method+` (`+a.Column()+`)`)
+	}
+	statements = append(statements,
+		`UPDATE user_profiles_jsonb j SET attributes = j.attributes || `+field+`
+		FROM `+values+` WHERE j.user_id = v.user_id`)
+	for _, q := range statements {
+		if _, err := tx.ExecContext(ctx, q); err != nil {
+			return err
+		}
+	}
+
+	storage := storageColumn
+	if a.Overflow {
+		storage = storageOverflow
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO attribute_registry (name, type, storage, index_name) VALUES ($1, $2, $3, NULLIF($4, ''))`,
+		a.Name, a.Type.String(), storage, a.Index); err != nil {
+		return fmt.Errorf("register: %w", err)
+	}
+	return tx.Commit()
+}
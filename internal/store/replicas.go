@@ -0,0 +1,114 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"audience-poc/internal/config"
+)
+
+// A primary and its read replicas. Reads go round-robin to the replicas that
+// answered the last health check, and to the primary when none did; writes,
+// and reads that must see them, always use the primary.
+type Router struct {
+	primary  *sql.DB
+	replicas []*Replica
+	next     atomic.Uint64
+}
+
+type Replica struct {
+	Addr    string
+	DB      *sql.DB
+	healthy atomic.Bool
+}
+
+// Whether the replica answered its last health check
+func (r *Replica) Healthy() bool { return r.healthy.Load() }
+
+// Open pools for cfg and each of its replicas without connecting. Replicas
+// take reads once a health check has found them answering.
+func OpenRouter(cfg config.DB) (*Router, error) {
+	replicaCfgs, err := cfg.ReplicaConfigs()
+	if err != nil {
+		return nil, err
+	}
+	primary, err := Open(cfg)
+	if err != nil {
+		return nil, err
+	}
+	r := &Router{primary: primary}
+	for _, rc := range replicaCfgs {
+		db, err := Open(rc)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.replicas = append(r.replicas, &Replica{Addr: net.JoinHostPort(rc.Host, strconv.Itoa(rc.Port)), DB: db})
+	}
+	return r, nil
+}
+
+func (r *Router) Primary() *sql.DB { return r.primary }
+
+func (r *Router) Replicas() []*Replica { return r.replicas }
+
+// Pool for the next read, taking the healthy replicas in turn
+func (r *Router) Read() *sql.DB {
+	healthy := make([]*sql.DB, 0, len(r.replicas))
+	for _, rep := range r.replicas {
+		if rep.Healthy() {
+			healthy = append(healthy, rep.DB)
+		}
+	}
+	if len(healthy) == 0 {
+		return r.primary
+	}
+	return healthy[r.next.Add(1)%uint64(len(healthy))]
+}
+
+// Ping every replica, each within timeout, and route reads by the outcome
+func (r *Router) CheckReplicas(ctx context.Context, timeout time.Duration) {
+	for _, rep := range r.replicas {
+		pingCtx, cancel := context.WithTimeout(ctx, timeout)
+		err := rep.DB.PingContext(pingCtx)
+		cancel()
+		if was := rep.healthy.Swap(err == nil); was != (err == nil) {
+			if err != nil {
+				slog.Warn("replica is down, its reads go elsewhere", "replica", rep.Addr, "err", err)
+			} else {
+				slog.Info("replica is up, routing reads to it", "replica", rep.Addr)
+			}
+		}
+	}
+}
+
+// Check the replicas now and every interval until ctx is done
+func (r *Router) WatchReplicas(ctx context.Context, interval, timeout time.Duration) {
+	if len(r.replicas) == 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		r.CheckReplicas(ctx, timeout)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Router) Close() error {
+	errs := []error{r.primary.Close()}
+	for _, rep := range r.replicas {
+		errs = append(errs, rep.DB.Close())
+	}
+	return errors.Join(errs...)
+}
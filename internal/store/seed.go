@@ -0,0 +1,482 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Fixed so every seeded dataset is identical for a given size
+const seedRandomSeed = 42
+
+// Users copied per transaction
+const seedBatchSize = 50000
+
+// Log progress every this many users, for multi-million seeds
+const seedProgressEvery = 1000000
+
+const profilePartitions = 10
+
+// Same schema as init.sql, safe to run against an existing database
+func schemaStatements() []string {
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS users (
+			user_id BIGSERIAL PRIMARY KEY,
+			tenant_id TEXT NOT NULL DEFAULT 'default'
+		)`,
+		// Databases created before tenants: every user is the default tenant's
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default'`,
+		`CREATE TABLE IF NOT EXISTS user_attributes (
+			id BIGSERIAL PRIMARY KEY,
+			user_id BIGINT REFERENCES users(user_id),
+			key VARCHAR(50),
+			value TEXT
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_user_attrs_user_id ON user_attributes(user_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_user_attrs_key ON user_attributes(key)`,
+		`CREATE TABLE IF NOT EXISTS user_profiles (
+			user_id BIGINT PRIMARY KEY,
+			tenant_id TEXT NOT NULL DEFAULT 'default',
+			country VARCHAR(2),
+			tier VARCHAR(20),
+			last_active_at TIMESTAMP DEFAULT NOW(),
+			has_purchased BOOLEAN DEFAULT FALSE,
+			total_spend DECIMAL(10,2) DEFAULT 0,
+			signup_date DATE,
+			age SMALLINT,
+			interests TEXT[],
+			overflow JSONB
+		) PARTITION BY HASH (user_id)`,
+		// Databases created before the typed attributes, the registry and tenants
+		`ALTER TABLE user_profiles
+			ADD COLUMN IF NOT EXISTS signup_date DATE,
+			ADD COLUMN IF NOT EXISTS age SMALLINT,
+			ADD COLUMN IF NOT EXISTS interests TEXT[],
+			ADD COLUMN IF NOT EXISTS overflow JSONB,
+			ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default'`,
+	}
+	for i := 0; i < profilePartitions; i++ {
+		statements = append(statements, fmt.Sprintf(
+			`CREATE TABLE IF NOT EXISTS user_profiles_%d PARTITION OF user_profiles FOR VALUES WITH (modulus %d, remainder %d)`,
+			i, profilePartitions, i))
+	}
+	return append(statements,
+		`CREATE INDEX IF NOT EXISTS idx_tenant ON user_profiles USING btree (tenant_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_country ON user_profiles USING btree (country)`,
+		`CREATE INDEX IF NOT EXISTS idx_tier ON user_profiles USING btree (tier)`,
+		`CREATE INDEX IF NOT EXISTS idx_active_recent ON user_profiles USING BRIN (last_active_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_has_purchased ON user_profiles USING btree (has_purchased) WHERE has_purchased = true`,
+		`CREATE INDEX IF NOT EXISTS idx_high_spender ON user_profiles USING btree (total_spend) WHERE total_spend > 100`,
+		`CREATE INDEX IF NOT EXISTS idx_signup_date ON user_profiles USING btree (signup_date)`,
+		`CREATE INDEX IF NOT EXISTS idx_age ON user_profiles USING btree (age)`,
+		`CREATE INDEX IF NOT EXISTS idx_interests ON user_profiles USING GIN (interests)`,
+		`CREATE INDEX IF NOT EXISTS idx_overflow ON user_profiles USING GIN (overflow jsonb_path_ops)`,
+		`CREATE TABLE IF NOT EXISTS attribute_registry (
+			name VARCHAR(50) PRIMARY KEY,
+			type TEXT NOT NULL,
+			storage TEXT NOT NULL CHECK (storage IN ('column', 'overflow')),
+			index_name TEXT,
+			registered_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`,
+		`CREATE TABLE IF NOT EXISTS user_profiles_jsonb (
+			user_id BIGINT PRIMARY KEY,
+			attributes JSONB NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_profiles_jsonb_gin ON user_profiles_jsonb USING GIN (attributes jsonb_path_ops)`,
+		`CREATE TABLE IF NOT EXISTS migration_checkpoints (
+			name VARCHAR(64) PRIMARY KEY,
+			last_user_id BIGINT NOT NULL,
+			users_done BIGINT NOT NULL,
+			started_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL,
+			completed_at TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS user_attributes_changes (
+			change_id BIGSERIAL PRIMARY KEY,
+			user_id BIGINT NOT NULL,
+			changed_at TIMESTAMP NOT NULL DEFAULT NOW()
+		)`,
+		`CREATE OR REPLACE FUNCTION record_user_attributes_change() RETURNS trigger AS $$
+		BEGIN
+			IF TG_OP <> 'INSERT' THEN
+				INSERT INTO user_attributes_changes (user_id) VALUES (OLD.user_id);
+			END IF;
+			IF TG_OP <> 'DELETE' AND (TG_OP = 'INSERT' OR NEW.user_id IS DISTINCT FROM OLD.user_id) THEN
+				INSERT INTO user_attributes_changes (user_id) VALUES (NEW.user_id);
+			END IF;
+			RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql`,
+		`CREATE OR REPLACE TRIGGER `+changeCaptureTrigger+`
+			AFTER INSERT OR UPDATE OR DELETE ON user_attributes
+			FOR EACH ROW EXECUTE FUNCTION record_user_attributes_change()`,
+		`CREATE TABLE IF NOT EXISTS predicate_cache (
+			predicate_hash VARCHAR(64) PRIMARY KEY,
+			user_count INT,
+			last_updated TIMESTAMP DEFAULT NOW()
+		)`,
+		`CREATE TABLE IF NOT EXISTS audiences (
+			audience_id BIGSERIAL PRIMARY KEY,
+			tenant_id TEXT NOT NULL DEFAULT 'default',
+			name TEXT NOT NULL,
+			rule TEXT NOT NULL,
+			owner TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`,
+		// Names were unique across every audience before tenants, now within one
+		`ALTER TABLE audiences ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default'`,
+		`ALTER TABLE audiences DROP CONSTRAINT IF EXISTS audiences_name_key`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS audiences_tenant_name ON audiences (tenant_id, name)`,
+		`CREATE TABLE IF NOT EXISTS audience_snapshots (
+			snapshot_id BIGSERIAL PRIMARY KEY,
+			audience_id BIGINT NOT NULL REFERENCES audiences(audience_id) ON DELETE CASCADE,
+			rule TEXT NOT NULL,
+			user_count BIGINT NOT NULL,
+			duration_ms DOUBLE PRECISION NOT NULL,
+			taken_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_audience_snapshots_taken ON audience_snapshots (audience_id, taken_at)`,
+		`CREATE TABLE IF NOT EXISTS audience_lists (
+			list_id BIGSERIAL PRIMARY KEY,
+			name TEXT NOT NULL UNIQUE,
+			tenant_id TEXT NOT NULL DEFAULT 'default',
+			source TEXT NOT NULL,
+			member_count BIGINT NOT NULL,
+			imported_at TIMESTAMPTZ NOT NULL
+		)`,
+		// Without a foreign key for the same reason as audience_members;
+		// ImportList and DeleteList replace a list's members themselves
+		`CREATE TABLE IF NOT EXISTS audience_list_members (
+			list_id BIGINT NOT NULL,
+			user_id BIGINT NOT NULL,
+			PRIMARY KEY (list_id, user_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS audience_triggers (
+			trigger_id BIGSERIAL PRIMARY KEY,
+			audience_id BIGINT NOT NULL REFERENCES audiences(audience_id) ON DELETE CASCADE,
+			condition TEXT NOT NULL,
+			threshold DOUBLE PRECISION NOT NULL,
+			target TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`,
+		`CREATE TABLE IF NOT EXISTS audience_materializations (
+			audience_id BIGINT PRIMARY KEY REFERENCES audiences(audience_id) ON DELETE CASCADE,
+			rule TEXT NOT NULL,
+			member_count BIGINT NOT NULL,
+			rows_written BIGINT NOT NULL,
+			duration_ms DOUBLE PRECISION NOT NULL,
+			refreshed_at TIMESTAMPTZ NOT NULL
+		)`,
+		// No foreign key: checking one per member would dominate a refresh, so
+		// members are removed with their materialization by a trigger instead
+		`CREATE TABLE IF NOT EXISTS audience_members (
+			audience_id BIGINT NOT NULL,
+			user_id BIGINT NOT NULL,
+			PRIMARY KEY (audience_id, user_id)
+		)`,
+		`CREATE OR REPLACE FUNCTION drop_audience_members() RETURNS trigger AS $$
+		BEGIN
+			DELETE FROM audience_members WHERE audience_id = OLD.audience_id;
+			RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql`,
+		`CREATE OR REPLACE TRIGGER audience_materializations_drop
+			AFTER DELETE ON audience_materializations
+			FOR EACH ROW EXECUTE FUNCTION drop_audience_members()`,
+	)
+}
+
+// Create the EAV and optimized schemas if they don't exist yet
+func EnsureSchema(ctx context.Context, db *sql.DB) error {
+	for _, q := range schemaStatements() {
+		if _, err := db.ExecContext(ctx, q); err != nil {
+			return fmt.Errorf("create schema: %w", err)
+		}
+	}
+	return nil
+}
+
+// user_profiles columns seeding fills: the built-in attributes. Registered
+// ones are left NULL, as their user_attributes rows are replaced too.
+var seedProfileColumns = []string{"user_id", "country", "tier", "last_active_at", "has_purchased", "total_spend", "signup_date", "age", "interests"}
+
+// Attribute values of one synthetic user
+type syntheticUser struct {
+	id           int64
+	country      string
+	tier         string
+	lastActiveAt time.Time
+	hasPurchased bool
+	totalSpend   string // 2 decimals, as stored in user_profiles
+	signupDate   time.Time
+	age          int
+	interests    []string // nil for none, stored as NULL
+}
+
+// How synthetic attribute values are drawn
+type Distribution string
+
+const (
+	// Independent attributes matching init.sql: 40% US, 1/3 gold or platinum, 20% purchasers,
+	// ages 18-80, each interest held by a quarter of users
+	Uniform Distribution = "uniform"
+	// Production-like skew: Zipfian countries and tiers, heavy-tailed spend
+	// concentrated in paying tiers, activity biased towards recent days
+	Zipf Distribution = "zipf"
+)
+
+func ParseDistribution(s string) (Distribution, error) {
+	switch d := Distribution(s); d {
+	case Uniform, Zipf:
+		return d, nil
+	}
+	return "", fmt.Errorf("unknown distribution %q, expected %s or %s", s, Uniform, Zipf)
+}
+
+var (
+	seedCountries = []string{"US", "UK", "DE", "FR", "JP", "AU", "CA", "BR", "IN"}
+	seedTiers     = []string{"free", "free", "free", "free", "gold", "platinum"}
+
+	// Ranked by expected frequency; the Zipf generator draws rank k with p ∝ 1/(k+1)^s
+	zipfCountries = []string{"US", "UK", "DE", "IN", "BR", "FR", "CA", "JP", "AU", "ES",
+		"IT", "MX", "NL", "PL", "SE", "KR", "TR", "AR", "ZA", "NG"}
+	zipfTiers = []string{"free", "gold", "platinum"}
+	// Share of each tier that has purchased at least once
+	zipfPurchaseRate = map[string]float64{"free": 0.08, "gold": 0.45, "platinum": 0.8}
+
+	// Also ranked: under Zipf interest k is held by 1/(k+2) of users
+	seedInterests = []string{"sports", "music", "travel", "gaming", "food", "fashion", "tech", "fitness"}
+)
+
+// Largest value DECIMAL(10,2) can hold
+const maxSpend = 99999999.99
+
+// Deterministic generator of users 1..n for a distribution
+func newUserGenerator(d Distribution, r *rand.Rand, now time.Time) func(id int64) syntheticUser {
+	if d == Uniform {
+		return func(id int64) syntheticUser {
+			u := syntheticUser{id: id}
+			// 40% US, the rest spread over all countries
+			if r.Float64() < 0.4 {
+				u.country = "US"
+			} else {
+				u.country = seedCountries[r.Intn(len(seedCountries))]
+			}
+			u.tier = seedTiers[r.Intn(len(seedTiers))]
+			u.lastActiveAt = now.Add(-time.Duration(r.Int63n(int64(365 * 24 * time.Hour)))).Truncate(time.Second)
+			u.hasPurchased = r.Float64() < 0.2
+			u.totalSpend = strconv.FormatFloat(r.Float64()*1000, 'f', 2, 64)
+			// Signed up within the two years before their last activity
+			u.signupDate = u.lastActiveAt.Add(-time.Duration(r.Int63n(int64(2 * 365 * 24 * time.Hour)))).Truncate(24 * time.Hour)
+			u.age = 18 + r.Intn(63)
+			for _, interest := range seedInterests {
+				if r.Float64() < 0.25 {
+					u.interests = append(u.interests, interest)
+				}
+			}
+			return u
+		}
+	}
+
+	countries := rand.NewZipf(r, 1.1, 1, uint64(len(zipfCountries)-1))
+	tiers := rand.NewZipf(r, 2, 1, uint64(len(zipfTiers)-1))
+	return func(id int64) syntheticUser {
+		u := syntheticUser{id: id, totalSpend: "0.00"}
+		u.country = zipfCountries[countries.Uint64()]
+		u.tier = zipfTiers[tiers.Uint64()]
+		// Exponential recency, mean 30 days, capped at a year
+		age := min(r.ExpFloat64()*30, 365) * float64(24*time.Hour)
+		u.lastActiveAt = now.Add(-time.Duration(age)).Truncate(time.Second)
+		u.hasPurchased = r.Float64() < zipfPurchaseRate[u.tier]
+		if u.hasPurchased {
+			// Log-normal: median ~$55, a long tail of big spenders
+			spend := math.Exp(4 + 1.2*r.NormFloat64())
+			u.totalSpend = strconv.FormatFloat(min(spend, maxSpend), 'f', 2, 64)
+		}
+		// Tenure exponential with a one-year mean, capped at five; ages around 34
+		tenure := min(r.ExpFloat64()*365, 5*365) * float64(24*time.Hour)
+		u.signupDate = u.lastActiveAt.Add(-time.Duration(tenure)).Truncate(24 * time.Hour)
+		u.age = int(min(max(34+10*r.NormFloat64(), 18), 90))
+		for k, interest := range seedInterests {
+			if r.Float64() < 1/float64(k+2) {
+				u.interests = append(u.interests, interest)
+			}
+		}
+		return u
+	}
+}
+
+// Empty every table derived from the dataset before it is replaced. Audiences
+// and imported lists stay; their materializations and members refer to user
+// ids of the old dataset, so they go, and lists are left with no members.
+var clearDatasetStatements = []string{
+	`TRUNCATE user_attributes, users, user_profiles, migration_checkpoints, user_attributes_changes,
+		audience_materializations, audience_members, audience_list_members`,
+	`UPDATE audience_lists SET member_count = 0`,
+}
+
+// Replace the dataset in both models with n deterministic synthetic users
+func Seed(ctx context.Context, db *sql.DB, n int, d Distribution) error {
+	if err := EnsureSchema(ctx, db); err != nil {
+		return err
+	}
+	for _, q := range clearDatasetStatements {
+		if _, err := db.ExecContext(ctx, q); err != nil {
+			return fmt.Errorf("clear existing data: %w", err)
+		}
+	}
+
+	generate := newUserGenerator(d, rand.New(rand.NewSource(seedRandomSeed)), time.Now().UTC())
+	batch := make([]syntheticUser, 0, min(n, seedBatchSize))
+	for id := int64(1); id <= int64(n); id++ {
+		batch = append(batch, generate(id))
+		if len(batch) == seedBatchSize || id == int64(n) {
+			if err := copySeedBatch(ctx, db, batch); err != nil {
+				return fmt.Errorf("copy users %d-%d: %w", batch[0].id, batch[len(batch)-1].id, err)
+			}
+			if id%seedProgressEvery == 0 {
+				slog.Info("seeding", "users", id, "of", n)
+			}
+			batch = batch[:0]
+		}
+	}
+
+	if err := RefreshJSONBProfiles(ctx, db); err != nil {
+		return err
+	}
+	statements := []string{
+		`SELECT setval('users_user_id_seq', GREATEST((SELECT MAX(user_id) FROM users), 1))`,
+		`ANALYZE users`,
+		`ANALYZE user_attributes`,
+		`ANALYZE user_profiles`,
+		`ANALYZE user_profiles_jsonb`,
+	}
+	for _, q := range statements {
+		if _, err := db.ExecContext(ctx, q); err != nil {
+			return fmt.Errorf("finalize seed: %w", err)
+		}
+	}
+	return nil
+}
+
+// Shrink a seeded dataset to its first n users in every model, then vacuum so
+// scans of the smaller tables don't read the freed pages. Seeded ids are
+// dense, so the users kept are the ones Seed(n) would generate.
+func TruncateUsers(ctx context.Context, db *sql.DB, n int) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := setChangeCapture(ctx, tx, false); err != nil {
+		return err
+	}
+	// Materialized counts no longer hold; as with Seed, the audiences stay and the materializations go
+	if _, err := tx.ExecContext(ctx, `DELETE FROM audience_materializations`); err != nil {
+		return fmt.Errorf("drop materializations: %w", err)
+	}
+	for _, table := range []string{"user_attributes", "user_profiles", "user_profiles_jsonb", "users", "audience_list_members"} {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE user_id > $1`, n); err != nil {
+			return fmt.Errorf("truncate %s: %w", table, err)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE audience_lists l
+		SET member_count = (SELECT COUNT(*) FROM audience_list_members m WHERE m.list_id = l.list_id)`); err != nil {
+		return fmt.Errorf("recount list members: %w", err)
+	}
+	if err := setChangeCapture(ctx, tx, true); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	// Trailing empty pages are given back to the filesystem; indexes keep their size
+	if _, err := db.ExecContext(ctx, `VACUUM ANALYZE users, user_attributes, user_profiles, user_profiles_jsonb`); err != nil {
+		return fmt.Errorf("vacuum after truncating: %w", err)
+	}
+	return nil
+}
+
+// Load one batch into both models with COPY FROM STDIN in a single transaction
+func copySeedBatch(ctx context.Context, db *sql.DB, users []syntheticUser) error {
+	// COPY runs on the connection itself
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := setChangeCapture(ctx, tx, false); err != nil {
+		return err
+	}
+
+	lastActive := make([]string, len(users))
+	signup := make([]string, len(users))
+	// Seven attributes per user plus one row per interest
+	attributes := make([][]interface{}, 0, len(users)*9)
+	for i, u := range users {
+		lastActive[i] = u.lastActiveAt.Format("2006-01-02 15:04:05")
+		signup[i] = u.signupDate.Format(time.DateOnly)
+		attributes = append(attributes,
+			[]interface{}{u.id, "country", u.country},
+			[]interface{}{u.id, "tier", u.tier},
+			[]interface{}{u.id, "last_active_at", lastActive[i]},
+			[]interface{}{u.id, "has_purchased", strconv.FormatBool(u.hasPurchased)},
+			[]interface{}{u.id, "total_spend", u.totalSpend},
+			[]interface{}{u.id, "signup_date", signup[i]},
+			[]interface{}{u.id, "age", strconv.Itoa(u.age)},
+		)
+		for _, interest := range u.interests {
+			attributes = append(attributes, []interface{}{u.id, "interests", interest})
+		}
+	}
+	copies := []struct {
+		table string
+		cols  []string
+		rows  int
+		row   func(i int) []interface{}
+	}{
+		{"users", []string{"user_id"}, len(users), func(i int) []interface{} {
+			return []interface{}{users[i].id}
+		}},
+		// Users must be in place first for the foreign key
+		{"user_attributes", []string{"user_id", "key", "value"}, len(attributes), func(i int) []interface{} {
+			return attributes[i]
+		}},
+		{"user_profiles", seedProfileColumns, len(users), func(i int) []interface{} {
+			u := users[i]
+			return []interface{}{u.id, u.country, u.tier, lastActive[i], u.hasPurchased, u.totalSpend, signup[i], u.age, pq.StringArray(u.interests)}
+		}},
+	}
+	client := StoreOf(db)
+	for _, c := range copies {
+		err := client.CopyIn(ctx, conn, tx, c.table, c.cols, func(send func(values ...interface{}) error) error {
+			for i := 0; i < c.rows; i++ {
+				if err := send(c.row(i)...); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", c.table, err)
+		}
+	}
+	if err := setChangeCapture(ctx, tx, true); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
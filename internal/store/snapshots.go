@@ -0,0 +1,67 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Size of a stored audience at one point in time (PostgreSQL only). The rule
+// is kept as evaluated, so later edits of the audience don't rewrite history.
+type Snapshot struct {
+	AudienceID int64
+	Rule       string
+	Users      int64
+	Duration   time.Duration
+	TakenAt    time.Time
+}
+
+func RecordSnapshot(ctx context.Context, db Querier, s Snapshot) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO audience_snapshots (audience_id, rule, user_count, duration_ms, taken_at)
+		VALUES ($1, $2, $3, $4, $5)`,
+		s.AudienceID, s.Rule, s.Users, float64(s.Duration.Microseconds())/1000, s.TakenAt)
+	return err
+}
+
+// Periods a trend can be bucketed by, as date_trunc fields
+var trendPeriods = map[string]bool{"day": true, "week": true, "month": true}
+
+// One audience's size in one period: its last snapshot in that period
+type TrendPoint struct {
+	AudienceID int64
+	Name       string
+	Period     time.Time
+	Users      int64
+	Snapshots  int
+}
+
+// Size of every audience of ctx's tenant (or just audienceID when non-zero) per
+// period since a point in time, ordered by audience and period
+func SnapshotTrend(ctx context.Context, db Querier, period string, since time.Time, audienceID int64) ([]TrendPoint, error) {
+	if !trendPeriods[period] {
+		return nil, fmt.Errorf("unknown period %q, expected day, week or month", period)
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT a.audience_id, a.name, date_trunc($1, s.taken_at) AS period,
+		       (array_agg(s.user_count ORDER BY s.taken_at DESC))[1], COUNT(*)
+		FROM audience_snapshots s
+		JOIN audiences a USING (audience_id)
+		WHERE s.taken_at >= $2 AND ($3 = 0 OR s.audience_id = $3) AND ($4 = '' OR a.tenant_id = $4)
+		GROUP BY a.audience_id, a.name, period
+		ORDER BY a.audience_id, period`, period, since, audienceID, ctxTenant(ctx))
+	if err != nil {
+		return nil, classify(err)
+	}
+	defer rows.Close()
+
+	var points []TrendPoint
+	for rows.Next() {
+		var p TrendPoint
+		if err := rows.Scan(&p.AudienceID, &p.Name, &p.Period, &p.Users, &p.Snapshots); err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+	return points, classify(rows.Err())
+}
@@ -0,0 +1,66 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// What the server recorded in pg_stat_statements for this role and database
+// since the last ResetStatementStats. Statements that failed or were cancelled
+// are not recorded.
+type StatementStats struct {
+	Statements int // distinct normalized statements
+	Calls      int64
+	Rows       int64
+	ExecTime   time.Duration // execution only; planning is not tracked by default
+	SharedHit  int64         // shared buffer blocks found in the cache
+	SharedRead int64         // shared blocks read from the OS page cache or disk
+}
+
+// Share of shared block accesses served from shared_buffers, 0 without any
+func (s StatementStats) HitRatio() float64 {
+	if s.SharedHit+s.SharedRead == 0 {
+		return 0
+	}
+	return float64(s.SharedHit) / float64(s.SharedHit+s.SharedRead)
+}
+
+// Create the extension if needed and check the module is loaded and this role
+// may reset it. PostgreSQL 13 or later.
+func EnableStatementStats(ctx context.Context, db Querier) error {
+	if _, err := db.ExecContext(ctx, `CREATE EXTENSION IF NOT EXISTS pg_stat_statements`); err != nil {
+		return fmt.Errorf("create extension pg_stat_statements: %w", err)
+	}
+	if err := ResetStatementStats(ctx, db); err != nil {
+		return fmt.Errorf("pg_stat_statements needs shared_preload_libraries = 'pg_stat_statements' and a role allowed to reset it: %w", err)
+	}
+	return nil
+}
+
+// Forget the statistics of this role in this database; other databases and
+// roles on the server keep theirs
+func ResetStatementStats(ctx context.Context, db Querier) error {
+	_, err := db.ExecContext(ctx, `
+		SELECT pg_stat_statements_reset(r.oid, d.oid, 0)
+		FROM pg_roles r, pg_database d
+		WHERE r.rolname = current_user AND d.datname = current_database()`)
+	return err
+}
+
+// Totals since the last reset, leaving out the statements reading and resetting the view
+func ReadStatementStats(ctx context.Context, db Querier) (StatementStats, error) {
+	var s StatementStats
+	var execMS float64
+	err := db.QueryRowContext(ctx, `
+		SELECT count(*), COALESCE(sum(calls), 0)::bigint, COALESCE(sum(rows), 0)::bigint,
+			COALESCE(sum(total_exec_time), 0), COALESCE(sum(shared_blks_hit), 0)::bigint,
+			COALESCE(sum(shared_blks_read), 0)::bigint
+		FROM pg_stat_statements
+		WHERE userid = (SELECT oid FROM pg_roles WHERE rolname = current_user)
+			AND dbid = (SELECT oid FROM pg_database WHERE datname = current_database())
+			AND query NOT LIKE '%pg_stat_statements%'`).
+		Scan(&s.Statements, &s.Calls, &s.Rows, &execMS, &s.SharedHit, &s.SharedRead)
+	s.ExecTime = time.Duration(execMS * float64(time.Millisecond))
+	return s, err
+}
@@ -0,0 +1,115 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Row trigger on user_attributes that queues the user_id of every write in
+// user_attributes_changes (PostgreSQL only)
+const changeCaptureTrigger = "user_attributes_cdc"
+
+const DefaultSyncBatch = 1000
+
+// Bulk loads disable change capture inside their own transaction: the data
+// they write is rebuilt wholesale, so queueing every row would only be overhead
+func setChangeCapture(ctx context.Context, tx *sql.Tx, enabled bool) error {
+	action := "DISABLE"
+	if enabled {
+		action = "ENABLE"
+	}
+	if _, err := tx.ExecContext(ctx, "ALTER TABLE user_attributes "+action+" TRIGGER "+changeCaptureTrigger); err != nil {
+		return fmt.Errorf("%s change capture: %w", action, err)
+	}
+	return nil
+}
+
+type SyncBatch struct {
+	Changes int64 // queued changes consumed
+	Users   int64 // distinct users re-pivoted
+}
+
+// Consume up to size queued changes and re-pivot the users they touch into
+// user_profiles and user_profiles_jsonb, all in one transaction. Users are
+// rebuilt from the EAV tables rather than patched, so inserts, updates and
+// deletes are handled alike and replaying a change is harmless. SKIP LOCKED
+// lets several sync processes share the queue.
+func SyncChanges(ctx context.Context, db *sql.DB, size int) (SyncBatch, error) {
+	var b SyncBatch
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return b, err
+	}
+	defer tx.Rollback()
+
+	var users pq.Int64Array
+	err = tx.QueryRowContext(ctx, `
+		WITH consumed AS (
+			DELETE FROM user_attributes_changes
+			WHERE change_id IN (
+				SELECT change_id FROM user_attributes_changes
+				ORDER BY change_id
+				LIMIT $1
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING user_id
+		)
+		SELECT COUNT(*), COALESCE(array_agg(DISTINCT user_id), '{}') FROM consumed`, size).Scan(&b.Changes, &users)
+	if err != nil {
+		return b, fmt.Errorf("consume changes: %w", err)
+	}
+	if b.Changes == 0 {
+		return b, nil
+	}
+	b.Users = int64(len(users))
+
+	for _, s := range []struct{ name, query string }{
+		{"clear user_profiles", `DELETE FROM user_profiles WHERE user_id = ANY($1)`},
+		{"clear user_profiles_jsonb", `DELETE FROM user_profiles_jsonb WHERE user_id = ANY($1)`},
+	} {
+		if _, err := tx.ExecContext(ctx, s.query, users); err != nil {
+			return b, fmt.Errorf("%s: %w", s.name, err)
+		}
+	}
+	// Read once the delete holds the rows, so an attribute schema sync was
+	// adding meanwhile has committed and is pivoted too
+	attrs, err := profileAttributes(ctx, tx)
+	if err != nil {
+		return b, err
+	}
+	for _, s := range []struct{ name, query string }{
+		{"pivot user_attributes", `
+			INSERT INTO user_profiles (` + strings.Join(profileColumns(attrs), ", ") + `)
+			` + profilesPivot(attrs) + `
+			WHERE u.user_id = ANY($1)
+			GROUP BY u.user_id`},
+		{"fill user_profiles_jsonb", `INSERT INTO user_profiles_jsonb (user_id, attributes) ` + JSONBProjection(attrs) + `
+			WHERE user_id = ANY($1)`},
+	} {
+		if _, err := tx.ExecContext(ctx, s.query, users); err != nil {
+			return b, fmt.Errorf("%s: %w", s.name, err)
+		}
+	}
+	return b, tx.Commit()
+}
+
+// How far user_profiles is behind the EAV tables
+type SyncLag struct {
+	Pending int64         // queued changes not applied yet
+	Oldest  time.Duration // age of the oldest of them, 0 when caught up
+}
+
+func SyncLagOf(ctx context.Context, db Querier) (SyncLag, error) {
+	var lag SyncLag
+	var seconds float64
+	err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*), COALESCE(EXTRACT(EPOCH FROM NOW() - MIN(changed_at)), 0)
+		FROM user_attributes_changes`).Scan(&lag.Pending, &seconds)
+	lag.Oldest = time.Duration(seconds * float64(time.Second))
+	return lag, err
+}
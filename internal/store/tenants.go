@@ -0,0 +1,183 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+
+	"audience-poc/internal/rules"
+)
+
+// Tenant of rows written before tenants existed, and of every user seeding creates
+const DefaultTenant = "default"
+
+// PostgreSQL setting the row-level security policies compare tenant_id with
+const tenantSetting = "audience.tenant"
+
+// Short enough to read in a log line, and safe in a header or a metric label
+var validTenant = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+func ValidTenant(tenant string) error {
+	if !validTenant.MatchString(tenant) {
+		return fmt.Errorf("tenant %q must be up to 63 lowercase letters, digits, '-' and '_'", tenant)
+	}
+	return nil
+}
+
+type tenantKey struct{}
+
+// A context whose rule evaluations and audience lookups only see tenant's
+// users and audiences; an empty tenant sees every tenant's
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// The tenant ctx is restricted to, if any
+func TenantFrom(ctx context.Context) (string, bool) {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant, tenant != ""
+}
+
+// ctx's tenant, empty for every tenant, as the queries filtering by it take it
+func ctxTenant(ctx context.Context) string {
+	tenant, _ := TenantFrom(ctx)
+	return tenant
+}
+
+// The rule restricted to ctx's tenant, unless it already is restricted to one
+// (a stored audience's rule is restricted to the audience's tenant)
+func Scope(ctx context.Context, rule *rules.Rule) *rules.Rule {
+	if tenant, ok := TenantFrom(ctx); ok && rule.Tenant() == "" {
+		return rule.ForTenant(tenant)
+	}
+	return rule
+}
+
+// Users and audiences of one tenant
+type TenantUsage struct {
+	Tenant    string
+	Users     int64
+	Audiences int64
+}
+
+// Every tenant with users or audiences, by name
+func ListTenants(ctx context.Context, db Querier) ([]TenantUsage, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT tenant_id, SUM(users)::bigint, SUM(audiences)::bigint
+		FROM (
+			SELECT tenant_id, COUNT(*) AS users, 0 AS audiences FROM user_profiles GROUP BY tenant_id
+			UNION ALL
+			SELECT tenant_id, 0, COUNT(*) FROM audiences GROUP BY tenant_id
+		) t
+		GROUP BY tenant_id
+		ORDER BY tenant_id`)
+	if err != nil {
+		return nil, classify(err)
+	}
+	defer rows.Close()
+
+	var tenants []TenantUsage
+	for rows.Next() {
+		var t TenantUsage
+		if err := rows.Scan(&t.Tenant, &t.Users, &t.Audiences); err != nil {
+			return nil, classify(err)
+		}
+		tenants = append(tenants, t)
+	}
+	return tenants, classify(rows.Err())
+}
+
+// Move the users matching rule, of whichever tenant, to tenant: in
+// user_profiles and in users, so a sync or migrate rebuilding user_profiles
+// from the EAV tables keeps them there. Materializations of the tenants the
+// users left and of tenant no longer hold their members, so they go stale in
+// the same statement. Returns the users moved and the materializations made stale.
+func AssignTenant(ctx context.Context, db Querier, tenant string, rule *rules.Rule) (moved, stale int64, err error) {
+	if err := ValidTenant(tenant); err != nil {
+		return 0, 0, err
+	}
+	query, args := rules.NewQuery(active).SQL(`
+		WITH previous AS (
+			SELECT user_id, tenant_id FROM user_profiles
+			WHERE tenant_id <> `).Bind(tenant).SQL(` AND (`).Optimized(rule).SQL(`)
+			FOR UPDATE
+		), moved AS (
+			UPDATE user_profiles p SET tenant_id = `).Bind(tenant).SQL(`
+			FROM previous WHERE p.user_id = previous.user_id
+			RETURNING p.user_id, previous.tenant_id AS previous
+		), eav AS (
+			UPDATE users SET tenant_id = `).Bind(tenant).SQL(`
+			WHERE user_id IN (SELECT user_id FROM moved)
+		), stale AS (
+			UPDATE audience_materializations SET rule = ''
+			WHERE rule <> '' AND EXISTS (SELECT 1 FROM moved) AND audience_id IN (
+				SELECT audience_id FROM audiences
+				WHERE tenant_id = `).Bind(tenant).SQL(` OR tenant_id IN (SELECT previous FROM moved))
+			RETURNING audience_id
+		)
+		SELECT (SELECT COUNT(*) FROM moved), (SELECT COUNT(*) FROM stale)`).Build()
+	err = db.QueryRowContext(ctx, query, args...).Scan(&moved, &stale)
+	return moved, stale, classify(err)
+}
+
+// Row-level security on top of the tenant_id filter every generated query
+// has: rows of user_profiles and the audience tables are only visible to a
+// session whose audience.tenant setting names their tenant, which the pgx
+// client sets from the query's context. Policies don't bind the tables'
+// owner, so serve has to connect as another role; the pq client never sets
+// the setting, so it sees no rows at all.
+var tenantPolicies = []struct{ table, using string }{
+	{"user_profiles", `tenant_id = current_setting('` + tenantSetting + `', true)`},
+	{"audiences", `tenant_id = current_setting('` + tenantSetting + `', true)`},
+	// Through the audiences the session can see
+	{"audience_snapshots", `audience_id IN (SELECT audience_id FROM audiences)`},
+	{"audience_triggers", `audience_id IN (SELECT audience_id FROM audiences)`},
+	{"audience_materializations", `audience_id IN (SELECT audience_id FROM audiences)`},
+	{"audience_lists", `tenant_id = current_setting('` + tenantSetting + `', true)`},
+	{"audience_list_members", `list_id IN (SELECT list_id FROM audience_lists)`},
+	{"audience_members", `audience_id IN (SELECT audience_id FROM audiences)`},
+}
+
+// Create the policies, replacing any from an earlier run, in one transaction.
+// Partitions of user_profiles are left without policies: queries go through
+// the parent, and a role that can read a partition directly isn't confined by them.
+func EnableTenantPolicies(ctx context.Context, db *sql.DB) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, p := range tenantPolicies {
+		for _, q := range []string{
+			`DROP POLICY IF EXISTS tenant_isolation ON ` + p.table,
+			`CREATE POLICY tenant_isolation ON ` + p.table + ` USING (` + p.using + `)`,
+			`ALTER TABLE ` + p.table + ` ENABLE ROW LEVEL SECURITY`,
+		} {
+			if _, err := tx.ExecContext(ctx, q); err != nil {
+				return fmt.Errorf("%s: %w", p.table, err)
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// Drop the policies and turn row-level security off again
+func DisableTenantPolicies(ctx context.Context, db *sql.DB) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, p := range tenantPolicies {
+		for _, q := range []string{
+			`ALTER TABLE ` + p.table + ` DISABLE ROW LEVEL SECURITY`,
+			`DROP POLICY IF EXISTS tenant_isolation ON ` + p.table,
+		} {
+			if _, err := tx.ExecContext(ctx, q); err != nil {
+				return fmt.Errorf("%s: %w", p.table, err)
+			}
+		}
+	}
+	return tx.Commit()
+}
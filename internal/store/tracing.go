@@ -0,0 +1,56 @@
+package store
+
+import (
+	"context"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"audience-poc/internal/rules"
+)
+
+// Spans go to the global provider, a no-op unless the CLI configured OTLP export
+var tracer = otel.Tracer("audience-poc/internal/store")
+
+// Parse a rule under a rules.parse span
+func parseRule(ctx context.Context, audienceRule string) (*rules.Rule, error) {
+	_, span := tracer.Start(ctx, "rules.parse", trace.WithAttributes(attribute.String("audience.rule", audienceRule)))
+	defer span.End()
+	rule, err := rules.Parse(audienceRule)
+	return rule, spanError(span, err)
+}
+
+// Generate a model's SQL for a rule under a rules.compile span
+func compileRule(ctx context.Context, model string, rule *rules.Rule, build buildFunc) (string, []interface{}, error) {
+	_, span := tracer.Start(ctx, "rules.compile", trace.WithAttributes(
+		attribute.String("audience.model", model),
+		attribute.String("audience.rule", rule.Canonical()),
+	))
+	defer span.End()
+	query, args, err := build(rule)
+	if err != nil {
+		return "", nil, spanError(span, err)
+	}
+	span.SetAttributes(attribute.String("db.query.text", query))
+	return query, args, nil
+}
+
+// Client span of one statement; db.scan spans cover reading its rows
+func startQuerySpan(ctx context.Context, name, query string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("db.system.name", strings.ToLower(active.Name())),
+		attribute.String("db.query.text", query),
+	))
+}
+
+// Mark the span failed when err is set, and pass err through
+func spanError(span trace.Span, err error) error {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
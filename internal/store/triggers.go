@@ -0,0 +1,266 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var ErrTriggerNotFound = errors.New("trigger not found")
+
+// Conditions a trigger can watch an audience's size for
+const (
+	TriggerAbove  = "above"  // size rose to threshold users or more
+	TriggerBelow  = "below"  // size fell under threshold users
+	TriggerChange = "change" // size changed by more than threshold percent
+)
+
+// A notification attached to a stored audience (PostgreSQL only), checked
+// whenever `snapshots run` records the audience's size. Target is a webhook
+// URL the operator allows, redis:CHANNEL to publish on the snapshot job's
+// Redis, or nats:SUBJECT to publish on its NATS JetStream, both under the
+// audience's tenant's prefix.
+type Trigger struct {
+	ID         int64     `json:"id"`
+	AudienceID int64     `json:"audience_id"`
+	Condition  string    `json:"condition"`
+	Threshold  float64   `json:"threshold"`
+	Target     string    `json:"target"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// The fields of a trigger set when it is attached
+type TriggerSpec struct {
+	Condition string  `json:"condition"`
+	Threshold float64 `json:"threshold"`
+	Target    string  `json:"target"`
+}
+
+func (s TriggerSpec) Validate(targets TriggerTargets) error {
+	switch s.Condition {
+	case TriggerAbove, TriggerBelow, TriggerChange:
+	default:
+		return fmt.Errorf("unknown trigger condition %q, expected above, below or change", s.Condition)
+	}
+	if s.Threshold <= 0 || math.IsInf(s.Threshold, 0) || math.IsNaN(s.Threshold) {
+		return errors.New("trigger threshold must be positive")
+	}
+	return targets.Check(s.Target)
+}
+
+// Scheme of a target (http, https, redis or nats) and where it points: the URL,
+// the channel or the subject
+func ParseTriggerTarget(target string) (string, string, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid trigger target %q: %w", target, err)
+	}
+	switch {
+	case (u.Scheme == "http" || u.Scheme == "https") && u.Host != "":
+		// user@host hides where a request goes from whoever reads the URL
+		if u.User != nil {
+			return "", "", fmt.Errorf("trigger target %q must not carry credentials", target)
+		}
+		return u.Scheme, target, nil
+	case u.Scheme == "redis" && u.Opaque != "":
+		return u.Scheme, u.Opaque, nil
+	case u.Scheme == "nats" && u.Opaque != "":
+		// Wildcards and empty tokens would publish outside the one subject named
+		if !natsSubject.MatchString(u.Opaque) {
+			return "", "", fmt.Errorf("trigger target %q must name a NATS subject of letters, digits, '-' and '_' tokens separated by '.'", target)
+		}
+		return u.Scheme, u.Opaque, nil
+	}
+	return "", "", fmt.Errorf("trigger target %q must be an http(s) URL, redis:CHANNEL or nats:SUBJECT", target)
+}
+
+var natsSubject = regexp.MustCompile(`^[A-Za-z0-9_-]+(\.[A-Za-z0-9_-]+)*$`)
+
+// Channel a tenant's redis:CHANNEL trigger publishes on. The prefix keeps a
+// tenant from publishing on another tenant's channels, or on other services'
+// channels of a shared Redis.
+func TriggerChannel(tenant, channel string) string {
+	return "audiences:" + tenant + ":" + channel
+}
+
+// Root of every trigger subject; a JetStream stream on TriggerSubjects.> stores them all
+const TriggerSubjects = "audiences"
+
+// Subject a tenant's nats:SUBJECT trigger publishes on, for the same reason.
+// Tenant names have no '.', so the tenant is always exactly the second token.
+func TriggerSubject(tenant, subject string) string {
+	return TriggerSubjects + "." + tenant + "." + subject
+}
+
+// Where the operator lets triggers deliver (--trigger-webhook-allow). Webhooks
+// outside it are refused, so a tenant can't have snapshots POST to metadata
+// endpoints or internal services; with no entries only Redis and NATS targets work.
+type TriggerTargets struct {
+	webhooks []webhookAllow
+}
+
+// A host, matched on any port and path when scheme is empty, or a URL prefix:
+// the same scheme and host, and a path starting with path
+type webhookAllow struct {
+	scheme, host, path string
+}
+
+// Allowlist from host names, e.g. hooks.example.com, and URL prefixes, e.g.
+// https://hooks.example.com/audiences/
+func ParseTriggerTargets(entries []string) (TriggerTargets, error) {
+	var t TriggerTargets
+	for _, e := range entries {
+		if !strings.Contains(e, "://") {
+			if e == "" || strings.ContainsAny(e, "/?#@") {
+				return t, fmt.Errorf("webhook allowlist entry %q must be a host or an http(s) URL prefix", e)
+			}
+			t.webhooks = append(t.webhooks, webhookAllow{host: strings.ToLower(e)})
+			continue
+		}
+		u, err := url.Parse(e)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+			u.User != nil || u.RawQuery != "" || u.Fragment != "" || !cleanPath(u.Path) {
+			return t, fmt.Errorf("webhook allowlist entry %q must be a host or an http(s) URL prefix", e)
+		}
+		t.webhooks = append(t.webhooks, webhookAllow{scheme: u.Scheme, host: strings.ToLower(u.Host), path: u.Path})
+	}
+	return t, nil
+}
+
+// Whether target is well formed and a webhook the allowlist admits
+func (t TriggerTargets) Check(target string) error {
+	scheme, _, err := ParseTriggerTarget(target)
+	if err != nil || scheme == "redis" || scheme == "nats" {
+		return err
+	}
+	u, _ := url.Parse(target)
+	// A .. segment could leave an allowed prefix once the receiver resolves it
+	if cleanPath(u.Path) {
+		for _, a := range t.webhooks {
+			if a.scheme == "" && (a.host == strings.ToLower(u.Host) || a.host == strings.ToLower(u.Hostname())) {
+				return nil
+			}
+			if a.scheme == u.Scheme && a.host == strings.ToLower(u.Host) && strings.HasPrefix(u.Path, a.path) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("webhook %q is not allowed by --trigger-webhook-allow", target)
+}
+
+// No . or .. segments, decoded, since url.Parse leaves them in place
+func cleanPath(p string) bool {
+	for _, seg := range strings.Split(p, "/") {
+		if seg == "." || seg == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether going from previous to users meets the trigger's condition. Crossing
+// a threshold fires once, on the snapshot that crosses it, not on every one beyond.
+func (t Trigger) Fires(previous, users int64) bool {
+	switch t.Condition {
+	case TriggerAbove:
+		return float64(previous) < t.Threshold && float64(users) >= t.Threshold
+	case TriggerBelow:
+		return float64(previous) >= t.Threshold && float64(users) < t.Threshold
+	case TriggerChange:
+		if previous == 0 {
+			return users > 0
+		}
+		return math.Abs(float64(users-previous))/float64(previous)*100 > t.Threshold
+	}
+	return false
+}
+
+const triggerColumns = `trigger_id, audience_id, condition, threshold, target, created_at`
+
+func scanTrigger(row interface{ Scan(...interface{}) error }) (Trigger, error) {
+	var t Trigger
+	err := row.Scan(&t.ID, &t.AudienceID, &t.Condition, &t.Threshold, &t.Target, &t.CreatedAt)
+	return t, err
+}
+
+// Attach a trigger to an audience of ctx's tenant
+func CreateTrigger(ctx context.Context, db Querier, audienceID int64, spec TriggerSpec, targets TriggerTargets) (Trigger, error) {
+	if err := spec.Validate(targets); err != nil {
+		return Trigger{}, err
+	}
+	t, err := scanTrigger(db.QueryRowContext(ctx, `
+		INSERT INTO audience_triggers (audience_id, condition, threshold, target)
+		SELECT audience_id, $2, $3, $4
+		FROM audiences
+		WHERE audience_id = $1 AND ($5 = '' OR tenant_id = $5)
+		RETURNING `+triggerColumns, audienceID, spec.Condition, spec.Threshold, spec.Target, ctxTenant(ctx)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return t, ErrAudienceNotFound
+	}
+	return t, err
+}
+
+// Triggers of one audience, or of every audience of ctx's tenant when
+// audienceID is 0, by audience and id
+func ListTriggers(ctx context.Context, db Querier, audienceID int64) ([]Trigger, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT t.trigger_id, t.audience_id, t.condition, t.threshold, t.target, t.created_at
+		FROM audience_triggers t
+		JOIN audiences a USING (audience_id)
+		WHERE ($1 = 0 OR t.audience_id = $1) AND ($2 = '' OR a.tenant_id = $2)
+		ORDER BY t.audience_id, t.trigger_id`, audienceID, ctxTenant(ctx))
+	if err != nil {
+		return nil, classify(err)
+	}
+	defer rows.Close()
+
+	triggers := []Trigger{}
+	for rows.Next() {
+		t, err := scanTrigger(rows)
+		if err != nil {
+			return nil, err
+		}
+		triggers = append(triggers, t)
+	}
+	return triggers, classify(rows.Err())
+}
+
+// Detach a trigger; audienceID 0 matches any audience of ctx's tenant
+func DeleteTrigger(ctx context.Context, db Querier, audienceID, id int64) error {
+	res, err := db.ExecContext(ctx, `
+		DELETE FROM audience_triggers t
+		USING audiences a
+		WHERE t.trigger_id = $1 AND a.audience_id = t.audience_id
+			AND ($2 = 0 OR t.audience_id = $2) AND ($3 = '' OR a.tenant_id = $3)`, id, audienceID, ctxTenant(ctx))
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrTriggerNotFound
+	}
+	return nil
+}
+
+// Size the audience's latest snapshot recorded, false when it has none yet
+func LatestSnapshotUsers(ctx context.Context, db Querier, audienceID int64) (int64, bool, error) {
+	var users int64
+	err := db.QueryRowContext(ctx, `
+		SELECT user_count FROM audience_snapshots
+		WHERE audience_id = $1
+		ORDER BY taken_at DESC, snapshot_id DESC
+		LIMIT 1`, audienceID).Scan(&users)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	return users, err == nil, classify(err)
+}